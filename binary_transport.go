@@ -18,6 +18,10 @@ type BinaryTransport struct {
 	// File receivers
 	fileReceiversMux sync.RWMutex
 	fileReceivers    map[string]*BinaryTransportFileReceiver
+
+	// Shard receivers (migration)
+	shardReceiversMux sync.RWMutex
+	shardReceivers    map[string]*BinaryTransportShardReceiver
 }
 
 // Send message
@@ -28,9 +32,10 @@ func (this *BinaryTransport) _send(node string, msg *BinaryTransportMessage) ([]
 // Create new binary transport
 func newBinaryTransport() *BinaryTransport {
 	b := &BinaryTransport{
-		transport:     newNetworkTransport("tcp", "binary", conf.BinaryPort, conf.BinaryTransportReadBuffer, conf.BinaryTransportNumStreams, false),
-		udpTransport:  newNetworkTransport("udp", "binary_udp", conf.BinaryUdpPort, conf.BinaryTransportReadBuffer, conf.BinaryTransportNumStreams, false),
-		fileReceivers: make(map[string]*BinaryTransportFileReceiver),
+		transport:      newNetworkTransport("tcp", "binary", conf.BinaryPort, conf.BinaryTransportReadBuffer, conf.BinaryTransportNumStreams, false),
+		udpTransport:   newNetworkTransport("udp", "binary_udp", conf.BinaryUdpPort, conf.BinaryTransportReadBuffer, conf.BinaryTransportNumStreams, false),
+		fileReceivers:  make(map[string]*BinaryTransportFileReceiver),
+		shardReceivers: make(map[string]*BinaryTransportShardReceiver),
 	}
 
 	// Binary on connect
@@ -46,6 +51,12 @@ func newBinaryTransport() *BinaryTransport {
 
 		log.Debugf("Received binary TCP message %d bytes", len(by))
 
+		// Clock of the sender
+		hlc.Update(msg.Clock)
+
+		// Response
+		var resp []byte = nil
+
 		switch msg.Type {
 		// Shard index
 		case ShardIdxBinaryTransportMessageType:
@@ -54,7 +65,7 @@ func newBinaryTransport() *BinaryTransport {
 
 		// File chunk
 		case FileBinaryTransportMessageType:
-			b._receiveFileChunk(cmeta, msg)
+			resp = b._receiveFileChunk(cmeta, msg)
 			break
 
 			// Create shard
@@ -62,14 +73,51 @@ func newBinaryTransport() *BinaryTransport {
 			b._receiveCreateShard(cmeta, msg)
 			break
 
+			// Shard removed
+		case RemoveShardIdxBinaryTransportMessageType:
+			b._receiveRemoveShardIndex(cmeta, msg)
+			break
+
+			// Shard migration
+		case ShardOfferBinaryTransportMessageType:
+			resp = b._receiveShardOffer(cmeta, msg)
+			break
+		case ShardChunkBinaryTransportMessageType:
+			resp = b._receiveShardChunk(cmeta, msg)
+			break
+		case ShardResumeBinaryTransportMessageType:
+			resp = b._receiveShardResume(cmeta, msg)
+			break
+		case ShardCommitBinaryTransportMessageType:
+			resp = b._receiveShardCommit(cmeta, msg)
+			break
+
+			// Block sealing
+		case DropShardBinaryTransportMessageType:
+			b._receiveDropShard(cmeta, msg)
+			break
+		case SealBlockBinaryTransportMessageType:
+			b._receiveSealBlock(cmeta, msg)
+			break
+
+			// Shard repair
+		case ShardRepairBinaryTransportMessageType:
+			b._receiveShardRepair(cmeta, msg)
+			break
+
+			// File written or deleted
+		case FileLocationBinaryTransportMessageType:
+			b._receiveFileLocationInvalidation(cmeta, msg)
+			break
+
 			// Unknown
 		default:
 			log.Warnf("Received unknown binary TCP message %v", msg)
 			break
 		}
 
-		// No response
-		return nil
+		// Response (nil if none)
+		return resp
 	}
 
 	// Binary on UDP message
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+)
+
+// Binary transport of block sealing to other nodes
+// drop shard: shard id (16 bytes)
+// seal block: block id (16 bytes)
+
+// Send drop replica of shard
+func (this *BinaryTransport) _sendDropShard(node string, shardId []byte) {
+	msg := newBinaryTransportMessage(DropShardBinaryTransportMessageType, shardId)
+	this._send(node, msg)
+}
+
+// Receive drop replica of shard
+func (this *BinaryTransport) _receiveDropShard(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) {
+	if len(msg.Data) != 16 {
+		log.Warnf("Received invalid drop shard from %s", cmeta.GetNode())
+		return
+	}
+	shard := datastore.LocalShardByIdStr(uuidToString(msg.Data))
+	if shard == nil {
+		return
+	}
+	log.Infof("Dropping replica of shard %s on request of %s", shard.IdStr(), cmeta.GetNode())
+	if err := datastore.RemoveShard(shard); err != nil {
+		log.Warnf("Failed to drop replica of shard %s: %s", shard.IdStr(), err)
+	}
+}
+
+// Broadcast block sealed
+func (this *BinaryTransport) _broadcastSealBlock(blockId []byte) {
+	msg := newBinaryTransportMessage(SealBlockBinaryTransportMessageType, blockId)
+	var wg sync.WaitGroup
+	for _, ns := range gossip.GetNodeStates() {
+		wg.Add(1)
+		go func(ns *GossipNodeState) {
+			this._send(ns.Node, msg)
+			wg.Done()
+		}(ns)
+	}
+	wg.Wait()
+}
+
+// Receive block sealed
+func (this *BinaryTransport) _receiveSealBlock(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) {
+	if len(msg.Data) != 16 {
+		log.Warnf("Received invalid seal block from %s", cmeta.GetNode())
+		return
+	}
+	block := datastore.BlockByIdStr(uuidToString(msg.Data))
+	if block == nil {
+		return
+	}
+	log.Infof("Block %s sealed by %s", block.IdStr(), cmeta.GetNode())
+	block.SetSealed(true)
+	if err := block.PersistManifest(); err != nil {
+		log.Errorf("Failed to write manifest of block %s: %s", block.IdStr(), err)
+	}
+}
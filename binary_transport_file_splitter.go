@@ -12,6 +12,7 @@ import (
 // chunk 0: transfer id (uint32) - chunk number (uint32) - shard selected (byte: 0 or 1) - target shard id (16 bytes) - file meta length (uint32) - actual file meta bytes - chunk count (uint32) - content chunk length (uint32) - content bytes
 // chunk 1-N: transfer id (uint32) - chunk number (uint32) - content chunk length (uint32) - content bytes
 // the chunk number is 0-based index
+// chunk lengths are bounded by the chunk size, the size of files beyond 4 GB travels in the file meta
 
 // Splitter
 type BinaryTransportFileSplitter struct {
@@ -43,23 +44,26 @@ func (this *BinaryTransportFileSplitter) Split(meta *FileMeta, data []byte, targ
 	}
 
 	// Byte length
-	dataLen := uint32(len(data))
+	dataLen := uint64(len(data))
 
 	// Determine chunk count
-	var chunkCount uint32
+	var chunkCount uint64
 	var availableContentBytesFirstChunk uint32 = this.ChunkSize - 4 /* transfer number */ - 4 /* chunk number */ - 1 /* shard selected */ - 16 /* target shard id */ - 4 /* file meta length */ - metaBytesLen - 4 /* chunk count */ - 4 /* content chunk length */
-	if availableContentBytesFirstChunk >= dataLen {
+	if uint64(availableContentBytesFirstChunk) >= dataLen {
 		// All fits in one chunk
 		chunkCount = 1
 	} else {
 		// Overhead per chunk after the first one
 		chunkCount = 1
-		dataLeft := dataLen - availableContentBytesFirstChunk
-		chunkCount += uint32(math.Ceil(float64(dataLeft) / float64(this.effectiveBytesAdditionalChunks)))
+		dataLeft := dataLen - uint64(availableContentBytesFirstChunk)
+		chunkCount += uint64(math.Ceil(float64(dataLeft) / float64(this.effectiveBytesAdditionalChunks)))
+	}
+	if chunkCount > math.MaxUint32 {
+		panic("Exceeds maximum chunk count")
 	}
 
 	// Create chunks
-	var contentPointer uint32 = 0
+	var contentPointer uint64 = 0
 	for i := 0; i < int(chunkCount); i++ {
 		// New buffer
 		buf := new(bytes.Buffer)
@@ -93,28 +97,28 @@ func (this *BinaryTransportFileSplitter) Split(meta *FileMeta, data []byte, targ
 			binary.Write(buf, binary.BigEndian, uint32(chunkCount))   // chunk count
 
 			// Bytes in chunk
-			if dataLen < availableContentBytesFirstChunk {
-				contentLen = dataLen
+			if dataLen < uint64(availableContentBytesFirstChunk) {
+				contentLen = uint32(dataLen)
 			} else {
 				contentLen = availableContentBytesFirstChunk
 			}
 			binary.Write(buf, binary.BigEndian, uint32(contentLen)) // content length of this chunk
-			buf.Write(data[contentPointer : contentPointer+contentLen])
+			buf.Write(data[contentPointer : contentPointer+uint64(contentLen)])
 			break
 		default:
 			// Additional chunks
 
 			// Data left
-			var dataLeft uint32 = dataLen - contentPointer
+			var dataLeft uint64 = dataLen - contentPointer
 
 			// Bytes in chunk
-			if dataLeft < this.effectiveBytesAdditionalChunks {
-				contentLen = dataLeft
+			if dataLeft < uint64(this.effectiveBytesAdditionalChunks) {
+				contentLen = uint32(dataLeft)
 			} else {
 				contentLen = this.effectiveBytesAdditionalChunks
 			}
 			binary.Write(buf, binary.BigEndian, uint32(contentLen)) // content length of this chunk
-			buf.Write(data[contentPointer : contentPointer+contentLen])
+			buf.Write(data[contentPointer : contentPointer+uint64(contentLen)])
 			break
 		}
 
@@ -124,7 +128,7 @@ func (this *BinaryTransportFileSplitter) Split(meta *FileMeta, data []byte, targ
 		chunks = append(chunks, chunk)
 
 		// Move content pointer
-		contentPointer += contentLen
+		contentPointer += uint64(contentLen)
 	}
 
 	// log.Infof("Chunk count %d (first chunk %d content, additioanl chunk %d content, meta len %d, data len %d)", chunkCount, availableContentBytesFirstChunk, this.effectiveBytesAdditionalChunks, metaBytesLen, dataLen)
@@ -17,7 +17,7 @@ func TestBinaryTransportFileSplitter(t *testing.T) {
 		// Fake file with data
 		fileMeta := newFileMeta("text.txt")
 		data := make([]byte, i)
-		fileMeta.Size = uint32(len(data))
+		fileMeta.Size = uint64(len(data))
 		fileMeta.Checksum = crc32.Checksum(data, crcTable)
 
 		// Split (no target shard id)
@@ -3,15 +3,16 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"time"
 )
 
 // Binary transport of shards to other nodes
 
-// Send file
-func (this *BinaryTransport) _sendFileChunk(node string, msg *BinaryTransportMessage) {
-	this._send(node, msg)
+// Send file chunk, returns the response of the receiver
+func (this *BinaryTransport) _sendFileChunk(node string, msg *BinaryTransportMessage) ([]byte, error) {
+	return this._send(node, msg)
 }
 
 // Get file receiver
@@ -86,8 +87,8 @@ func (this *BinaryTransport) _removeFileReceiver(cmeta *TransportConnectionMeta,
 	}
 }
 
-// Receive file
-func (this *BinaryTransport) _receiveFileChunk(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) {
+// Receive file, the last chunk is answered with the result of the write
+func (this *BinaryTransport) _receiveFileChunk(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) []byte {
 	// Validate this is what it should be
 	if msg.Type != FileBinaryTransportMessageType {
 		panic("Invalid message type")
@@ -111,72 +112,142 @@ func (this *BinaryTransport) _receiveFileChunk(cmeta *TransportConnectionMeta, m
 	// Add to receiver
 	done := receiver.Add(buf)
 
-	// Done?
-	if done {
-		// To bytes
-		b, be := receiver.Bytes()
-		panicErr(be)
+	// Not done yet
+	if !done {
+		return nil
+	}
+
+	// Store
+	writeResFileMeta, writeResErr := this._storeReceivedFile(receiver)
+
+	// Cleanup file receivers
+	this._removeFileReceiver(cmeta, transferNumber)
+
+	// Result
+	if writeResErr != nil {
+		log.Errorf("Failed to store received file: %s", writeResErr)
+		return this._fileWriteResponse(writeResErr)
+	}
+	log.Infof("Received file %s of length %d", writeResFileMeta.FullName, writeResFileMeta.Size)
+	return this._fileWriteResponse(nil)
+}
+
+// Store received file in shard and replicate
+func (this *BinaryTransport) _storeReceivedFile(receiver *BinaryTransportFileReceiver) (*FileMeta, error) {
+	// To bytes
+	b, be := receiver.Bytes()
+	if be != nil {
+		return nil, be
+	}
 
-		// Validate file meta
-		if receiver.fileMeta == nil {
-			panic("Unexpected nil file meta")
+	// Validate file meta
+	if receiver.fileMeta == nil {
+		return nil, errors.New("Unexpected nil file meta")
+	}
+
+	// Chunk references of a large file
+	if receiver.fileMeta.Chunked {
+		manifest, err := parseFileChunkManifest(b)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid chunk manifest of %s: %s", receiver.fileMeta.FullName, err))
 		}
+		receiver.fileMeta.Chunks = manifest.Chunks
+	}
 
-		// Store file in shard
-		var targetShard *Shard = nil
+	// Store file in shard
+	var targetShard *Shard = nil
 
-		// Has target shard?
+	// Temporary tier?
+	if receiver.fileMeta.Temporary {
+		// Memory only
+		var allocErr error
 		if receiver.targetShardId != nil {
-			// Has target shard
-			targetShard = datastore.LocalShardByIdStr(uuidToString(receiver.targetShardId))
+			targetShard, allocErr = temporaryStore.ReplicaShard(receiver.targetShardId, receiver.fileMeta)
 		} else {
-			// No target shard
-			targetShard = datastore.AllocateShardCapacity(receiver.fileMeta)
+			targetShard, allocErr = temporaryStore.AllocateShardCapacity(receiver.fileMeta)
 		}
-
-		// Target shard must be non-nil
-		if targetShard == nil {
-			panic("Unexpected nil target shard")
+		if allocErr != nil {
+			return nil, allocErr
+		}
+		defer temporaryStore.WriteDone(targetShard)
+	} else if receiver.targetShardId != nil {
+		// Has target shard
+		targetShard = datastore.LocalShardByIdStr(uuidToString(receiver.targetShardId))
+		if targetShard == nil || targetShard.IsTemporary() {
+			return nil, errors.New(fmt.Sprintf("Target shard %s not found", uuidToString(receiver.targetShardId)))
+		}
+		if !targetShard.Block().Volume().IsWritable() {
+			return nil, errors.New(fmt.Sprintf("Volume of target shard %s is not writable", targetShard.IdStr()))
+		}
+	} else if targetShard = dedupIndex.Lookup(receiver.fileMeta); targetShard != nil {
+		// Contents already stored in a shard, the file only references them
+		log.Infof("Writing file %s to shard %s that holds the same contents", receiver.fileMeta.FullName, targetShard.IdStr())
+	} else {
+		// No target shard
+		var allocErr error
+		targetShard, allocErr = datastore.AllocateShardCapacity(receiver.fileMeta)
+		if allocErr != nil {
+			return nil, allocErr
 		}
+	}
+
+	// Write to shard and persist, nothing is stored if that fails so the client can retry elsewhere
+	writeResFileMeta, writeResErr := targetShard.AddFileAndPersist(receiver.fileMeta, b)
+	if writeResErr != nil {
+		return nil, writeResErr
+	}
+
+	// We should replicate if there's no target shard specified
+	if receiver.targetShardId == nil {
+		// Figure out other targets
+		for _, node := range this._replicaNodes(targetShard) {
+			// Replicate
+			log.Infof("Replicate file to %s", node)
 
-		// Write to shard
-		writeResFileMeta, writeResErr := targetShard.AddFile(receiver.fileMeta, b)
-		panicErr(writeResErr)
-
-		// Persist shard
-		targetShard.Persist()
-
-		// We should replicate if there's no target shard specified
-		if receiver.targetShardId == nil {
-			// Figure out other targets
-			targetShardLocations := datastore.fileLocator.ShardLocationsByIdStr(targetShard.IdStr())
-			if len(targetShardLocations) > 1 {
-				for _, targetShardLocation := range targetShardLocations {
-					// Skip local shards
-					if targetShardLocation.Local {
-						continue
-					}
-
-					// Replicate
-					log.Infof("Replicate file to shard location %v", targetShardLocation)
-
-					// Split file
-					msgs := datastore.fileSplitter.Split(writeResFileMeta, b, targetShard.Id)
-
-					// Send chunks to remote node
-					for _, msg := range msgs {
-						this._sendFileChunk(targetShardLocation.Node, msg)
-					}
-				}
+			// Split file
+			msgs := datastore.fileSplitter.Split(writeResFileMeta, b, targetShard.Id)
+
+			// Send chunks to remote node
+			for _, msg := range msgs {
+				this._sendFileChunk(node, msg)
 			}
 		}
 
-		// Log
-		if writeResFileMeta != nil {
-			log.Infof("Received file %s of length %d", writeResFileMeta.FullName, writeResFileMeta.Size)
+		// Other nodes drop cached locations and contents, once for all copies
+		this._broadcastFileLocationInvalidation(writeResFileMeta.FullName)
+	}
+
+	return writeResFileMeta, nil
+}
+
+// Nodes that hold a copy of the shard, temporary shards are replicated to memory of other nodes
+func (this *BinaryTransport) _replicaNodes(shard *Shard) []string {
+	if shard.IsTemporary() {
+		return temporaryStore.ReplicaNodes(shard)
+	}
+	nodes := make([]string, 0)
+	for _, location := range datastore.fileLocator.ShardLocationsByIdStr(shard.IdStr()) {
+		// Skip local shards
+		if location.Local {
+			continue
 		}
+		nodes = append(nodes, location.Node)
+	}
+	return nodes
+}
+
+// Write result: status (byte: 0 = ok, 1 = error) - error message
+func (this *BinaryTransport) _fileWriteResponse(err error) []byte {
+	if err == nil {
+		return []byte{0}
+	}
+	return append([]byte{1}, []byte(err.Error())...)
+}
 
-		// Cleanup file receivers
-		this._removeFileReceiver(cmeta, transferNumber)
+// Read write result, nodes that do not answer are considered successful
+func (this *BinaryTransport) _readFileWriteResponse(b []byte) error {
+	if len(b) < 1 || b[0] == 0 {
+		return nil
 	}
+	return errors.New(string(b[1:]))
 }
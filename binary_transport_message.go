@@ -11,20 +11,33 @@ type BinaryTransportMessage struct {
 	Type    BinaryTransportMessageType // Sort message
 	Len     uint32                     // Length of data
 	Data    []byte                     // Actual data
+	Clock   uint64                     // Hybrid logical clock of the sender, after the data (not sent by older nodes)
 }
 
 // This version
 const BINARY_TRANSPORT_MESSAGE_VERSION uint32 = 1
 
+// Version of messages with 64-bit lengths and offsets in the data (e.g. shard migration beyond 4 GB), only sent to nodes that support them
+const BINARY_TRANSPORT_LARGE_MESSAGE_VERSION uint32 = 2
+
 // Message type
 type BinaryTransportMessageType uint32
 
 // Message types
 const (
-	EmptyBinaryTransportMessageType       BinaryTransportMessageType = iota // 0 = not set
-	ShardIdxBinaryTransportMessageType                                      // 1 = shard index
-	FileBinaryTransportMessageType                                          // 2 = file binary transport
-	CreateShardBinaryTransportMessageType                                   // 3 = create shard (replication)
+	EmptyBinaryTransportMessageType          BinaryTransportMessageType = iota // 0 = not set
+	ShardIdxBinaryTransportMessageType                                         // 1 = shard index
+	FileBinaryTransportMessageType                                             // 2 = file binary transport
+	CreateShardBinaryTransportMessageType                                      // 3 = create shard (replication)
+	ShardOfferBinaryTransportMessageType                                       // 4 = offer shard (migration)
+	ShardChunkBinaryTransportMessageType                                       // 5 = shard bytes chunk (migration)
+	ShardResumeBinaryTransportMessageType                                      // 6 = resume offset of shard (migration)
+	ShardCommitBinaryTransportMessageType                                      // 7 = commit shard (migration)
+	RemoveShardIdxBinaryTransportMessageType                                   // 8 = shard index removed (shard no longer on node)
+	DropShardBinaryTransportMessageType                                        // 9 = drop replica of shard (after sealing)
+	SealBlockBinaryTransportMessageType                                        // 10 = block is sealed, no more writes
+	ShardRepairBinaryTransportMessageType                                      // 11 = shard lost on node, repair from a copy
+	FileLocationBinaryTransportMessageType                                     // 12 = file written or deleted, drop cached locations and contents
 )
 
 // To bytes
@@ -39,6 +52,9 @@ func (this *BinaryTransportMessage) Bytes() []byte {
 	if this.Data != nil {
 		buf.Write(this.Data)
 	}
+	if this.Clock > 0 {
+		binary.Write(buf, binary.BigEndian, this.Clock) // clock
+	}
 	return buf.Bytes()
 }
 
@@ -56,6 +72,11 @@ func (this *BinaryTransportMessage) FromBytes(b []byte) {
 	// Read data
 	this.Data = make([]byte, this.Len)
 	buf.Read(this.Data)
+
+	// Clock (optional)
+	if buf.Len() >= 8 {
+		binary.Read(buf, binary.BigEndian, &this.Clock)
+	}
 }
 
 // New message
@@ -69,5 +90,6 @@ func newBinaryTransportMessage(t BinaryTransportMessageType, data []byte) *Binar
 		Type:    t,
 		Len:     l,
 		Data:    data,
+		Clock:   hlc.Now(),
 	}
 }
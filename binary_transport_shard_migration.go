@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"time"
+)
+
+// Binary transport of full shards (contents, file meta and index) to other nodes
+// offer: block id (16 bytes) - shard id (16 bytes) - block index (uint32) - parity (byte: 0 or 1) - total length (uint32) - crc (uint32) - shard meta length (uint32) - shard meta bytes - replace (byte: 0 or 1, optional)
+// chunk: shard id (16 bytes) - offset (uint32) - content chunk length (uint32) - content chunk crc (uint32) - content bytes
+// resume: shard id (16 bytes)
+// commit: shard id (16 bytes)
+// every message is answered with: status (byte) - offset (uint32, uint64 beyond 4 GB) where the sender should continue
+// shards of 4 GB and more are sent in large messages (BINARY_TRANSPORT_LARGE_MESSAGE_VERSION) with a uint64 total length and offset, only to nodes that support them
+
+// Migration status
+type ShardMigrationStatus byte
+
+const (
+	OkShardMigrationStatus         ShardMigrationStatus = iota // 0 = accepted
+	ExistsShardMigrationStatus                                 // 1 = shard already exists on the receiving node
+	UnknownShardMigrationStatus                                // 2 = no migration in progress for this shard
+	InvalidShardMigrationStatus                                // 3 = validation failed (offset, checksum, shard meta)
+	NoCapacityShardMigrationStatus                             // 4 = no writable volume with capacity on the receiving node
+	DivergedShardMigrationStatus                               // 5 = a different copy of the shard exists on the receiving node
+)
+
+// A different copy of the shard exists on the node, it only counts as a copy once replaced
+var errShardDiverged = errors.New("A different copy of the shard exists on the node")
+
+// Migrate shard to another node, resumes from the offset of the receiver
+func (this *BinaryTransport) _migrateShard(node string, shard *Shard) error {
+	return this._sendShard(node, shard, false, nil)
+}
+
+// Replace the copy of a shard on another node with the local version, whatever that copy holds (e.g. a diverged copy of a sealed block)
+func (this *BinaryTransport) _replicateShard(node string, shard *Shard) error {
+	return this._sendShard(node, shard, true, nil)
+}
+
+// Replace the copy of a shard on another node with the local version (e.g. after compaction), only if that copy has the previous shard meta,
+// a different copy is left as is and errShardDiverged returned
+func (this *BinaryTransport) _replaceShardCopy(node string, shard *Shard, previous *ShardMeta) error {
+	return this._sendShard(node, shard, true, previous)
+}
+
+// Send shard to another node
+func (this *BinaryTransport) _sendShard(node string, shard *Shard, replace bool, previous *ShardMeta) error {
+	log.Infof("Sending shard %s to %s (replace %t)", shard.IdStr(), node, replace)
+
+	// Make sure the latest version is on disk
+	if err := shard.Persist(); err != nil {
+		return err
+	}
+
+	// Format the node can read, shards are sent as is
+	if v := shard.ShardMeta().MetaVersion; v > nodeFormatVersion(node) {
+		return errors.New(fmt.Sprintf("Shard %s in version %d can not be sent to %s, the node supports version %d", shard.IdStr(), v, node, nodeFormatVersion(node)))
+	}
+
+	// Length and checksum
+	totalLength, checksum, err := shard.FileChecksum()
+	if err != nil {
+		return err
+	}
+	if totalLength > math.MaxUint32 && nodeFormatVersion(node) < BINARY_LARGE_VERSION {
+		return errors.New(fmt.Sprintf("Shard %s of %d bytes can not be sent to %s, the node does not support 64-bit sizes", shard.IdStr(), totalLength, node))
+	}
+
+	// Open file
+	f, err := shard._openFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Offer
+	status, offset, err := this._sendShardMigrationMessage(node, this._shardOfferMessage(shard, totalLength, checksum, replace, previous))
+	if err != nil {
+		return err
+	}
+	switch status {
+	case OkShardMigrationStatus:
+		break
+	case ExistsShardMigrationStatus:
+		log.Infof("Shard %s already exists on %s", shard.IdStr(), node)
+		return nil
+	case DivergedShardMigrationStatus:
+		log.Warnf("Shard %s on %s differs from the local copy", shard.IdStr(), node)
+		return errShardDiverged
+	default:
+		return errors.New(fmt.Sprintf("Shard %s offer rejected by %s with status %d", shard.IdStr(), node, status))
+	}
+
+	// Chunks
+	chunkSize := uint64(conf.ShardMigrationChunkSize)
+	var failures int = 0
+	for offset < totalLength {
+		// Read chunk
+		n := totalLength - offset
+		if n > chunkSize {
+			n = chunkSize
+		}
+		b := make([]byte, n)
+		if _, err := f.ReadAt(b, int64(offset)); err != nil {
+			return err
+		}
+
+		// Send chunk
+		status, newOffset, err := this._sendShardMigrationMessage(node, this._shardChunkMessage(shard.Id, offset, b))
+		if err == nil && status == OkShardMigrationStatus {
+			offset = newOffset
+			continue
+		}
+
+		// Failed, ask the receiver where to resume
+		failures++
+		log.Warnf("Failed to send shard %s chunk at %d to %s (status %d): %v", shard.IdStr(), offset, node, status, err)
+		if failures > 5 {
+			return errors.New(fmt.Sprintf("Too many failures migrating shard %s to %s", shard.IdStr(), node))
+		}
+		time.Sleep(time.Duration(failures) * 100 * time.Millisecond)
+		status, newOffset, err = this._sendShardMigrationMessage(node, this._shardIdMessage(ShardResumeBinaryTransportMessageType, shard.Id))
+		if err != nil {
+			continue
+		}
+		if status != OkShardMigrationStatus {
+			return errors.New(fmt.Sprintf("Shard %s migration to %s can not be resumed (status %d)", shard.IdStr(), node, status))
+		}
+		offset = newOffset
+	}
+
+	// Commit
+	status, _, err = this._sendShardMigrationMessage(node, this._shardIdMessage(ShardCommitBinaryTransportMessageType, shard.Id))
+	if err != nil {
+		return err
+	}
+	if status != OkShardMigrationStatus {
+		return errors.New(fmt.Sprintf("Shard %s commit rejected by %s with status %d", shard.IdStr(), node, status))
+	}
+
+	log.Infof("Migrated shard %s (%d bytes) to %s", shard.IdStr(), totalLength, node)
+	return nil
+}
+
+// Send migration message and read the response
+func (this *BinaryTransport) _sendShardMigrationMessage(node string, msg *BinaryTransportMessage) (ShardMigrationStatus, uint64, error) {
+	resp, err := this._send(node, msg)
+	if err != nil {
+		return InvalidShardMigrationStatus, 0, err
+	}
+	return this._readShardMigrationResponse(resp)
+}
+
+// Offer message
+func (this *BinaryTransport) _shardOfferMessage(shard *Shard, totalLength uint64, checksum uint32, replace bool, previous *ShardMeta) *BinaryTransportMessage {
+	large := totalLength > math.MaxUint32
+	buf := new(bytes.Buffer)
+	buf.Write(shard.Block().Id)                                   // block id
+	buf.Write(shard.Id)                                           // shard id
+	binary.Write(buf, binary.BigEndian, uint32(shard.BlockIndex)) // block index
+	if shard.Parity {                                             // parity
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	writeShardMigrationSize(buf, totalLength, large) // total length
+	binary.Write(buf, binary.BigEndian, checksum)    // crc
+	metaBytes := shard.ShardMeta().Bytes()
+	binary.Write(buf, binary.BigEndian, uint32(len(metaBytes))) // shard meta length
+	buf.Write(metaBytes)                                        // shard meta
+	if replace {                                                // replace existing copy
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	if previous != nil { // shard meta of the copy that is replaced
+		previousBytes := previous.Bytes()
+		binary.Write(buf, binary.BigEndian, uint32(len(previousBytes)))
+		buf.Write(previousBytes)
+	}
+	return newShardMigrationMessage(ShardOfferBinaryTransportMessageType, buf.Bytes(), large)
+}
+
+// Chunk message
+func (this *BinaryTransport) _shardChunkMessage(shardId []byte, offset uint64, b []byte) *BinaryTransportMessage {
+	large := offset+uint64(len(b)) > math.MaxUint32
+	buf := new(bytes.Buffer)
+	buf.Write(shardId)                                               // shard id
+	writeShardMigrationSize(buf, offset, large)                      // offset
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))              // content chunk length
+	binary.Write(buf, binary.BigEndian, crc32.Checksum(b, crcTable)) // content chunk crc
+	buf.Write(b)                                                     // content
+	return newShardMigrationMessage(ShardChunkBinaryTransportMessageType, buf.Bytes(), large)
+}
+
+// Migration message, large messages have 64-bit lengths and offsets
+func newShardMigrationMessage(t BinaryTransportMessageType, data []byte, large bool) *BinaryTransportMessage {
+	msg := newBinaryTransportMessage(t, data)
+	if large {
+		msg.Version = BINARY_TRANSPORT_LARGE_MESSAGE_VERSION
+	}
+	return msg
+}
+
+// Write length or offset
+func writeShardMigrationSize(buf *bytes.Buffer, v uint64, large bool) {
+	if large {
+		binary.Write(buf, binary.BigEndian, v)
+	} else {
+		binary.Write(buf, binary.BigEndian, uint32(v))
+	}
+}
+
+// Read length or offset
+func readShardMigrationSize(buf *bytes.Reader, large bool) (uint64, error) {
+	if large {
+		var v uint64
+		err := binary.Read(buf, binary.BigEndian, &v)
+		return v, err
+	}
+	var v uint32
+	err := binary.Read(buf, binary.BigEndian, &v)
+	return uint64(v), err
+}
+
+// Message that only contains the shard id (resume, commit)
+func (this *BinaryTransport) _shardIdMessage(t BinaryTransportMessageType, shardId []byte) *BinaryTransportMessage {
+	return newBinaryTransportMessage(t, shardId)
+}
+
+// Response
+func (this *BinaryTransport) _shardMigrationResponse(status ShardMigrationStatus, offset uint64) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(status))
+	writeShardMigrationSize(buf, offset, offset > math.MaxUint32)
+	return buf.Bytes()
+}
+
+// Read response
+func (this *BinaryTransport) _readShardMigrationResponse(b []byte) (ShardMigrationStatus, uint64, error) {
+	if len(b) != 1+4 && len(b) != 1+8 {
+		return InvalidShardMigrationStatus, 0, errors.New(fmt.Sprintf("Invalid shard migration response of %d bytes", len(b)))
+	}
+	buf := bytes.NewReader(b)
+	status, _ := buf.ReadByte()
+	offset, err := readShardMigrationSize(buf, len(b) == 1+8)
+	return ShardMigrationStatus(status), offset, err
+}
+
+// Shard receiver key
+func (this *BinaryTransport) _shardReceiverKey(cmeta *TransportConnectionMeta, shardId []byte) string {
+	return fmt.Sprintf("%s~shard%s", cmeta.GetNode(), uuidToString(shardId))
+}
+
+// Get shard receiver
+func (this *BinaryTransport) _getShardReceiver(cmeta *TransportConnectionMeta, shardId []byte) *BinaryTransportShardReceiver {
+	this.shardReceiversMux.RLock()
+	defer this.shardReceiversMux.RUnlock()
+	return this.shardReceivers[this._shardReceiverKey(cmeta, shardId)]
+}
+
+// Remove shard receiver
+func (this *BinaryTransport) _removeShardReceiver(cmeta *TransportConnectionMeta, shardId []byte) {
+	this.shardReceiversMux.Lock()
+	delete(this.shardReceivers, this._shardReceiverKey(cmeta, shardId))
+	this.shardReceiversMux.Unlock()
+}
+
+// Cleanup shard receivers that have not received data for a long time
+func (this *BinaryTransport) _cleanupShardReceivers() {
+	this.shardReceiversMux.Lock()
+	for k, receiver := range this.shardReceivers {
+		if time.Now().Sub(receiver.GetLastChunkReceived()).Seconds() > 300 {
+			log.Warnf("Removing shard %s receiver which didn't have data in timeout period", k)
+			receiver.Abort()
+			delete(this.shardReceivers, k)
+		}
+	}
+	this.shardReceiversMux.Unlock()
+}
+
+// Read shard id from message
+func (this *BinaryTransport) _readShardId(buf *bytes.Reader) ([]byte, error) {
+	shardId := make([]byte, 16)
+	n, _ := buf.Read(shardId)
+	if n != 16 {
+		return nil, errors.New("Shard id bytes read mismatch")
+	}
+	return shardId, nil
+}
+
+// Receive shard offer
+func (this *BinaryTransport) _receiveShardOffer(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) []byte {
+	buf := bytes.NewReader(msg.Data)
+
+	// Block id
+	blockId, blockIdErr := this._readShardId(buf)
+	if blockIdErr != nil {
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+
+	// Shard id
+	shardId, shardIdErr := this._readShardId(buf)
+	if shardIdErr != nil {
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+
+	// Block index, parity, length, checksum, meta length
+	var blockIndex uint32
+	var checksum uint32
+	var metaLen uint32
+	binary.Read(buf, binary.BigEndian, &blockIndex)
+	parity, _ := buf.ReadByte()
+	totalLength, _ := readShardMigrationSize(buf, msg.Version >= BINARY_TRANSPORT_LARGE_MESSAGE_VERSION)
+	binary.Read(buf, binary.BigEndian, &checksum)
+	err := binary.Read(buf, binary.BigEndian, &metaLen)
+	if err != nil || !isShardMetaLength(metaLen) {
+		log.Warnf("Received invalid shard offer from %s", cmeta.GetNode())
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+
+	// Shard meta
+	metaBytes := make([]byte, metaLen)
+	metaBytesRead, _ := buf.Read(metaBytes)
+	if uint32(metaBytesRead) != metaLen {
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+	shardMeta := newShardMeta()
+	shardMeta.FromBytes(metaBytes)
+
+	// Replace existing copy?
+	var replace bool = false
+	if buf.Len() > 0 {
+		replaceByte, _ := buf.ReadByte()
+		replace = replaceByte == 1
+	}
+
+	// Shard meta of the copy that is replaced (optional)
+	var previous *ShardMeta = nil
+	if buf.Len() > 0 {
+		var previousLen uint32
+		binary.Read(buf, binary.BigEndian, &previousLen)
+		if !isShardMetaLength(previousLen) {
+			return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+		}
+		previousBytes := make([]byte, previousLen)
+		if n, _ := buf.Read(previousBytes); uint32(n) != previousLen {
+			return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+		}
+		previous = newShardMeta()
+		previous.FromBytes(previousBytes)
+	}
+
+	// Already existing? Only an identical copy counts, a different one is only replaced on request
+	if existing := datastore.LocalShardByIdStr(uuidToString(shardId)); existing != nil && (!replace || previous != nil) {
+		if existing._isCopy(shardMeta, totalLength, checksum) {
+			return this._shardMigrationResponse(ExistsShardMigrationStatus, totalLength)
+		}
+		if !replace || !existing._isReplicaOf(previous) {
+			log.Warnf("Shard %s offered by %s differs from the local copy", uuidToString(shardId), cmeta.GetNode())
+			return this._shardMigrationResponse(DivergedShardMigrationStatus, 0)
+		}
+	}
+
+	// Cleanup stale receivers
+	go this._cleanupShardReceivers()
+
+	// Resume transfer of the same shard?
+	existing := this._getShardReceiver(cmeta, shardId)
+	if existing != nil {
+		if existing.totalLength == totalLength && existing.checksum == checksum {
+			log.Infof("Resuming migration of shard %s from %s at %d", uuidToString(shardId), cmeta.GetNode(), existing.Offset())
+			return this._shardMigrationResponse(OkShardMigrationStatus, existing.Offset())
+		}
+		existing.Abort()
+	}
+
+	// Block (the block is registered once the shard is committed)
+	block := datastore.BlockByIdStr(uuidToString(blockId))
+	if block == nil {
+		volume := datastore.GetVolume()
+		if volume == nil {
+			return this._shardMigrationResponse(NoCapacityShardMigrationStatus, 0)
+		}
+		block = newBlockFromId(volume, blockId)
+	} else if !block.Volume().IsWritable() {
+		return this._shardMigrationResponse(NoCapacityShardMigrationStatus, 0)
+	}
+
+	// New receiver
+	receiver := newBinaryTransportShardReceiver(block, shardId, blockIndex, parity == 1, totalLength, checksum, shardMeta, replace, previous)
+	if err := receiver.Open(); err != nil {
+		log.Errorf("Failed to open shard %s receiver: %s", uuidToString(shardId), err)
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+	this.shardReceiversMux.Lock()
+	this.shardReceivers[this._shardReceiverKey(cmeta, shardId)] = receiver
+	this.shardReceiversMux.Unlock()
+
+	log.Infof("Receiving shard %s (%d bytes) from %s", uuidToString(shardId), totalLength, cmeta.GetNode())
+	return this._shardMigrationResponse(OkShardMigrationStatus, 0)
+}
+
+// Receive shard chunk
+func (this *BinaryTransport) _receiveShardChunk(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) []byte {
+	buf := bytes.NewReader(msg.Data)
+
+	// Shard id
+	shardId, shardIdErr := this._readShardId(buf)
+	if shardIdErr != nil {
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+
+	// Receiver
+	receiver := this._getShardReceiver(cmeta, shardId)
+	if receiver == nil {
+		return this._shardMigrationResponse(UnknownShardMigrationStatus, 0)
+	}
+
+	// Offset, length, checksum
+	var contentLen uint32
+	var checksum uint32
+	offset, _ := readShardMigrationSize(buf, msg.Version >= BINARY_TRANSPORT_LARGE_MESSAGE_VERSION)
+	binary.Read(buf, binary.BigEndian, &contentLen)
+	err := binary.Read(buf, binary.BigEndian, &checksum)
+	if err != nil {
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, receiver.Offset())
+	}
+
+	// Content
+	contentBytes := make([]byte, contentLen)
+	contentBytesRead, _ := buf.Read(contentBytes)
+	if uint32(contentBytesRead) != contentLen {
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, receiver.Offset())
+	}
+
+	// Write
+	newOffset, writeErr := receiver.Write(offset, contentBytes, checksum)
+	if writeErr != nil {
+		log.Warnf("Failed to write shard %s chunk at %d: %s", uuidToString(shardId), offset, writeErr)
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, newOffset)
+	}
+	return this._shardMigrationResponse(OkShardMigrationStatus, newOffset)
+}
+
+// Receive shard resume request
+func (this *BinaryTransport) _receiveShardResume(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) []byte {
+	shardId, shardIdErr := this._readShardId(bytes.NewReader(msg.Data))
+	if shardIdErr != nil {
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+	receiver := this._getShardReceiver(cmeta, shardId)
+	if receiver == nil {
+		return this._shardMigrationResponse(UnknownShardMigrationStatus, 0)
+	}
+	return this._shardMigrationResponse(OkShardMigrationStatus, receiver.Offset())
+}
+
+// Receive shard commit
+func (this *BinaryTransport) _receiveShardCommit(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) []byte {
+	shardId, shardIdErr := this._readShardId(bytes.NewReader(msg.Data))
+	if shardIdErr != nil {
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+	receiver := this._getShardReceiver(cmeta, shardId)
+	if receiver == nil {
+		// Committed before? (e.g. retried commit)
+		if datastore.LocalShardByIdStr(uuidToString(shardId)) != nil {
+			return this._shardMigrationResponse(OkShardMigrationStatus, 0)
+		}
+		return this._shardMigrationResponse(UnknownShardMigrationStatus, 0)
+	}
+
+	// Commit
+	shard, err := receiver.Commit()
+	if err != nil {
+		log.Errorf("Failed to commit shard %s from %s: %s", uuidToString(shardId), cmeta.GetNode(), err)
+		receiver.Abort()
+		this._removeShardReceiver(cmeta, shardId)
+		return this._shardMigrationResponse(InvalidShardMigrationStatus, 0)
+	}
+	this._removeShardReceiver(cmeta, shardId)
+	log.Infof("Received shard %s from %s", shard.IdStr(), cmeta.GetNode())
+
+	// Let the other nodes know where to find this shard
+	go this._broadcastShardIndex(shard)
+
+	return this._shardMigrationResponse(OkShardMigrationStatus, receiver.totalLength)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBinaryTransportShardMigration(t *testing.T) {
+	startApplication()
+
+	// Block that is not registered with this node, acts as the sender
+	b := newBlock(datastore.GetVolume())
+	b.initShards()
+	shard := b.DataShards[0]
+	shard.BlockIndex = 0
+	_, err := shard.AddFile(newFileMeta("/migration/hello.txt"), []byte("Hello migration"))
+	if err != nil {
+		t.Error(err)
+	}
+	shard.Persist()
+
+	// Shard bytes of the sender
+	shardBytes, readErr := ioutil.ReadFile(shard.FullPath())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	checksum := crc32.Checksum(shardBytes, crcTable)
+
+	// Remove from disk, so the receiver has to build it from the transfer
+	os.RemoveAll(b.FullPath())
+
+	cmeta := newTransportConnectionMeta("10.1.2.3:1234")
+	var status ShardMigrationStatus
+	var offset uint64
+
+	// Offer
+	offer := binaryTransport._shardOfferMessage(shard, uint64(len(shardBytes)), checksum, false, nil)
+	status, offset, err = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardOffer(cmeta, offer))
+	if err != nil || status != OkShardMigrationStatus || offset != 0 {
+		t.Fatalf("Offer not accepted: status %d offset %d err %v", status, offset, err)
+	}
+
+	// First chunk
+	half := uint64(len(shardBytes) / 2)
+	chunk := binaryTransport._shardChunkMessage(shard.Id, 0, shardBytes[:half])
+	status, offset, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardChunk(cmeta, chunk))
+	if status != OkShardMigrationStatus || offset != half {
+		t.Errorf("First chunk not accepted: status %d offset %d", status, offset)
+	}
+
+	// Duplicate chunk must be rejected, offset stays
+	status, offset, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardChunk(cmeta, chunk))
+	if status != InvalidShardMigrationStatus || offset != half {
+		t.Errorf("Duplicate chunk should be rejected: status %d offset %d", status, offset)
+	}
+
+	// Resume is possible while incomplete
+	status, _, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardResume(cmeta, binaryTransport._shardIdMessage(ShardResumeBinaryTransportMessageType, shard.Id)))
+	if status != OkShardMigrationStatus {
+		t.Errorf("Resume should be possible, status %d", status)
+	}
+
+	// Re-offer resumes at the received offset
+	status, offset, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardOffer(cmeta, offer))
+	if status != OkShardMigrationStatus || offset != half {
+		t.Errorf("Offer should resume at %d: status %d offset %d", half, status, offset)
+	}
+
+	// Last chunk
+	chunk = binaryTransport._shardChunkMessage(shard.Id, offset, shardBytes[offset:])
+	status, offset, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardChunk(cmeta, chunk))
+	if status != OkShardMigrationStatus || offset != uint64(len(shardBytes)) {
+		t.Errorf("Last chunk not accepted: status %d offset %d", status, offset)
+	}
+
+	// Commit
+	commit := binaryTransport._shardIdMessage(ShardCommitBinaryTransportMessageType, shard.Id)
+	status, _, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardCommit(cmeta, commit))
+	if status != OkShardMigrationStatus {
+		t.Fatalf("Commit failed with status %d", status)
+	}
+
+	// Shard must be registered and readable
+	received := datastore.LocalShardByIdStr(shard.IdStr())
+	if received == nil {
+		t.Fatal("Received shard not registered")
+	}
+	if datastore.BlockByIdStr(b.IdStr()) == nil {
+		t.Error("Received block not registered")
+	}
+	fileBytes, fileErr, _ := received.ReadFile("/migration/hello.txt")
+	if fileErr != nil || string(fileBytes) != "Hello migration" {
+		t.Errorf("Failed to read file from received shard: %v", fileErr)
+	}
+
+	// Offering again is a no-op
+	status, _, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardOffer(cmeta, offer))
+	if status != ExistsShardMigrationStatus {
+		t.Errorf("Offer of existing shard should return exists, was %d", status)
+	}
+
+	// A different copy does not count as existing
+	diverged := binaryTransport._shardOfferMessage(shard, uint64(len(shardBytes)), checksum+1, false, nil)
+	status, _, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardOffer(cmeta, diverged))
+	if status != DivergedShardMigrationStatus {
+		t.Errorf("Offer of a different copy should return diverged, was %d", status)
+	}
+
+	// Replacing a copy of another version (e.g. after compaction) only if the local copy is that version
+	other := newShardMeta()
+	other.FromBytes(received.ShardMeta().Bytes())
+	other.FileCount++
+	replace := binaryTransport._shardOfferMessage(shard, uint64(len(shardBytes)), checksum+1, true, other)
+	status, _, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardOffer(cmeta, replace))
+	if status != DivergedShardMigrationStatus {
+		t.Errorf("Replace of a copy of another version should return diverged, was %d", status)
+	}
+	replace = binaryTransport._shardOfferMessage(shard, uint64(len(shardBytes)), checksum+1, true, received.ShardMeta())
+	status, _, _ = binaryTransport._readShardMigrationResponse(binaryTransport._receiveShardOffer(cmeta, replace))
+	if status != OkShardMigrationStatus {
+		t.Errorf("Replace of a copy of the previous version should be accepted, was %d", status)
+	}
+	binaryTransport._getShardReceiver(cmeta, shard.Id).Abort()
+	binaryTransport._removeShardReceiver(cmeta, shard.Id)
+}
+
+// Test that shards are not sent to nodes that can not read their format
+func TestBinaryTransportShardMigrationFormat(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	if _, err := shard.AddFile(newFileMeta("/migration/format.txt"), []byte("Format")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	shard.ShardMeta().SetMetaVersion(BINARY_VERSION)
+
+	// Node that did not announce a format reads the oldest
+	if err := binaryTransport._migrateShard("old-format-node", shard); err == nil {
+		t.Error("Expected shard in a newer format to be refused")
+	}
+}
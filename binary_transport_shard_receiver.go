@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Receiver of a migrated shard, should only be used for one shard
+type BinaryTransportShardReceiver struct {
+	lastChunkReceived time.Time
+	mux               sync.RWMutex
+	block             *Block // Target block, is only registered with the volume on commit
+	shardId           []byte
+	blockIndex        uint32
+	parity            bool
+	totalLength       uint64     // Length of the full shard file
+	checksum          uint32     // Crc 32 (Castagnoli) of the full shard file
+	shardMeta         *ShardMeta // Shard meta of the sender, used to validate the received shard
+	offset            uint64     // Number of bytes received (and written) so far
+	replace           bool       // Replaces the local copy (e.g. compacted version)
+	previous          *ShardMeta // Shard meta the replaced copy must have, nil replaces any copy
+	file              *os.File
+}
+
+// Path of the partially received shard file (is not picked up by block recovery)
+func (this *BinaryTransportShardReceiver) PartialPath() string {
+	return fmt.Sprintf("%s/s_%s.partial", this.block.FullPath(), uuidToString(this.shardId))
+}
+
+// Open partial file, truncates any previous partial data
+func (this *BinaryTransportShardReceiver) Open() error {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+
+	// Make sure block folder is prepared
+	this.block.PrepareFolder()
+
+	// Open
+	f, err := os.OpenFile(this.PartialPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, conf.UnixFilePermissions)
+	if err != nil {
+		return err
+	}
+	this.file = f
+	this.offset = 0
+	return nil
+}
+
+// Write chunk at offset, returns the new offset
+func (this *BinaryTransportShardReceiver) Write(offset uint64, b []byte, checksum uint32) (uint64, error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.lastChunkReceived = time.Now()
+
+	// Must continue where we are
+	if offset != this.offset {
+		return this.offset, errors.New(fmt.Sprintf("Shard chunk offset mismatch, expected %d received %d", this.offset, offset))
+	}
+
+	// Must fit
+	if this.offset+uint64(len(b)) > this.totalLength {
+		return this.offset, errors.New("Shard chunk exceeds total length")
+	}
+
+	// Validate chunk
+	if crc32.Checksum(b, crcTable) != checksum {
+		return this.offset, errors.New("Shard chunk checksum mismatch")
+	}
+
+	// Write
+	if this.file == nil {
+		return this.offset, errors.New("Shard receiver file not open")
+	}
+	n, err := this.file.WriteAt(b, int64(offset))
+	if err != nil {
+		return this.offset, err
+	}
+	this.offset += uint64(n)
+	return this.offset, nil
+}
+
+// Current offset
+func (this *BinaryTransportShardReceiver) Offset() uint64 {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.offset
+}
+
+// Get last chunk received time
+func (this *BinaryTransportShardReceiver) GetLastChunkReceived() time.Time {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.lastChunkReceived
+}
+
+// Commit, validates the received bytes and turns them into a registered shard
+func (this *BinaryTransportShardReceiver) Commit() (*Shard, error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+
+	// All bytes received?
+	if this.offset != this.totalLength {
+		return nil, errors.New(fmt.Sprintf("Shard incomplete, received %d of %d bytes", this.offset, this.totalLength))
+	}
+
+	// Close
+	if this.file != nil {
+		this.file.Close()
+		this.file = nil
+	}
+
+	// Validate full checksum
+	f, err := os.Open(this.PartialPath())
+	if err != nil {
+		return nil, err
+	}
+	hasher := crc32.New(crcTable)
+	_, copyErr := io.Copy(hasher, f)
+	f.Close()
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	if hasher.Sum32() != this.checksum {
+		os.Remove(this.PartialPath())
+		return nil, errors.New(fmt.Sprintf("Shard checksum mismatch, expected %d found %d", this.checksum, hasher.Sum32()))
+	}
+
+	// Replaced local copy? Swap the new version in
+	if this.replace {
+		existing := datastore.LocalShardByIdStr(uuidToString(this.shardId))
+		if existing != nil {
+			if this.previous != nil && !existing._isReplicaOf(this.previous) {
+				os.Remove(this.PartialPath())
+				return nil, errors.New(fmt.Sprintf("Local copy of shard %s changed during the transfer", uuidToString(this.shardId)))
+			}
+			if err := existing._replaceFromFile(this.PartialPath(), this.shardMeta); err != nil {
+				return nil, err
+			}
+			return existing, nil
+		}
+	}
+
+	// Shard
+	shard := newShardFromId(this.block, this.shardId)
+	shard.BlockIndex = uint(this.blockIndex)
+	shard.Parity = this.parity
+
+	// Move into place
+	if err := os.Rename(this.PartialPath(), shard.FullPath()); err != nil {
+		return nil, err
+	}
+
+	// Load from disk
+	_, loadErr := shard.Load()
+	if loadErr != nil {
+		os.Remove(shard.FullPath())
+		return nil, loadErr
+	}
+
+	// Validate against the shard meta of the sender
+	if !shard.ShardMeta().Equals(this.shardMeta) {
+		os.Remove(shard.FullPath())
+		return nil, errors.New(fmt.Sprintf("Shard meta mismatch, expected %v found %v", this.shardMeta.Bytes(), shard.ShardMeta().Bytes()))
+	}
+
+	// Erasure coding scheme of a new block
+	if this.block.ShardCount() == 0 && shard.ShardIndex().DataShards > 0 {
+		this.block.dataShardCount = int(shard.ShardIndex().DataShards)
+		this.block.parityShardCount = int(shard.ShardIndex().ParityShards)
+	}
+
+	// Register with block and volume
+	this.block.RegisterShard(shard)
+	this.block.Volume().RegisterBlock(this.block)
+	if err := this.block.PersistManifest(); err != nil {
+		log.Errorf("Failed to write manifest of block %s: %s", this.block.IdStr(), err)
+	}
+
+	return shard, nil
+}
+
+// Abort, removes partial data
+func (this *BinaryTransportShardReceiver) Abort() {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.file != nil {
+		this.file.Close()
+		this.file = nil
+	}
+	os.Remove(this.PartialPath())
+}
+
+// New receiver
+func newBinaryTransportShardReceiver(block *Block, shardId []byte, blockIndex uint32, parity bool, totalLength uint64, checksum uint32, shardMeta *ShardMeta, replace bool, previous *ShardMeta) *BinaryTransportShardReceiver {
+	return &BinaryTransportShardReceiver{
+		block:             block,
+		shardId:           shardId,
+		blockIndex:        blockIndex,
+		parity:            parity,
+		totalLength:       totalLength,
+		checksum:          checksum,
+		shardMeta:         shardMeta,
+		replace:           replace,
+		previous:          previous,
+		lastChunkReceived: time.Now(),
+	}
+}
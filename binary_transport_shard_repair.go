@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Binary transport of shard repairs: a node reports shards it lost (e.g. failed volume), a node with a copy re-replicates it
+// repair: shard id (16 bytes)
+
+// Broadcast shard repair
+func (this *BinaryTransport) _broadcastShardRepair(shardId []byte) {
+	msg := newBinaryTransportMessage(ShardRepairBinaryTransportMessageType, shardId)
+	var wg sync.WaitGroup
+	for _, ns := range gossip.GetNodeStates() {
+		wg.Add(1)
+		go func(ns *GossipNodeState) {
+			this._send(ns.Node, msg)
+			wg.Done()
+		}(ns)
+	}
+	wg.Wait()
+}
+
+// Receive shard repair
+func (this *BinaryTransport) _receiveShardRepair(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) {
+	if len(msg.Data) != 16 {
+		log.Warnf("Received invalid shard repair from %s", cmeta.GetNode())
+		return
+	}
+	reporter := cmeta.GetNode()
+
+	// No longer available on the reporting node
+	datastore.fileLocator.UnloadIndex(reporter, msg.Data)
+
+	// Do we have a copy?
+	shard := datastore.LocalShardByIdStr(uuidToString(msg.Data))
+	if shard == nil {
+		return
+	}
+
+	// Only one of the nodes with a copy repairs: the first by name
+	nodes := make([]string, 0)
+	for _, location := range datastore.fileLocator.ShardLocationsByIdStr(shard.IdStr()) {
+		if location.Node != reporter {
+			nodes = append(nodes, location.Node)
+		}
+	}
+	sort.Strings(nodes)
+	if len(nodes) > 0 && !runtime.IsLocalNode(nodes[0]) {
+		log.Infof("Shard %s is repaired by %s", shard.IdStr(), nodes[0])
+		return
+	}
+
+	go this._repairShard(shard, reporter)
+}
+
+// Copy shard to a node that does not have it yet
+func (this *BinaryTransport) _repairShard(shard *Shard, reporter string) {
+	criteria := newNodeRouterCriteria()
+	criteria.ExcludeLocalNodes = true
+	criteria.ExcludeNodes = append(criteria.ExcludeNodes, reporter)
+	for _, location := range datastore.fileLocator.ShardLocationsByIdStr(shard.IdStr()) {
+		criteria.ExcludeNodes = append(criteria.ExcludeNodes, location.Node)
+	}
+	node, err := datastore.nodeRouter.PickNode(criteria)
+	if err != nil {
+		log.Errorf("Unable to repair shard %s: %s", shard.IdStr(), err)
+		return
+	}
+	if err := this._migrateShard(node, shard); err != nil {
+		log.Errorf("Failed to repair shard %s on %s: %s", shard.IdStr(), node, err)
+		return
+	}
+	log.Infof("Repaired shard %s on %s", shard.IdStr(), node)
+}
@@ -20,6 +20,13 @@ func (this *BinaryTransport) _sendShardIndices(node string) {
 			}(shard)
 		}
 	}
+	for _, shard := range temporaryStore.Shards() {
+		wg.Add(1)
+		go func(shard *Shard) {
+			this._sendShardIndex(shard, node)
+			wg.Done()
+		}(shard)
+	}
 	wg.Wait()
 }
 
@@ -42,7 +49,9 @@ func (this *BinaryTransport) _sendShardIndex(shard *Shard, node string) {
 	log.Infof("Sending local shard index %s (%s) to %s", shard.IdStr(), uuidToString(shard.shardIndex.ShardId), node)
 
 	// To bytes
-	b := shard.ShardIndex().Bytes()
+	idx := shard.ShardIndex()
+	shard._syncIndexBlockInfo()
+	b := idx.Bytes()
 	// log.Infof("Start idx serialized %s", shard.IdStr())
 
 	// Msg
@@ -66,6 +75,29 @@ func (this *BinaryTransport) _receiveShardIndex(cmeta *TransportConnectionMeta,
 	datastore.fileLocator.LoadIndex(cmeta.GetNode(), s.ShardId, s)
 }
 
+// Broadcast removal of local shard
+func (this *BinaryTransport) _broadcastRemoveShardIndex(shardId []byte) {
+	msg := newBinaryTransportMessage(RemoveShardIdxBinaryTransportMessageType, shardId)
+	var wg sync.WaitGroup
+	for _, ns := range gossip.GetNodeStates() {
+		wg.Add(1)
+		go func(ns *GossipNodeState) {
+			this._send(ns.Node, msg)
+			wg.Done()
+		}(ns)
+	}
+	wg.Wait()
+}
+
+// Receive removal of shard on node
+func (this *BinaryTransport) _receiveRemoveShardIndex(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) {
+	if len(msg.Data) != 16 {
+		log.Warnf("Received invalid shard index removal from %s", cmeta.GetNode())
+		return
+	}
+	datastore.fileLocator.UnloadIndex(cmeta.GetNode(), msg.Data)
+}
+
 // Send create shard
 func (this *BinaryTransport) _sendCreateShard(node string, blockId []byte, shardId []byte) {
 	// Build message
@@ -73,6 +105,11 @@ func (this *BinaryTransport) _sendCreateShard(node string, blockId []byte, shard
 	buf.Write(blockId)
 	buf.Write(shardId)
 
+	// Data key of an encrypted block (optional)
+	if bk := keyring.BlockKey(blockId); bk != nil {
+		buf.Write(bk.Bytes())
+	}
+
 	// Send
 	msg := newBinaryTransportMessage(CreateShardBinaryTransportMessageType, buf.Bytes())
 	this._send(node, msg)
@@ -87,8 +124,22 @@ func (this *BinaryTransport) _receiveCreateShard(cmeta *TransportConnectionMeta,
 	shardId := make([]byte, 16)
 	buf.Read(shardId)
 
+	// Data key of an encrypted block
+	if buf.Len() > 0 {
+		keyBytes := make([]byte, buf.Len())
+		buf.Read(keyBytes)
+		if _, err := keyring.ImportBlockKey(blockId, keyBytes); err != nil {
+			log.Errorf("Unable to create shard %s, data key of block %s: %s", uuidToString(shardId), uuidToString(blockId), err)
+			return
+		}
+	}
+
 	// Get volume
 	volume := datastore.GetVolume()
+	if volume == nil {
+		log.Errorf("Unable to create shard %s, no writable volume", uuidToString(shardId))
+		return
+	}
 
 	// Block
 	blockIdStr := uuidToString(blockId)
@@ -117,5 +168,26 @@ func (this *BinaryTransport) _receiveCreateShard(cmeta *TransportConnectionMeta,
 	block.RegisterDataShard(shard)
 
 	// Persist shard
-	shard.Persist()
+	if err := shard.Persist(); err != nil {
+		log.Errorf("Failed to persist shard %s: %s", shard.IdStr(), err)
+		return
+	}
+	if err := block.PersistManifest(); err != nil {
+		log.Errorf("Failed to write manifest of block %s: %s", block.IdStr(), err)
+	}
+}
+
+// Broadcast that a file was written or deleted, other nodes drop its cached locations and contents, sent by the node that coordinates
+// the write or delete without waiting (a lost message is covered by the ttl of the cached locations)
+func (this *BinaryTransport) _broadcastFileLocationInvalidation(fullName string) {
+	msg := newBinaryTransportMessage(FileLocationBinaryTransportMessageType, []byte(fullName))
+	for _, ns := range gossip.GetNodeStates() {
+		go this._send(ns.Node, msg)
+	}
+}
+
+// Receive file written or deleted on node
+func (this *BinaryTransport) _receiveFileLocationInvalidation(cmeta *TransportConnectionMeta, msg *BinaryTransportMessage) {
+	datastore.fileLocator.InvalidateLocation(string(msg.Data))
+	fileCache.Invalidate(string(msg.Data))
 }
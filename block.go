@@ -15,6 +15,19 @@ type Block struct {
 	volume    *Volume
 	shardsMux sync.RWMutex
 
+	// Sealed blocks are erasure coded and accept no more writes
+	sealed  bool
+	sealMux sync.RWMutex
+	created uint32 // Unix timestamp, used to seal blocks after a time limit
+
+	// Erasure coding scheme, fixed per block
+	dataShardCount   int
+	parityShardCount int
+
+	// Last manifest written to or read from disk
+	manifest    *BlockManifest
+	manifestMux sync.Mutex
+
 	// these must be an array to preserve the order
 	DataShards   []*Shard
 	ParityShards []*Shard
@@ -22,15 +35,15 @@ type Block struct {
 
 // Init local shards
 func (this *Block) initShards() {
-	for i := 0; i < conf.DataShardsPerBlock; i++ {
+	for i := 0; i < this.DataShardCount(); i++ {
 		shard := newShard(this)
 		shard.BlockIndex = uint(i)
 		this.RegisterDataShard(shard)
 	}
-	for i := 0; i < conf.ParityShardsPerBlock; i++ {
+	for i := 0; i < this.ParityShardCount(); i++ {
 		shard := newShard(this)
 		shard.Parity = true
-		shard.BlockIndex = uint(i + conf.DataShardsPerBlock)
+		shard.BlockIndex = uint(i + this.DataShardCount())
 		this.RegisterParityShard(shard)
 	}
 }
@@ -76,14 +89,21 @@ func (this *Block) Persist() bool {
 	this.PrepareFolder()
 
 	// Shards to disk
-	for _, shard := range this.DataShards {
-		shard.Persist()
+	var res bool = true
+	for _, shard := range this._shards() {
+		if err := shard.Persist(); err != nil {
+			log.Errorf("Failed to persist shard %s: %s", shard.IdStr(), err)
+			res = false
+		}
 	}
-	for _, shard := range this.ParityShards {
-		shard.Persist()
+
+	// Layout of the block
+	if err := this.PersistManifest(); err != nil {
+		log.Errorf("Failed to write manifest of block %s: %s", this.IdStr(), err)
+		return false
 	}
 
-	return true
+	return res
 }
 
 // Prepare folder
@@ -113,8 +133,8 @@ func (this *Block) recoverShards() {
 	log.Infof("Found %d entries in block directory", len(list))
 	for _, elm := range list {
 		split := strings.Split(elm.Name(), "_")
-		// Must be in format s_UUID
-		if len(split) != 2 || split[0] != "s" {
+		// Must be in format s_UUID(.parity).data
+		if len(split) != 2 || split[0] != "s" || !strings.HasSuffix(elm.Name(), ".data") {
 			log.Warnf("Ignoring invalid shard %s", elm)
 			continue
 		}
@@ -135,13 +155,22 @@ func (this *Block) recoverShards() {
 	}
 }
 
+// Register shard of either type
+func (this *Block) RegisterShard(s *Shard) {
+	if s.Parity {
+		this.RegisterParityShard(s)
+	} else {
+		this.RegisterDataShard(s)
+	}
+}
+
 // Register shards
 func (this *Block) RegisterDataShard(s *Shard) {
 	if s.Parity == true {
 		panic("Not a data shard")
 	}
 	this.shardsMux.Lock()
-	if len(this.DataShards) > conf.DataShardsPerBlock {
+	if len(this.DataShards) > this.DataShardCount() {
 		panic("Block full, can not register data shard")
 	}
 	log.Infof("Registered data shard %s with block %s", s.IdStr(), this.IdStr())
@@ -155,7 +184,7 @@ func (this *Block) RegisterParityShard(s *Shard) {
 		panic("Not a parity shard")
 	}
 	this.shardsMux.Lock()
-	if len(this.ParityShards) > conf.ParityShardsPerBlock {
+	if len(this.ParityShards) > this.ParityShardCount() {
 		panic("Block full, can not register data shard")
 	}
 	log.Infof("Registered parity shard %s with block %s", s.IdStr(), this.IdStr())
@@ -163,6 +192,57 @@ func (this *Block) RegisterParityShard(s *Shard) {
 	this.shardsMux.Unlock()
 }
 
+// Unregister shard (e.g. migrated away)
+func (this *Block) UnregisterShard(s *Shard) {
+	this.shardsMux.Lock()
+	dataShards := make([]*Shard, 0)
+	for _, ds := range this.DataShards {
+		if ds != s {
+			dataShards = append(dataShards, ds)
+		}
+	}
+	parityShards := make([]*Shard, 0)
+	for _, ps := range this.ParityShards {
+		if ps != s {
+			parityShards = append(parityShards, ps)
+		}
+	}
+	this.DataShards = dataShards
+	this.ParityShards = parityShards
+	this.shardsMux.Unlock()
+}
+
+// Number of local shards
+func (this *Block) ShardCount() int {
+	this.shardsMux.RLock()
+	defer this.shardsMux.RUnlock()
+	return len(this.DataShards) + len(this.ParityShards)
+}
+
+// Number of data shards in the erasure coding scheme
+func (this *Block) DataShardCount() int {
+	return this.dataShardCount
+}
+
+// Number of parity shards in the erasure coding scheme
+func (this *Block) ParityShardCount() int {
+	return this.parityShardCount
+}
+
+// Is sealed?
+func (this *Block) IsSealed() bool {
+	this.sealMux.RLock()
+	defer this.sealMux.RUnlock()
+	return this.sealed
+}
+
+// Set sealed
+func (this *Block) SetSealed(sealed bool) {
+	this.sealMux.Lock()
+	this.sealed = sealed
+	this.sealMux.Unlock()
+}
+
 // Full path
 func (this *Block) FullPath() string {
 	return fmt.Sprintf("%s/b_%s", this.Volume().FullPath(), this.IdStr())
@@ -177,10 +257,14 @@ func newBlock(v *Volume) *Block {
 // New block from ID
 func newBlockFromId(v *Volume, id []byte) *Block {
 	b := &Block{
-		volume:       v,
-		Id:           id,
-		DataShards:   make([]*Shard, 0),
-		ParityShards: make([]*Shard, 0),
+		volume:  v,
+		Id:      id,
+		created: unixTsUint32(),
+
+		dataShardCount:   conf.DataShardsPerBlock,
+		parityShardCount: conf.ParityShardsPerBlock,
+		DataShards:       make([]*Shard, 0),
+		ParityShards:     make([]*Shard, 0),
 	}
 	return b
 }
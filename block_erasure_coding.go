@@ -5,7 +5,7 @@ import (
 	"github.com/klauspost/reedsolomon"
 )
 
-// Create parity of block
+// Create parity of block, writes to the data shards must be stopped (see Seal)
 func (this *Block) ErasureEncoding() {
 	// Create encoder
 	enc, err := reedsolomon.New(len(this.DataShards), len(this.ParityShards))
@@ -13,15 +13,16 @@ func (this *Block) ErasureEncoding() {
 		panic(err)
 	}
 
-	// Build data array
+	// Build data array, parity is computed from copies of the contents (zero padded)
 	var data [][]byte = make([][]byte, len(this.DataShards)+len(this.ParityShards))
 	for i, s := range this.DataShards {
-		buf := s.Contents()
-		data[i] = padByteArrZeros(buf.Bytes(), conf.ShardSizeInBytes)
+		data[i] = make([]byte, conf.ShardSizeInBytes)
+		s.contentsMux.Lock()
+		copy(data[i], s.Contents().Bytes())
+		s.contentsMux.Unlock()
 	}
-	for ip, is := range this.ParityShards {
-		buf := is.Contents()
-		data[len(this.DataShards)+ip] = padByteArrZeros(buf.Bytes(), conf.ShardSizeInBytes)
+	for ip := range this.ParityShards {
+		data[len(this.DataShards)+ip] = make([]byte, conf.ShardSizeInBytes)
 	}
 
 	// Encode
@@ -30,10 +31,29 @@ func (this *Block) ErasureEncoding() {
 		panic(encodeE)
 	}
 
-	// Write party into shard
-	for i := len(this.DataShards); i < len(this.ParityShards); i++ {
-		this.ParityShards[i].SetContents(bytes.NewBuffer(data[i]))
+	// Write parity into shard
+	for ip, ps := range this.ParityShards {
+		ps.SetContents(bytes.NewBuffer(data[len(this.DataShards)+ip]))
+
+		// Parity keeps a copy of the file metadata, to be able to decode files when data shards are lost
+		ps._setDataShardsFileMeta(this.DataShards)
+		ps._markDirty()
+	}
+}
+
+// Decode the region of one shard from the same region of the other shards of the block
+// shards must be ordered by block index, missing shards are nil
+func reconstructShardRange(dataShards int, parityShards int, shards [][]byte, blockIndex int) ([]byte, error) {
+	enc, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	shards[blockIndex] = nil
+	reconstructErr := enc.Reconstruct(shards)
+	if reconstructErr != nil {
+		return nil, reconstructErr
 	}
+	return shards[blockIndex], nil
 }
 
 // Pad zero bytes
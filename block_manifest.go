@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// Manifest of a block, stored in the block folder so the layout survives restarts
+
+// This version
+const BLOCK_MANIFEST_VERSION uint32 = 1
+
+// Manifest file name
+const BLOCK_MANIFEST_FILENAME string = "manifest.json"
+
+type BlockManifest struct {
+	Version      uint32
+	BlockId      string
+	DataShards   int // Erasure coding scheme of this block
+	ParityShards int
+	Sealed       bool
+	Created      uint32
+	Shards       []*BlockManifestShard
+}
+
+// Shard in the manifest
+type BlockManifestShard struct {
+	Id        string
+	Index     uint32   // Position in block (data shards first, then parity)
+	Parity    bool     // Role
+	Local     bool     // Stored on this node
+	Locations []string // Known remote nodes with this shard
+}
+
+// Get shard by id
+func (this *BlockManifest) Shard(id string) *BlockManifestShard {
+	for _, s := range this.Shards {
+		if s.Id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// Validate
+func (this *BlockManifest) Validate() error {
+	if this.Version < 1 || this.Version > BLOCK_MANIFEST_VERSION {
+		return errors.New(fmt.Sprintf("Unsupported block manifest version %d", this.Version))
+	}
+	if this.DataShards < 1 || this.ParityShards < 0 {
+		return errors.New(fmt.Sprintf("Invalid erasure coding scheme %d+%d", this.DataShards, this.ParityShards))
+	}
+	for _, s := range this.Shards {
+		if int(s.Index) >= this.DataShards+this.ParityShards {
+			return errors.New(fmt.Sprintf("Shard %s has invalid index %d", s.Id, s.Index))
+		}
+		if s.Parity != (int(s.Index) >= this.DataShards) {
+			return errors.New(fmt.Sprintf("Shard %s has invalid role for index %d", s.Id, s.Index))
+		}
+	}
+	return nil
+}
+
+// Manifest path
+func (this *Block) ManifestPath() string {
+	return fmt.Sprintf("%s/%s", this.FullPath(), BLOCK_MANIFEST_FILENAME)
+}
+
+// Build manifest from the current state, shards that are no longer local are kept with their known locations
+func (this *Block) Manifest() *BlockManifest {
+	m := &BlockManifest{
+		Version:      BLOCK_MANIFEST_VERSION,
+		BlockId:      this.IdStr(),
+		DataShards:   this.DataShardCount(),
+		ParityShards: this.ParityShardCount(),
+		Sealed:       this.IsSealed(),
+		Created:      this.created,
+		Shards:       make([]*BlockManifestShard, 0),
+	}
+
+	// Previously known shards
+	if this.manifest != nil {
+		for _, s := range this.manifest.Shards {
+			c := *s
+			c.Local = false
+			m.Shards = append(m.Shards, &c)
+		}
+	}
+
+	// Local shards
+	for _, shard := range this._shards() {
+		s := m.Shard(shard.IdStr())
+		if s == nil {
+			s = &BlockManifestShard{
+				Id: shard.IdStr(),
+			}
+			m.Shards = append(m.Shards, s)
+		}
+		s.Index = uint32(shard.BlockIndex)
+		s.Parity = shard.Parity
+		s.Local = true
+	}
+
+	// Remote locations
+	if datastore != nil {
+		for _, s := range m.Shards {
+			locations := datastore.fileLocator.ShardLocationsByIdStr(s.Id)
+			if len(locations) == 0 {
+				// Keep what we knew
+				continue
+			}
+			s.Locations = make([]string, 0)
+			for _, location := range locations {
+				if !location.Local {
+					s.Locations = append(s.Locations, location.Node)
+				}
+			}
+		}
+	}
+
+	// Stable order
+	sort.Sort(BlockManifestShards(m.Shards))
+	return m
+}
+
+// Write manifest to disk, atomic by writing a temporary file first
+func (this *Block) PersistManifest() error {
+	this.manifestMux.Lock()
+	defer this.manifestMux.Unlock()
+
+	m := this.Manifest()
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Make sure block folder is prepared
+	this.PrepareFolder()
+
+	// Temporary file
+	tmpPath := fmt.Sprintf("%s.tmp", this.ManifestPath())
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, conf.UnixFilePermissions)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	f.Close()
+
+	// Move into place
+	if err := os.Rename(tmpPath, this.ManifestPath()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	this.manifest = m
+	return nil
+}
+
+// Read manifest from disk
+func (this *Block) readManifest() (*BlockManifest, error) {
+	b, err := ioutil.ReadFile(this.ManifestPath())
+	if err != nil {
+		return nil, err
+	}
+	m := &BlockManifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if m.BlockId != this.IdStr() {
+		return nil, errors.New(fmt.Sprintf("Manifest of block %s found in folder of block %s", m.BlockId, this.IdStr()))
+	}
+	return m, nil
+}
+
+// Recover block from manifest, returns false if there is no (valid) manifest
+func (this *Block) recoverFromManifest() bool {
+	m, err := this.readManifest()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to read manifest of block %s: %s", this.IdStr(), err)
+		}
+		return false
+	}
+
+	// Scheme and state
+	this.dataShardCount = m.DataShards
+	this.parityShardCount = m.ParityShards
+	this.created = m.Created
+	this.SetSealed(m.Sealed)
+
+	// Local shards, in block order
+	for _, s := range m.Shards {
+		if !s.Local {
+			continue
+		}
+		shard := newShardFromId(this, uuidStringToBytes(s.Id))
+		shard.BlockIndex = uint(s.Index)
+		shard.Parity = s.Parity
+		if _, err := os.Stat(shard.FullPath()); err != nil {
+			log.Errorf("Shard %s of block %s is in manifest but not on disk: %s", s.Id, this.IdStr(), err)
+			s.Local = false
+			continue
+		}
+		this.RegisterShard(shard)
+	}
+
+	this.manifest = m
+	return true
+}
+
+// Recover block from the shard files, for blocks written before there was a manifest
+func (this *Block) recoverWithoutManifest() {
+	this.recoverShards()
+
+	// Position in block is in the shard index of newer shards, otherwise the listing order is used
+	this.shardsMux.Lock()
+	for i, shard := range this.DataShards {
+		if _, err := shard.Load(); err != nil || !shard.shardIndex.HasBlockInfo() {
+			log.Warnf("Shard %s has no block position, assuming %d", shard.IdStr(), i)
+			shard.BlockIndex = uint(i)
+			continue
+		}
+		if shard.shardIndex.DataShards > 0 {
+			this.dataShardCount = int(shard.shardIndex.DataShards)
+			this.parityShardCount = int(shard.shardIndex.ParityShards)
+		}
+	}
+	for i, shard := range this.ParityShards {
+		if _, err := shard.Load(); err != nil || !shard.shardIndex.HasBlockInfo() {
+			log.Warnf("Shard %s has no block position, assuming %d", shard.IdStr(), this.DataShardCount()+i)
+			shard.BlockIndex = uint(this.DataShardCount() + i)
+		}
+	}
+	sort.Sort(ShardsByBlockIndex(this.DataShards))
+	sort.Sort(ShardsByBlockIndex(this.ParityShards))
+	this.shardsMux.Unlock()
+
+	// Write manifest, next time it is used
+	if err := this.PersistManifest(); err != nil {
+		log.Errorf("Failed to write manifest of block %s: %s", this.IdStr(), err)
+	}
+}
+
+// Sort shards by index
+type BlockManifestShards []*BlockManifestShard
+
+func (a BlockManifestShards) Len() int           { return len(a) }
+func (a BlockManifestShards) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a BlockManifestShards) Less(i, j int) bool { return a[i].Index < a[j].Index }
+
+// Sort shards by position in block
+type ShardsByBlockIndex []*Shard
+
+func (a ShardsByBlockIndex) Len() int           { return len(a) }
+func (a ShardsByBlockIndex) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ShardsByBlockIndex) Less(i, j int) bool { return a[i].BlockIndex < a[j].BlockIndex }
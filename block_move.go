@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Move a block to another volume of this node (e.g. lifecycle transition to a colder storage class)
+
+// Bytes of the block on disk
+func (this *Block) DiskBytes() uint64 {
+	var n uint64 = 0
+	list, err := ioutil.ReadDir(this.FullPath())
+	if err != nil {
+		return 0
+	}
+	for _, elm := range list {
+		n += uint64(elm.Size())
+	}
+	return n
+}
+
+// Move block with all its local shards to the target volume
+func (this *Block) MoveToVolume(target *Volume) error {
+	source := this.Volume()
+	if source == target {
+		return nil
+	}
+	if !target.IsWritable() {
+		return errors.New(fmt.Sprintf("Volume %s is not writable", target.IdStr()))
+	}
+	shards := this._shards()
+	if !target.HasCapacity(uint64(len(shards)) * uint64(conf.ShardSizeInBytes)) {
+		return errors.New(fmt.Sprintf("Volume %s has no capacity for block %s", target.IdStr(), this.IdStr()))
+	}
+
+	// Pending writes first
+	if !this.Persist() {
+		return errors.New(fmt.Sprintf("Failed to persist block %s before move", this.IdStr()))
+	}
+
+	// No reads or writes while moving
+	for _, shard := range shards {
+		shard.compactMux.Lock()
+		defer shard.compactMux.Unlock()
+	}
+
+	// Copy
+	sourcePath := this.FullPath()
+	targetPath := fmt.Sprintf("%s/b_%s", target.FullPath(), this.IdStr())
+	log.Infof("Moving block %s from volume %s to %s", this.IdStr(), source.IdStr(), target.IdStr())
+	if err := copyFolder(sourcePath, targetPath); err != nil {
+		os.RemoveAll(targetPath)
+		target.RegisterIOError(err)
+		return err
+	}
+
+	// Switch
+	source.UnregisterBlock(this)
+	for _, shard := range shards {
+		source.UnregisterShard(shard)
+	}
+	this.volume = target
+	target.RegisterBlock(this)
+
+	// Remove old copy
+	if err := os.RemoveAll(sourcePath); err != nil {
+		log.Warnf("Failed to remove %s after moving block %s: %s", sourcePath, this.IdStr(), err)
+	}
+	return nil
+}
+
+// Copy the files of a folder (not recursive), each file is written to a temporary file first
+func copyFolder(sourcePath string, targetPath string) error {
+	list, err := ioutil.ReadDir(sourcePath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(targetPath, conf.UnixFolderPermissions); err != nil {
+		return err
+	}
+	for _, elm := range list {
+		if elm.IsDir() {
+			continue
+		}
+		if err := copyFile(filepath.Join(sourcePath, elm.Name()), filepath.Join(targetPath, elm.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy single file
+func copyFile(sourcePath string, targetPath string) error {
+	in, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := fmt.Sprintf("%s.tmp", targetPath)
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, conf.UnixFilePermissions)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, targetPath)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sealing a block: compute parity and spread the data and parity shards over distinct nodes
+
+// Block seal result
+type BlockSealStatus struct {
+	BlockId         string
+	Placement       map[string]string // Shard id => node
+	ShardsMigrated  int
+	ShardsFailed    int
+	ReplicasDropped int
+}
+
+// Has this node all shards of the block? Only the node that created the block can seal it
+func (this *Block) IsComplete() bool {
+	this.shardsMux.RLock()
+	defer this.shardsMux.RUnlock()
+	return len(this.DataShards) == this.DataShardCount() && len(this.ParityShards) == this.ParityShardCount()
+}
+
+// Has any file?
+func (this *Block) HasFiles() bool {
+	for _, shard := range this._shards() {
+		if !shard.Parity && shard.ShardMeta().FileCount > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Are all data shards full?
+func (this *Block) IsFull() bool {
+	for _, shard := range this._shards() {
+		if !shard.Parity && shard.FreeBytes() >= uint64(conf.BlockSealMinFreeBytes) {
+			return false
+		}
+	}
+	return true
+}
+
+// Should the block be sealed?
+func (this *Block) ShouldSeal() bool {
+	if this.IsSealed() || !this.IsComplete() || !this.HasFiles() {
+		return false
+	}
+	return this.IsFull() || unixTsUint32()-this.created > conf.BlockSealMaxAge
+}
+
+// All local shards, data shards first
+func (this *Block) _shards() []*Shard {
+	this.shardsMux.RLock()
+	defer this.shardsMux.RUnlock()
+	list := make([]*Shard, 0)
+	list = append(list, this.DataShards...)
+	list = append(list, this.ParityShards...)
+	return list
+}
+
+// Seal, computes parity and places every shard on a distinct node
+func (this *Block) Seal() (*BlockSealStatus, error) {
+	if !this.IsComplete() {
+		return nil, errors.New(fmt.Sprintf("Block %s is not complete on this node, can not seal", this.IdStr()))
+	}
+	if this.IsSealed() {
+		return nil, errors.New(fmt.Sprintf("Block %s is already sealed", this.IdStr()))
+	}
+	log.Infof("Sealing block %s", this.IdStr())
+
+	// No more writes, the ones in progress finish first and later ones see the sealed flag
+	dataShards := make([]*Shard, 0)
+	for _, shard := range this._shards() {
+		if !shard.Parity {
+			dataShards = append(dataShards, shard)
+		}
+	}
+	for _, shard := range dataShards {
+		shard.compactMux.Lock()
+	}
+	this.SetSealed(true)
+
+	// Parity
+	this.ErasureEncoding()
+	for _, shard := range dataShards {
+		shard.compactMux.Unlock()
+	}
+	if !this.Persist() {
+		// Sealed again later, the parity is computed again
+		this.SetSealed(false)
+		return nil, errors.New(fmt.Sprintf("Failed to persist block %s after computing parity", this.IdStr()))
+	}
+
+	// Place shards
+	status := &BlockSealStatus{
+		BlockId:   this.IdStr(),
+		Placement: this._placeShards(),
+	}
+	localNode := runtime.GetNode()
+	confirmed := make(map[string]bool) // Shards that are on their placement node
+	for _, shard := range this._shards() {
+		node := status.Placement[shard.IdStr()]
+		if runtime.IsLocalNode(node) {
+			confirmed[shard.IdStr()] = true
+			continue
+		}
+
+		// Copies on the node are verified, parity was computed from the local version so that one replaces a different copy
+		err := binaryTransport._migrateShard(node, shard)
+		if err == errShardDiverged {
+			err = binaryTransport._replicateShard(node, shard)
+		}
+		if err != nil {
+			log.Warnf("Failed to place shard %s of block %s on %s: %s", shard.IdStr(), this.IdStr(), node, err)
+			status.Placement[shard.IdStr()] = localNode
+			status.ShardsFailed++
+			continue
+		}
+		confirmed[shard.IdStr()] = true
+		status.ShardsMigrated++
+	}
+
+	// Other nodes must no longer write into this block
+	binaryTransport._broadcastSealBlock(this.Id)
+
+	// Drop extra replicas, every shard remains on exactly one node (only when all are placed, the replicas cover the failed ones)
+	if conf.DropReplicasAfterSeal {
+		if status.ShardsFailed > 0 {
+			log.Warnf("Not dropping replicas of block %s, %d shard(s) were not placed", this.IdStr(), status.ShardsFailed)
+		} else {
+			status.ReplicasDropped = this._dropReplicas(status.Placement, confirmed)
+		}
+	}
+
+	// Layout after placement
+	if err := this.PersistManifest(); err != nil {
+		log.Errorf("Failed to write manifest of block %s: %s", this.IdStr(), err)
+	}
+
+	log.Infof("Sealed block %s: %d shard(s) migrated, %d failed, %d replica(s) dropped", this.IdStr(), status.ShardsMigrated, status.ShardsFailed, status.ReplicasDropped)
+	return status, nil
+}
+
+// Assign a distinct node to each shard, prefers nodes that already have a replica (verified or replaced when placed)
+func (this *Block) _placeShards() map[string]string {
+	placement := make(map[string]string)
+	used := make(map[string]bool)
+	shards := this._shards()
+	localNode := runtime.GetNode()
+
+	// Existing remote replicas
+	for _, shard := range shards {
+		for _, location := range datastore.fileLocator.ShardLocationsByIdStr(shard.IdStr()) {
+			if location.Local || used[location.Node] {
+				continue
+			}
+			placement[shard.IdStr()] = location.Node
+			used[location.Node] = true
+			break
+		}
+	}
+
+	// This node keeps one shard
+	for _, shard := range shards {
+		if len(placement[shard.IdStr()]) == 0 {
+			placement[shard.IdStr()] = localNode
+			used[localNode] = true
+			break
+		}
+	}
+
+	// New nodes for the others
+	for _, shard := range shards {
+		if len(placement[shard.IdStr()]) > 0 {
+			continue
+		}
+		criteria := newNodeRouterCriteria()
+		criteria.ExcludeLocalNodes = true
+		for node := range used {
+			criteria.ExcludeNodes = append(criteria.ExcludeNodes, node)
+		}
+		node, err := datastore.nodeRouter.PickNode(criteria)
+		if err != nil {
+			// Not enough nodes, stays here
+			log.Warnf("No distinct node for shard %s of block %s, keeping it local: %s", shard.IdStr(), this.IdStr(), err)
+			placement[shard.IdStr()] = localNode
+			continue
+		}
+		placement[shard.IdStr()] = node
+		used[node] = true
+	}
+
+	return placement
+}
+
+// Drop all copies of shards that are not on their placement node, only of shards of which the placement node confirmed its copy
+func (this *Block) _dropReplicas(placement map[string]string, confirmed map[string]bool) int {
+	var dropped int = 0
+	for _, shard := range this._shards() {
+		if !confirmed[shard.IdStr()] {
+			continue
+		}
+		target := placement[shard.IdStr()]
+		for _, location := range datastore.fileLocator.ShardLocationsByIdStr(shard.IdStr()) {
+			if location.Node == target || (location.Local && runtime.IsLocalNode(target)) {
+				continue
+			}
+			if location.Local {
+				if err := datastore.RemoveShard(shard); err != nil {
+					log.Warnf("Failed to drop local replica of shard %s: %s", shard.IdStr(), err)
+					continue
+				}
+			} else {
+				binaryTransport._sendDropShard(location.Node, shard.Id)
+			}
+			dropped++
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Seals local blocks when their data shards are full or after a time limit
+
+var blockSealer *BlockSealer
+
+type BlockSealer struct {
+	mux          sync.RWMutex
+	running      bool
+	blocksSealed uint32
+	blocksFailed uint32
+	lastError    string
+}
+
+// Seal all blocks that are ready
+func (this *BlockSealer) seal() {
+	// Only one at a time
+	this.mux.Lock()
+	if this.running {
+		this.mux.Unlock()
+		return
+	}
+	this.running = true
+	this.mux.Unlock()
+	defer func() {
+		this.mux.Lock()
+		this.running = false
+		this.mux.Unlock()
+	}()
+
+	for _, volume := range datastore.Volumes() {
+		for _, block := range volume.Blocks() {
+			if !block.ShouldSeal() {
+				continue
+			}
+			_, err := block.Seal()
+			this.mux.Lock()
+			if err != nil {
+				log.Warnf("Failed to seal block %s: %s", block.IdStr(), err)
+				this.blocksFailed++
+				this.lastError = err.Error()
+			} else {
+				this.blocksSealed++
+			}
+			this.mux.Unlock()
+		}
+	}
+}
+
+// New sealer
+func newBlockSealer() *BlockSealer {
+	s := &BlockSealer{}
+
+	// Ticker
+	ticker := time.NewTicker(time.Second * 10)
+	go func() {
+		for _ = range ticker.C {
+			s.seal()
+		}
+	}()
+
+	return s
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestNewBlock(t *testing.T) {
@@ -40,3 +41,209 @@ func TestNewBlock(t *testing.T) {
 	// Persist with encoding
 	b.Persist()
 }
+
+func TestBlockDegradedRead(t *testing.T) {
+	startApplication()
+
+	// Small shards to keep the encoding fast
+	shardSize := conf.ShardSizeInBytes
+	conf.ShardSizeInBytes = 64 * 1024
+	defer func() {
+		conf.ShardSizeInBytes = shardSize
+	}()
+
+	// Block with files in multiple data shards
+	b := datastore.NewBlock()
+	b.DataShards[1].AddFile(newFileMeta("/degraded/other.txt"), []byte("Other file in another data shard"))
+	ds := b.DataShards[3]
+	ds.AddFile(newFileMeta("/degraded/first.txt"), []byte("First file"))
+	ds.AddFile(newFileMeta("/degraded/hello.txt"), []byte("Hello degraded read"))
+
+	// Encode and persist
+	b.ErasureEncoding()
+	b.Persist()
+
+	// Lose the data shard
+	idx := ds.ShardIndex()
+	ds._syncIndexBlockInfo()
+	if err := datastore.RemoveShard(ds); err != nil {
+		t.Error(err)
+	}
+
+	// Decode from the other shards
+	fileBytes, err := datastore.DegradedReadFile(idx, "/degraded/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fileBytes) != "Hello degraded read" {
+		t.Errorf("Degraded read returned %s", string(fileBytes))
+	}
+
+	// Unknown file
+	_, err = datastore.DegradedReadFile(idx, "/degraded/unknown.txt")
+	if err == nil {
+		t.Error("Degraded read of unknown file should fail")
+	}
+}
+
+func TestBlockSeal(t *testing.T) {
+	startApplication()
+
+	// Small shards to keep the encoding fast
+	shardSize := conf.ShardSizeInBytes
+	minFree := conf.BlockSealMinFreeBytes
+	conf.ShardSizeInBytes = 64 * 1024
+	conf.BlockSealMinFreeBytes = 1024
+	defer func() {
+		conf.ShardSizeInBytes = shardSize
+		conf.BlockSealMinFreeBytes = minFree
+	}()
+
+	// Block with a file
+	b := datastore.NewBlock()
+	if b.ShouldSeal() {
+		t.Error("Empty block should not be sealed")
+	}
+	b.DataShards[0].AddFile(newFileMeta("/seal/hello.txt"), []byte("Hello seal"))
+	if b.ShouldSeal() {
+		t.Error("Block with free space should not be sealed before the time limit")
+	}
+	b.created -= conf.BlockSealMaxAge + 1
+	if !b.ShouldSeal() {
+		t.Error("Block should be sealed after the time limit")
+	}
+
+	// Seal
+	status, err := b.Seal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.IsSealed() {
+		t.Error("Block not sealed")
+	}
+	if len(status.Placement) != conf.DataShardsPerBlock+conf.ParityShardsPerBlock {
+		t.Errorf("Expected placement of all shards, found %d", len(status.Placement))
+	}
+
+	// No more writes
+	if b.DataShards[1].AllocateCapacity(1) {
+		t.Error("Sealed block should not allocate capacity")
+	}
+	files := len(b.DataShards[0].ShardFileMeta().FileMeta)
+	if _, err := b.DataShards[0].AddFile(newFileMeta("/seal/late.txt"), []byte("Late replica")); err == nil {
+		t.Error("Sealed block should not accept files")
+	}
+	if len(b.DataShards[0].ShardFileMeta().FileMeta) != files || b.DataShards[0].ShardFileMeta().GetByName("/seal/late.txt") != nil {
+		t.Error("Rejected file must not change the shard")
+	}
+	if _, err := b.Seal(); err == nil {
+		t.Error("Block should not be sealed twice")
+	}
+
+	// Parity computed
+	var nonZero bool = false
+	for _, v := range b.ParityShards[0].Contents().Bytes() {
+		if v != 0 {
+			nonZero = true
+			break
+		}
+	}
+	if !nonZero {
+		t.Error("Parity not computed")
+	}
+	if b.ParityShards[0].ShardFileMeta().GetCopyByName("/seal/hello.txt", 0) == nil {
+		t.Error("Parity should keep a copy of the file meta")
+	}
+}
+
+// Test that a write which passed the sealed check before sealing started does not change the shard after the parity is computed
+func TestBlockSealWriteInProgress(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+
+	// Sealing holds the lock, the write waits for it
+	shard.compactMux.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := shard.AddFile(newFileMeta("/seal/in-progress.txt"), []byte("In progress"))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	b.SetSealed(true)
+	shard.compactMux.Unlock()
+	if err := <-done; err == nil {
+		t.Error("Write that waited for sealing must fail")
+	}
+	if shard.ShardFileMeta().GetByName("/seal/in-progress.txt") != nil {
+		t.Error("Rejected write must not change the shard")
+	}
+
+	// Replicas of shards of which the placement is not confirmed are kept
+	placement := make(map[string]string)
+	for _, s := range b._shards() {
+		placement[s.IdStr()] = "other-node:1"
+	}
+	if dropped := b._dropReplicas(placement, make(map[string]bool)); dropped != 0 {
+		t.Errorf("Expected no replicas dropped without confirmed placement, dropped %d", dropped)
+	}
+	if datastore.LocalShardByIdStr(shard.IdStr()) == nil {
+		t.Error("Local shard must be kept")
+	}
+}
+
+func TestBlockManifest(t *testing.T) {
+	startApplication()
+
+	// Small shards
+	shardSize := conf.ShardSizeInBytes
+	conf.ShardSizeInBytes = 64 * 1024
+	defer func() {
+		conf.ShardSizeInBytes = shardSize
+	}()
+
+	// New block writes manifest
+	b := datastore.NewBlock()
+	b.SetSealed(true)
+	b.Persist()
+	m, err := b.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.DataShards != conf.DataShardsPerBlock || m.ParityShards != conf.ParityShardsPerBlock || !m.Sealed {
+		t.Errorf("Unexpected manifest %v", m)
+	}
+	if len(m.Shards) != conf.DataShardsPerBlock+conf.ParityShardsPerBlock {
+		t.Errorf("Expected all shards in manifest, found %d", len(m.Shards))
+	}
+
+	// Recover block from manifest, with a scheme different from the current configuration
+	dataShards := conf.DataShardsPerBlock
+	conf.DataShardsPerBlock = 4
+	defer func() {
+		conf.DataShardsPerBlock = dataShards
+	}()
+	r := newBlockFromId(b.Volume(), b.Id)
+	if !r.recoverFromManifest() {
+		t.Fatal("Failed to recover block from manifest")
+	}
+	if r.DataShardCount() != dataShards || !r.IsSealed() {
+		t.Errorf("Unexpected recovered block, data shards %d sealed %t", r.DataShardCount(), r.IsSealed())
+	}
+	for i, shard := range r.DataShards {
+		if shard.IdStr() != b.DataShards[i].IdStr() || shard.BlockIndex != uint(i) {
+			t.Errorf("Data shard %d not recovered in order", i)
+		}
+	}
+	for i, shard := range r.ParityShards {
+		if !shard.Parity || shard.BlockIndex != uint(dataShards+i) {
+			t.Errorf("Parity shard %d not recovered", i)
+		}
+	}
+
+	// Unknown versions are rejected
+	m.Version = BLOCK_MANIFEST_VERSION + 1
+	if m.Validate() == nil {
+		t.Error("Manifest with unknown version should be rejected")
+	}
+}
@@ -15,6 +15,8 @@ go get "github.com/willf/bloom"
 go get "github.com/spaolacci/murmur3"
 go get "github.com/julienschmidt/httprouter"
 go get "github.com/RobinUS2/golang-jresp"
+go get "github.com/golang/snappy"
+go get "github.com/klauspost/compress/zstd"
 
 case "$1" in
 	docker)
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"os"
+)
+
+// Offline commands of the binary (e.g. xyzfs fsck), they work on the files on disk and do not start a node
+
+// Run command, returns the exit code
+func runCommand(args []string) int {
+	// Only the outcome is of interest
+	log.Level = logrus.WarnLevel
+
+	// Configuration, without touching the volumes
+	conf = newConf()
+	keyring = newKeyring()
+
+	switch args[0] {
+	case "fsck":
+		return runFsckCommand(args[1:])
+	case "shard":
+		return runShardCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %s, expected fsck or shard\n", args[0])
+	return 2
+}
+
+// Print result of a command as JSON
+func printCommandJson(v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode JSON: %s\n", err)
+		return
+	}
+	fmt.Println(string(b))
+}
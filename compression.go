@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compression at rest: files are compressed before they are written to a shard, when it helps
+
+type CompressionCodec byte
+
+const (
+	NoneCompressionCodec   CompressionCodec = iota // 0 = stored as is
+	GzipCompressionCodec                           // 1 = gzip
+	SnappyCompressionCodec                         // 2 = snappy (block format)
+	ZstdCompressionCodec                           // 3 = zstandard
+)
+
+// Zstandard encoder and decoder, safe for concurrent use
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+// Name of the codec
+func (this CompressionCodec) String() string {
+	switch this {
+	case NoneCompressionCodec:
+		return "none"
+	case GzipCompressionCodec:
+		return "gzip"
+	case SnappyCompressionCodec:
+		return "snappy"
+	case ZstdCompressionCodec:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(this))
+}
+
+// HTTP content coding of the codec (Content-Encoding), empty if there is none
+func (this CompressionCodec) ContentEncoding() string {
+	switch this {
+	case GzipCompressionCodec:
+		return "gzip"
+	case ZstdCompressionCodec:
+		return "zstd"
+	}
+	return ""
+}
+
+// Parse codec name
+func parseCompressionCodec(s string) (CompressionCodec, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none":
+		return NoneCompressionCodec, nil
+	case "gzip":
+		return GzipCompressionCodec, nil
+	case "snappy":
+		return SnappyCompressionCodec, nil
+	case "zstd":
+		return ZstdCompressionCodec, nil
+	}
+	return NoneCompressionCodec, errors.New(fmt.Sprintf("Invalid compression codec %s, expected none, gzip, snappy or zstd", s))
+}
+
+// Prepare zstandard
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEncoder, err = zstd.NewWriter(nil)
+		panicErr(err)
+		zstdDecoder, err = zstd.NewReader(nil)
+		panicErr(err)
+	})
+}
+
+// Compress bytes
+func compressBytes(codec CompressionCodec, b []byte) ([]byte, error) {
+	switch codec {
+	case NoneCompressionCodec:
+		return b, nil
+	case GzipCompressionCodec:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case SnappyCompressionCodec:
+		return snappy.Encode(nil, b), nil
+	case ZstdCompressionCodec:
+		initZstd()
+		return zstdEncoder.EncodeAll(b, nil), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported compression codec %s", codec))
+}
+
+// Decompress bytes, the size is the expected uncompressed size
+func decompressBytes(codec CompressionCodec, b []byte, size uint64) ([]byte, error) {
+	var res []byte
+	var err error
+	switch codec {
+	case NoneCompressionCodec:
+		return b, nil
+	case GzipCompressionCodec:
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(b))
+		if err == nil {
+			res, err = ioutil.ReadAll(r)
+		}
+	case SnappyCompressionCodec:
+		res, err = snappy.Decode(nil, b)
+	case ZstdCompressionCodec:
+		initZstd()
+		res, err = zstdDecoder.DecodeAll(b, nil)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported compression codec %s", codec))
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to decompress %s: %s", codec, err))
+	}
+	if uint64(len(res)) != size {
+		return nil, errors.New(fmt.Sprintf("Decompressed %d bytes, expected %d", len(res), size))
+	}
+	return res, nil
+}
+
+// Contents to store for a file: compressed when that saves enough, the codec and sizes are set in the meta
+func compressFileContents(fileMeta *FileMeta, data []byte, codec CompressionCodec) []byte {
+	fileMeta.Codec = NoneCompressionCodec
+	fileMeta.RawSize = 0
+	if codec != NoneCompressionCodec && len(data) >= conf.CompressionMinSize {
+		compressed, err := compressBytes(codec, data)
+		if err != nil {
+			log.Warnf("Failed to compress %s with %s: %s", fileMeta.FullName, codec, err)
+		} else if float64(len(compressed)) <= float64(len(data))*conf.CompressionMaxRatio {
+			fileMeta.Codec = codec
+			fileMeta.RawSize = uint64(len(data))
+			data = compressed
+		}
+	}
+	fileMeta.UpdateFromData(data)
+	return data
+}
+
+// Parameters of an encoding in Accept-Encoding allow it? Refused with a quality of zero (e.g. q=0.000) or one that can not be read
+func acceptEncodingAllowed(params []string) bool {
+	for _, param := range params {
+		param = strings.ToLower(strings.Replace(strings.TrimSpace(param), " ", "", -1))
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		q, err := strconv.ParseFloat(param[2:], 64)
+		if err != nil || q <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Codecs accepted by a client (Accept-Encoding), that can be served without decompressing
+func acceptedCompressionCodecs(acceptEncoding string) []CompressionCodec {
+	list := make([]CompressionCodec, 0)
+	for _, elm := range strings.Split(acceptEncoding, ",") {
+		split := strings.Split(elm, ";")
+		name := strings.ToLower(strings.TrimSpace(split[0]))
+		if !acceptEncodingAllowed(split[1:]) {
+			continue
+		}
+		for _, codec := range []CompressionCodec{GzipCompressionCodec, ZstdCompressionCodec} {
+			if name == codec.ContentEncoding() {
+				list = append(list, codec)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressionCodecs(t *testing.T) {
+	startApplication()
+	data := bytes.Repeat([]byte("compressible contents "), 100)
+	for _, codec := range []CompressionCodec{NoneCompressionCodec, GzipCompressionCodec, SnappyCompressionCodec, ZstdCompressionCodec} {
+		parsed, err := parseCompressionCodec(codec.String())
+		if err != nil || parsed != codec {
+			t.Errorf("Failed to parse codec %s", codec)
+		}
+		compressed, err := compressBytes(codec, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := decompressBytes(codec, compressed, uint64(len(data)))
+		if err != nil || !bytes.Equal(decompressed, data) {
+			t.Errorf("Failed round trip of %s: %s", codec, err)
+		}
+		if _, err := decompressBytes(codec, compressed, uint64(len(data))+1); codec != NoneCompressionCodec && err == nil {
+			t.Errorf("Size mismatch of %s must fail", codec)
+		}
+	}
+	if _, err := parseCompressionCodec("lz4"); err == nil {
+		t.Error("Unknown codec must fail")
+	}
+
+	// Accept-Encoding
+	accept := acceptedCompressionCodecs("br, gzip;q=0.8, zstd;q=0, deflate")
+	if len(accept) != 1 || accept[0] != GzipCompressionCodec {
+		t.Errorf("Unexpected accepted codecs %v", accept)
+	}
+	for _, refused := range []string{"gzip;q=0.0", "gzip; q=0.000", "gzip;Q=0", "gzip;q=abc"} {
+		if accept := acceptedCompressionCodecs(refused); len(accept) != 0 {
+			t.Errorf("Expected %s to be refused, accepted %v", refused, accept)
+		}
+	}
+	if accept := acceptedCompressionCodecs("gzip;q=0.001"); len(accept) != 1 {
+		t.Error("Expected gzip with a low quality to be accepted")
+	}
+}
+
+func TestFileCompression(t *testing.T) {
+	startApplication()
+
+	// Compressible file
+	data := bytes.Repeat([]byte("Hello compression "), 200)
+	meta := newFileMeta("/compression/hello.txt")
+	stored := compressFileContents(meta, data, ZstdCompressionCodec)
+	if !meta.IsCompressed() || meta.RawSize != uint64(len(data)) || meta.Size != uint64(len(stored)) || meta.Size >= meta.RawSize {
+		t.Fatalf("Unexpected compressed meta %v", meta)
+	}
+
+	// Codec and sizes survive the binary format
+	decoded := &FileMeta{}
+	decoded.FromBytes(meta.Bytes())
+	if decoded.Codec != ZstdCompressionCodec || decoded.RawSize != meta.RawSize || decoded.ContentSize() != uint64(len(data)) {
+		t.Error("Codec and sizes must survive binary format")
+	}
+
+	// Incompressible and small files are stored as is
+	random := make([]byte, 4096)
+	rand.Read(random)
+	randomMeta := newFileMeta("/compression/random.bin")
+	if stored := compressFileContents(randomMeta, random, GzipCompressionCodec); randomMeta.IsCompressed() || !bytes.Equal(stored, random) {
+		t.Error("Incompressible file must be stored as is")
+	}
+	smallMeta := newFileMeta("/compression/small.txt")
+	if compressFileContents(smallMeta, []byte("aaaaaaaaaaaaaaaa"), GzipCompressionCodec); smallMeta.IsCompressed() {
+		t.Error("Small file must be stored as is")
+	}
+
+	// Stored compressed in a shard
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	if _, err := shard.AddFile(meta, stored); err != nil {
+		t.Fatal(err)
+	}
+	shardBytes, err, _ := shard.ReadFile(meta.FullName)
+	if err != nil || !bytes.Equal(shardBytes, stored) {
+		t.Fatalf("Failed to read stored bytes: %s", err)
+	}
+	if m := shard.ShardFileMeta().GetByName(meta.FullName); m.Codec != ZstdCompressionCodec || m.RawSize != uint64(len(data)) {
+		t.Error("Codec must be kept in the shard")
+	}
+
+	// Passthrough of accepted codecs, decompressed otherwise
+	res := &FileReadResult{Data: shardBytes, Codec: meta.Codec, RawSize: meta.RawSize}
+	if err := res._decompress([]CompressionCodec{ZstdCompressionCodec}); err != nil || res.Codec != ZstdCompressionCodec || !bytes.Equal(res.Data, stored) {
+		t.Error("Accepted codec must be served as stored")
+	}
+	if err := res._decompress([]CompressionCodec{GzipCompressionCodec}); err != nil || res.Codec != NoneCompressionCodec || !bytes.Equal(res.Data, data) {
+		t.Errorf("Failed transparent decompression: %s", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -8,6 +9,13 @@ import (
 
 var conf *Conf
 var confSeedFlag string
+var confVolumesFlag string
+var confLifecycleFlag string
+var confDedupFlag bool
+var confCompressionFlag string
+var confShardIndexFlag string
+var confEncryptionFlag bool
+var confKeyFileFlag string
 
 type Conf struct {
 	HttpPort                   int
@@ -16,12 +24,24 @@ type Conf struct {
 	DataShardsPerBlock         int
 	ParityShardsPerBlock       int
 	ShardSizeInBytes           int
+	ShardIndexExpectedFiles    int
+	ShardIndexExpectedFileSize int
+	ShardIndexFalsePosRate     float64
+	ShardIndexType             ShardIndexType
 	UnixFolderPermissions      os.FileMode
 	UnixFilePermissions        os.FileMode
 	MetaBasePath               string
 	VolumeBasePath             string
+	Volumes                    []*VolumeConf
+	DefaultStorageClass        string
+	VolumeHighWatermark        float64
+	VolumeLowWatermark         float64
+	VolumeReadOnlyErrors       int
+	VolumeFailedErrors         int
+	VolumeIOErrorWindow        uint32
 	GossipPort                 int
 	GossipHelloInterval        uint32
+	GossipForgetTtl            uint32
 	GossipTransportReadBuffer  int
 	GossipTransportNumStreams  int
 	BinaryPort                 int
@@ -29,7 +49,40 @@ type Conf struct {
 	BinaryTransportReadBuffer  int
 	BinaryTransportWriteBuffer int
 	BinaryTransportNumStreams  int
+	ShardMigrationChunkSize    int
+	BlockSealMinFreeBytes      int
+	BlockSealMaxAge            uint32
+	DropReplicasAfterSeal      bool
+	CompactionInterval         uint32
+	CompactionLiveRatio        float64
+	CompactionBytesPerSecond   int
+	CompactionMaxShardsPerRun  int
+	ShardMetaMemoryBudget      int
+	ShardMetaMinIdleSeconds    uint32
+	ShardMetaCacheInterval     uint32
+	TemporaryMemoryBudget      int
+	TemporaryDefaultTTL        uint32
+	TemporaryMaxTTL            uint32
+	TemporaryExpiryInterval    uint32
+	TemporaryReplicas          int
+	LifecycleRules             []*LifecycleRule
+	LifecycleInterval          uint32
 	MaxFileSize                int
+	FileChunkSize              int
+	FileChunkParallelism       int
+	FileVersionRetention       int
+	FileLocationCacheSize      int
+	FileLocationCacheTtl       uint32
+	FileCacheSize              int
+	Dedup                      bool
+	Compression                CompressionCodec
+	CompressionMinSize         int
+	CompressionMaxRatio        float64
+	Encryption                 bool
+	EncryptionKeyFile          string
+	ClockMaxDrift              uint32
+	AddFileAttempts            int
+	MaxMaintenanceDuration     uint32
 	HttpDebug                  bool
 }
 
@@ -50,6 +103,12 @@ func newConf() *Conf {
 		ParityShardsPerBlock: 3,
 		ShardSizeInBytes:     1024 * 1024 * 32,
 
+		// Shard index (bloom filters), sized for the files of a full shard (0 = shard size / expected file size), grows when a shard holds more
+		ShardIndexExpectedFiles:    0,
+		ShardIndexExpectedFileSize: 16 * 1024,
+		ShardIndexFalsePosRate:     0.01,
+		ShardIndexType:             BloomShardIndexType, // counting filters remove the names of deleted files, at 4 times the memory
+
 		// Permission
 		UnixFolderPermissions: 0755,
 		UnixFilePermissions:   0644,
@@ -58,8 +117,17 @@ func newConf() *Conf {
 		MetaBasePath:   "/xyzfs/meta",
 		VolumeBasePath: "/xyzfs/data",
 
+		// Volumes
+		DefaultStorageClass:  "standard",
+		VolumeHighWatermark:  0.95,
+		VolumeLowWatermark:   0.90,
+		VolumeReadOnlyErrors: 3,
+		VolumeFailedErrors:   10,
+		VolumeIOErrorWindow:  300,
+
 		// Gossip
 		GossipHelloInterval:       1,
+		GossipForgetTtl:           7 * 24 * 3600, // Forgotten nodes can rejoin after this
 		GossipTransportReadBuffer: 8 * 1024,
 		GossipTransportNumStreams: 2,
 
@@ -68,8 +136,59 @@ func newConf() *Conf {
 		BinaryTransportWriteBuffer: 32 * 1024,
 		BinaryTransportNumStreams:  16,
 
+		// Shard migration
+		ShardMigrationChunkSize: 1024 * 1024,
+
+		// Block sealing (erasure coding)
+		BlockSealMinFreeBytes: 1024 * 1024,
+		BlockSealMaxAge:       3600,
+		DropReplicasAfterSeal: false,
+
+		// Shard compaction
+		CompactionInterval:        300,
+		CompactionLiveRatio:       0.5,
+		CompactionBytesPerSecond:  16 * 1024 * 1024,
+		CompactionMaxShardsPerRun: 4,
+
+		// Shard metadata in memory, beyond the budget the file meta of shards that were idle for a while is evicted (0 = unlimited)
+		ShardMetaMemoryBudget:   512 * 1024 * 1024,
+		ShardMetaMinIdleSeconds: 300,
+		ShardMetaCacheInterval:  60,
+
+		// Temporary tier (memory only)
+		TemporaryMemoryBudget:   256 * 1024 * 1024,
+		TemporaryDefaultTTL:     300,
+		TemporaryMaxTTL:         24 * 3600,
+		TemporaryExpiryInterval: 10,
+		TemporaryReplicas:       1,
+
+		// Lifecycle (expiry and transitions)
+		LifecycleInterval: 3600,
+
 		// Files
-		MaxFileSize: 1024 * 1024 * 1024,
+		MaxFileSize:          1024 * 1024 * 1024,
+		AddFileAttempts:      3,
+		FileChunkSize:        8 * 1024 * 1024,
+		FileChunkParallelism: 4,
+		FileVersionRetention: 1,
+		Dedup:                confDedupFlag,
+
+		// Locations of the latest version of files that were read, by name, expire after the ttl (seconds)
+		FileLocationCacheSize: 100000,
+		FileLocationCacheTtl:  60,
+
+		// Contents of hot files that were read in bytes (0 = disabled), only evict files that were read less often
+		FileCacheSize: 64 * 1024 * 1024,
+
+		// Compression at rest, only kept when the file shrinks to the ratio
+		CompressionMinSize:  512,
+		CompressionMaxRatio: 0.9,
+
+		// Hybrid logical clock, remote timestamps further ahead (seconds) are ignored
+		ClockMaxDrift: 300,
+
+		// Node modes
+		MaxMaintenanceDuration: 24 * 3600,
 
 		// HTTP Debug
 		HttpDebug: true,
@@ -79,6 +198,50 @@ func newConf() *Conf {
 		c.Seeds = strings.Split(confSeedFlag, ",")
 	}
 
+	// Volumes, defaults to a single volume in the base path
+	if len(confVolumesFlag) > 0 {
+		vcs, err := parseVolumeConfs(confVolumesFlag, c.DefaultStorageClass)
+		if err != nil {
+			log.Fatalf("Invalid volumes: %s", err)
+		}
+		c.Volumes = vcs
+	} else {
+		c.Volumes = []*VolumeConf{newVolumeConf(c.VolumeBasePath, 0, c.DefaultStorageClass)}
+	}
+
+	// Shard index
+	indexType, err := parseShardIndexType(confShardIndexFlag)
+	if err != nil {
+		log.Fatalf("Invalid shard index: %s", err)
+	}
+	c.ShardIndexType = indexType
+
+	// Compression at rest
+	codec, err := parseCompressionCodec(confCompressionFlag)
+	if err != nil {
+		log.Fatalf("Invalid compression: %s", err)
+	}
+	c.Compression = codec
+
+	// Encryption at rest, the keyfile defaults to the meta folder
+	c.Encryption = confEncryptionFlag
+	if len(confKeyFileFlag) > 0 {
+		c.EncryptionKeyFile = confKeyFileFlag
+	} else {
+		c.EncryptionKeyFile = fmt.Sprintf("%s/keyfile.json", c.MetaBasePath)
+	}
+
+	// Lifecycle rules
+	if len(confLifecycleFlag) > 0 {
+		rules, err := parseLifecycleRules(confLifecycleFlag)
+		if err != nil {
+			log.Fatalf("Invalid lifecycle rules: %s", err)
+		}
+		c.LifecycleRules = rules
+	} else {
+		c.LifecycleRules = make([]*LifecycleRule, 0)
+	}
+
 	return c
 }
 
@@ -93,13 +256,15 @@ func (this *Conf) prepareStartup() {
 		}
 	}
 
-	// Volume folder exists?
-	if _, err := os.Stat(this.VolumeBasePath); os.IsNotExist(err) {
-		// Create
-		log.Infof("Creating folder %s", this.VolumeBasePath)
-		e := os.MkdirAll(this.VolumeBasePath, conf.UnixFolderPermissions)
-		if e != nil {
-			log.Errorf("Failed to create %s: %s", this.VolumeBasePath, e)
+	// Volume folders exist?
+	for _, vc := range this.Volumes {
+		if _, err := os.Stat(vc.Path); os.IsNotExist(err) {
+			// Create
+			log.Infof("Creating folder %s", vc.Path)
+			e := os.MkdirAll(vc.Path, conf.UnixFolderPermissions)
+			if e != nil {
+				log.Errorf("Failed to create %s: %s", vc.Path, e)
+			}
 		}
 	}
 }
@@ -107,21 +272,25 @@ func (this *Conf) prepareStartup() {
 func newDatastoreConf() *DatastoreConf {
 	d := make([]*Volume, 0)
 
-	// Read volumes on disk
-	vcs := recoverVolumeConfiguration()
-	if vcs != nil {
-		for _, vc := range vcs {
-			d = append(d, vc)
+	for _, vc := range conf.Volumes {
+		// Read volumes on disk
+		vs := recoverVolumeConfiguration(vc.Path)
+
+		// Default volume?
+		if len(vs) == 0 {
+			v := newVolume()
+			v.Id = randomUuid()
+			v.Path = vc.Path
+			vs = append(vs, v)
 		}
-	}
 
-	// Default volume?
-	if len(d) == 0 {
-		v := newVolume()
-		v.Id = randomUuid()
-		v.Path = conf.VolumeBasePath
-		// Do not prepare, is done all at once
-		d = append(d, v)
+		// Declared limits
+		for _, v := range vs {
+			v.Capacity = vc.Capacity
+			v.StorageClass = vc.StorageClass
+			// Do not prepare, is done all at once
+			d = append(d, v)
+		}
 	}
 
 	return &DatastoreConf{
@@ -130,10 +299,10 @@ func newDatastoreConf() *DatastoreConf {
 }
 
 // Recover volume configuration from local disk
-func recoverVolumeConfiguration() []*Volume {
-	list, e := ioutil.ReadDir(conf.VolumeBasePath)
+func recoverVolumeConfiguration(path string) []*Volume {
+	list, e := ioutil.ReadDir(path)
 	if e != nil {
-		log.Errorf("Failed to list volumes in %s: %s", conf.VolumeBasePath, e)
+		log.Errorf("Failed to list volumes in %s: %s", path, e)
 		return nil
 	}
 
@@ -141,7 +310,7 @@ func recoverVolumeConfiguration() []*Volume {
 	d := make([]*Volume, 0)
 
 	// Iterate
-	log.Infof("Found %d entries in xyzFS data directory", len(list))
+	log.Infof("Found %d entries in xyzFS data directory %s", len(list), path)
 	for _, elm := range list {
 		split := strings.Split(elm.Name(), "_")
 		// Must be in format v=UUID
@@ -152,8 +321,7 @@ func recoverVolumeConfiguration() []*Volume {
 		// Init
 		v := newVolume()
 		v.Id = uuidStringToBytes(split[1])
-		v.Path = conf.VolumeBasePath
-		// Do not prepare, is done all at once
+		v.Path = path
 		d = append(d, v)
 	}
 	return d
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/spaolacci/murmur3"
+)
+
+// Counting bloom filter: a 4-bit counter instead of a bit per position, so names can be removed again
+// counters that reach the maximum stay there (the name can no longer be removed, it only costs false positives)
+
+type CountingBloomFilter struct {
+	m        uint   // Counters
+	k        uint   // Hash functions
+	counters []byte // Two counters per byte
+}
+
+// Maximum value of a counter
+const COUNTING_BLOOM_FILTER_MAX_COUNT byte = 15
+
+// Positions of the data (double hashing)
+func (this *CountingBloomFilter) locations(b []byte) []uint {
+	h1, h2 := murmur3.Sum128(b)
+	res := make([]uint, this.k)
+	for i := uint(0); i < this.k; i++ {
+		res[i] = uint((h1 + uint64(i)*h2) % uint64(this.m))
+	}
+	return res
+}
+
+// Get counter
+func (this *CountingBloomFilter) get(i uint) byte {
+	if i%2 == 0 {
+		return this.counters[i/2] & 0x0F
+	}
+	return this.counters[i/2] >> 4
+}
+
+// Set counter
+func (this *CountingBloomFilter) set(i uint, v byte) {
+	if i%2 == 0 {
+		this.counters[i/2] = this.counters[i/2]&0xF0 | v
+	} else {
+		this.counters[i/2] = this.counters[i/2]&0x0F | v<<4
+	}
+}
+
+// Add
+func (this *CountingBloomFilter) Add(b []byte) {
+	for _, i := range this.locations(b) {
+		if v := this.get(i); v < COUNTING_BLOOM_FILTER_MAX_COUNT {
+			this.set(i, v+1)
+		}
+	}
+}
+
+// Test
+func (this *CountingBloomFilter) Test(b []byte) bool {
+	for _, i := range this.locations(b) {
+		if this.get(i) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove, only names that have been added may be removed (otherwise other names can go missing)
+func (this *CountingBloomFilter) Remove(b []byte) bool {
+	if !this.Test(b) {
+		return false
+	}
+	for _, i := range this.locations(b) {
+		if v := this.get(i); v < COUNTING_BLOOM_FILTER_MAX_COUNT {
+			this.set(i, v-1)
+		}
+	}
+	return true
+}
+
+// Counters
+func (this *CountingBloomFilter) Cap() uint {
+	return this.m
+}
+
+// Hash functions
+func (this *CountingBloomFilter) K() uint {
+	return this.k
+}
+
+// To bytes: counters (uint64) - hash functions (uint64) - counter bytes
+func (this *CountingBloomFilter) Bytes() []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint64(this.m))
+	binary.Write(buf, binary.BigEndian, uint64(this.k))
+	buf.Write(this.counters)
+	return buf.Bytes()
+}
+
+// From bytes
+func (this *CountingBloomFilter) FromBytes(b []byte) error {
+	if len(b) < 16 {
+		return errors.New(fmt.Sprintf("Counting bloom filter of %d bytes too short", len(b)))
+	}
+	m := binary.BigEndian.Uint64(b[0:8])
+	k := binary.BigEndian.Uint64(b[8:16])
+	if m < 1 || k < 1 || uint64(len(b)-16) != (m+1)/2 {
+		return errors.New(fmt.Sprintf("Invalid counting bloom filter of %d counters with %d hash functions in %d bytes", m, k, len(b)))
+	}
+	this.m = uint(m)
+	this.k = uint(k)
+	this.counters = append([]byte(nil), b[16:]...)
+	return nil
+}
+
+// New counting bloom filter
+func newCountingBloomFilter(m uint, k uint) *CountingBloomFilter {
+	if m < 1 {
+		m = 1
+	}
+	if k < 1 {
+		k = 1
+	}
+	return &CountingBloomFilter{
+		m:        m,
+		k:        k,
+		counters: make([]byte, (m+1)/2),
+	}
+}
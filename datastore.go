@@ -2,6 +2,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
 )
 
 // Data store
@@ -34,35 +38,193 @@ func (this *Datastore) LocateFile(fullName string) ([]*ShardIndex, uint32, error
 
 // Add file
 func (this *Datastore) AddFile(fullName string, data []byte) (bool, error) {
+	_, err := this.AddFileWithOptions(fullName, data, newFileWriteOptions())
+	return err == nil, err
+}
+
+// Add file with upload options (e.g. temporary with TTL), returns the meta of the new version
+func (this *Datastore) AddFileWithOptions(fullName string, data []byte, opts *FileWriteOptions) (*FileMeta, error) {
 	// Validate max file size
 	if len(data) > conf.MaxFileSize {
-		return false, errors.New("Exceeds maximum file size")
+		return nil, errors.New("Exceeds maximum file size")
 	}
 
-	// Select node on where to execute this (it will be written there locally to a shard with space)
-	node, nodeSelectionErr := this.nodeRouter.PickNode(nil)
-	if nodeSelectionErr != nil {
-		return false, nodeSelectionErr
+	// Chunks are only written as part of a large file
+	if isFileChunkName(fullName) {
+		return nil, errReservedFileName
+	}
+
+	// Larger than a chunk? Stored in chunks with a manifest
+	var fileMeta *FileMeta
+	var err error
+	if uint32(len(data)) > fileChunkSize() {
+		fileMeta, err = this._addChunkedFile(fullName, data, opts)
+	} else {
+		// Create meta
+		fileMeta = newFileMeta(fullName)
+		stored := compressFileContents(fileMeta, data, opts.Compression)
+		opts.Apply(fileMeta)
+		_, err = this._addFile(fileMeta, stored)
+	}
+	if err != nil {
+		return nil, err
 	}
-	log.Infof("Routing add file request to %s", node)
 
-	// Create meta
+	// Older versions in other shards
+	this._enforceRetention(fullName)
+	return fileMeta, nil
+}
+
+// Add chunked file, the chunks are written in parallel before the manifest
+func (this *Datastore) _addChunkedFile(fullName string, data []byte, opts *FileWriteOptions) (*FileMeta, error) {
 	fileMeta := newFileMeta(fullName)
-	fileMeta.UpdateFromData(data)
+	manifest, parts := newFileChunkManifest(fileMeta.Id, data, fileChunkSize())
+	log.Infof("Adding file %s of %d bytes in %d chunk(s)", fullName, len(data), len(manifest.Chunks))
+
+	// Chunks
+	err := parallelFor(len(parts), conf.FileChunkParallelism, func(i int) error {
+		chunkMeta := newFileMeta(manifest.Chunks[i].FullName)
+		stored := compressFileContents(chunkMeta, parts[i], opts.Compression)
+		opts.Apply(chunkMeta)
+		_, err := this._addFile(chunkMeta, stored)
+		return err
+	})
+	if err != nil {
+		// Remove the chunks that were written
+		fileMeta.Chunks = manifest.Chunks
+		go this._deleteChunks([]*FileMeta{fileMeta})
+		return nil, err
+	}
+
+	// Manifest
+	manifestBytes := manifest.Bytes()
+	fileMeta.Chunked = true
+	fileMeta.UpdateFromData(manifestBytes)
+	opts.Apply(fileMeta)
+	if _, err := this._addFile(fileMeta, manifestBytes); err != nil {
+		return nil, err
+	}
+	return fileMeta, nil
+}
+
+// Add file to a node with capacity
+func (this *Datastore) _addFile(fileMeta *FileMeta, data []byte) (bool, error) {
+	fullName := fileMeta.FullName
 
 	// Split file into message chunks (no target shard)
 	msgs := this.fileSplitter.Split(fileMeta, data, nil)
 
-	// Send data to node
-	for _, msg := range msgs {
-		// log.Infof("send chunk %d %v", chunkNumber, msg.Data[12:])
-		binaryTransport._sendFileChunk(node, msg)
+	// Select node on where to execute this (it will be written there locally to a shard with space), falls back to other nodes if it refuses
+	criteria := newNodeRouterCriteria()
+	var lastErr error
+	for attempt := 0; attempt < conf.AddFileAttempts; attempt++ {
+		node, nodeSelectionErr := this.nodeRouter.PickNode(criteria)
+		if nodeSelectionErr != nil {
+			if lastErr != nil {
+				return false, lastErr
+			}
+			return false, nodeSelectionErr
+		}
+		log.Infof("Routing add file request to %s", node)
+
+		// Send data to node, the last chunk is answered with the result
+		var resp []byte
+		var sendErr error
+		for _, msg := range msgs {
+			// log.Infof("send chunk %d %v", chunkNumber, msg.Data[12:])
+			resp, sendErr = binaryTransport._sendFileChunk(node, msg)
+			if sendErr != nil {
+				break
+			}
+		}
+		if sendErr == nil {
+			sendErr = binaryTransport._readFileWriteResponse(resp)
+		}
+		if sendErr == nil {
+			return true, nil
+		}
+
+		// Try another node
+		log.Warnf("Failed to add file %s on %s: %s", fullName, node, sendErr)
+		lastErr = sendErr
+		criteria.ExcludeNodes = append(criteria.ExcludeNodes, node)
 	}
 
 	// @todo Write to other replicate nodes
 	// @todo Write shard index change (effectively add file to bloom filter) to all nodes (UDP)
 
-	return true, nil
+	return false, lastErr
+}
+
+// Delete file from all copies of the shards that contain it, returns the number of shard copies it was deleted from
+func (this *Datastore) DeleteFile(fullName string) (int, error) {
+	return this.DeleteFileVersion(fullName, "")
+}
+
+// Delete version of a file (all versions if empty) from all copies of the shards that contain it
+func (this *Datastore) DeleteFileVersion(fullName string, versionId string) (int, error) {
+	indices, _, err := this.LocateFile(fullName)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int = 0
+	var lastErr error
+	for _, shardIdx := range indices {
+		shardId := uuidToString(shardIdx.ShardId)
+		for _, location := range this.fileLocator.ShardLocationsByIdStr(shardId) {
+			// Local
+			if location.Local {
+				shard := this.LocalShardByIdStr(shardId)
+				if shard == nil {
+					continue
+				}
+				var res bool
+				var err error
+				if len(versionId) > 0 {
+					res, err = shard.DeleteFileVersion(fullName, versionId)
+				} else {
+					res, err = shard.DeleteFile(fullName)
+				}
+				if err != nil {
+					lastErr = err
+					continue
+				}
+				if res {
+					deleted++
+				}
+				continue
+			}
+
+			// Remote
+			uri := fmt.Sprintf("http://%s:%d/v1/local/file?filename=%s&shard=%s&version=%s", location.Node, conf.HttpPort, url.QueryEscape(fullName), shardId, url.QueryEscape(versionId))
+			req, _ := http.NewRequest("DELETE", uri, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNotFound {
+				continue
+			}
+			if resp.StatusCode != http.StatusOK {
+				lastErr = errors.New(fmt.Sprintf("Request %s failed with status %d", uri, resp.StatusCode))
+				continue
+			}
+			deleted++
+		}
+	}
+
+	// Other nodes drop cached locations and contents, once for all copies
+	if deleted > 0 {
+		binaryTransport._broadcastFileLocationInvalidation(fullName)
+	}
+
+	if deleted == 0 && lastErr != nil {
+		return 0, lastErr
+	}
+	return deleted, nil
 }
 
 // Find block
@@ -77,9 +239,17 @@ func (this *Datastore) BlockByIdStr(id string) *Block {
 	return nil
 }
 
-// Find shard
+// Find shard (not on failed volumes, includes temporary shards)
 func (this *Datastore) LocalShardByIdStr(id string) *Shard {
+	if temporaryStore != nil {
+		if shard := temporaryStore.ShardByIdStr(id); shard != nil {
+			return shard
+		}
+	}
 	for _, volume := range this.Volumes() {
+		if !volume.IsReadable() {
+			continue
+		}
 		for _, shard := range volume.Shards() {
 			if shard.IdStr() == id {
 				return shard
@@ -89,9 +259,46 @@ func (this *Datastore) LocalShardByIdStr(id string) *Shard {
 	return nil
 }
 
+// Remove local shard from this node and its disk (e.g. after it has been migrated away)
+func (this *Datastore) RemoveShard(shard *Shard) error {
+	log.Infof("Removing local shard %s", shard.IdStr())
+	block := shard.Block()
+	block.UnregisterShard(shard)
+	block.Volume().UnregisterShard(shard)
+	err := os.Remove(shard.FullPath())
+
+	// Empty block?
+	if block.ShardCount() == 0 {
+		block.Volume().UnregisterBlock(block)
+		os.Remove(block.ManifestPath())
+		os.Remove(block.FullPath())
+	} else if manifestErr := block.PersistManifest(); manifestErr != nil {
+		log.Errorf("Failed to write manifest of block %s: %s", block.IdStr(), manifestErr)
+	}
+
+	// No longer available from this node
+	this.fileLocator.UnloadIndex(runtime.GetNode(), shard.Id)
+	binaryTransport._broadcastRemoveShardIndex(shard.Id)
+
+	return err
+}
+
 // Find writable shard
-func (this *Datastore) AllocateShardCapacity(fileMeta *FileMeta) *Shard {
+func (this *Datastore) AllocateShardCapacity(fileMeta *FileMeta) (*Shard, error) {
+	// Never fits, large files must be chunked
+	if fileMeta.Size > shardCapacity() {
+		return nil, errors.New(fmt.Sprintf("File of %d bytes exceeds shard size of %d bytes", fileMeta.Size, shardCapacity()))
+	}
+
+	// Stored size, encryption adds a tag
+	n := fileMeta.Size + keyring.Overhead()
+
 	for _, volume := range this.Volumes() {
+		// Full or failing
+		if !volume.IsWritable() {
+			continue
+		}
+
 		for _, shard := range volume.Shards() {
 			// Ignore parity shards
 			if shard.Parity {
@@ -99,35 +306,58 @@ func (this *Datastore) AllocateShardCapacity(fileMeta *FileMeta) *Shard {
 			}
 
 			// Allocate capacity
-			if shard.AllocateCapacity(fileMeta.Size) {
-				return shard
+			if shard.AllocateCapacity(n) {
+				return shard, nil
 			}
 		}
 	}
 
 	// No capacity found, let's create some
-	this.NewBlock()
-	return this.AllocateShardCapacity(fileMeta)
+	block := this.NewBlock()
+	if block == nil {
+		return nil, errors.New("No writable volume with capacity left on this node")
+	}
+	for _, shard := range block._shards() {
+		if !shard.Parity && shard.AllocateCapacity(n) {
+			return shard, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Unable to allocate %d bytes in new block %s", fileMeta.Size, block.IdStr()))
 }
 
-// Get volume
+// Get volume for a new block, the default storage class is preferred, nil if all volumes are full or failing
 func (this *Datastore) GetVolume() *Volume {
-	volumes := this.Volumes()
-	// @todo Improve volume allocator (e.g. least full / fastest)
-	volume := volumes[len(volumes)-1]
+	n := uint64(conf.DataShardsPerBlock+conf.ParityShardsPerBlock) * uint64(conf.ShardSizeInBytes)
+	volume := this.AllocateVolume(conf.DefaultStorageClass, n)
+	if volume == nil {
+		volume = this.AllocateVolume("", n)
+	}
+	if volume == nil {
+		log.Warn("No writable volume with capacity left")
+	}
 	return volume
 }
 
-// New block
+// New block, nil if there is no writable volume
 func (this *Datastore) NewBlock() *Block {
 	log.Info("Allocating new block")
 
 	// Volume
 	volume := this.GetVolume()
+	if volume == nil {
+		log.Error("Unable to allocate new block, no writable volume")
+		return nil
+	}
 
 	// Create new block
 	b := newBlock(volume)
 
+	// Data key (encryption at rest)
+	if _, err := keyring.NewBlockKey(b.Id); err != nil {
+		log.Errorf("Unable to allocate new block, failed to create data key: %s", err)
+		return nil
+	}
+
 	// Init shards
 	b.initShards()
 
@@ -155,3 +385,14 @@ func newDatastore() *Datastore {
 	d.prepare()
 	return d
 }
+
+// Delete the chunks of chunked files
+func (this *Datastore) _deleteChunks(metas []*FileMeta) {
+	for _, meta := range metas {
+		for _, chunk := range meta.Chunks {
+			if _, err := this.DeleteFile(chunk.FullName); err != nil {
+				log.Warnf("Failed to delete chunk %s of %s: %s", chunk.FullName, meta.FullName, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Degraded reads: decode a file from the other shards of its block when no replica of its data shard is reachable
+
+// Read file by decoding it from the surviving data and parity shards of the block
+func (this *Datastore) DegradedReadFile(shardIdx *ShardIndex, fullName string) ([]byte, error) {
+	b, _, err := this._degradedRead(shardIdx, fullName)
+	return b, err
+}
+
+// Degraded read, also returns the file meta
+func (this *Datastore) _degradedRead(shardIdx *ShardIndex, fullName string) ([]byte, *FileMeta, error) {
+	// Block layout known?
+	if !shardIdx.HasBlockInfo() {
+		return nil, nil, errors.New(fmt.Sprintf("Block of shard %s unknown, unable to decode %s", uuidToString(shardIdx.ShardId), fullName))
+	}
+	blockIndex := shardIdx.BlockIndex
+	dataShards, parityShards := shardIdx.ErasureCodingScheme()
+	log.Warnf("Degraded read of %s from block %s (shard index %d)", fullName, uuidToString(shardIdx.BlockId), blockIndex)
+
+	// Other shards of the block
+	indices := make([]*ShardIndex, 0)
+	for _, idx := range this.fileLocator.BlockShardIndices(this, shardIdx.BlockId) {
+		if idx.BlockIndex == blockIndex || int(idx.BlockIndex) >= dataShards+parityShards {
+			continue
+		}
+		indices = append(indices, idx)
+	}
+	if len(indices) < dataShards {
+		return nil, nil, errors.New(fmt.Sprintf("Only %d shards of block %s available, need %d to decode %s", len(indices), uuidToString(shardIdx.BlockId), dataShards, fullName))
+	}
+
+	// File meta, parity shards keep a copy
+	var meta *FileMeta
+	for _, idx := range indices {
+		if !idx.Parity {
+			continue
+		}
+		m, err := this._readShardFileMetaCopy(idx, fullName, blockIndex)
+		if err != nil {
+			log.Warnf("Failed to read file meta of %s from parity shard %s: %s", fullName, uuidToString(idx.ShardId), err)
+			continue
+		}
+		meta = m
+		break
+	}
+	if meta == nil {
+		return nil, nil, errors.New(fmt.Sprintf("File meta of %s not found on any parity shard", fullName))
+	}
+
+	// Read the same range from the other shards
+	shards := make([][]byte, dataShards+parityShards)
+	var available int = 0
+	for _, idx := range indices {
+		b, err := this._readShardRange(idx, meta.StartOffset, meta.Size)
+		if err != nil {
+			log.Warnf("Failed to read range of shard %s: %s", uuidToString(idx.ShardId), err)
+			continue
+		}
+		shards[idx.BlockIndex] = b
+		available++
+		if available == dataShards {
+			break
+		}
+	}
+	if available < dataShards {
+		return nil, nil, errors.New(fmt.Sprintf("Only %d shards of block %s readable, need %d to decode %s", available, uuidToString(shardIdx.BlockId), dataShards, fullName))
+	}
+
+	// Decode
+	fileBytes, err := reconstructShardRange(dataShards, parityShards, shards, int(blockIndex))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Validate CRC
+	if crc32.Checksum(fileBytes, crcTable) != meta.Checksum {
+		return nil, nil, errors.New(fmt.Sprintf("CRC checksum mismatch after decoding %s", fullName))
+	}
+
+	// Encrypted, the data key is known to nodes that hold a shard of the block
+	if meta.IsEncrypted() {
+		bk := keyring.BlockKey(shardIdx.BlockId)
+		if bk == nil {
+			return nil, nil, errors.New(fmt.Sprintf("Data key of block %s unknown on this node, unable to decrypt %s", uuidToString(shardIdx.BlockId), fullName))
+		}
+		if fileBytes, err = bk.OpenFile(meta, fileBytes); err != nil {
+			return nil, nil, err
+		}
+	}
+	return fileBytes, meta, nil
+}
+
+// Read copy of file meta from parity shard (local or remote)
+func (this *Datastore) _readShardFileMetaCopy(idx *ShardIndex, fullName string, dataShardIndex uint32) (*FileMeta, error) {
+	// Local
+	shard := this.LocalShardByIdStr(uuidToString(idx.ShardId))
+	if shard != nil {
+		meta := shard.ShardFileMeta().GetCopyByName(fullName, dataShardIndex)
+		if meta == nil {
+			return nil, errors.New("File meta not found")
+		}
+		return meta, nil
+	}
+
+	// Remote
+	path := fmt.Sprintf("/v1/local/shard/file-meta?shard=%s&filename=%s&index=%d", uuidToString(idx.ShardId), url.QueryEscape(fullName), dataShardIndex)
+	b, err := this._requestShardLocations(idx, path)
+	if err != nil {
+		return nil, err
+	}
+	meta := &FileMeta{}
+	meta.FromBytes(b)
+	return meta, nil
+}
+
+// Read raw range of shard (local or remote)
+func (this *Datastore) _readShardRange(idx *ShardIndex, offset uint64, length uint64) ([]byte, error) {
+	// Local
+	shard := this.LocalShardByIdStr(uuidToString(idx.ShardId))
+	if shard != nil {
+		return shard.ReadRange(offset, length)
+	}
+
+	// Remote
+	b, err := this._requestShardLocations(idx, fmt.Sprintf("/v1/local/shard/range?shard=%s&offset=%d&length=%d", uuidToString(idx.ShardId), offset, length))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b)) != length {
+		return nil, errors.New(fmt.Sprintf("Range length mismatch, expected %d received %d", length, len(b)))
+	}
+	return b, nil
+}
+
+// Request path from the nodes that have the shard, first success wins
+func (this *Datastore) _requestShardLocations(idx *ShardIndex, path string) ([]byte, error) {
+	var lastErr error = errors.New("No locations")
+	for _, location := range this.fileLocator.ShardLocationsByIdStr(uuidToString(idx.ShardId)) {
+		if location.Local {
+			continue
+		}
+		uri := fmt.Sprintf("http://%s:%d%s", location.Node, conf.HttpPort, path)
+		resp, err := http.Get(uri)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = errors.New(fmt.Sprintf("Request %s failed with status %d", uri, resp.StatusCode))
+			continue
+		}
+		return body, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+)
+
+// Reading files from the nodes that hold them
+
+// Header that marks the contents as a chunk manifest
+const CHUNKED_FILE_HEADER string = "X-Xyzfs-Chunked"
+
+// Header with the version id of the contents
+const FILE_VERSION_HEADER string = "X-Xyzfs-Version"
+
+// Headers with the codec and uncompressed size of compressed contents
+const FILE_CODEC_HEADER string = "X-Xyzfs-Codec"
+const FILE_RAW_SIZE_HEADER string = "X-Xyzfs-Raw-Size"
+
+// Header with the expiry of temporary files (unix timestamp)
+const FILE_EXPIRES_HEADER string = "X-Xyzfs-Expires"
+
+// Result of reading the stored contents of a file
+type FileReadResult struct {
+	Data      []byte
+	VersionId string
+	Chunked   bool             // Data is a chunk manifest
+	Degraded  bool             // Decoded from the other shards of the block
+	Codec     CompressionCodec // Data is compressed with this codec
+	RawSize   uint64           // Uncompressed size
+	Local     bool             // Read from a shard on this node
+	Expires   uint32           // Expiry of a temporary file (unix timestamp), 0 if it does not expire
+}
+
+// Decompress the data, unless the codec is accepted as is
+func (this *FileReadResult) _decompress(accept []CompressionCodec) error {
+	if this.Codec == NoneCompressionCodec {
+		return nil
+	}
+	for _, codec := range accept {
+		if codec == this.Codec {
+			return nil
+		}
+	}
+	b, err := decompressBytes(this.Codec, this.Data, this.RawSize)
+	if err != nil {
+		return err
+	}
+	this.Data = b
+	this.Codec = NoneCompressionCodec
+	this.RawSize = 0
+	return nil
+}
+
+// Read latest version of a file
+func (this *Datastore) ReadFile(fullName string) (*FileReadResult, error) {
+	return this.ReadFileVersion(fullName, "")
+}
+
+// Read version of a file (latest if empty), chunked files are reassembled and compressed files decompressed
+func (this *Datastore) ReadFileVersion(fullName string, versionId string) (*FileReadResult, error) {
+	return this.ReadFileVersionEncoded(fullName, versionId, nil)
+}
+
+// Read version of a file, contents compressed with an accepted codec are returned as stored (e.g. gzip for HTTP clients that accept it)
+func (this *Datastore) ReadFileVersionEncoded(fullName string, versionId string, accept []CompressionCodec) (*FileReadResult, error) {
+	res, err := this._readStored(fullName, versionId)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Chunked {
+		if err := res._decompress(accept); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	// Reassemble
+	manifest, err := parseFileChunkManifest(res.Data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid chunk manifest of %s: %s", fullName, err))
+	}
+	var degradedChunks int32 = 0
+	data, err := manifest.Assemble(func(chunk *FileChunk) ([]byte, error) {
+		chunkRes, err := this._readStored(chunk.FullName, "")
+		if err != nil {
+			return nil, err
+		}
+		if chunkRes.Degraded {
+			atomic.AddInt32(&degradedChunks, 1)
+		}
+		if err := chunkRes._decompress(nil); err != nil {
+			return nil, err
+		}
+		return chunkRes.Data, nil
+	}, conf.FileChunkParallelism)
+	if err != nil {
+		return nil, err
+	}
+	return &FileReadResult{
+		Data:      data,
+		VersionId: res.VersionId,
+		Degraded:  res.Degraded || atomic.LoadInt32(&degradedChunks) > 0,
+	}, nil
+}
+
+// Read the stored contents of a file, hot files are cached (contents of local shards are cached by the shard)
+func (this *Datastore) _readStored(fullName string, versionId string) (*FileReadResult, error) {
+	key := fileCacheReadKey(fullName, versionId)
+	if res := fileCache.Get(key); res != nil {
+		return res, nil
+	}
+	since := fileCache.Seq()
+	res, err := this._readStoredFromReplicas(fullName, versionId)
+	if err == nil && !res.Local && !res.Degraded {
+		fileCache.Put(key, fullName, res, since)
+	}
+	return res, err
+}
+
+// Read the stored contents of a file, falls back to decoding it from parity when no replica is reachable
+func (this *Datastore) _readStoredFromReplicas(fullName string, versionId string) (*FileReadResult, error) {
+	// Latest version, from the cached location if it was read before
+	latest := len(versionId) == 0
+	since := this.fileLocator.LocationCacheSeq()
+	if latest {
+		cached := this.fileLocator.CachedLocations(fullName)
+		for _, location := range cached {
+			res, err := this._readReplica(location.Node, location.ShardId, fullName, "")
+			if err == nil {
+				return res, nil
+			}
+			log.Warnf("Failed to read %s from cached location: %s", fullName, err)
+		}
+		if len(cached) > 0 {
+			this.fileLocator.InvalidateLocation(fullName)
+		}
+	}
+
+	// A specific version is read from the first shard that holds it (version ids are unique), the latest version can be in any shard
+	// (old versions in sealed blocks are not removed), so those read all shards
+	if !latest {
+		indices, _, err := this.fileLocator._locateFirst(this, fullName)
+		if err == nil {
+			if res := this._readReplicas(indices, fullName, versionId, latest, since); res != nil {
+				return res, nil
+			}
+		}
+	}
+
+	// Locate
+	indices, _, err := this.LocateFile(fullName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Several shards can hold versions, pick the latest
+	if latest && len(indices) > 1 {
+		versions, err := this.FileVersions(fullName)
+		if err != nil {
+			log.Warnf("Failed to list versions of %s: %s", fullName, err)
+		} else {
+			versionId = versions[0].VersionId
+		}
+	}
+
+	// Replicas
+	if res := this._readReplicas(indices, fullName, versionId, latest, since); res != nil {
+		return res, nil
+	}
+
+	// No replica reachable, decode from the other shards of the block
+	for _, shardIdx := range indices {
+		body, meta, err := this._degradedRead(shardIdx, fullName)
+		if err != nil {
+			log.Warnf("Degraded read of %s failed: %s", fullName, err)
+			continue
+		}
+		if len(versionId) > 0 && meta.VersionId() != versionId {
+			log.Warnf("Degraded read of %s returned version %s, expected %s", fullName, meta.VersionId(), versionId)
+			continue
+		}
+		return &FileReadResult{
+			Data:      body,
+			VersionId: meta.VersionId(),
+			Chunked:   meta.Chunked,
+			Degraded:  true,
+			Codec:     meta.Codec,
+			RawSize:   meta.RawSize,
+		}, nil
+	}
+
+	return nil, errors.New("File not found")
+}
+
+// Read from the first replica of the shards that returns the file, nil if none does
+// reads of the latest version cache the location, unless the file was written or deleted since the sequence
+func (this *Datastore) _readReplicas(indices []*ShardIndex, fullName string, versionId string, latest bool, since uint64) *FileReadResult {
+	for _, shardIdx := range indices {
+		for _, location := range this.fileLocator.ShardLocationsByIdStr(uuidToString(shardIdx.ShardId)) {
+			res, err := this._readReplica(location.Node, shardIdx.ShardId, fullName, versionId)
+			if err != nil {
+				log.Warnf("Failed to read %s from %s: %s", fullName, location.Node, err)
+				continue
+			}
+			if latest {
+				this.fileLocator.CacheLocation(fullName, shardIdx.ShardId, location.Node, since)
+			}
+			return res
+		}
+	}
+	return nil
+}
+
+// Read file from the shard on a node
+func (this *Datastore) _readReplica(node string, shardId []byte, fullName string, versionId string) (*FileReadResult, error) {
+	uri := fmt.Sprintf("http://%s:%d/v1/local/file?filename=%s&version=%s&shard=%s", node, conf.HttpPort, url.QueryEscape(fullName), url.QueryEscape(versionId), uuidToString(shardId))
+	resp, err := http.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Shard lost on this node?
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("Request %s failed with status %d", uri, resp.StatusCode))
+	}
+
+	res := &FileReadResult{
+		Data:      body,
+		VersionId: resp.Header.Get(FILE_VERSION_HEADER),
+		Chunked:   resp.Header.Get(CHUNKED_FILE_HEADER) == "1",
+		Local:     node == runtime.GetNode(),
+	}
+	if expires := resp.Header.Get(FILE_EXPIRES_HEADER); len(expires) > 0 {
+		ts, err := strconv.ParseUint(expires, 10, 32)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid expiry of %s from %s", fullName, uri))
+		}
+		res.Expires = uint32(ts)
+	}
+	if codecName := resp.Header.Get(FILE_CODEC_HEADER); len(codecName) > 0 {
+		codec, err := parseCompressionCodec(codecName)
+		if err != nil {
+			return nil, err
+		}
+		rawSize, err := strconv.ParseUint(resp.Header.Get(FILE_RAW_SIZE_HEADER), 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid uncompressed size of %s from %s", fullName, uri))
+		}
+		res.Codec = codec
+		res.RawSize = rawSize
+	}
+	return res, nil
+}
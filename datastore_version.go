@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// Versions of files across the shards that hold them
+
+// Versions of a file, newest first
+func (this *Datastore) FileVersions(fullName string) ([]*FileVersion, error) {
+	indices, _, err := this.LocateFile(fullName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge, replicas and other shards can hold the same version
+	now := unixTsUint32()
+	byId := make(map[string]*FileVersion)
+	var lastErr error
+	for _, idx := range indices {
+		if idx.Parity {
+			continue
+		}
+		metas, err := this._shardFileVersions(idx, fullName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, meta := range metas {
+			if meta.IsExpired(now) {
+				continue
+			}
+			v := byId[meta.VersionId()]
+			if v == nil {
+				v = newFileVersion(meta)
+				byId[meta.VersionId()] = v
+			}
+			v.Shards = append(v.Shards, uuidToString(idx.ShardId))
+		}
+	}
+
+	// Newest first
+	list := make([]*FileVersion, 0)
+	for _, v := range byId {
+		list = append(list, v)
+	}
+	if len(list) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, errors.New("File not found")
+	}
+	sort.Sort(FileVersions(list))
+	list[0].Latest = true
+	return list, nil
+}
+
+// Versions of a file in a shard (local or remote)
+func (this *Datastore) _shardFileVersions(idx *ShardIndex, fullName string) ([]*FileMeta, error) {
+	// Local
+	shard := this.LocalShardByIdStr(uuidToString(idx.ShardId))
+	if shard != nil {
+		return shard.ShardFileMeta().Versions(fullName), nil
+	}
+
+	// Remote
+	b, err := this._requestShardLocations(idx, fmt.Sprintf("/v1/local/file/versions?shard=%s&filename=%s", uuidToString(idx.ShardId), url.QueryEscape(fullName)))
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]*FileMeta, 0)
+	if err := json.Unmarshal(b, &metas); err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
+
+// Read version of a file from the local shards, the latest if no version is given
+func (this *Datastore) _readLocalVersion(fullName string, versionId string) ([]byte, *FileMeta, error) {
+	indices, _, err := this.LocateFile(fullName)
+	if err != nil {
+		return nil, nil, err
+	}
+	shards := make([]*Shard, 0)
+	for _, idx := range indices {
+		if s := this.LocalShardByIdStr(uuidToString(idx.ShardId)); s != nil {
+			shards = append(shards, s)
+		}
+	}
+	return this._readLocalShards(shards, fullName, versionId)
+}
+
+// Read version of a file from a local shard (e.g. located by the node that proxies the read), the latest if no version is given
+func (this *Datastore) _readLocalShardVersion(shardId string, fullName string, versionId string) ([]byte, *FileMeta, error) {
+	s := this.LocalShardByIdStr(shardId)
+	if s == nil {
+		return nil, nil, errors.New(fmt.Sprintf("Shard %s not on this node", shardId))
+	}
+	return this._readLocalShards([]*Shard{s}, fullName, versionId)
+}
+
+// Read version of a file from the latest of the local shards that hold it
+func (this *Datastore) _readLocalShards(shards []*Shard, fullName string, versionId string) ([]byte, *FileMeta, error) {
+	// Pick
+	var shard *Shard = nil
+	var meta *FileMeta = nil
+	for _, s := range shards {
+		if s.Parity {
+			continue
+		}
+		var m *FileMeta
+		if len(versionId) > 0 {
+			m = s.ShardFileMeta().GetVersion(fullName, versionId)
+		} else {
+			m = s.ShardFileMeta().GetByName(fullName)
+		}
+		if m != nil && (meta == nil || m.IsNewerThan(meta)) {
+			shard = s
+			meta = m
+		}
+	}
+	if meta == nil {
+		return nil, nil, errors.New("Unable to read file locally")
+	}
+
+	// Read
+	b, err, _ := shard.ReadFileVersion(fullName, meta.VersionId())
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, meta, nil
+}
+
+// Remove the versions beyond the retention, only needed when other shards hold versions too (shards enforce it themselves)
+func (this *Datastore) _enforceRetention(fullName string) {
+	if conf.FileVersionRetention < 1 {
+		return
+	}
+	indices, _, err := this.LocateFile(fullName)
+	if err != nil || len(indices) < 2 {
+		return
+	}
+	versions, err := this.FileVersions(fullName)
+	if err != nil || len(versions) <= conf.FileVersionRetention {
+		return
+	}
+	for _, v := range versions[conf.FileVersionRetention:] {
+		if _, err := this.DeleteFileVersion(fullName, v.VersionId); err != nil {
+			log.Warnf("Failed to remove version %s of %s: %s", v.VersionId, fullName, err)
+		}
+	}
+}
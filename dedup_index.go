@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/hex"
+	"sync"
+)
+
+// Deduplication: files with the same contents (SHA-256) are written to the shard that already holds them, the new file only references the existing bytes
+
+var dedupIndex *DedupIndex
+
+type DedupIndex struct {
+	mux    sync.RWMutex
+	shards map[string]string // Content hash (hex) to id of the local shard that holds it
+
+	// Stats
+	statsMux     sync.RWMutex
+	lookups      uint64
+	hits         uint64
+	bytesDeduped uint64 // Total of all writes that were deduplicated
+}
+
+// Deduplication status
+type DedupIndexStatus struct {
+	Enabled      bool
+	Entries      int
+	Lookups      uint64
+	Hits         uint64
+	BytesDeduped uint64 // Total of all writes that were deduplicated
+	BytesSaved   uint64 // Currently not stored because live files share their contents
+}
+
+// Local shard that holds the contents of the file and still accepts writes, nil if none
+func (this *DedupIndex) Lookup(f *FileMeta) *Shard {
+	if !conf.Dedup || len(f.ContentHash) == 0 {
+		return nil
+	}
+	k := hex.EncodeToString(f.ContentHash)
+	this.mux.RLock()
+	shardId := this.shards[k]
+	this.mux.RUnlock()
+
+	this.statsMux.Lock()
+	this.lookups++
+	this.statsMux.Unlock()
+	if len(shardId) == 0 {
+		return nil
+	}
+
+	// Still there? Entries are not removed on delete, the shard is the source of truth
+	shard := datastore.LocalShardByIdStr(shardId)
+	if shard == nil || shard.Parity || shard.IsTemporary() || shard.Block().IsSealed() || !shard.Block().Volume().IsWritable() || shard.ShardFileMeta().GetByContents(f) == nil {
+		this.mux.Lock()
+		if this.shards[k] == shardId {
+			delete(this.shards, k)
+		}
+		this.mux.Unlock()
+		return nil
+	}
+
+	// Room to store the contents again in case they are deleted before the write
+	if shard.FreeBytes() < f.Size {
+		return nil
+	}
+	return shard
+}
+
+// Register contents stored in a shard
+func (this *DedupIndex) Register(shard *Shard, f *FileMeta) {
+	if len(f.ContentHash) == 0 || shard.Parity || shard.IsTemporary() {
+		return
+	}
+	this.mux.Lock()
+	this.shards[hex.EncodeToString(f.ContentHash)] = shard.IdStr()
+	this.mux.Unlock()
+}
+
+// Register the live files of a shard (e.g. after loading it from disk), the file meta is passed as the shard can still be loading
+func (this *DedupIndex) _registerShardFileMeta(shard *Shard, shardFileMeta *ShardFileMeta) {
+	for _, f := range shardFileMeta.Live() {
+		this.Register(shard, f)
+	}
+}
+
+// Record a write that only references existing contents
+func (this *DedupIndex) RecordHit(f *FileMeta) {
+	this.statsMux.Lock()
+	this.hits++
+	this.bytesDeduped += uint64(f.Size)
+	this.statsMux.Unlock()
+}
+
+// Status
+func (this *DedupIndex) Status() *DedupIndexStatus {
+	var saved uint64 = 0
+	for _, volume := range datastore.Volumes() {
+		if !volume.IsReadable() {
+			continue
+		}
+		for _, shard := range volume.Shards() {
+			if shard.Parity {
+				continue
+			}
+			saved += shard.DedupBytes()
+		}
+	}
+	for _, shard := range temporaryStore.Shards() {
+		saved += shard.DedupBytes()
+	}
+
+	this.mux.RLock()
+	entries := len(this.shards)
+	this.mux.RUnlock()
+	this.statsMux.RLock()
+	defer this.statsMux.RUnlock()
+	return &DedupIndexStatus{
+		Enabled:      conf.Dedup,
+		Entries:      entries,
+		Lookups:      this.lookups,
+		Hits:         this.hits,
+		BytesDeduped: this.bytesDeduped,
+		BytesSaved:   saved,
+	}
+}
+
+func newDedupIndex() *DedupIndex {
+	return &DedupIndex{
+		shards: make(map[string]string),
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// Test encryption at rest with a stand-in key management service
+func TestEncryptionAtRest(t *testing.T) {
+	startApplication()
+	kms := newLocalKms()
+	keyring.SetProvider(kms)
+	defer keyring.SetProvider(nil)
+
+	// Write
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	contents := []byte("Top secret contents of an encrypted file")
+	meta, err := shard.AddFile(newFileMeta("/encrypted/secret.txt"), contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsEncrypted() || meta.Size != uint64(len(contents))+ENCRYPTION_TAG_SIZE {
+		t.Errorf("Expected sealed contents, size %d", meta.Size)
+	}
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	if shard.ShardMeta().KeyLength < 1 {
+		t.Error("Expected wrapped data key in footer")
+	}
+
+	// Nothing readable on disk
+	onDisk, err := ioutil.ReadFile(shard.FullPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, contents) || bytes.Contains(onDisk, []byte("/encrypted/secret.txt")) {
+		t.Error("Contents and file meta must not be stored in plain text")
+	}
+
+	// Reload, the data key is unwrapped from the footer
+	reload := func() {
+		keyring.SetProvider(kms)
+		shard.ResetLoaded()
+		if _, err := shard.Load(); err != nil {
+			t.Fatalf("Failed to load encrypted shard: %s", err)
+		}
+		if read, err, _ := shard.ReadFile("/encrypted/secret.txt"); err != nil || !bytes.Equal(read, contents) {
+			t.Errorf("Failed to read encrypted file: %s", err)
+		}
+	}
+	reload()
+
+	// Rotate, the old master key is no longer needed
+	oldMasterKeyId := kms.CurrentKeyId()
+	result, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MasterKeyId == oldMasterKeyId || result.ShardsRewritten < 1 || result.Failures > 0 {
+		t.Errorf("Unexpected rotation result %v", result)
+	}
+	kms.DisableKey(oldMasterKeyId)
+	reload()
+	if keyring.BlockKey(b.Id).MasterKeyId != result.MasterKeyId {
+		t.Error("Expected data key wrapped by the new master key")
+	}
+	afterRotation, _ := ioutil.ReadFile(shard.FullPath())
+	if !bytes.Equal(afterRotation[:meta.Size], onDisk[:meta.Size]) {
+		t.Error("Rotation must not rewrite the contents")
+	}
+
+	// Tampered contents are detected
+	tampered := *meta
+	tampered.Nonce = make([]byte, FILE_NONCE_SIZE)
+	if _, err := keyring.BlockKey(b.Id).OpenFile(&tampered, afterRotation[:meta.Size]); err == nil {
+		t.Error("Expected authentication failure")
+	}
+
+	// Unknown master key
+	keyring.SetProvider(newLocalKms())
+	shard.ResetLoaded()
+	if _, err := shard.Load(); err == nil {
+		t.Error("Expected load to fail without the master key")
+	}
+}
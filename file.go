@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"github.com/spaolacci/murmur3"
@@ -14,11 +15,61 @@ type FileMeta struct {
 	Id          []byte // Random uuid
 	FullName    string // virtual path, folder/directory + filename (e.g. /images/robin/profile.JPG)
 	Created     uint32 // Unix timestamp
-	Size        uint32 // Length of file in bytes
-	StartOffset uint32 // Offset in bytes to start reading contents
+	Size        uint64 // Length of file in bytes
+	StartOffset uint64 // Offset in bytes to start reading contents
 	Checksum    uint32 // Crc 32 (Castagnoli)
+
+	// Only set on the copies kept by parity shards: block index of the data shard that holds the contents
+	DataShardIndex uint32
+
+	// Deleted or overwritten, the bytes remain in the shard until it is compacted
+	Deleted bool
+
+	// Large file, the contents are a manifest of the chunks that hold the data
+	Chunked bool
+	Chunks  []*FileChunk `json:",omitempty"`
+
+	// Stored in memory only (temporary tier)
+	Temporary bool
+
+	// Unix timestamp after which the file is gone, 0 = never
+	Expires uint32
+
+	// Hybrid logical clock timestamp of the write, orders the versions of a file (the id is the version id)
+	Timestamp uint64
+
+	// Runtime id of the node that accepted the write, breaks ties between concurrent writes
+	Origin string `json:",omitempty"`
+
+	// Strong hash of the contents (SHA-256, only with deduplication), files with the same hash in a shard share their bytes
+	ContentHash []byte `json:",omitempty"`
+
+	// Compression at rest, the size and checksum are of the stored (compressed) bytes
+	Codec   CompressionCodec `json:",omitempty"`
+	RawSize uint64           `json:",omitempty"` // Uncompressed size
+
+	// Encryption at rest, nonce of the contents sealed with the data key of the block (the size and checksum are of the sealed bytes)
+	Nonce []byte `json:",omitempty"`
 }
 
+// Flags in the binary format
+const (
+	ChunkedFileMetaFlag     byte = 1 << iota // 1 = contents are a chunk manifest
+	TemporaryFileMetaFlag                    // 2 = temporary tier
+	ExpiresFileMetaFlag                      // 4 = followed by expiry timestamp (uint32)
+	TimestampFileMetaFlag                    // 8 = followed by write timestamp (uint64)
+	OriginFileMetaFlag                       // 16 = followed by origin node (uint16 length + runtime id)
+	ContentHashFileMetaFlag                  // 32 = followed by content hash (32 bytes)
+	CompressedFileMetaFlag                   // 64 = followed by codec (byte) and uncompressed size (uint32)
+	EncryptedFileMetaFlag                    // 128 = followed by nonce (12 bytes)
+)
+
+// Length of the nonce of encrypted contents in bytes
+const FILE_NONCE_SIZE int = 12
+
+// Size or offset that does not fit in 32 bits, the 64-bit value follows at the end (older nodes read files below 4 GB as before)
+const FILE_META_EXTENDED_SIZE uint32 = 0xFFFFFFFF
+
 // Serialize to bytes
 func (this *FileMeta) Bytes() []byte {
 	buf := new(bytes.Buffer)
@@ -26,9 +77,37 @@ func (this *FileMeta) Bytes() []byte {
 	binary.Write(buf, binary.BigEndian, uint32(len([]byte(this.FullName)))) // Length of name
 	buf.Write([]byte(this.FullName))                                        // Name
 	binary.Write(buf, binary.BigEndian, this.Created)                       // Created
-	binary.Write(buf, binary.BigEndian, this.Size)                          // Size
-	binary.Write(buf, binary.BigEndian, this.StartOffset)                   // StartOffset
+	binary.Write(buf, binary.BigEndian, fileMetaSize32(this.Size))          // Size
+	binary.Write(buf, binary.BigEndian, fileMetaSize32(this.StartOffset))   // StartOffset
 	binary.Write(buf, binary.BigEndian, this.Checksum)                      // Checksum
+	buf.WriteByte(this.flags())                                             // Flags
+	if this.Expires > 0 {
+		binary.Write(buf, binary.BigEndian, this.Expires) // Expires
+	}
+	if this.Timestamp > 0 {
+		binary.Write(buf, binary.BigEndian, this.Timestamp) // Timestamp
+	}
+	if len(this.Origin) > 0 {
+		binary.Write(buf, binary.BigEndian, uint16(len(this.Origin))) // Length of origin
+		buf.Write([]byte(this.Origin))                                // Origin
+	}
+	if len(this.ContentHash) == sha256.Size {
+		buf.Write(this.ContentHash) // Content hash
+	}
+	if this.IsCompressed() {
+		buf.WriteByte(byte(this.Codec))                                   // Codec
+		binary.Write(buf, binary.BigEndian, fileMetaSize32(this.RawSize)) // Uncompressed size
+	}
+	if this.IsEncrypted() {
+		buf.Write(this.Nonce) // Nonce
+	}
+
+	// Extended sizes, in order
+	for _, v := range []uint64{this.Size, this.StartOffset, this.RawSize} {
+		if fileMetaSize32(v) == FILE_META_EXTENDED_SIZE {
+			binary.Write(buf, binary.BigEndian, v)
+		}
+	}
 	return buf.Bytes()
 }
 
@@ -43,6 +122,7 @@ func (this *FileMeta) FromBytes(b []byte) {
 	if idBytesRead != 16 {
 		panic("ID not 16 bytes")
 	}
+	this.Id = idBytes
 
 	// Name length
 	var nameLen uint32
@@ -50,7 +130,7 @@ func (this *FileMeta) FromBytes(b []byte) {
 	panicErr(err)
 
 	// Read actual name
-	nameBytes := allocByteArr(nameLen, 1024)
+	nameBytes := allocByteArr(uint64(nameLen), 1024)
 	nameBytesRead, _ := buf.Read(nameBytes)
 	if uint32(nameBytesRead) != nameLen {
 		panic(fmt.Sprintf("Name bytes read mismatch: %v", b))
@@ -62,29 +142,175 @@ func (this *FileMeta) FromBytes(b []byte) {
 	panicErr(err)
 
 	// Size
-	err = binary.Read(buf, binary.BigEndian, &this.Size)
+	var size uint32
+	err = binary.Read(buf, binary.BigEndian, &size)
 	panicErr(err)
+	this.Size = uint64(size)
 
 	// StartOffset
-	err = binary.Read(buf, binary.BigEndian, &this.StartOffset)
+	var startOffset uint32
+	err = binary.Read(buf, binary.BigEndian, &startOffset)
 	panicErr(err)
+	this.StartOffset = uint64(startOffset)
 
 	// Checksum
 	err = binary.Read(buf, binary.BigEndian, &this.Checksum)
 	panicErr(err)
 
+	// Flags (optional, not sent by older nodes)
+	if buf.Len() > 0 {
+		flags, _ := buf.ReadByte()
+		this.Chunked = flags&ChunkedFileMetaFlag != 0
+		this.Temporary = flags&TemporaryFileMetaFlag != 0
+		if flags&ExpiresFileMetaFlag != 0 {
+			err = binary.Read(buf, binary.BigEndian, &this.Expires)
+			panicErr(err)
+		}
+		if flags&TimestampFileMetaFlag != 0 {
+			err = binary.Read(buf, binary.BigEndian, &this.Timestamp)
+			panicErr(err)
+		}
+		if flags&OriginFileMetaFlag != 0 {
+			var originLen uint16
+			err = binary.Read(buf, binary.BigEndian, &originLen)
+			panicErr(err)
+			originBytes := make([]byte, originLen)
+			originBytesRead, _ := buf.Read(originBytes)
+			if originBytesRead != int(originLen) {
+				panic("Origin bytes read mismatch")
+			}
+			this.Origin = string(originBytes)
+		}
+		if flags&ContentHashFileMetaFlag != 0 {
+			hashBytes := make([]byte, sha256.Size)
+			hashBytesRead, _ := buf.Read(hashBytes)
+			if hashBytesRead != sha256.Size {
+				panic("Content hash bytes read mismatch")
+			}
+			this.ContentHash = hashBytes
+		}
+		if flags&CompressedFileMetaFlag != 0 {
+			codec, err := buf.ReadByte()
+			panicErr(err)
+			this.Codec = CompressionCodec(codec)
+			var rawSize uint32
+			err = binary.Read(buf, binary.BigEndian, &rawSize)
+			panicErr(err)
+			this.RawSize = uint64(rawSize)
+		}
+		if flags&EncryptedFileMetaFlag != 0 {
+			nonceBytes := make([]byte, FILE_NONCE_SIZE)
+			nonceBytesRead, _ := buf.Read(nonceBytes)
+			if nonceBytesRead != FILE_NONCE_SIZE {
+				panic("Nonce bytes read mismatch")
+			}
+			this.Nonce = nonceBytes
+		}
+	}
+
+	// Extended sizes
+	for _, v := range []*uint64{&this.Size, &this.StartOffset, &this.RawSize} {
+		if *v == uint64(FILE_META_EXTENDED_SIZE) {
+			err = binary.Read(buf, binary.BigEndian, v)
+			panicErr(err)
+		}
+	}
+}
+
+// Size or offset in the 32 bits of the binary format, FILE_META_EXTENDED_SIZE if it does not fit
+func fileMetaSize32(v uint64) uint32 {
+	if v >= uint64(FILE_META_EXTENDED_SIZE) {
+		return FILE_META_EXTENDED_SIZE
+	}
+	return uint32(v)
+}
+
+// Version id
+func (this *FileMeta) VersionId() string {
+	return uuidToString(this.Id)
+}
+
+// Is this a later version than the other? Last writer wins, concurrent writes resolve the same way on every node
+func (this *FileMeta) IsNewerThan(o *FileMeta) bool {
+	return compareFileVersions(this.Timestamp, this.Origin, this.Created, []byte(this.VersionId()), o.Timestamp, o.Origin, o.Created, []byte(o.VersionId())) > 0
+}
+
+// Are the stored bytes compressed?
+func (this *FileMeta) IsCompressed() bool {
+	return this.Codec != NoneCompressionCodec
+}
+
+// Are the stored bytes encrypted?
+func (this *FileMeta) IsEncrypted() bool {
+	return len(this.Nonce) == FILE_NONCE_SIZE
+}
+
+// Uncompressed size
+func (this *FileMeta) ContentSize() uint64 {
+	if this.IsCompressed() {
+		return this.RawSize
+	}
+	return this.Size
+}
+
+// Is expired?
+func (this *FileMeta) IsExpired(now uint32) bool {
+	return this.Expires > 0 && this.Expires <= now
+}
+
+// Flags for the binary format
+func (this *FileMeta) flags() byte {
+	var flags byte = 0
+	if this.Chunked {
+		flags |= ChunkedFileMetaFlag
+	}
+	if this.Temporary {
+		flags |= TemporaryFileMetaFlag
+	}
+	if this.Expires > 0 {
+		flags |= ExpiresFileMetaFlag
+	}
+	if this.Timestamp > 0 {
+		flags |= TimestampFileMetaFlag
+	}
+	if len(this.Origin) > 0 {
+		flags |= OriginFileMetaFlag
+	}
+	if len(this.ContentHash) == sha256.Size {
+		flags |= ContentHashFileMetaFlag
+	}
+	if this.IsCompressed() {
+		flags |= CompressedFileMetaFlag
+	}
+	if this.IsEncrypted() {
+		flags |= EncryptedFileMetaFlag
+	}
+	return flags
 }
 
 // Update contents from data of the file (e.g. length)
 func (this *FileMeta) UpdateFromData(b []byte) {
 	// Size
-	this.Size = uint32(len(b))
-	if this.Size > uint32(conf.MaxFileSize) {
+	this.Size = uint64(len(b))
+	if this.Size > uint64(conf.MaxFileSize) {
 		panic("Exceeds maximum file size")
 	}
 
 	// File meta checksum
 	this.Checksum = crc32.Checksum(b, crcTable)
+
+	// Content hash for deduplication
+	if conf.Dedup {
+		hash := sha256.Sum256(b)
+		this.ContentHash = hash[:]
+	} else {
+		this.ContentHash = nil
+	}
+}
+
+// Same contents as the other file? The size and checksum are not compared, once encrypted they are of the sealed bytes
+func (this *FileMeta) HasSameContents(o *FileMeta) bool {
+	return len(this.ContentHash) == sha256.Size && bytes.Equal(this.ContentHash, o.ContentHash) && this.Codec == o.Codec && this.RawSize == o.RawSize
 }
 
 // Get murmur hash
@@ -101,5 +327,15 @@ func newFileMeta(name string) *FileMeta {
 		Size:        0, // auto-calculated on write
 		StartOffset: 0, // auto-calculated on write
 		Checksum:    0, // auto-calculated on write
+		Timestamp:   nextFileTimestamp(),
+		Origin:      fileOrigin(),
+	}
+}
+
+// Origin of files written on this node
+func fileOrigin() string {
+	if runtime == nil {
+		return ""
 	}
+	return runtime.Id
 }
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/spaolacci/murmur3"
+	"sync"
+)
+
+// Read-through cache of the contents of hot files, on the node that reads them from its shards and on the node that proxies the read
+// TinyLFU admission: a file only evicts files that were read less often, the frequencies are estimated with a count-min sketch that ages
+
+var fileCache *FileCache
+
+type FileCache struct {
+	mux     sync.Mutex
+	size    uint64 // Bytes
+	bytes   uint64
+	entries map[string]*list.Element
+	names   map[string][]*list.Element // Entries by file name, to invalidate
+	lru     *list.List                 // Most recently used in front
+
+	// Estimated read frequencies
+	sketch *fileCacheSketch
+
+	// Invalidation sequence, reads that started before an invalidation of the name do not fill the cache
+	seq         uint64
+	invalidated map[string]uint64 // Sequence of the last invalidation by name
+	clearedSeq  uint64            // Latest invalidation of the names that were cleared
+
+	// Stats
+	hits          uint64
+	misses        uint64
+	admissions    uint64
+	rejections    uint64 // Read less often than the files they would evict
+	evictions     uint64
+	invalidations uint64
+}
+
+// Cached contents
+type fileCacheEntry struct {
+	key      string
+	fullName string
+	res      *FileReadResult
+}
+
+// File cache status
+type FileCacheStatus struct {
+	Entries       int
+	Bytes         uint64
+	Size          uint64
+	Hits          uint64
+	Misses        uint64
+	HitRate       float64
+	Admissions    uint64
+	Rejections    uint64
+	Evictions     uint64
+	Invalidations uint64
+}
+
+// Key of a version of a file in a shard (immutable, dropped when the file is written or deleted)
+func fileCacheShardKey(shardId string, meta *FileMeta) string {
+	return fmt.Sprintf("shard/%s/%s/%s", shardId, meta.VersionId(), meta.FullName)
+}
+
+// Invalidated names that are remembered, beyond this all are forgotten and reads in progress do not fill the cache
+const FILE_CACHE_MAX_INVALIDATED int = 100000
+
+// Key of a read of a file through the datastore, the latest version if no version is given
+func fileCacheReadKey(fullName string, versionId string) string {
+	return fmt.Sprintf("read/%s/%s", versionId, fullName)
+}
+
+// Bytes of an entry
+func (this *fileCacheEntry) size() uint64 {
+	return uint64(len(this.res.Data) + len(this.key))
+}
+
+// Current invalidation sequence, to pass to Put after the read
+func (this *FileCache) Seq() uint64 {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return this.seq
+}
+
+// Get contents, nil if not cached or expired
+func (this *FileCache) Get(key string) *FileReadResult {
+	if this.size < 1 {
+		return nil
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.sketch.Increment(key)
+	elm := this.entries[key]
+	if elm == nil {
+		this.misses++
+		return nil
+	}
+	if expires := elm.Value.(*fileCacheEntry).res.Expires; expires > 0 && expires <= unixTsUint32() {
+		this._remove(elm)
+		this.misses++
+		return nil
+	}
+	this.hits++
+	this.lru.MoveToFront(elm)
+	res := *elm.Value.(*fileCacheEntry).res
+	return &res
+}
+
+// Add contents that were read, ignored if the file was invalidated after the sequence or when read less often than the files it would evict
+func (this *FileCache) Put(key string, fullName string, res *FileReadResult, since uint64) {
+	if this.size < 1 {
+		return
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.clearedSeq > since || this.invalidated[fullName] > since {
+		return
+	}
+	if elm := this.entries[key]; elm != nil {
+		this._remove(elm)
+	}
+	stored := *res
+	entry := &fileCacheEntry{key: key, fullName: fullName, res: &stored}
+	n := entry.size()
+	if n > this.size {
+		this.rejections++
+		return
+	}
+
+	// Admission, the victims must be read less often
+	victims := make([]*list.Element, 0)
+	var freed uint64 = 0
+	if this.bytes+n > this.size {
+		frequency := this.sketch.Estimate(key)
+		for elm := this.lru.Back(); elm != nil && this.bytes+n-freed > this.size; elm = elm.Prev() {
+			victim := elm.Value.(*fileCacheEntry)
+			if this.sketch.Estimate(victim.key) >= frequency {
+				this.rejections++
+				return
+			}
+			victims = append(victims, elm)
+			freed += victim.size()
+		}
+	}
+	for _, elm := range victims {
+		this._remove(elm)
+		this.evictions++
+	}
+
+	// Add
+	elm := this.lru.PushFront(entry)
+	this.entries[key] = elm
+	this.names[fullName] = append(this.names[fullName], elm)
+	this.bytes += n
+	this.admissions++
+}
+
+// Invalidate the contents of a file (e.g. written or deleted), reads in progress will not cache it
+func (this *FileCache) Invalidate(fullName string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.seq++
+	if len(this.invalidated) >= FILE_CACHE_MAX_INVALIDATED {
+		this.invalidated = make(map[string]uint64)
+		this.clearedSeq = this.seq - 1
+	}
+	this.invalidated[fullName] = this.seq
+	for _, elm := range this.names[fullName] {
+		this._remove(elm)
+		this.invalidations++
+	}
+}
+
+// Remove entry (caller must hold the lock)
+func (this *FileCache) _remove(elm *list.Element) {
+	entry := elm.Value.(*fileCacheEntry)
+	this.lru.Remove(elm)
+	delete(this.entries, entry.key)
+	this.bytes -= entry.size()
+
+	// By name
+	remaining := make([]*list.Element, 0, len(this.names[entry.fullName]))
+	for _, other := range this.names[entry.fullName] {
+		if other != elm {
+			remaining = append(remaining, other)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(this.names, entry.fullName)
+	} else {
+		this.names[entry.fullName] = remaining
+	}
+}
+
+// Status
+func (this *FileCache) Status() *FileCacheStatus {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	s := &FileCacheStatus{
+		Entries:       this.lru.Len(),
+		Bytes:         this.bytes,
+		Size:          this.size,
+		Hits:          this.hits,
+		Misses:        this.misses,
+		Admissions:    this.admissions,
+		Rejections:    this.rejections,
+		Evictions:     this.evictions,
+		Invalidations: this.invalidations,
+	}
+	if this.hits+this.misses > 0 {
+		s.HitRate = float64(this.hits) / float64(this.hits+this.misses)
+	}
+	return s
+}
+
+// New cache of the bytes, the sketch is sized for the expected file size
+func newFileCache(size uint64, expectedFileSize int) *FileCache {
+	var width uint64 = 1024
+	if expectedFileSize > 0 && size/uint64(expectedFileSize) > width {
+		width = size / uint64(expectedFileSize)
+	}
+	return &FileCache{
+		size:        size,
+		entries:     make(map[string]*list.Element),
+		names:       make(map[string][]*list.Element),
+		lru:         list.New(),
+		sketch:      newFileCacheSketch(width),
+		invalidated: make(map[string]uint64),
+	}
+}
+
+// Count-min sketch of 4-bit counters, all counters are halved after 10 reads per counter so old popularity fades
+type fileCacheSketch struct {
+	width     uint64
+	rows      [FILE_CACHE_SKETCH_DEPTH][]byte
+	additions uint64
+}
+
+// Rows of the sketch
+const FILE_CACHE_SKETCH_DEPTH int = 4
+
+// Maximum value of a counter
+const FILE_CACHE_SKETCH_MAX_COUNT byte = 15
+
+// Counter positions of the key in the rows (double hashing)
+func (this *fileCacheSketch) locations(key string) [FILE_CACHE_SKETCH_DEPTH]uint64 {
+	h1, h2 := murmur3.Sum128([]byte(key))
+	var res [FILE_CACHE_SKETCH_DEPTH]uint64
+	for i := 0; i < FILE_CACHE_SKETCH_DEPTH; i++ {
+		res[i] = (h1 + uint64(i)*h2) % this.width
+	}
+	return res
+}
+
+// Count a read
+func (this *fileCacheSketch) Increment(key string) {
+	for i, pos := range this.locations(key) {
+		if this.rows[i][pos] < FILE_CACHE_SKETCH_MAX_COUNT {
+			this.rows[i][pos]++
+		}
+	}
+	this.additions++
+	if this.additions >= 10*this.width {
+		this._age()
+	}
+}
+
+// Estimated reads
+func (this *fileCacheSketch) Estimate(key string) byte {
+	var res byte = FILE_CACHE_SKETCH_MAX_COUNT
+	for i, pos := range this.locations(key) {
+		if this.rows[i][pos] < res {
+			res = this.rows[i][pos]
+		}
+	}
+	return res
+}
+
+// Halve all counters
+func (this *fileCacheSketch) _age() {
+	for i := range this.rows {
+		for pos := range this.rows[i] {
+			this.rows[i][pos] /= 2
+		}
+	}
+	this.additions /= 2
+}
+
+// New sketch of the counters per row
+func newFileCacheSketch(width uint64) *fileCacheSketch {
+	s := &fileCacheSketch{width: width}
+	for i := range s.rows {
+		s.rows[i] = make([]byte, width)
+	}
+	return s
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+)
+
+// Test that files only evict files that were read less often
+func TestFileCacheAdmission(t *testing.T) {
+	c := newFileCache(100, 10)
+	put := func(key string) {
+		since := c.Seq()
+		if c.Get(key) == nil {
+			c.Put(key, key, &FileReadResult{Data: make([]byte, 40)}, since)
+		}
+	}
+
+	// Hot files fill the cache
+	for i := 0; i < 3; i++ {
+		put("hot1")
+		put("hot2")
+	}
+	if c.Get("hot1") == nil || c.Get("hot2") == nil {
+		t.Fatal("Expected hot files in cache")
+	}
+
+	// Read once, not admitted
+	put("cold")
+	if c.Get("cold") != nil {
+		t.Error("Expected cold file not to evict hot files")
+	}
+
+	// Read more often than the least recently used, admitted
+	for i := 0; i < 10; i++ {
+		put("warm")
+	}
+	if c.Get("warm") == nil {
+		t.Error("Expected warm file to be admitted")
+	}
+	if c.Get("hot1") != nil && c.Get("hot2") != nil {
+		t.Error("Expected a hot file to be evicted")
+	}
+
+	status := c.Status()
+	if status.Entries != 2 || status.Bytes > status.Size || status.Rejections < 1 || status.Evictions != 1 || status.HitRate <= 0 {
+		t.Errorf("Unexpected status %v", status)
+	}
+
+	// Larger than the cache
+	c.Put("large", "large", &FileReadResult{Data: make([]byte, 200)}, c.Seq())
+	if c.Get("large") != nil {
+		t.Error("Expected file larger than the cache not to be admitted")
+	}
+}
+
+// Test that writes and deletes invalidate the contents
+func TestFileCacheInvalidate(t *testing.T) {
+	c := newFileCache(1024, 10)
+	res := &FileReadResult{Data: []byte("Hello"), VersionId: "v1"}
+	c.Put(fileCacheReadKey("/cache/a.txt", ""), "/cache/a.txt", res, c.Seq())
+	c.Put(fileCacheReadKey("/cache/a.txt", "v1"), "/cache/a.txt", res, c.Seq())
+	c.Put(fileCacheReadKey("/cache/b.txt", ""), "/cache/b.txt", res, c.Seq())
+
+	// Callers can not change the cached result
+	cached := c.Get(fileCacheReadKey("/cache/a.txt", ""))
+	if cached == nil || string(cached.Data) != "Hello" {
+		t.Fatal("Expected contents in cache")
+	}
+	cached.VersionId = "changed"
+	if c.Get(fileCacheReadKey("/cache/a.txt", "")).VersionId != "v1" {
+		t.Error("Expected cached result to be a copy")
+	}
+
+	// All versions of the name
+	since := c.Seq()
+	c.Invalidate("/cache/a.txt")
+	if c.Get(fileCacheReadKey("/cache/a.txt", "")) != nil || c.Get(fileCacheReadKey("/cache/a.txt", "v1")) != nil {
+		t.Error("Expected contents to be invalidated")
+	}
+	if c.Get(fileCacheReadKey("/cache/b.txt", "")) == nil {
+		t.Error("Expected other file to stay in cache")
+	}
+
+	// Read that started before the invalidation
+	c.Put(fileCacheReadKey("/cache/a.txt", ""), "/cache/a.txt", res, since)
+	if c.Get(fileCacheReadKey("/cache/a.txt", "")) != nil {
+		t.Error("Expected stale contents not to be cached")
+	}
+	if status := c.Status(); status.Invalidations != 2 || status.Entries != 1 {
+		t.Errorf("Unexpected status %v", status)
+	}
+
+	// Reads of other files are not affected
+	c.Put(fileCacheReadKey("/cache/c.txt", ""), "/cache/c.txt", res, since)
+	if c.Get(fileCacheReadKey("/cache/c.txt", "")) == nil {
+		t.Error("Expected other file read during the invalidation to be cached")
+	}
+}
+
+// Test that temporary files are not served from the cache after they expire
+func TestFileCacheExpires(t *testing.T) {
+	c := newFileCache(1024, 10)
+	now := unixTsUint32()
+	c.Put("live", "/cache/live.txt", &FileReadResult{Data: []byte("Live"), Expires: now + 60}, c.Seq())
+	c.Put("expired", "/cache/expired.txt", &FileReadResult{Data: []byte("Expired"), Expires: now}, c.Seq())
+	if c.Get("live") == nil {
+		t.Error("Expected file that did not expire in cache")
+	}
+	if c.Get("expired") != nil {
+		t.Error("Expected expired file not to be served")
+	}
+	if status := c.Status(); status.Entries != 1 {
+		t.Errorf("Unexpected status %v", status)
+	}
+}
+
+// Test that files read from disk are cached by the shard until overwritten
+func TestFileCacheShard(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	name := "/cache/shard.txt"
+	if _, err := shard.AddFile(newFileMeta(name), []byte("Cached")); err != nil {
+		t.Fatal(err)
+	}
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	shard.SetContents(nil)
+	shard.ResetLoaded()
+	if _, err := shard.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// From disk, then from cache
+	if data, err, fromMemory := shard.ReadFile(name); err != nil || fromMemory || string(data) != "Cached" {
+		t.Fatalf("Failed to read from disk: %s", err)
+	}
+	before := fileCache.Status()
+	if data, err, fromMemory := shard.ReadFile(name); err != nil || !fromMemory || string(data) != "Cached" {
+		t.Errorf("Failed to read from cache: %s", err)
+	}
+	if fileCache.Status().Hits != before.Hits+1 {
+		t.Error("Expected cache hit")
+	}
+
+	// Overwritten
+	if _, err := shard.AddFile(newFileMeta(name), []byte("Overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err, _ := shard.ReadFile(name); err != nil || string(data) != "Overwritten" {
+		t.Errorf("Expected overwritten contents, read %s (%v)", data, err)
+	}
+	if fileCache.Get(fileCacheShardKey(shard.IdStr(), shard.ShardFileMeta().GetByName(name))) != nil {
+		t.Error("Expected new version read from memory not to be cached")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"sync"
+)
+
+// Large files are split into chunks that are stored as regular files, the file itself only holds a manifest of its chunks
+
+// Prefix of the names of chunk files
+const FILE_CHUNK_PREFIX string = "/.xyzfs/chunks/"
+
+// Chunk of a large file
+type FileChunk struct {
+	FullName string // Name of the chunk file
+	Offset   uint64 // Position in the large file
+	Size     uint64
+	Checksum uint32 // Crc 32 (Castagnoli) of the chunk
+}
+
+// Manifest of a chunked file, stored as the contents of the file
+type FileChunkManifest struct {
+	Size      uint64 // Size of the large file
+	Checksum  uint32 // Crc 32 (Castagnoli) of the large file
+	ChunkSize uint32
+	Chunks    []*FileChunk
+}
+
+// Clients can not write or delete chunk files, that would damage the large files they belong to
+var errReservedFileName = errors.New(fmt.Sprintf("Names starting with %s are reserved for chunks of large files", FILE_CHUNK_PREFIX))
+
+// Is this the name of a chunk file?
+func isFileChunkName(fullName string) bool {
+	return strings.HasPrefix(fullName, FILE_CHUNK_PREFIX)
+}
+
+// Name of a chunk, unique per version of the large file
+func fileChunkName(fileId []byte, index int) string {
+	return fmt.Sprintf("%s%s/%d", FILE_CHUNK_PREFIX, uuidToString(fileId), index)
+}
+
+// Chunk size, never more than fits in a shard
+func fileChunkSize() uint32 {
+	if conf.FileChunkSize > conf.ShardSizeInBytes {
+		return uint32(conf.ShardSizeInBytes)
+	}
+	return uint32(conf.FileChunkSize)
+}
+
+// Split data into chunks, returns the manifest and the chunk bytes in the same order
+func newFileChunkManifest(fileId []byte, data []byte, chunkSize uint32) (*FileChunkManifest, [][]byte) {
+	m := &FileChunkManifest{
+		Size:      uint64(len(data)),
+		Checksum:  crc32.Checksum(data, crcTable),
+		ChunkSize: chunkSize,
+		Chunks:    make([]*FileChunk, 0),
+	}
+	parts := make([][]byte, 0)
+	for offset := uint64(0); offset < m.Size; offset += uint64(chunkSize) {
+		end := offset + uint64(chunkSize)
+		if end > m.Size {
+			end = m.Size
+		}
+		part := data[offset:end]
+		m.Chunks = append(m.Chunks, &FileChunk{
+			FullName: fileChunkName(fileId, len(m.Chunks)),
+			Offset:   offset,
+			Size:     end - offset,
+			Checksum: crc32.Checksum(part, crcTable),
+		})
+		parts = append(parts, part)
+	}
+	return m, parts
+}
+
+// To bytes
+func (this *FileChunkManifest) Bytes() []byte {
+	b, err := json.Marshal(this)
+	if err != nil {
+		panic("Failed to convert chunk manifest to JSON")
+	}
+	return b
+}
+
+// Validate that the chunks cover the file without gaps
+func (this *FileChunkManifest) Validate() error {
+	var offset uint64 = 0
+	for i, chunk := range this.Chunks {
+		if chunk.Offset != offset {
+			return errors.New(fmt.Sprintf("Chunk %d starts at %d, expected %d", i, chunk.Offset, offset))
+		}
+		if !isFileChunkName(chunk.FullName) {
+			return errors.New(fmt.Sprintf("Chunk %d has invalid name %s", i, chunk.FullName))
+		}
+		offset += chunk.Size
+	}
+	if offset != this.Size {
+		return errors.New(fmt.Sprintf("Chunks cover %d bytes, expected %d", offset, this.Size))
+	}
+	return nil
+}
+
+// Read chunks in parallel and reassemble the file
+func (this *FileChunkManifest) Assemble(read func(chunk *FileChunk) ([]byte, error), parallelism int) ([]byte, error) {
+	if err := this.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Read
+	data := make([]byte, this.Size)
+	err := parallelFor(len(this.Chunks), parallelism, func(i int) error {
+		chunk := this.Chunks[i]
+		b, err := read(chunk)
+		if err != nil {
+			return err
+		}
+		if uint64(len(b)) != chunk.Size {
+			return errors.New(fmt.Sprintf("Chunk %s has %d bytes, expected %d", chunk.FullName, len(b), chunk.Size))
+		}
+		if crc32.Checksum(b, crcTable) != chunk.Checksum {
+			return errors.New(fmt.Sprintf("CRC checksum mismatch of chunk %s", chunk.FullName))
+		}
+		copy(data[chunk.Offset:], b)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate CRC
+	if crc32.Checksum(data, crcTable) != this.Checksum {
+		return nil, errors.New("CRC checksum mismatch of reassembled file")
+	}
+	return data, nil
+}
+
+// From bytes
+func parseFileChunkManifest(b []byte) (*FileChunkManifest, error) {
+	m := &FileChunkManifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Run fn for 0..n-1 with at most parallelism at the same time, returns the first error
+func parallelFor(n int, parallelism int, fn func(i int) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	work := make(chan int, n)
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+
+	var errMux sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if err := fn(i); err != nil {
+					errMux.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMux.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
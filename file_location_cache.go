@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// Cache of the confirmed locations (shard and node) of the latest version of files, least recently used are evicted
+// a location is only cached when the name was not invalidated (written or deleted) since the read started, locations expire after the ttl
+// in case an invalidation from another node was lost
+
+type FileLocationCache struct {
+	mux     sync.Mutex
+	size    int
+	ttl     uint32 // Seconds, 0 = no expiry
+	entries map[string]*list.Element
+	lru     *list.List // Most recently used in front
+
+	// Invalidation sequence, reads that started before the last invalidation of a name do not fill the cache
+	seq        uint64
+	evictedSeq uint64 // Latest invalidation of the evicted names
+
+	// Stats
+	hits          uint64
+	misses        uint64
+	invalidations uint64
+}
+
+// Location of a file
+type FileLocation struct {
+	ShardId []byte
+	Node    string
+}
+
+// Cached name
+type fileLocationCacheEntry struct {
+	fullName    string
+	locations   []*FileLocation // Empty if invalidated
+	invalidated uint64          // Sequence of the last invalidation
+	cached      uint32          // Time the first location was cached
+}
+
+// File location cache status
+type FileLocationCacheStatus struct {
+	Entries       int
+	Size          int
+	Hits          uint64
+	Misses        uint64
+	Invalidations uint64
+}
+
+// Current invalidation sequence, to pass to Put after the read
+func (this *FileLocationCache) Seq() uint64 {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return this.seq
+}
+
+// Get locations of a file, nil if not cached
+func (this *FileLocationCache) Get(fullName string) []*FileLocation {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	elm := this.entries[fullName]
+	if elm == nil || len(elm.Value.(*fileLocationCacheEntry).locations) == 0 {
+		this.misses++
+		return nil
+	}
+	if entry := elm.Value.(*fileLocationCacheEntry); this.ttl > 0 && unixTsUint32()-entry.cached >= this.ttl {
+		entry.locations = nil
+		this.misses++
+		return nil
+	}
+	this.hits++
+	this.lru.MoveToFront(elm)
+	locations := elm.Value.(*fileLocationCacheEntry).locations
+	res := make([]*FileLocation, len(locations))
+	copy(res, locations)
+	return res
+}
+
+// Add location of a file that was read, ignored if the name was invalidated after the sequence
+func (this *FileLocationCache) Put(fullName string, location *FileLocation, since uint64) {
+	if this.size < 1 {
+		return
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	elm := this.entries[fullName]
+	if elm == nil {
+		if this.evictedSeq > since {
+			return
+		}
+		elm = this.lru.PushFront(&fileLocationCacheEntry{fullName: fullName})
+		this.entries[fullName] = elm
+		this._evict()
+	}
+	entry := elm.Value.(*fileLocationCacheEntry)
+	if entry.invalidated > since {
+		return
+	}
+	for _, l := range entry.locations {
+		if l.Node == location.Node && bytes.Equal(l.ShardId, location.ShardId) {
+			this.lru.MoveToFront(elm)
+			return
+		}
+	}
+	if len(entry.locations) == 0 {
+		entry.cached = unixTsUint32()
+	}
+	entry.locations = append(entry.locations, location)
+	this.lru.MoveToFront(elm)
+}
+
+// Invalidate a file (e.g. written or deleted), reads in progress will not cache it
+func (this *FileLocationCache) Invalidate(fullName string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.seq++
+	this.invalidations++
+	if this.size < 1 {
+		return
+	}
+	elm := this.entries[fullName]
+	if elm == nil {
+		elm = this.lru.PushFront(&fileLocationCacheEntry{fullName: fullName})
+		this.entries[fullName] = elm
+		this._evict()
+	}
+	entry := elm.Value.(*fileLocationCacheEntry)
+	entry.locations = nil
+	entry.invalidated = this.seq
+}
+
+// Invalidate the locations of a shard on a node (e.g. shard migrated away)
+func (this *FileLocationCache) InvalidateShard(node string, shardId []byte) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.seq++
+	for _, elm := range this.entries {
+		entry := elm.Value.(*fileLocationCacheEntry)
+		remaining := make([]*FileLocation, 0, len(entry.locations))
+		for _, l := range entry.locations {
+			if l.Node == node && bytes.Equal(l.ShardId, shardId) {
+				this.invalidations++
+				continue
+			}
+			remaining = append(remaining, l)
+		}
+		if len(remaining) != len(entry.locations) {
+			entry.locations = remaining
+			entry.invalidated = this.seq
+		}
+	}
+}
+
+// Evict least recently used beyond the size (caller must hold the lock)
+func (this *FileLocationCache) _evict() {
+	for this.lru.Len() > this.size {
+		elm := this.lru.Back()
+		entry := elm.Value.(*fileLocationCacheEntry)
+		if entry.invalidated > this.evictedSeq {
+			this.evictedSeq = entry.invalidated
+		}
+		this.lru.Remove(elm)
+		delete(this.entries, entry.fullName)
+	}
+}
+
+// Status
+func (this *FileLocationCache) Status() *FileLocationCacheStatus {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return &FileLocationCacheStatus{
+		Entries:       this.lru.Len(),
+		Size:          this.size,
+		Hits:          this.hits,
+		Misses:        this.misses,
+		Invalidations: this.invalidations,
+	}
+}
+
+// New cache of the number of names, locations expire after the ttl in seconds
+func newFileLocationCache(size int, ttl uint32) *FileLocationCache {
+	return &FileLocationCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
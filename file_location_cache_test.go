@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+)
+
+// Test least recently used eviction
+func TestFileLocationCache(t *testing.T) {
+	c := newFileLocationCache(2, 0)
+	shardId := randomUuid()
+	c.Put("a", &FileLocation{ShardId: shardId, Node: "localhost"}, c.Seq())
+	c.Put("b", &FileLocation{ShardId: shardId, Node: "localhost"}, c.Seq())
+	c.Put("b", &FileLocation{ShardId: shardId, Node: "localhost"}, c.Seq())
+	if len(c.Get("b")) != 1 {
+		t.Error("Expected single location of b")
+	}
+
+	// Touch a, then b is the least recently used
+	if c.Get("a") == nil {
+		t.Error("Expected a in cache")
+	}
+	c.Put("c", &FileLocation{ShardId: shardId, Node: "localhost"}, c.Seq())
+	if c.Get("b") != nil {
+		t.Error("Expected b to be evicted")
+	}
+	if c.Get("a") == nil || c.Get("c") == nil {
+		t.Error("Expected a and c in cache")
+	}
+
+	status := c.Status()
+	if status.Entries != 2 || status.Hits != 4 || status.Misses != 1 {
+		t.Errorf("Unexpected status %v", status)
+	}
+
+	// Shard migrated away
+	c.InvalidateShard("localhost", shardId)
+	if c.Get("a") != nil || c.Get("c") != nil {
+		t.Error("Expected locations of shard to be invalidated")
+	}
+}
+
+// Test that reads which started before a write or delete do not fill the cache
+func TestFileLocationCacheInvalidate(t *testing.T) {
+	c := newFileLocationCache(10, 0)
+	location := &FileLocation{ShardId: randomUuid(), Node: "localhost"}
+
+	// Invalidated during the read
+	since := c.Seq()
+	c.Invalidate("a")
+	c.Put("a", location, since)
+	if c.Get("a") != nil {
+		t.Error("Expected stale location not to be cached")
+	}
+
+	// Read after the invalidation
+	c.Put("a", location, c.Seq())
+	if c.Get("a") == nil {
+		t.Error("Expected location to be cached")
+	}
+	c.Invalidate("a")
+	if c.Get("a") != nil {
+		t.Error("Expected location to be invalidated")
+	}
+
+	// Tombstone evicted, stale reads are still rejected
+	since = c.Seq()
+	c.Invalidate("b")
+	for i := 0; i < 20; i++ {
+		c.Invalidate(uuidToString(randomUuid()))
+	}
+	c.Put("b", location, since)
+	if c.Get("b") != nil {
+		t.Error("Expected stale location of evicted name not to be cached")
+	}
+
+	// Disabled
+	d := newFileLocationCache(0, 0)
+	d.Put("a", location, d.Seq())
+	if d.Get("a") != nil {
+		t.Error("Expected disabled cache to be empty")
+	}
+}
+
+// Test that locations expire in case an invalidation was lost
+func TestFileLocationCacheTtl(t *testing.T) {
+	c := newFileLocationCache(10, 60)
+	c.Put("a", &FileLocation{ShardId: randomUuid(), Node: "localhost"}, c.Seq())
+	if c.Get("a") == nil {
+		t.Fatal("Expected location to be cached")
+	}
+	c.entries["a"].Value.(*fileLocationCacheEntry).cached -= 60
+	if c.Get("a") != nil {
+		t.Error("Expected location to expire")
+	}
+}
+
+// Test that writes and deletes invalidate the cached locations
+func TestFileLocationCacheShard(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	name := "/locator/cached.txt"
+	if _, err := shard.AddFile(newFileMeta(name), []byte("Cached")); err != nil {
+		t.Fatal(err)
+	}
+	datastore.fileLocator.CacheLocation(name, shard.Id, runtime.GetNode(), datastore.fileLocator.LocationCacheSeq())
+	if datastore.fileLocator.CachedLocations(name) == nil {
+		t.Fatal("Expected location to be cached")
+	}
+
+	// Overwrite
+	if _, err := shard.AddFile(newFileMeta(name), []byte("Overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	if datastore.fileLocator.CachedLocations(name) != nil {
+		t.Error("Expected location to be invalidated by write")
+	}
+
+	// Delete
+	datastore.fileLocator.CacheLocation(name, shard.Id, runtime.GetNode(), datastore.fileLocator.LocationCacheSeq())
+	if _, err := shard.DeleteFile(name); err != nil {
+		t.Fatal(err)
+	}
+	if datastore.fileLocator.CachedLocations(name) != nil {
+		t.Error("Expected location to be invalidated by delete")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"sync"
@@ -15,31 +16,95 @@ type FileLocator struct {
 	// Shard indices
 	remoteShardIndicesMux sync.RWMutex
 	remoteShardIndices    map[string]*ShardIndex
+
+	// Confirmed locations of files
+	locationCache *FileLocationCache
+
+	// Stats
+	statsMux       sync.RWMutex
+	locates        uint64
+	firstMatches   uint64
+	tests          uint64
+	positives      uint64
+	localNegatives uint64 // Local indices that did not match
+	falsePositives uint64 // Local indices that matched a file the shard does not hold
+}
+
+// File locator status
+type FileLocatorStatus struct {
+	Locates           uint64
+	FirstMatchLocates uint64
+	Tests             uint64
+	Positives         uint64
+	FalsePositives    uint64  // Observed on local shards, remote indices can not be verified
+	FalsePositiveRate float64 // Of the local shards
+	LocationCache     *FileLocationCacheStatus
 }
 
 // Locate
-// @todo Support first-match returns mode, for faster reads
 func (this *FileLocator) _locate(datastore *Datastore, fullName string) ([]*ShardIndex, uint32, error) {
+	return this._locateMode(datastore, fullName, false)
+}
+
+// Locate the first shard that holds the file: a local shard that holds any version, otherwise the first remote index that matches,
+// the caller has to check the version it reads (only the first shard with a specific version is the right one)
+func (this *FileLocator) _locateFirst(datastore *Datastore, fullName string) ([]*ShardIndex, uint32, error) {
+	return this._locateMode(datastore, fullName, true)
+}
+
+// Locate in all shards, or stop at the first match
+func (this *FileLocator) _locateMode(datastore *Datastore, fullName string, firstMatch bool) ([]*ShardIndex, uint32, error) {
 	// Result placeholder
 	var res []*ShardIndex = make([]*ShardIndex, 0)
 	var scanCount uint32 = 0
+	var localNegatives uint64 = 0
+	var falsePositives uint64 = 0
+
+	// Local shard matches, false positives are counted (not for shards with evicted file meta, the read finds out)
+	matchLocal := func(shard *Shard) bool {
+		scanCount++
+		if !shard.TestContainsFile(fullName) {
+			localNegatives++
+			return false
+		}
+		if !shard.IsFileMetaEvicted() && !shard.ShardFileMeta().HasName(fullName) {
+			falsePositives++
+			return false
+		}
+		res = append(res, shard.shardIndex)
+		return firstMatch
+	}
 
 	// @todo scan all local bloom filters (local shards + distributed shards) (this should cover 99.9% of traffic under regular operations, includes nodes down)
+	var found bool = false
 	if datastore != nil {
+	volumes:
 		for _, volume := range datastore.Volumes() {
+			// Failed volumes are being repaired
+			if !volume.IsReadable() {
+				continue
+			}
+
 			for _, shard := range volume.Shards() {
 				// No parity shards
 				if shard.Parity {
 					continue
 				}
 
-				// Keep track of scan count
-				scanCount++
-
 				// Test file
-				if shard.TestContainsFile(fullName) {
-					// Result found
-					res = append(res, shard.shardIndex)
+				if matchLocal(shard) {
+					found = true
+					break volumes
+				}
+			}
+		}
+
+		// Temporary shards
+		if !found {
+			for _, shard := range temporaryStore.Shards() {
+				if matchLocal(shard) {
+					found = true
+					break
 				}
 			}
 		}
@@ -51,15 +116,32 @@ func (this *FileLocator) _locate(datastore *Datastore, fullName string) ([]*Shar
 	// Scan registered bloom filters
 	this.remoteShardIndicesMux.RLock()
 	for _, idx := range this.remoteShardIndices {
+		if found {
+			break
+		}
+
 		// Is this file in here? Can give false positives
 		scanCount++
 		if idx.Test(fullName) {
 			// Result found
 			res = append(res, idx)
+			found = firstMatch
 		}
 	}
 	this.remoteShardIndicesMux.RUnlock()
 
+	// Stats
+	this.statsMux.Lock()
+	this.locates++
+	if firstMatch {
+		this.firstMatches++
+	}
+	this.tests += uint64(scanCount)
+	this.positives += uint64(len(res))
+	this.localNegatives += localNegatives
+	this.falsePositives += falsePositives
+	this.statsMux.Unlock()
+
 	// @todo IF NOT FOUND => convert name to murmur3 => determine primary bloomfilter index quorum, send RPC call, determine valid quorum (this step is done in order to prevent invalid data on a single node)
 
 	// Not found?
@@ -71,6 +153,76 @@ func (this *FileLocator) _locate(datastore *Datastore, fullName string) ([]*Shar
 	return res, scanCount, nil
 }
 
+// Status
+func (this *FileLocator) Status() *FileLocatorStatus {
+	this.statsMux.RLock()
+	defer this.statsMux.RUnlock()
+	s := &FileLocatorStatus{
+		Locates:           this.locates,
+		FirstMatchLocates: this.firstMatches,
+		Tests:             this.tests,
+		Positives:         this.positives,
+		FalsePositives:    this.falsePositives,
+		LocationCache:     this.locationCache.Status(),
+	}
+	if this.falsePositives+this.localNegatives > 0 {
+		s.FalsePositiveRate = float64(this.falsePositives) / float64(this.falsePositives+this.localNegatives)
+	}
+	return s
+}
+
+// Cached locations of the latest version of a file, nil if not cached
+func (this *FileLocator) CachedLocations(fullName string) []*FileLocation {
+	return this.locationCache.Get(fullName)
+}
+
+// Cache the location of the latest version of a file after a read that started at the sequence
+func (this *FileLocator) CacheLocation(fullName string, shardId []byte, node string, since uint64) {
+	this.locationCache.Put(fullName, &FileLocation{ShardId: shardId, Node: node}, since)
+}
+
+// Sequence of the location cache, to pass to CacheLocation
+func (this *FileLocator) LocationCacheSeq() uint64 {
+	return this.locationCache.Seq()
+}
+
+// Drop the cached locations of a file (e.g. written or deleted)
+func (this *FileLocator) InvalidateLocation(fullName string) {
+	this.locationCache.Invalidate(fullName)
+}
+
+// Get indices of all known shards of a block (local and remote, data and parity)
+func (this *FileLocator) BlockShardIndices(datastore *Datastore, blockId []byte) []*ShardIndex {
+	res := make([]*ShardIndex, 0)
+	seen := make(map[string]bool)
+
+	// Local shards
+	if datastore != nil {
+		for _, volume := range datastore.Volumes() {
+			for _, shard := range volume.Shards() {
+				if shard.Block() == nil || !bytes.Equal(shard.Block().Id, blockId) {
+					continue
+				}
+				shard._syncIndexBlockInfo()
+				res = append(res, shard.ShardIndex())
+				seen[shard.IdStr()] = true
+			}
+		}
+	}
+
+	// Remote shards
+	this.remoteShardIndicesMux.RLock()
+	for k, idx := range this.remoteShardIndices {
+		if seen[k] || !idx.HasBlockInfo() || !bytes.Equal(idx.BlockId, blockId) {
+			continue
+		}
+		res = append(res, idx)
+	}
+	this.remoteShardIndicesMux.RUnlock()
+
+	return res
+}
+
 // Load index
 func (this *FileLocator) LoadIndex(node string, shardId []byte, idx *ShardIndex) {
 	// Ignore local shards
@@ -96,6 +248,63 @@ func (this *FileLocator) LoadIndex(node string, shardId []byte, idx *ShardIndex)
 	this._addShardNodeMapping(shardId, node, false)
 }
 
+// Unload index of shard on node (e.g. shard has been migrated away)
+func (this *FileLocator) UnloadIndex(node string, shardId []byte) {
+	k := uuidToString(shardId)
+	log.Infof("Unloading shard index %s from %s from file locator", k, node)
+
+	// Cached locations
+	this.locationCache.InvalidateShard(node, shardId)
+
+	// Remove mapping
+	this.shardLocationsMux.Lock()
+	remaining := make([]*ShardLocation, 0)
+	var remoteRemaining bool = false
+	for _, l := range this.shardLocations[k] {
+		if l.Node == node {
+			continue
+		}
+		remaining = append(remaining, l)
+		if !l.Local {
+			remoteRemaining = true
+		}
+	}
+	if len(remaining) == 0 {
+		delete(this.shardLocations, k)
+	} else {
+		this.shardLocations[k] = remaining
+	}
+	this.shardLocationsMux.Unlock()
+
+	// No remote copies left? Then remove the index
+	if !remoteRemaining {
+		this.remoteShardIndicesMux.Lock()
+		delete(this.remoteShardIndices, k)
+		this.remoteShardIndicesMux.Unlock()
+	}
+}
+
+// Unload all shard indices of node (e.g. node removed from cluster)
+func (this *FileLocator) UnloadNode(node string) {
+	// Shards on this node
+	shardIds := make([][]byte, 0)
+	this.shardLocationsMux.RLock()
+	for k, locations := range this.shardLocations {
+		for _, l := range locations {
+			if l.Node == node {
+				shardIds = append(shardIds, uuidStringToBytes(k))
+				break
+			}
+		}
+	}
+	this.shardLocationsMux.RUnlock()
+
+	// Unload
+	for _, shardId := range shardIds {
+		this.UnloadIndex(node, shardId)
+	}
+}
+
 // Add shard=>node mapping
 func (this *FileLocator) _addShardNodeMapping(shardId []byte, node string, localShard bool) {
 	k := uuidToString(shardId)
@@ -136,6 +345,9 @@ func (this *FileLocator) ShardLocations() map[string][]*ShardLocation {
 			this._addShardNodeMapping(shard.Id, runtime.GetNode(), true)
 		}
 	}
+	for _, shard := range temporaryStore.Shards() {
+		this._addShardNodeMapping(shard.Id, runtime.GetNode(), true)
+	}
 
 	this.shardLocationsMux.RLock()
 	defer this.shardLocationsMux.RUnlock()
@@ -149,8 +361,15 @@ func (this *FileLocator) ShardLocationsByIdStr(shardId string) []*ShardLocation
 
 // New
 func newFileLocator() *FileLocator {
+	var cacheSize int = 0
+	var cacheTtl uint32 = 0
+	if conf != nil {
+		cacheSize = conf.FileLocationCacheSize
+		cacheTtl = conf.FileLocationCacheTtl
+	}
 	return &FileLocator{
 		remoteShardIndices: make(map[string]*ShardIndex),
 		shardLocations:     make(map[string][]*ShardLocation),
+		locationCache:      newFileLocationCache(cacheSize, cacheTtl),
 	}
 }
@@ -4,7 +4,16 @@ import (
 	"testing"
 )
 
+// Remove a node the test registered with gossip, known nodes that never said hello keep the cluster at the oldest format
+func forgetTestNode(node string) {
+	gossip.nodesMux.Lock()
+	delete(gossip.nodes, node)
+	gossip.nodesMux.Unlock()
+}
+
 func TestFileLocator(t *testing.T) {
+	defer forgetTestNode("localhost")
+
 	// Locator
 	l := newFileLocator()
 
@@ -60,3 +69,78 @@ func TestFileLocator(t *testing.T) {
 		log.Error("Found non-existing file")
 	}
 }
+
+// Test that the observed false positive rate of local shards is kept
+func TestFileLocatorStatus(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	if _, err := shard.AddFile(newFileMeta("/locator/status.txt"), []byte("Status")); err != nil {
+		t.Fatal(err)
+	}
+	before := datastore.fileLocator.Status()
+	if _, _, err := datastore.LocateFile("/locator/status.txt"); err != nil {
+		t.Fatal(err)
+	}
+	after := datastore.fileLocator.Status()
+	if after.Locates != before.Locates+1 || after.Tests <= before.Tests || after.Positives <= before.Positives {
+		t.Errorf("Unexpected status %v", after)
+	}
+	if after.FalsePositiveRate < 0 || after.FalsePositiveRate > conf.ShardIndexFalsePosRate*10 {
+		t.Errorf("Unexpected false positive rate %f", after.FalsePositiveRate)
+	}
+}
+
+// Test that shard indices of different types are located side by side
+func TestFileLocatorMixedTypes(t *testing.T) {
+	startApplication()
+	defer forgetTestNode("localhost")
+	l := newFileLocator()
+	remotes := make([]*ShardIndex, 0)
+	previousType := conf.ShardIndexType
+	for _, indexType := range []ShardIndexType{BloomShardIndexType, CountingShardIndexType} {
+		conf.ShardIndexType = indexType
+		idx := newShardIndex(randomUuid())
+		idx.Add("mixed.txt")
+
+		// As received from another node
+		remote := newShardIndex(randomUuid())
+		remote.FromBytes(idx.Bytes())
+		remotes = append(remotes, remote)
+	}
+	conf.ShardIndexType = previousType
+	for _, remote := range remotes {
+		l.LoadIndex("localhost", remote.ShardId, remote)
+	}
+	res, scanCount, err := l._locate(nil, "mixed.txt")
+	if err != nil || len(res) != 2 || scanCount != 2 {
+		t.Errorf("Expected 2 of 2 indices, found %d of %d (%v)", len(res), scanCount, err)
+	}
+	if res[0].Type() == res[1].Type() {
+		t.Error("Expected indices of both types")
+	}
+}
+
+// Test that the first-match mode stops at the first index that holds the file
+func TestFileLocatorFirstMatch(t *testing.T) {
+	defer forgetTestNode("localhost")
+	l := newFileLocator()
+	for i := 0; i < 3; i++ {
+		idx := newShardIndex(randomUuid())
+		idx.Add("first.txt")
+		l.LoadIndex("localhost", idx.ShardId, idx)
+	}
+	if res, _, err := l._locate(nil, "first.txt"); err != nil || len(res) != 3 {
+		t.Errorf("Expected 3 indices, found %d (%v)", len(res), err)
+	}
+	res, scanCount, err := l._locateFirst(nil, "first.txt")
+	if err != nil || len(res) != 1 || scanCount != 1 {
+		t.Errorf("Expected 1 index after 1 scan, found %d after %d (%v)", len(res), scanCount, err)
+	}
+	if _, _, err := l._locateFirst(nil, "other.txt"); err == nil {
+		t.Error("Expected missing file not to be found")
+	}
+	if l.Status().FirstMatchLocates != 2 {
+		t.Errorf("Unexpected status %v", l.Status())
+	}
+}
@@ -1,10 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 )
 
+// Test that sizes and offsets beyond 4 GB survive the binary format
+func TestFileMetaLargeSize(t *testing.T) {
+	f := newFileMeta("large.bin")
+	f.Size = 5 << 30
+	f.StartOffset = 6 << 30
+	f.Checksum = 123
+	f.Codec = GzipCompressionCodec
+	f.RawSize = 1 << 20
+	f2 := &FileMeta{}
+	f2.FromBytes(f.Bytes())
+	if f2.Size != f.Size || f2.StartOffset != f.StartOffset || f2.RawSize != f.RawSize || f2.Checksum != 123 || f2.Codec != GzipCompressionCodec {
+		t.Errorf("Large file meta mismatch %v", f2)
+	}
+
+	// Small sizes keep the 32-bit format
+	f.Size = 100
+	f.StartOffset = 200
+	f.RawSize = 300
+	f3 := &FileMeta{}
+	f3.FromBytes(f.Bytes())
+	if len(f.Bytes()) != len(f2.Bytes())-16 || f3.Size != 100 || f3.StartOffset != 200 || f3.RawSize != 300 {
+		t.Errorf("Small file meta mismatch %v", f3)
+	}
+}
+
 func TestNewFileHash(t *testing.T) {
 	f := newFileMeta("test.txt")
 	if fmt.Sprintf("%d", f.GetHash()) != "751898125953766072" {
@@ -38,3 +64,79 @@ func TestNewFileHash(t *testing.T) {
 		t.Error("Failed checksum")
 	}
 }
+
+func TestFileChunkManifest(t *testing.T) {
+	startApplication()
+
+	// Chunked flag survives serialisation
+	f := newFileMeta("large.bin")
+	f.Chunked = true
+	f2 := &FileMeta{}
+	f2.FromBytes(f.Bytes())
+	if !f2.Chunked {
+		t.Error("Failed chunked flag")
+	}
+
+	// Split
+	data := make([]byte, 5000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	manifest, parts := newFileChunkManifest(f.Id, data, 1024)
+	if len(manifest.Chunks) != 5 || len(parts) != 5 {
+		t.Fatalf("Expected 5 chunks, got %d", len(manifest.Chunks))
+	}
+	if manifest.Chunks[4].Size != 5000-4*1024 {
+		t.Errorf("Unexpected size of last chunk %d", manifest.Chunks[4].Size)
+	}
+	if !isFileChunkName(manifest.Chunks[0].FullName) {
+		t.Error("Chunk name must have chunk prefix")
+	}
+	if _, err := datastore.AddFileWithOptions(manifest.Chunks[0].FullName, parts[0], newFileWriteOptions()); err != errReservedFileName {
+		t.Errorf("Expected chunk name to be reserved, found %v", err)
+	}
+
+	// Manifest (de)serialisation
+	parsed, err := parseFileChunkManifest(manifest.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Size != 5000 || len(parsed.Chunks) != 5 {
+		t.Error("Failed manifest parse")
+	}
+
+	// Reassemble
+	byName := make(map[string][]byte)
+	for i, chunk := range manifest.Chunks {
+		byName[chunk.FullName] = parts[i]
+	}
+	read := func(chunk *FileChunk) ([]byte, error) {
+		return byName[chunk.FullName], nil
+	}
+	assembled, err := parsed.Assemble(read, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled, data) {
+		t.Error("Reassembled file does not match")
+	}
+
+	// Corrupt chunk
+	byName[manifest.Chunks[2].FullName] = make([]byte, manifest.Chunks[2].Size)
+	if _, err := parsed.Assemble(read, 3); err == nil {
+		t.Error("Corrupt chunk must fail reassembly")
+	}
+
+	// Gap in chunks
+	parsed.Chunks = append(parsed.Chunks[:1], parsed.Chunks[2:]...)
+	if _, err := parseFileChunkManifest(parsed.Bytes()); err == nil {
+		t.Error("Manifest with gap must be invalid")
+	}
+
+	// Files that never fit in a shard are refused instead of allocating blocks
+	large := newFileMeta("too-large.bin")
+	large.Size = uint64(conf.ShardSizeInBytes) + 1
+	if _, err := datastore.AllocateShardCapacity(large); err == nil {
+		t.Error("Allocation larger than a shard must fail")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+)
+
+// Versions of a file: every write is a new version, identified by the file id and ordered by a hybrid logical clock timestamp and the origin node (last writer wins)
+
+// Version of a file in a listing
+type FileVersion struct {
+	VersionId string
+	Timestamp uint64
+	Origin    string `json:",omitempty"`
+	Created   uint32
+	Size      uint64
+	Checksum  uint32
+	Expires   uint32 `json:",omitempty"`
+	Chunked   bool   `json:",omitempty"`
+	Latest    bool
+	Shards    []string // Shards that hold this version
+}
+
+// Next write timestamp, from the hybrid logical clock of this node
+func nextFileTimestamp() uint64 {
+	return hlc.Now()
+}
+
+// Versions sorted newest first
+type FileVersions []*FileVersion
+
+func (a FileVersions) Len() int      { return len(a) }
+func (a FileVersions) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a FileVersions) Less(i, j int) bool {
+	return compareFileVersions(a[i].Timestamp, a[i].Origin, a[i].Created, []byte(a[i].VersionId), a[j].Timestamp, a[j].Origin, a[j].Created, []byte(a[j].VersionId)) > 0
+}
+
+// Order of two versions (1 = a is newer, -1 = b is newer), the same on every node: timestamp, then origin node, then creation (files written before versioning), then id
+func compareFileVersions(aTs uint64, aOrigin string, aCreated uint32, aId []byte, bTs uint64, bOrigin string, bCreated uint32, bId []byte) int {
+	if aTs != bTs {
+		if aTs > bTs {
+			return 1
+		}
+		return -1
+	}
+	if aOrigin != bOrigin {
+		if aOrigin > bOrigin {
+			return 1
+		}
+		return -1
+	}
+	if aCreated != bCreated {
+		if aCreated > bCreated {
+			return 1
+		}
+		return -1
+	}
+	return bytes.Compare(aId, bId)
+}
+
+// New version from meta
+func newFileVersion(meta *FileMeta) *FileVersion {
+	return &FileVersion{
+		VersionId: meta.VersionId(),
+		Timestamp: meta.Timestamp,
+		Origin:    meta.Origin,
+		Created:   meta.Created,
+		Size:      meta.Size,
+		Checksum:  meta.Checksum,
+		Expires:   meta.Expires,
+		Chunked:   meta.Chunked,
+		Shards:    make([]string, 0),
+	}
+}
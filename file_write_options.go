@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Options of a single upload
+
+type FileWriteOptions struct {
+	Temporary bool   // Memory only (temporary tier)
+	TTL       uint32 // Seconds until the file expires, 0 = never
+	Expires   uint32 // Unix timestamp at which the file expires, takes precedence over the TTL
+
+	// Compression at rest, applied when it helps
+	Compression CompressionCodec
+}
+
+// Apply to the meta of a new file
+func (this *FileWriteOptions) Apply(fileMeta *FileMeta) {
+	fileMeta.Temporary = this.Temporary
+	if this.Expires > 0 {
+		fileMeta.Expires = this.Expires
+	} else if this.TTL > 0 {
+		fileMeta.Expires = fileMeta.Created + this.TTL
+	}
+}
+
+// Validate and fill in defaults
+func (this *FileWriteOptions) Validate() error {
+	now := unixTsUint32()
+	if this.Expires > 0 && this.Expires <= now {
+		return errors.New("The 'expires' timestamp must be in the future")
+	}
+	if !this.Temporary {
+		return nil
+	}
+
+	// Temporary files always expire
+	if this.TTL == 0 && this.Expires == 0 {
+		this.TTL = conf.TemporaryDefaultTTL
+	}
+	if this.TTL > conf.TemporaryMaxTTL || (this.Expires > 0 && this.Expires-now > conf.TemporaryMaxTTL) {
+		return errors.New(fmt.Sprintf("Temporary files can not live longer than %d seconds", conf.TemporaryMaxTTL))
+	}
+	return nil
+}
+
+// Read from query parameters (e.g. ?temporary=1&ttl=300, ?expires=1500000000 or ?compression=zstd)
+func parseFileWriteOptions(query url.Values) (*FileWriteOptions, error) {
+	opts := newFileWriteOptions()
+	if v := strings.TrimSpace(query.Get("temporary")); len(v) > 0 {
+		temporary, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.New("Invalid value for 'temporary', expected 1 or 0")
+		}
+		opts.Temporary = temporary
+	}
+	if v := strings.TrimSpace(query.Get("ttl")); len(v) > 0 {
+		ttl, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, errors.New("Invalid value for 'ttl', expected seconds")
+		}
+		opts.TTL = uint32(ttl)
+	}
+	if v := strings.TrimSpace(query.Get("expires")); len(v) > 0 {
+		expires, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, errors.New("Invalid value for 'expires', expected unix timestamp")
+		}
+		opts.Expires = uint32(expires)
+	}
+	if v := strings.TrimSpace(query.Get("compression")); len(v) > 0 {
+		codec, err := parseCompressionCodec(v)
+		if err != nil {
+			return nil, err
+		}
+		opts.Compression = codec
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func newFileWriteOptions() *FileWriteOptions {
+	return &FileWriteOptions{
+		Compression: conf.Compression,
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+// Format negotiation for rolling upgrades: nodes announce the newest shard and transport format they support in the gossip hello,
+// shards and messages that other nodes read are written in the newest format that all nodes support
+
+// Format of nodes that do not announce one
+const MIN_FORMAT_VERSION uint32 = 1
+
+// Format of a node, the oldest if it did not say hello yet
+func nodeFormatVersion(node string) uint32 {
+	if gossip == nil {
+		return MIN_FORMAT_VERSION
+	}
+	gossip.nodesMux.RLock()
+	state := gossip.nodes[node]
+	gossip.nodesMux.RUnlock()
+	if state == nil || state.GetFormatVersion() < MIN_FORMAT_VERSION {
+		return MIN_FORMAT_VERSION
+	}
+	return state.GetFormatVersion()
+}
+
+// Newest format supported by this node and all nodes it knows, the oldest until all of them said hello (e.g. right after start)
+func clusterFormatVersion() uint32 {
+	v := BINARY_VERSION
+	if gossip == nil {
+		return v
+	}
+	gossip.nodesMux.RLock()
+	defer gossip.nodesMux.RUnlock()
+	for _, state := range gossip.nodes {
+		if state.GetLastHelloReceived() == 0 {
+			return MIN_FORMAT_VERSION
+		}
+		if nv := state.GetFormatVersion(); nv < v {
+			v = nv
+		}
+	}
+	if v < MIN_FORMAT_VERSION {
+		return MIN_FORMAT_VERSION
+	}
+	return v
+}
+
+// Largest size or offset in the cluster format, 32-bit until all nodes support 64-bit sizes
+func clusterMaxSize() uint64 {
+	if clusterFormatVersion() < BINARY_LARGE_VERSION {
+		return uint64(FILE_META_EXTENDED_SIZE) - 1
+	}
+	return ^uint64(0)
+}
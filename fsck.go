@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Offline consistency check of the blocks and shards of a volume (e.g. after a crash), the node must not be running
+
+// Folder in a volume for shards taken out by a repair, the node recovers them from other nodes
+const FSCK_QUARANTINE_FOLDER string = "quarantine"
+
+type Fsck struct {
+	path   string
+	repair bool
+	report *FsckReport
+}
+
+// Result of a check
+type FsckReport struct {
+	Path        string
+	Repair      bool
+	Volumes     int
+	Blocks      int
+	Shards      int
+	Files       int
+	Problems    []*FsckProblem
+	Truncated   int
+	Quarantined int
+}
+
+// Problem found
+type FsckProblem struct {
+	Path   string
+	Kind   string // footer, tail, load, key, offset, crc, bloom, nameindex, manifest, missing or orphan
+	Detail string
+	Repair string `json:",omitempty"` // Action taken
+}
+
+// Is the volume consistent?
+func (this *FsckReport) OK() bool {
+	return len(this.Problems) == 0
+}
+
+// Check volumes in the path, either a volume folder (v_UUID) or the folder that holds them
+func (this *Fsck) Run() (*FsckReport, error) {
+	fi, err := os.Stat(this.path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New(fmt.Sprintf("%s is not a folder", this.path))
+	}
+
+	// Volume folders
+	volumePaths := make([]string, 0)
+	if _, ok := fsckParseId(filepath.Base(this.path), "v_"); ok {
+		volumePaths = append(volumePaths, this.path)
+	} else {
+		list, err := ioutil.ReadDir(this.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, elm := range list {
+			if _, ok := fsckParseId(elm.Name(), "v_"); ok && elm.IsDir() {
+				volumePaths = append(volumePaths, filepath.Join(this.path, elm.Name()))
+			}
+		}
+	}
+	if len(volumePaths) == 0 {
+		return nil, errors.New(fmt.Sprintf("No volume found in %s", this.path))
+	}
+
+	for _, volumePath := range volumePaths {
+		if err := this._checkVolume(volumePath); err != nil {
+			return nil, err
+		}
+	}
+	return this.report, nil
+}
+
+// Check blocks of a volume
+func (this *Fsck) _checkVolume(volumePath string) error {
+	this.report.Volumes++
+	id, _ := fsckParseId(filepath.Base(volumePath), "v_")
+	volume := newVolume()
+	volume.Id = id
+	volume.Path = filepath.Dir(volumePath)
+
+	list, err := ioutil.ReadDir(volumePath)
+	if err != nil {
+		return err
+	}
+	for _, elm := range list {
+		if elm.Name() == FSCK_QUARANTINE_FOLDER {
+			continue
+		}
+		blockId, ok := fsckParseId(elm.Name(), "b_")
+		if !ok || !elm.IsDir() {
+			this._problem(filepath.Join(volumePath, elm.Name()), "orphan", "Not a block folder")
+			continue
+		}
+		this._checkBlock(newBlockFromId(volume, blockId))
+	}
+	return nil
+}
+
+// Check shards of a block against its manifest
+func (this *Fsck) _checkBlock(block *Block) {
+	this.report.Blocks++
+
+	// Manifest, blocks written before there was one have none
+	manifest, err := block.readManifest()
+	if err != nil && !os.IsNotExist(err) {
+		this._problem(block.ManifestPath(), "manifest", fmt.Sprintf("%s", err))
+	}
+
+	list, err := ioutil.ReadDir(block.FullPath())
+	if err != nil {
+		this._problem(block.FullPath(), "orphan", fmt.Sprintf("Unable to list block folder: %s", err))
+		return
+	}
+	found := make(map[string]bool)
+	for _, elm := range list {
+		if elm.Name() == BLOCK_MANIFEST_FILENAME {
+			continue
+		}
+		path := filepath.Join(block.FullPath(), elm.Name())
+
+		// Must be in format s_UUID(.parity).data
+		name := strings.TrimSuffix(elm.Name(), ".data")
+		parity := strings.HasSuffix(name, ".parity")
+		shardId, ok := fsckParseId(strings.TrimSuffix(name, ".parity"), "s_")
+		if !ok || !strings.HasSuffix(elm.Name(), ".data") || elm.IsDir() {
+			this._problem(path, "orphan", "Not a shard file (e.g. left behind by an interrupted write)")
+			continue
+		}
+		if manifest != nil && manifest.Shard(uuidToString(shardId)) == nil {
+			this._problem(path, "orphan", "Shard not in block manifest")
+		}
+		found[uuidToString(shardId)] = true
+
+		shard := newShardFromId(block, shardId)
+		shard.Parity = parity
+		this._checkShard(shard)
+	}
+
+	// Local shards of the manifest that are gone
+	if manifest != nil {
+		for _, s := range manifest.Shards {
+			if s.Local && !found[s.Id] {
+				this._problem(block.ManifestPath(), "missing", fmt.Sprintf("Shard %s is local according to the manifest, but not on disk", s.Id))
+			}
+		}
+	}
+	if len(found) == 0 {
+		this._problem(block.FullPath(), "orphan", "Block folder without shards")
+	}
+}
+
+// Check a shard file: footer, sections, contents of every file and the index
+func (this *Fsck) _checkShard(shard *Shard) {
+	this.report.Shards++
+	path := shard.FullPath()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		this._problem(path, "footer", fmt.Sprintf("Unable to read: %s", err))
+		return
+	}
+
+	// Footer, a torn tail can leave bytes behind the last complete footer
+	meta, err := parseShardMetaFooter(b)
+	if err != nil {
+		end := fsckFindFooter(b)
+		if end < 0 {
+			this._quarantine(shard, this._problem(path, "footer", fmt.Sprintf("%s, no complete footer found", err)))
+			return
+		}
+		p := this._problem(path, "tail", fmt.Sprintf("%d bytes after the last complete footer (%s)", len(b)-end, err))
+		if this.repair {
+			if err := os.Truncate(path, int64(end)); err != nil {
+				p.Repair = fmt.Sprintf("Failed to truncate: %s", err)
+				return
+			}
+			p.Repair = fmt.Sprintf("Truncated to %d bytes", end)
+			this.report.Truncated++
+		}
+		b = b[:end]
+		meta, _ = parseShardMetaFooter(b)
+	}
+
+	// Encrypted shards need the master key
+	if meta.KeyLength > 0 {
+		if !keyring.Enabled() {
+			this._problem(path, "key", "Shard is encrypted, enable encryption with the keyfile to check the file meta and index")
+			return
+		}
+		keyOffset := len(b) - int(meta.Length()) - int(meta.KeyLength)
+		if _, err := keyring.ImportBlockKey(shard.Block().Id, b[keyOffset:keyOffset+int(meta.KeyLength)]); err != nil {
+			this._problem(path, "key", fmt.Sprintf("Unable to unwrap data key: %s", err))
+			return
+		}
+	}
+
+	// Sections
+	if _, err := shard._fromBinaryReader(bytes.NewReader(b), int64(len(b))); err != nil {
+		this._quarantine(shard, this._problem(path, "load", fmt.Sprintf("%s", err)))
+		return
+	}
+
+	// Name index of the file meta (version 2 and up)
+	var fileMetaBytes []byte = nil
+	if meta.MetaVersion >= 2 {
+		fileMetaBytes = b[meta.ContentsLength : meta.ContentsLength+meta.FileMetaLength]
+		if meta.KeyLength > 0 {
+			fileMetaBytes, _ = shard._blockKey().Open(fileMetaBytes, SHARD_FILE_META_SECTION)
+		}
+	}
+
+	// Files, parity shards only keep copies of the meta of the data shards
+	var bad *FsckProblem = nil
+	for _, f := range shard.shardFileMeta.FileMeta {
+		this.report.Files++
+		if fileMetaBytes != nil && !fsckInNameIndex(fileMetaBytes, f) {
+			bad = this._problem(path, "nameindex", fmt.Sprintf("File %s (%s) not found by the name index of the file meta", f.FullName, f.VersionId()))
+		}
+		if shard.Parity {
+			continue
+		}
+		if f.StartOffset+f.Size > meta.ContentsLength {
+			bad = this._problem(path, "offset", fmt.Sprintf("File %s (%s) at offset %d with size %d exceeds contents of %d bytes", f.FullName, f.VersionId(), f.StartOffset, f.Size, meta.ContentsLength))
+			continue
+		}
+		if crc := crc32.Checksum(b[f.StartOffset:f.StartOffset+f.Size], crcTable); crc != f.Checksum {
+			bad = this._problem(path, "crc", fmt.Sprintf("File %s (%s) has checksum %d, expected %d", f.FullName, f.VersionId(), crc, f.Checksum))
+		}
+		if !f.Deleted && !shard.shardIndex.Test(f.FullName) {
+			bad = this._problem(path, "bloom", fmt.Sprintf("File %s not in index, it can not be located", f.FullName))
+		}
+	}
+	if bad != nil {
+		this._quarantine(shard, bad)
+	}
+}
+
+// Register problem
+func (this *Fsck) _problem(path string, kind string, detail string) *FsckProblem {
+	p := &FsckProblem{
+		Path:   path,
+		Kind:   kind,
+		Detail: detail,
+	}
+	this.report.Problems = append(this.report.Problems, p)
+	return p
+}
+
+// Move a bad shard out of its block, on start the node treats it as lost and repairs it from the other nodes
+func (this *Fsck) _quarantine(shard *Shard, p *FsckProblem) {
+	if !this.repair {
+		return
+	}
+	folder := filepath.Join(shard.Block().Volume().FullPath(), FSCK_QUARANTINE_FOLDER)
+	if err := os.MkdirAll(folder, conf.UnixFolderPermissions); err != nil {
+		p.Repair = fmt.Sprintf("Failed to quarantine: %s", err)
+		return
+	}
+	target := filepath.Join(folder, fmt.Sprintf("b_%s_%s", shard.Block().IdStr(), filepath.Base(shard.FullPath())))
+	if err := os.Rename(shard.FullPath(), target); err != nil {
+		p.Repair = fmt.Sprintf("Failed to quarantine: %s", err)
+		return
+	}
+	p.Repair = fmt.Sprintf("Moved to %s", target)
+	this.report.Quarantined++
+}
+
+// Can the file be found by the name index of the file meta bytes?
+func fsckInNameIndex(b []byte, f *FileMeta) bool {
+	list, err := lookupShardFileMeta(b, f.FullName)
+	if err != nil {
+		return false
+	}
+	for _, elm := range list {
+		if elm.VersionId() == f.VersionId() && elm.DataShardIndex == f.DataShardIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate the footer of the bytes of a shard file
+func parseShardMetaFooter(b []byte) (*ShardMeta, error) {
+	return readShardMeta(bytes.NewReader(b), int64(len(b)))
+}
+
+// Length of the bytes up to the last complete footer, -1 if there is none
+func fsckFindFooter(b []byte) int {
+	for end := len(b) - 4; end >= int(BINARY_METADATA_LENGTH); end-- {
+		metadataLength := binary.BigEndian.Uint32(b[end-4 : end])
+		if !isShardMetaLength(metadataLength) {
+			continue
+		}
+		if _, err := parseShardMetaFooter(b[:end]); err == nil {
+			return end
+		}
+	}
+	return -1
+}
+
+// Id from a folder or file name with a prefix (e.g. b_UUID)
+func fsckParseId(name string, prefix string) ([]byte, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return nil, false
+	}
+	id := uuidStringToBytes(strings.TrimPrefix(name, prefix))
+	return id, len(id) == 16
+}
+
+// Command: xyzfs fsck --volume <path> [--repair] [--json]
+func runFsckCommand(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	path := fs.String("volume", "", "Volume folder (v_UUID) or the folder that holds the volumes")
+	repair := fs.Bool("repair", false, "Truncate torn tails and quarantine bad shards")
+	asJson := fs.Bool("json", false, "Print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if len(*path) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: xyzfs fsck --volume <path> [--repair] [--json]")
+		return 2
+	}
+
+	report, err := newFsck(*path, *repair).Run()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %s\n", err)
+		return 2
+	}
+
+	if *asJson {
+		printCommandJson(report)
+	} else {
+		for _, p := range report.Problems {
+			fmt.Printf("%s\t%s\t%s", p.Kind, p.Path, p.Detail)
+			if len(p.Repair) > 0 {
+				fmt.Printf("\t%s", p.Repair)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("Checked %d volume(s), %d block(s), %d shard(s), %d file(s): %d problem(s), %d truncated, %d quarantined\n", report.Volumes, report.Blocks, report.Shards, report.Files, len(report.Problems), report.Truncated, report.Quarantined)
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+func newFsck(path string, repair bool) *Fsck {
+	return &Fsck{
+		path:   path,
+		repair: repair,
+		report: &FsckReport{
+			Path:     path,
+			Repair:   repair,
+			Problems: make([]*FsckProblem, 0),
+		},
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test offline check and repair of a volume
+func TestFsck(t *testing.T) {
+	startApplication()
+
+	// Volume of its own
+	tmp, err := ioutil.TempDir("", "xyzfs-fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	volume := newVolume()
+	volume.Id = randomUuid()
+	volume.Path = tmp
+	b := newBlock(volume)
+	b.initShards()
+	torn := b.DataShards[0]
+	corrupt := b.DataShards[1]
+	truncated := b.DataShards[2]
+	for i, shard := range []*Shard{torn, corrupt, truncated} {
+		if _, err := shard.AddFile(newFileMeta(fmt.Sprintf("/fsck/%d.txt", i)), []byte("Contents checked by fsck")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !b.Persist() {
+		t.Fatal("Failed to persist block")
+	}
+
+	// Clean
+	report, err := newFsck(volume.FullPath(), false).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Blocks != 1 || report.Shards != b.ShardCount() || report.Files < 3 {
+		t.Fatalf("Expected clean volume, got %v problem(s) %v", report, report.Problems)
+	}
+
+	// Damage: torn tail, flipped byte in contents, truncated footer, stray file
+	appendFile(t, torn.FullPath(), []byte("half written"))
+	contents, _ := ioutil.ReadFile(corrupt.FullPath())
+	contents[0] ^= 0xFF
+	ioutil.WriteFile(corrupt.FullPath(), contents, conf.UnixFilePermissions)
+	contents, _ = ioutil.ReadFile(truncated.FullPath())
+	ioutil.WriteFile(truncated.FullPath(), contents[:len(contents)-10], conf.UnixFilePermissions)
+	ioutil.WriteFile(filepath.Join(volume.FullPath(), "stray.tmp"), []byte("?"), conf.UnixFilePermissions)
+
+	// Loading a damaged shard fails without panic
+	truncated.ResetLoaded()
+	if _, err := truncated.Load(); err == nil {
+		t.Error("Expected load of truncated shard to fail")
+	}
+
+	// Check
+	kinds := func(report *FsckReport) map[string]int {
+		m := make(map[string]int)
+		for _, p := range report.Problems {
+			m[p.Kind]++
+		}
+		return m
+	}
+	report, _ = newFsck(volume.FullPath(), false).Run()
+	found := kinds(report)
+	if found["tail"] != 1 || found["crc"] != 1 || found["footer"] != 1 || found["orphan"] != 1 {
+		t.Errorf("Unexpected problems %v", found)
+	}
+	if report.Truncated != 0 || report.Quarantined != 0 {
+		t.Error("Must not repair without repair option")
+	}
+
+	// Repair
+	report, _ = newFsck(volume.FullPath(), true).Run()
+	if report.Truncated != 1 || report.Quarantined != 2 {
+		t.Errorf("Expected 1 truncated and 2 quarantined shards, got %d and %d", report.Truncated, report.Quarantined)
+	}
+	if _, err := os.Stat(corrupt.FullPath()); !os.IsNotExist(err) {
+		t.Error("Expected corrupt shard to be quarantined")
+	}
+	torn.ResetLoaded()
+	if _, err := torn.Load(); err != nil {
+		t.Errorf("Expected truncated shard to load: %s", err)
+	}
+
+	// Only the missing shards and the stray file remain
+	report, _ = newFsck(volume.FullPath(), false).Run()
+	found = kinds(report)
+	if len(found) != 2 || found["missing"] != 2 || found["orphan"] != 1 {
+		t.Errorf("Unexpected problems after repair %v", found)
+	}
+}
+
+// Append bytes to a file
+func appendFile(t *testing.T, path string, b []byte) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(b)
+}
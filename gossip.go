@@ -15,6 +15,9 @@ type Gossip struct {
 
 	nodesMux sync.RWMutex
 	nodes    map[string]*GossipNodeState
+
+	// Nodes that have been removed from the cluster (node => unix timestamp), ignored until the forget TTL passes
+	forgotten map[string]uint32
 }
 
 // Discover seeds
@@ -56,6 +59,12 @@ func (this *Gossip) GetNodeState(node string) *GossipNodeState {
 
 	// Existing node?
 	if s == nil {
+		// Forgotten nodes are ignored, their state is not kept
+		if this.IsForgotten(node) {
+			log.Debugf("Ignoring forgotten node %s", node)
+			return newGossipNodeState(node)
+		}
+
 		// New node
 		this.nodesMux.Lock()
 		this.nodes[node] = newGossipNodeState(node)
@@ -74,6 +83,7 @@ func newGossip() *Gossip {
 	g := &Gossip{
 		transport: newNetworkTransport("tcp", "gossip", conf.GossipPort, conf.GossipTransportReadBuffer, conf.GossipTransportNumStreams, false),
 		nodes:     make(map[string]*GossipNodeState),
+		forgotten: make(map[string]uint32),
 	}
 
 	// Message
@@ -92,6 +102,16 @@ func newGossip() *Gossip {
 			g._receiveNodeList(cmeta, msg)
 			break
 
+			// Mode change for this node (e.g. draining)
+		case NodeStateGossipMessageType:
+			g._receiveNodeMode(cmeta, msg)
+			break
+
+			// Node removed from the cluster
+		case ForgetNodeGossipMessageType:
+			g._receiveForgetNode(cmeta, msg)
+			break
+
 			// Unknown
 		default:
 			log.Warnf("Received unknown message %v", msg)
@@ -0,0 +1,55 @@
+package main
+
+// Forget node: removes a node from the gossip state, the persisted node list and the file locator
+
+// Forget node, returns true if the node was known
+func (this *Gossip) ForgetNode(node string) bool {
+	log.Infof("Forgetting node %s", node)
+
+	// Remove from state
+	this.nodesMux.Lock()
+	_, found := this.nodes[node]
+	delete(this.nodes, node)
+	this.forgotten[node] = unixTsUint32()
+	this.nodesMux.Unlock()
+
+	// Close connections
+	this.transport._closeConnections(node)
+	binaryTransport.transport._closeConnections(node)
+
+	// Shards on this node are no longer available
+	datastore.fileLocator.UnloadNode(node)
+
+	// Keep list on local disk
+	this.PersistNodesToDisk()
+
+	return found
+}
+
+// Was the node forgotten within the forget TTL?
+func (this *Gossip) IsForgotten(node string) bool {
+	this.nodesMux.RLock()
+	defer this.nodesMux.RUnlock()
+	return this._isForgotten(node, unixTsUint32())
+}
+
+// Was the node forgotten within the forget TTL? (caller must hold the lock)
+func (this *Gossip) _isForgotten(node string, now uint32) bool {
+	ts := this.forgotten[node]
+	return ts > 0 && now-ts < conf.GossipForgetTtl
+}
+
+// Tell all other nodes to forget node
+func (this *Gossip) _broadcastForgetNode(node string) {
+	msg := newGossipMessage(ForgetNodeGossipMessageType, []byte(node))
+	for _, ns := range this.GetNodeStates() {
+		go this._send(ns.Node, msg)
+	}
+}
+
+// Receive forget node
+func (this *Gossip) _receiveForgetNode(cmeta *TransportConnectionMeta, msg *GossipMessage) {
+	node := string(msg.Data)
+	log.Infof("Received forget node %s from %s", node, cmeta.GetNode())
+	this.ForgetNode(node)
+}
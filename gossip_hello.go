@@ -1,11 +1,26 @@
 package main
 
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Hello data: runtime id (string, 36 bytes) - mode (uint32) - mode until (uint32) - clock (uint64) - format version (uint32)
+// nodes of older versions only send the runtime id, or no clock or format version
+
 // Send hello message to node
 func (this *Gossip) _sendHello(node string) error {
 	// log.Infof("Gossip to %s", node)
 
-	// Create message with the runtime ID
-	msg := newGossipMessage(HelloGossipMessageType, []byte(runtime.Id))
+	// Create message with the runtime ID and mode
+	buf := new(bytes.Buffer)
+	buf.Write([]byte(runtime.Id))
+	mode, modeUntil := runtime.GetMode()
+	binary.Write(buf, binary.BigEndian, uint32(mode))
+	binary.Write(buf, binary.BigEndian, modeUntil)
+	binary.Write(buf, binary.BigEndian, hlc.Now())
+	binary.Write(buf, binary.BigEndian, BINARY_VERSION)
+	msg := newGossipMessage(HelloGossipMessageType, buf.Bytes())
 
 	// Send
 	_, err := this._send(node, msg)
@@ -26,6 +41,25 @@ func (this *Gossip) _receiveHello(cmeta *TransportConnectionMeta, msg *GossipMes
 
 	// Hello runtime ID
 	remoteRuntimeId := string(msg.Data)
+	var remoteMode uint32
+	var remoteModeUntil uint32
+	var remoteClock uint64
+	var remoteFormatVersion uint32 = MIN_FORMAT_VERSION
+	if len(msg.Data) > 36 {
+		remoteRuntimeId = string(msg.Data[0:36])
+		buf := bytes.NewReader(msg.Data[36:])
+		binary.Read(buf, binary.BigEndian, &remoteMode)
+		binary.Read(buf, binary.BigEndian, &remoteModeUntil)
+		if buf.Len() >= 8 {
+			binary.Read(buf, binary.BigEndian, &remoteClock)
+		}
+		if buf.Len() >= 4 {
+			binary.Read(buf, binary.BigEndian, &remoteFormatVersion)
+		}
+	}
+
+	// Clock
+	hlc.Update(remoteClock)
 
 	// State
 	state := this.GetNodeState(cmeta.GetNode())
@@ -33,6 +67,12 @@ func (this *Gossip) _receiveHello(cmeta *TransportConnectionMeta, msg *GossipMes
 	// Runtime
 	state.SetRuntimeId(remoteRuntimeId)
 
+	// Mode
+	state.SetMode(GossipNodeMode(remoteMode), remoteModeUntil)
+
+	// Formats
+	state.SetFormatVersion(remoteFormatVersion)
+
 	// Ignore messages from ourselves
 	// if remoteRuntimeId == runtime.Id {
 	// 	runtime.SetNode(cmeta.GetNode())
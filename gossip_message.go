@@ -21,10 +21,11 @@ type GossipMessageType uint32
 
 // Message types
 const (
-	EmptyGossipMessageType     GossipMessageType = iota // 0 = not set
-	HelloGossipMessageType                              // 1 = initial hello message for handshake
-	NodeStateGossipMessageType                          // 2 = node state changes
-	NodeListGossipMessageType                           // 3 = node list (exchange list of servers)
+	EmptyGossipMessageType      GossipMessageType = iota // 0 = not set
+	HelloGossipMessageType                               // 1 = initial hello message for handshake
+	NodeStateGossipMessageType                           // 2 = node state changes
+	NodeListGossipMessageType                            // 3 = node list (exchange list of servers)
+	ForgetNodeGossipMessageType                          // 4 = forget node (remove from cluster)
 )
 
 // To bytes
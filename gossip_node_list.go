@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 )
 
 // Receive list of nodes
@@ -24,9 +25,10 @@ func (this *Gossip) _startGossipFromJson(b []byte) {
 
 	// New nodes?
 	var newList []string = make([]string, 0)
+	now := unixTsUint32()
 	this.nodesMux.RLock()
 	for _, elm := range list {
-		if this.nodes[elm] == nil {
+		if this.nodes[elm] == nil && !this._isForgotten(elm, now) {
 			newList = append(newList, elm)
 		}
 	}
@@ -62,20 +64,68 @@ func (this *Gossip) NodesToJSON() []byte {
 	return jsonBytes
 }
 
-// Persist list of nodes to disk for future
+// Forgotten nodes to JSON object (node => unix timestamp), the ones beyond the forget TTL are dropped
+func (this *Gossip) ForgottenNodesToJSON() []byte {
+	now := unixTsUint32()
+	this.nodesMux.Lock()
+	for node := range this.forgotten {
+		if !this._isForgotten(node, now) {
+			delete(this.forgotten, node)
+		}
+	}
+	jsonBytes, jsonE := json.Marshal(this.forgotten)
+	this.nodesMux.Unlock()
+	panicErr(jsonE)
+	return jsonBytes
+}
+
+// Persist list of nodes to disk for future, forgotten nodes are kept so they are not discovered again after a restart
 func (this *Gossip) PersistNodesToDisk() {
 	// To JSON
 	jsonBytes := this.NodesToJSON()
+	forgottenBytes := this.ForgottenNodesToJSON()
 
 	// Write to disk
 	err := ioutil.WriteFile(fmt.Sprintf("%s/gossip_nodes.json", conf.MetaBasePath), jsonBytes, 0644)
 	if err != nil {
 		log.Errorf("Failed to persist gossip nodes list to disk: %s", err)
 	}
+	err = ioutil.WriteFile(fmt.Sprintf("%s/gossip_forgotten_nodes.json", conf.MetaBasePath), forgottenBytes, 0644)
+	if err != nil {
+		log.Errorf("Failed to persist forgotten gossip nodes to disk: %s", err)
+	}
+}
+
+// Recover forgotten nodes, before the node list so these are not contacted
+func (this *Gossip) _recoverForgottenNodesFromDisk() {
+	// Read JSON, not there if no node was forgotten yet
+	jsonBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/gossip_forgotten_nodes.json", conf.MetaBasePath))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to read forgotten gossip nodes from disk: %s", err)
+		return
+	}
+
+	// Parse JSON
+	var forgotten map[string]uint32
+	if jsonE := json.Unmarshal(jsonBytes, &forgotten); jsonE != nil {
+		log.Warnf("Failed to read forgotten gossip nodes: %s", jsonE)
+		return
+	}
+	this.nodesMux.Lock()
+	for node, ts := range forgotten {
+		this.forgotten[node] = ts
+	}
+	this.nodesMux.Unlock()
 }
 
 // Recover gossip
 func (this *Gossip) recoverGossipFromDisk() {
+	// Forgotten nodes
+	this._recoverForgottenNodesFromDisk()
+
 	// Read JSON
 	jsonBytes, err := ioutil.ReadFile(fmt.Sprintf("%s/gossip_nodes.json", conf.MetaBasePath))
 	if err != nil {
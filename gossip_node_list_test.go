@@ -9,3 +9,60 @@ func TestGossipNodeList(t *testing.T) {
 	// the running gossip will accept this and process it
 	gossip._sendNodeList("127.0.0.1")
 }
+
+// Test that forgotten nodes are not discovered again after a restart
+func TestGossipForgottenNodesPersisted(t *testing.T) {
+	startApplication()
+	node := "forgotten.example:1"
+	gossip.nodesMux.Lock()
+	gossip.forgotten[node] = unixTsUint32()
+	gossip.nodesMux.Unlock()
+	gossip.PersistNodesToDisk()
+	defer func() {
+		gossip.nodesMux.Lock()
+		delete(gossip.forgotten, node)
+		gossip.nodesMux.Unlock()
+		gossip.PersistNodesToDisk()
+	}()
+
+	// Restart
+	g := &Gossip{
+		nodes:     make(map[string]*GossipNodeState),
+		forgotten: make(map[string]uint32),
+	}
+	g._recoverForgottenNodesFromDisk()
+	if g.forgotten[node] == 0 {
+		t.Error("Expected forgotten node to be recovered from disk")
+	}
+}
+
+// Test that forgotten nodes are not added back by their messages until the forget TTL passed
+func TestGossipForgottenNodeIgnored(t *testing.T) {
+	startApplication()
+	node := "ignored.example:1"
+	gossip.nodesMux.Lock()
+	gossip.forgotten[node] = unixTsUint32()
+	gossip.nodesMux.Unlock()
+	defer func() {
+		gossip.nodesMux.Lock()
+		delete(gossip.forgotten, node)
+		delete(gossip.nodes, node)
+		gossip.nodesMux.Unlock()
+	}()
+
+	if gossip.GetNodeState(node) == nil {
+		t.Fatal("Expected detached state of forgotten node")
+	}
+	if gossip.GetNodeStates()[node] != nil {
+		t.Error("Forgotten node must not be added back")
+	}
+
+	// Forget TTL passed
+	gossip.nodesMux.Lock()
+	gossip.forgotten[node] -= conf.GossipForgetTtl
+	gossip.nodesMux.Unlock()
+	gossip.GetNodeState(node)
+	if gossip.GetNodeStates()[node] == nil {
+		t.Error("Node must be able to rejoin after the forget TTL")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Operational mode of a node, gossipped with the hellos
+
+type GossipNodeMode uint32
+
+const (
+	NormalGossipNodeMode      GossipNodeMode = iota // 0 = regular operations
+	DrainingGossipNodeMode                          // 1 = accepts no new data, all shards are migrated away until empty
+	MaintenanceGossipNodeMode                       // 2 = excluded from write placement for a bounded time, is not considered lost
+)
+
+// To string
+func (this GossipNodeMode) String() string {
+	switch this {
+	case NormalGossipNodeMode:
+		return "normal"
+	case DrainingGossipNodeMode:
+		return "draining"
+	case MaintenanceGossipNodeMode:
+		return "maintenance"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(this))
+}
+
+// Accepts new data?
+func (this GossipNodeMode) AcceptsWrites() bool {
+	return this == NormalGossipNodeMode
+}
+
+// Parse mode from string
+func parseGossipNodeMode(s string) (GossipNodeMode, error) {
+	for _, mode := range []GossipNodeMode{NormalGossipNodeMode, DrainingGossipNodeMode, MaintenanceGossipNodeMode} {
+		if mode.String() == s {
+			return mode, nil
+		}
+	}
+	return NormalGossipNodeMode, errors.New(fmt.Sprintf("Unknown node mode %s", s))
+}
+
+// Send mode change to node, the node will gossip its new mode to all others with its hellos
+// data: mode (uint32) - until (uint32)
+func (this *Gossip) _sendNodeMode(node string, mode GossipNodeMode, until uint32) error {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(mode))
+	binary.Write(buf, binary.BigEndian, until)
+	msg := newGossipMessage(NodeStateGossipMessageType, buf.Bytes())
+	_, err := this._send(node, msg)
+	if err == nil {
+		// Update our view right away, the hellos of the node will confirm
+		this.GetNodeState(node).SetMode(mode, until)
+	}
+	return err
+}
+
+// Receive mode change for this node
+func (this *Gossip) _receiveNodeMode(cmeta *TransportConnectionMeta, msg *GossipMessage) {
+	buf := bytes.NewReader(msg.Data)
+	var mode uint32
+	var until uint32
+	binary.Read(buf, binary.BigEndian, &mode)
+	err := binary.Read(buf, binary.BigEndian, &until)
+	if err != nil {
+		log.Warnf("Received invalid node mode from %s", cmeta.GetNode())
+		return
+	}
+	log.Infof("Received node mode %s from %s", GossipNodeMode(mode), cmeta.GetNode())
+	runtime.SetMode(GossipNodeMode(mode), until)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGossipNodeMode(t *testing.T) {
+	startApplication()
+
+	// Parse
+	mode, err := parseGossipNodeMode("draining")
+	if err != nil || mode != DrainingGossipNodeMode {
+		t.Error("Failed to parse draining mode")
+	}
+	_, err = parseGossipNodeMode("unknown")
+	if err == nil {
+		t.Error("Unknown mode should not parse")
+	}
+
+	// Only normal accepts writes
+	if !NormalGossipNodeMode.AcceptsWrites() || DrainingGossipNodeMode.AcceptsWrites() || MaintenanceGossipNodeMode.AcceptsWrites() {
+		t.Error("Only normal mode should accept writes")
+	}
+
+	// Maintenance is bounded in time
+	ns := newGossipNodeState("10.9.9.9")
+	ns.SetMode(MaintenanceGossipNodeMode, unixTsUint32()+60)
+	if ns.GetMode() != MaintenanceGossipNodeMode {
+		t.Error("Node should be in maintenance")
+	}
+	if datastore.nodeRouter._acceptsWrites(ns) {
+		t.Error("Node in maintenance should not accept writes")
+	}
+	ns.SetMode(MaintenanceGossipNodeMode, unixTsUint32()-1)
+	if ns.GetMode() != NormalGossipNodeMode {
+		t.Error("Expired maintenance should fall back to normal")
+	}
+	if !datastore.nodeRouter._acceptsWrites(ns) {
+		t.Error("Node after maintenance should accept writes")
+	}
+
+	// Draining has no time limit
+	ns.SetMode(DrainingGossipNodeMode, 0)
+	if datastore.nodeRouter._acceptsWrites(ns) {
+		t.Error("Draining node should not accept writes")
+	}
+}
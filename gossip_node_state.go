@@ -12,6 +12,11 @@ type GossipNodeState struct {
 	LastHelloSent     uint32
 	LastHelloReceived uint32
 	Stats             *PerformanceProfilerStats
+	// Operational mode as gossipped by the node itself
+	Mode      GossipNodeMode
+	ModeUntil uint32
+	// Newest shard and transport format the node supports (see clusterFormatVersion)
+	FormatVersion uint32
 }
 
 func (this *GossipNodeState) UpdateLastHelloSent() {
@@ -62,6 +67,35 @@ func (this *GossipNodeState) GetRuntimeId() string {
 	return this.RuntimeId
 }
 
+func (this *GossipNodeState) SetMode(mode GossipNodeMode, until uint32) {
+	this.mux.Lock()
+	this.Mode = mode
+	this.ModeUntil = until
+	this.mux.Unlock()
+}
+
+// Get mode, expired modes fall back to normal
+func (this *GossipNodeState) GetMode() GossipNodeMode {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	if this.ModeUntil > 0 && this.ModeUntil < unixTsUint32() {
+		return NormalGossipNodeMode
+	}
+	return this.Mode
+}
+
+func (this *GossipNodeState) SetFormatVersion(v uint32) {
+	this.mux.Lock()
+	this.FormatVersion = v
+	this.mux.Unlock()
+}
+
+func (this *GossipNodeState) GetFormatVersion() uint32 {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.FormatVersion
+}
+
 func (this *GossipNodeState) Reset() {
 	this.mux.Lock()
 	this.LastHelloSent = 0
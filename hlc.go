@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Hybrid logical clock of this node: orders writes across nodes, carried in gossip hellos and binary messages
+// timestamps are unix nanoseconds of which the lowest 16 bits are a logical counter, so they compare with plain wall-clock timestamps of older versions
+
+var hlc *HybridLogicalClock = newHybridLogicalClock()
+
+// Bits of the logical counter
+const HLC_LOGICAL_BITS uint = 16
+
+type HybridLogicalClock struct {
+	mux  sync.Mutex
+	last uint64
+}
+
+// Physical part of the current wall-clock time
+func (this *HybridLogicalClock) _physical() uint64 {
+	return uint64(time.Now().UnixNano()) >> HLC_LOGICAL_BITS << HLC_LOGICAL_BITS
+}
+
+// Timestamp for a local event, strictly increasing on this node
+func (this *HybridLogicalClock) Now() uint64 {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	ts := this._physical()
+	if ts <= this.last {
+		// Same or earlier tick, the counter overflows into the physical part
+		ts = this.last + 1
+	}
+	this.last = ts
+	return ts
+}
+
+// Merge a timestamp received from another node, later local timestamps are after it
+func (this *HybridLogicalClock) Update(remote uint64) bool {
+	if remote == 0 {
+		return false
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if remote > this._physical()+uint64(conf.ClockMaxDrift)*uint64(time.Second) {
+		log.Warnf("Ignoring clock timestamp %d that is more than %d seconds ahead", remote, conf.ClockMaxDrift)
+		return false
+	}
+	if remote > this.last {
+		this.last = remote
+	}
+	return true
+}
+
+// Last timestamp
+func (this *HybridLogicalClock) Last() uint64 {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return this.last
+}
+
+// New clock
+func newHybridLogicalClock() *HybridLogicalClock {
+	return &HybridLogicalClock{}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHybridLogicalClock(t *testing.T) {
+	startApplication()
+
+	// Strictly increasing
+	c := newHybridLogicalClock()
+	prev := c.Now()
+	for i := 0; i < 100000; i++ {
+		ts := c.Now()
+		if ts <= prev {
+			t.Fatalf("Clock went back from %d to %d", prev, ts)
+		}
+		prev = ts
+	}
+
+	// Remote ahead, later local events are after it
+	remote := c.Now() + uint64(time.Second)
+	if !c.Update(remote) {
+		t.Error("Expected update to be accepted")
+	}
+	if ts := c.Now(); ts <= remote {
+		t.Errorf("Expected timestamp after remote %d, got %d", remote, ts)
+	}
+
+	// Too far ahead
+	farAhead := c.Now() + 2*uint64(conf.ClockMaxDrift)*uint64(time.Second)
+	if c.Update(farAhead) {
+		t.Error("Expected update to be ignored")
+	}
+	if c.Last() >= farAhead {
+		t.Error("Clock must not jump ahead")
+	}
+
+	// Binary messages carry the clock
+	msg := newBinaryTransportMessage(FileBinaryTransportMessageType, []byte("data"))
+	msg2 := &BinaryTransportMessage{}
+	msg2.FromBytes(msg.Bytes())
+	if msg2.Clock != msg.Clock || msg2.Clock == 0 || string(msg2.Data) != "data" {
+		t.Error("Failed clock of binary message")
+	}
+
+	// Messages of older nodes have no clock
+	msg.Clock = 0
+	msg3 := &BinaryTransportMessage{}
+	msg3.FromBytes(msg.Bytes())
+	if msg3.Clock != 0 || string(msg3.Data) != "data" {
+		t.Error("Failed message without clock")
+	}
+}
+
+func TestFileMetaLastWriterWins(t *testing.T) {
+	startApplication()
+
+	// Origin survives serialisation
+	a := newFileMeta("/lww.txt")
+	if a.Origin != runtime.Id {
+		t.Error("Expected origin of this node")
+	}
+	a2 := &FileMeta{}
+	a2.FromBytes(a.Bytes())
+	if a2.Origin != a.Origin || a2.Timestamp != a.Timestamp {
+		t.Error("Failed origin and timestamp serialisation")
+	}
+
+	// Concurrent write on another node with the same timestamp, the origin decides on every node
+	b := newFileMeta("/lww.txt")
+	b.Timestamp = a.Timestamp
+	b.Origin = "ffffffff-ffff-ffff-ffff-ffffffffffff"
+	if !b.IsNewerThan(a) || a.IsNewerThan(b) {
+		t.Error("Expected origin tiebreak")
+	}
+
+	// Later timestamp wins
+	c := newFileMeta("/lww.txt")
+	if !c.IsNewerThan(b) {
+		t.Error("Expected last writer to win")
+	}
+
+	// Listings agree with the metas
+	versions := FileVersions{newFileVersion(a), newFileVersion(c), newFileVersion(b)}
+	sort.Sort(versions)
+	if versions[0].VersionId != c.VersionId() || versions[1].VersionId != b.VersionId() {
+		t.Error("Failed version order")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Key hierarchy: master keys of a key provider wrap the data keys of the blocks
+
+// Wraps and unwraps data keys with master keys
+type KeyProvider interface {
+	// Wrap a data key with the current master key, returns the wrapped key and the id of the master key
+	WrapKey(dataKey []byte) ([]byte, string, error)
+
+	// Unwrap a data key with the master key it was wrapped with
+	UnwrapKey(wrapped []byte, masterKeyId string) ([]byte, error)
+
+	// Create a new current master key, older master keys remain available to unwrap
+	Rotate() (string, error)
+
+	// Id of the current master key
+	CurrentKeyId() string
+}
+
+// Length of keys in bytes (AES-256)
+const ENCRYPTION_KEY_SIZE int = 32
+
+// Length of the authentication tag of AES-GCM in bytes
+const ENCRYPTION_TAG_SIZE uint64 = 16
+
+// Master key
+type MasterKey struct {
+	Id  string
+	Key []byte
+}
+
+// Encrypt and authenticate with AES-GCM, the random nonce is prepended
+func sealGcm(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Decrypt bytes of sealGcm
+func openGcm(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("Encrypted bytes too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+// AES-GCM cipher
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// New random key
+func newEncryptionKey() []byte {
+	key := make([]byte, ENCRYPTION_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("Failed to create key: %s", err))
+	}
+	return key
+}
+
+// Master keys in a local keyfile (JSON), the last key is the current one; the keyfile must be the same on all nodes
+type LocalKeyProvider struct {
+	path string
+	mux  sync.RWMutex
+	keys []*MasterKey
+}
+
+// Wrap data key
+func (this *LocalKeyProvider) WrapKey(dataKey []byte) ([]byte, string, error) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	current := this.keys[len(this.keys)-1]
+	wrapped, err := sealGcm(current.Key, dataKey, []byte(current.Id))
+	return wrapped, current.Id, err
+}
+
+// Unwrap data key, the keyfile is read again for master keys that are unknown (e.g. rotated on another node and copied here)
+func (this *LocalKeyProvider) UnwrapKey(wrapped []byte, masterKeyId string) ([]byte, error) {
+	if key := this._key(masterKeyId); key != nil {
+		return openGcm(key.Key, wrapped, []byte(key.Id))
+	}
+	keys, err := readKeyfile(this.path)
+	if err != nil {
+		return nil, err
+	}
+	this.mux.Lock()
+	this.keys = keys
+	this.mux.Unlock()
+	if key := this._key(masterKeyId); key != nil {
+		return openGcm(key.Key, wrapped, []byte(key.Id))
+	}
+	return nil, errors.New(fmt.Sprintf("Master key %s not found in keyfile %s", masterKeyId, this.path))
+}
+
+// Master key by id, nil if unknown
+func (this *LocalKeyProvider) _key(masterKeyId string) *MasterKey {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	for _, key := range this.keys {
+		if key.Id == masterKeyId {
+			return key
+		}
+	}
+	return nil
+}
+
+// Rotate, the new master key is appended to the keyfile
+func (this *LocalKeyProvider) Rotate() (string, error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	key := &MasterKey{Id: uuidToString(randomUuid()), Key: newEncryptionKey()}
+	keys := append(this.keys, key)
+	if err := this._save(keys); err != nil {
+		return "", err
+	}
+	this.keys = keys
+	return key.Id, nil
+}
+
+// Current master key id
+func (this *LocalKeyProvider) CurrentKeyId() string {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.keys[len(this.keys)-1].Id
+}
+
+// Write keyfile, atomic by writing a temporary file first
+func (this *LocalKeyProvider) _save(keys []*MasterKey) error {
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	tmpPath := fmt.Sprintf("%s.tmp", this.path)
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, this.path)
+}
+
+// Read keyfile, a new one with a single master key is created if it does not exist
+func newLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	p := &LocalKeyProvider{
+		path: path,
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Infof("Creating keyfile %s", path)
+		p.keys = []*MasterKey{&MasterKey{Id: uuidToString(randomUuid()), Key: newEncryptionKey()}}
+		return p, p._save(p.keys)
+	}
+	keys, err := readKeyfile(path)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	return p, nil
+}
+
+// Read and validate the master keys of a keyfile
+func readKeyfile(path string) ([]*MasterKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*MasterKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid keyfile %s: %s", path, err))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New(fmt.Sprintf("Keyfile %s contains no keys", path))
+	}
+	for _, key := range keys {
+		if len(key.Key) != ENCRYPTION_KEY_SIZE {
+			return nil, errors.New(fmt.Sprintf("Master key %s in keyfile %s is not %d bytes", key.Id, path, ENCRYPTION_KEY_SIZE))
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Stand-in for a key management service: the master keys live in memory only and never leave the provider (e.g. for tests)
+
+type LocalKms struct {
+	mux     sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+// Wrap data key
+func (this *LocalKms) WrapKey(dataKey []byte) ([]byte, string, error) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	wrapped, err := sealGcm(this.keys[this.current], dataKey, []byte(this.current))
+	return wrapped, this.current, err
+}
+
+// Unwrap data key
+func (this *LocalKms) UnwrapKey(wrapped []byte, masterKeyId string) ([]byte, error) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	key := this.keys[masterKeyId]
+	if key == nil {
+		return nil, errors.New(fmt.Sprintf("Master key %s not found in key management service", masterKeyId))
+	}
+	return openGcm(key, wrapped, []byte(masterKeyId))
+}
+
+// Rotate
+func (this *LocalKms) Rotate() (string, error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	id := uuidToString(randomUuid())
+	this.keys[id] = newEncryptionKey()
+	this.current = id
+	return id, nil
+}
+
+// Current master key id
+func (this *LocalKms) CurrentKeyId() string {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.current
+}
+
+// Forget a master key (e.g. to test that data keys were re-wrapped)
+func (this *LocalKms) DisableKey(masterKeyId string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	delete(this.keys, masterKeyId)
+}
+
+func newLocalKms() *LocalKms {
+	k := &LocalKms{
+		keys: make(map[string][]byte),
+	}
+	k.Rotate()
+	return k
+}
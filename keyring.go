@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"time"
+)
+
+// Encryption at rest: every block has a data key (AES-256-GCM) wrapped by a master key of the key provider, the wrapped key is stored in the footer of its shards
+
+var keyring *Keyring
+
+type Keyring struct {
+	mux      sync.RWMutex
+	provider KeyProvider
+	keys     map[string]*BlockKey
+
+	// Stats
+	rotations    uint64
+	lastRotation uint32
+}
+
+// Data key of a block
+type BlockKey struct {
+	BlockId     []byte
+	MasterKeyId string
+	Wrapped     []byte
+	key         []byte // Unwrapped, memory only
+	mux         sync.RWMutex
+}
+
+// Keyring status
+type KeyringStatus struct {
+	Enabled      bool
+	MasterKeyId  string
+	BlockKeys    int
+	Rotations    uint64
+	LastRotation uint32
+}
+
+// Result of a key rotation
+type KeyRotationResult struct {
+	MasterKeyId     string
+	BlockKeys       int // Data keys re-wrapped
+	ShardsRewritten int // Shard footers written
+	Failures        int
+	Duration        float64 // Seconds
+}
+
+// Footer bytes: master key id length (uint16) - master key id - wrapped key length (uint16) - wrapped key
+func (this *BlockKey) Bytes() []byte {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint16(len(this.MasterKeyId)))
+	buf.Write([]byte(this.MasterKeyId))
+	binary.Write(buf, binary.BigEndian, uint16(len(this.Wrapped)))
+	buf.Write(this.Wrapped)
+	return buf.Bytes()
+}
+
+// Parse footer bytes
+func parseBlockKey(blockId []byte, b []byte) (*BlockKey, error) {
+	buf := bytes.NewReader(b)
+	var idLen uint16
+	if err := binary.Read(buf, binary.BigEndian, &idLen); err != nil {
+		return nil, errors.New("Invalid block key, missing master key id")
+	}
+	id := make([]byte, idLen)
+	if n, _ := buf.Read(id); n != int(idLen) {
+		return nil, errors.New("Invalid block key, master key id too short")
+	}
+	var wrappedLen uint16
+	if err := binary.Read(buf, binary.BigEndian, &wrappedLen); err != nil {
+		return nil, errors.New("Invalid block key, missing wrapped key")
+	}
+	wrapped := make([]byte, wrappedLen)
+	if n, _ := buf.Read(wrapped); n != int(wrappedLen) {
+		return nil, errors.New("Invalid block key, wrapped key too short")
+	}
+	return &BlockKey{
+		BlockId:     blockId,
+		MasterKeyId: string(id),
+		Wrapped:     wrapped,
+	}, nil
+}
+
+// Cipher of the data key
+func (this *BlockKey) _gcm() cipher.AEAD {
+	gcm, err := newGcm(this.key)
+	panicErr(err)
+	return gcm
+}
+
+// Encrypt the contents of a file, the nonce is kept in the meta so that every copy of the shard holds the same bytes (replicas receive the nonce of the primary)
+func (this *BlockKey) SealFile(meta *FileMeta, b []byte) []byte {
+	gcm := this._gcm()
+	if len(meta.Nonce) != gcm.NonceSize() {
+		meta.Nonce = make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(meta.Nonce); err != nil {
+			panic(fmt.Sprintf("Failed to create nonce: %s", err))
+		}
+	}
+	sealed := gcm.Seal(nil, meta.Nonce, b, this.BlockId)
+	meta.Size = uint64(len(sealed))
+	meta.Checksum = crc32.Checksum(sealed, crcTable)
+	return sealed
+}
+
+// Decrypt the contents of a file
+func (this *BlockKey) OpenFile(meta *FileMeta, sealed []byte) ([]byte, error) {
+	b, err := this._gcm().Open(nil, meta.Nonce, sealed, this.BlockId)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to decrypt %s: %s", meta.FullName, err))
+	}
+	return b, nil
+}
+
+// Encrypt a section of a shard (e.g. file meta), sections are rewritten on every persist and get a random nonce
+func (this *BlockKey) Seal(b []byte, section string) []byte {
+	sealed, err := sealGcm(this.key, b, this._additionalData(section))
+	panicErr(err)
+	return sealed
+}
+
+// Decrypt a section of a shard
+func (this *BlockKey) Open(sealed []byte, section string) ([]byte, error) {
+	b, err := openGcm(this.key, sealed, this._additionalData(section))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to decrypt %s of block %s: %s", section, uuidToString(this.BlockId), err))
+	}
+	return b, nil
+}
+
+// Authenticated data of a section, binds it to the block
+func (this *BlockKey) _additionalData(section string) []byte {
+	ad := make([]byte, 0, len(this.BlockId)+len(section))
+	ad = append(ad, this.BlockId...)
+	return append(ad, []byte(section)...)
+}
+
+// Is encryption enabled?
+func (this *Keyring) Enabled() bool {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.provider != nil
+}
+
+// Bytes added to every file by encryption (authentication tag)
+func (this *Keyring) Overhead() uint64 {
+	if !this.Enabled() {
+		return 0
+	}
+	return ENCRYPTION_TAG_SIZE
+}
+
+// Set key provider (e.g. a key management service)
+func (this *Keyring) SetProvider(provider KeyProvider) {
+	this.mux.Lock()
+	this.provider = provider
+	this.keys = make(map[string]*BlockKey)
+	this.mux.Unlock()
+}
+
+// Create data key of a new block, nil if encryption is disabled
+func (this *Keyring) NewBlockKey(blockId []byte) (*BlockKey, error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.provider == nil {
+		return nil, nil
+	}
+	key := newEncryptionKey()
+	wrapped, masterKeyId, err := this.provider.WrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	bk := &BlockKey{
+		BlockId:     blockId,
+		MasterKeyId: masterKeyId,
+		Wrapped:     wrapped,
+		key:         key,
+	}
+	this.keys[uuidToString(blockId)] = bk
+	return bk, nil
+}
+
+// Data key of a block, nil if the block is not encrypted (or its key was not loaded)
+func (this *Keyring) BlockKey(blockId []byte) *BlockKey {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.keys[uuidToString(blockId)]
+}
+
+// Unwrap data key of a block from footer bytes (e.g. of a shard loaded from disk or received from another node)
+func (this *Keyring) ImportBlockKey(blockId []byte, b []byte) (*BlockKey, error) {
+	if bk := this.BlockKey(blockId); bk != nil {
+		return bk, nil
+	}
+	bk, err := parseBlockKey(blockId, b)
+	if err != nil {
+		return nil, err
+	}
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if this.provider == nil {
+		return nil, errors.New(fmt.Sprintf("Block %s is encrypted, but encryption is not enabled", uuidToString(blockId)))
+	}
+	key, err := this.provider.UnwrapKey(bk.Wrapped, bk.MasterKeyId)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ENCRYPTION_KEY_SIZE {
+		return nil, errors.New(fmt.Sprintf("Data key of block %s is not %d bytes", uuidToString(blockId), ENCRYPTION_KEY_SIZE))
+	}
+	bk.key = key
+	this.keys[uuidToString(blockId)] = bk
+	return bk, nil
+}
+
+// New master key: the data keys are re-wrapped and only the footers of the local shards are rewritten, the contents stay as they are
+func (this *Keyring) Rotate() (*KeyRotationResult, error) {
+	start := time.Now()
+	this.mux.RLock()
+	provider := this.provider
+	this.mux.RUnlock()
+	if provider == nil {
+		return nil, errors.New("Encryption is not enabled")
+	}
+
+	// Load the keys of all local shards first
+	shards := make([]*Shard, 0)
+	for _, volume := range datastore.Volumes() {
+		if !volume.IsReadable() {
+			continue
+		}
+		for _, shard := range volume.Shards() {
+			if _, err := shard.Load(); err != nil {
+				log.Warnf("Failed to load shard %s for key rotation: %s", shard.IdStr(), err)
+				continue
+			}
+			shards = append(shards, shard)
+		}
+	}
+
+	// New master key
+	masterKeyId, err := provider.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Rotated to master key %s", masterKeyId)
+	result := &KeyRotationResult{
+		MasterKeyId: masterKeyId,
+	}
+
+	// Re-wrap
+	this.mux.RLock()
+	keys := make([]*BlockKey, 0)
+	for _, bk := range this.keys {
+		keys = append(keys, bk)
+	}
+	this.mux.RUnlock()
+	for _, bk := range keys {
+		wrapped, id, err := provider.WrapKey(bk.key)
+		if err != nil {
+			log.Errorf("Failed to re-wrap data key of block %s: %s", uuidToString(bk.BlockId), err)
+			result.Failures++
+			continue
+		}
+		bk.mux.Lock()
+		bk.Wrapped = wrapped
+		bk.MasterKeyId = id
+		bk.mux.Unlock()
+		result.BlockKeys++
+	}
+
+	// Footers
+	for _, shard := range shards {
+		if shard.Block() == nil || this.BlockKey(shard.Block().Id) == nil {
+			continue
+		}
+		if err := shard._rewriteFooter(); err != nil {
+			log.Errorf("Failed to rewrite footer of shard %s: %s", shard.IdStr(), err)
+			shard._registerIOError(err)
+			result.Failures++
+			continue
+		}
+		result.ShardsRewritten++
+	}
+
+	this.mux.Lock()
+	this.rotations++
+	this.lastRotation = unixTsUint32()
+	this.mux.Unlock()
+	result.Duration = time.Since(start).Seconds()
+	return result, nil
+}
+
+// Status
+func (this *Keyring) Status() *KeyringStatus {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	status := &KeyringStatus{
+		Enabled:      this.provider != nil,
+		BlockKeys:    len(this.keys),
+		Rotations:    this.rotations,
+		LastRotation: this.lastRotation,
+	}
+	if this.provider != nil {
+		status.MasterKeyId = this.provider.CurrentKeyId()
+	}
+	return status
+}
+
+// New keyring, with the local keyfile as provider when encryption is enabled
+func newKeyring() *Keyring {
+	k := &Keyring{
+		keys: make(map[string]*BlockKey),
+	}
+	if conf.Encryption {
+		provider, err := newLocalKeyProvider(conf.EncryptionKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read keyfile: %s", err)
+		}
+		k.provider = provider
+	}
+	return k
+}
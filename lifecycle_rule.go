@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Lifecycle rule by name prefix: prefix:action:age[:storage_class], e.g. /logs/*:expire:30d or /archive/*:transition:7d:cold
+
+type LifecycleAction string
+
+const (
+	ExpireLifecycleAction     LifecycleAction = "expire"     // Tombstone the file
+	TransitionLifecycleAction LifecycleAction = "transition" // Move to a volume of another storage class
+)
+
+type LifecycleRule struct {
+	Prefix       string // Name prefix, a trailing * is optional
+	Action       LifecycleAction
+	Age          uint32 // Seconds after creation of the file
+	StorageClass string // Target of transitions
+}
+
+// Does the rule apply to this file?
+func (this *LifecycleRule) Matches(fullName string) bool {
+	return strings.HasPrefix(fullName, this.Prefix)
+}
+
+// Is the action due for this file?
+func (this *LifecycleRule) IsDue(meta *FileMeta, now uint32) bool {
+	return this.Matches(meta.FullName) && meta.Created+this.Age <= now
+}
+
+// To string, in the format it is parsed from
+func (this *LifecycleRule) String() string {
+	s := fmt.Sprintf("%s*:%s:%ds", this.Prefix, this.Action, this.Age)
+	if this.Action == TransitionLifecycleAction {
+		s += ":" + this.StorageClass
+	}
+	return s
+}
+
+// Rule of the action with the longest matching prefix, nil if none
+func matchLifecycleRule(rules []*LifecycleRule, fullName string, action LifecycleAction) *LifecycleRule {
+	var best *LifecycleRule = nil
+	for _, rule := range rules {
+		if rule.Action != action || !rule.Matches(fullName) {
+			continue
+		}
+		if best == nil || len(rule.Prefix) > len(best.Prefix) {
+			best = rule
+		}
+	}
+	return best
+}
+
+// Parse list of lifecycle rules
+func parseLifecycleRules(s string) ([]*LifecycleRule, error) {
+	res := make([]*LifecycleRule, 0)
+	for _, elm := range strings.Split(s, ",") {
+		elm = strings.TrimSpace(elm)
+		if len(elm) < 1 {
+			continue
+		}
+		rule, err := parseLifecycleRule(elm)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, rule)
+	}
+	return res, nil
+}
+
+// Parse single lifecycle rule
+func parseLifecycleRule(s string) (*LifecycleRule, error) {
+	split := strings.Split(s, ":")
+	if len(split) < 3 || len(split) > 4 {
+		return nil, errors.New(fmt.Sprintf("Invalid lifecycle rule %s, expected prefix:action:age[:storage_class]", s))
+	}
+	rule := &LifecycleRule{
+		Prefix: strings.TrimSuffix(strings.TrimSpace(split[0]), "*"),
+		Action: LifecycleAction(strings.TrimSpace(split[1])),
+	}
+	if !strings.HasPrefix(rule.Prefix, "/") {
+		return nil, errors.New(fmt.Sprintf("Invalid lifecycle rule %s, the prefix must start with /", s))
+	}
+	age, err := parseAge(strings.TrimSpace(split[2]))
+	if err != nil {
+		return nil, err
+	}
+	rule.Age = age
+	switch rule.Action {
+	case ExpireLifecycleAction:
+		if len(split) > 3 {
+			return nil, errors.New(fmt.Sprintf("Invalid lifecycle rule %s, expire has no storage class", s))
+		}
+	case TransitionLifecycleAction:
+		if len(split) < 4 || len(strings.TrimSpace(split[3])) < 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid lifecycle rule %s, transition requires a storage class", s))
+		}
+		rule.StorageClass = strings.TrimSpace(split[3])
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid lifecycle action %s, expected expire or transition", rule.Action))
+	}
+	return rule, nil
+}
+
+// Parse age with unit (s, m, h, d; seconds without unit)
+func parseAge(s string) (uint32, error) {
+	var multiplier uint64 = 1
+	lower := strings.ToLower(s)
+	if len(lower) > 0 && (lower[len(lower)-1] < '0' || lower[len(lower)-1] > '9') {
+		switch lower[len(lower)-1] {
+		case 's':
+			multiplier = 1
+		case 'm':
+			multiplier = 60
+		case 'h':
+			multiplier = 3600
+		case 'd':
+			multiplier = 24 * 3600
+		default:
+			return 0, errors.New(fmt.Sprintf("Invalid age %s, expected unit s, m, h or d", s))
+		}
+		lower = lower[:len(lower)-1]
+	}
+	n, err := strconv.ParseUint(lower, 10, 32)
+	if err != nil || n*multiplier > 0xFFFFFFFF {
+		return 0, errors.New(fmt.Sprintf("Invalid age %s", s))
+	}
+	return uint32(n * multiplier), nil
+}
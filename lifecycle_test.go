@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseLifecycleRules(t *testing.T) {
+	rules, err := parseLifecycleRules("/logs/*:expire:30d, /archive/*:transition:7d:cold,/tmp/:expire:3600")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules, found %d", len(rules))
+	}
+	if rules[0].Prefix != "/logs/" || rules[0].Action != ExpireLifecycleAction || rules[0].Age != 30*24*3600 {
+		t.Errorf("Unexpected rule %v", rules[0])
+	}
+	if rules[1].Action != TransitionLifecycleAction || rules[1].Age != 7*24*3600 || rules[1].StorageClass != "cold" {
+		t.Errorf("Unexpected rule %v", rules[1])
+	}
+	if rules[2].Age != 3600 {
+		t.Errorf("Unexpected rule %v", rules[2])
+	}
+
+	// Longest prefix
+	rules, _ = parseLifecycleRules("/logs/*:expire:30d,/logs/debug/*:expire:1d")
+	if rule := matchLifecycleRule(rules, "/logs/debug/a.log", ExpireLifecycleAction); rule == nil || rule.Age != 24*3600 {
+		t.Errorf("Expected most specific rule, found %v", rule)
+	}
+	if rule := matchLifecycleRule(rules, "/other/a.log", ExpireLifecycleAction); rule != nil {
+		t.Errorf("Expected no rule, found %v", rule)
+	}
+
+	// Invalid
+	for _, s := range []string{"/logs/*:expire", "logs/*:expire:1d", "/logs/*:delete:1d", "/logs/*:expire:1w", "/a/*:transition:1d", "/a/*:expire:1d:cold"} {
+		if _, err := parseLifecycleRules(s); err == nil {
+			t.Errorf("Lifecycle rule %s should be invalid", s)
+		}
+	}
+}
+
+func TestLifecycleWorker(t *testing.T) {
+	startApplication()
+	now := unixTsUint32()
+	rules := conf.LifecycleRules
+	conf.LifecycleRules, _ = parseLifecycleRules("/lifecycle/logs/*:expire:30d,/lifecycle/archive/*:transition:7d:cold")
+	defer func() {
+		conf.LifecycleRules = rules
+	}()
+
+	// Files
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	oldLog := newFileMeta("/lifecycle/logs/old.log")
+	oldLog.Created = now - 31*24*3600
+	newLog := newFileMeta("/lifecycle/logs/new.log")
+	expired := newFileMeta("/lifecycle/expired.txt")
+	expired.Expires = now - 1
+	for _, meta := range []*FileMeta{oldLog, newLog, expired} {
+		if _, err := shard.AddFile(meta, []byte("Lifecycle")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Per-file expiry hides the file right away
+	if _, err, _ := shard.ReadFile(expired.FullName); err == nil {
+		t.Error("Expired file must not be readable")
+	}
+
+	// Expire
+	lifecycleWorker._expire(now)
+	for name, live := range map[string]bool{oldLog.FullName: false, newLog.FullName: true, expired.FullName: false} {
+		if (shard.ShardFileMeta().GetByName(name) != nil) != live {
+			t.Errorf("Expected %s to be live: %v", name, live)
+		}
+	}
+	if lifecycleWorker.Status().FilesExpired < 2 {
+		t.Error("Expired files must be reported")
+	}
+
+	// Sealed blocks keep their contents, the files are only marked deleted
+	b3 := datastore.NewBlock()
+	sealedShard := b3.DataShards[0]
+	sealedExpired := newFileMeta("/lifecycle/sealed.txt")
+	sealedExpired.Expires = now - 1
+	if _, err := sealedShard.AddFile(sealedExpired, []byte("Sealed")); err != nil {
+		t.Fatal(err)
+	}
+	b3.Persist()
+	b3.SetSealed(true)
+	contents := string(sealedShard.Contents().Bytes())
+	lifecycleWorker._expire(now)
+	if sealedShard.ShardFileMeta().GetByName(sealedExpired.FullName) != nil {
+		t.Error("Expired file of sealed block must be deleted")
+	}
+	reloaded := newShardFromId(b3, sealedShard.Id)
+	if _, err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.ShardFileMeta().GetByName(sealedExpired.FullName) != nil {
+		t.Error("Deleted file of sealed block must be persisted")
+	}
+	if string(reloaded.Contents().Bytes()) != contents {
+		t.Error("Contents of sealed block must not change")
+	}
+
+	// Cold volume
+	cold := newVolume()
+	cold.Id = randomUuid()
+	cold.Path = conf.VolumeBasePath
+	cold.StorageClass = "cold"
+	cold.prepare()
+	volumes := conf.Datastore.Volumes
+	conf.Datastore.Volumes = append(volumes, cold)
+	defer func() {
+		conf.Datastore.Volumes = volumes
+		os.RemoveAll(cold.FullPath())
+	}()
+
+	// Sealed block with archived files only
+	b2 := datastore.NewBlock()
+	archived := newFileMeta("/lifecycle/archive/a.txt")
+	archived.Created = now - 8*24*3600
+	if _, err := b2.DataShards[0].AddFile(archived, []byte("Archived")); err != nil {
+		t.Fatal(err)
+	}
+	b2.Persist()
+
+	// Open blocks are not moved
+	lifecycleWorker._transition(now)
+	if b2.Volume() == cold {
+		t.Error("Open block must not be transitioned")
+	}
+
+	// Move
+	b2.SetSealed(true)
+	lifecycleWorker._transition(now)
+	if b2.Volume() != cold {
+		t.Fatal("Block must be transitioned to the cold volume")
+	}
+	if cold.Blocks()[b2.IdStr()] != b2 || cold.Shards()[b2.DataShards[0].IdStr()] == nil {
+		t.Error("Block and shards must be registered with the cold volume")
+	}
+	if _, err := os.Stat(b2.DataShards[0].FullPath()); err != nil {
+		t.Errorf("Shard must be on the cold volume: %s", err)
+	}
+	b2.DataShards[0].SetContents(nil)
+	if data, err, _ := b2.DataShards[0].ReadFile(archived.FullName); err != nil || string(data) != "Archived" {
+		t.Errorf("Failed to read file after transition: %s", err)
+	}
+	if lifecycleWorker.Status().BlocksTransitioned < 1 {
+		t.Error("Transitioned blocks must be reported")
+	}
+}
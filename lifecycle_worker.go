@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Applies the lifecycle rules and per-file expiry to the local shards: expired files are tombstoned, sealed blocks are moved to the volumes of their storage class
+
+var lifecycleWorker *LifecycleWorker
+
+// Number of recent actions kept for reporting
+const LIFECYCLE_MAX_EVENTS int = 100
+
+type LifecycleWorker struct {
+	mux                sync.RWMutex
+	running            bool
+	filesExpired       uint64
+	blocksTransitioned uint64
+	bytesTransitioned  uint64
+	failures           uint64
+	lastRun            uint32
+	lastError          string
+	events             []*LifecycleEvent
+}
+
+// Action taken by the worker
+type LifecycleEvent struct {
+	Time   uint32
+	Action LifecycleAction
+	Target string // File name or block id
+	Rule   string // Empty for per-file expiry
+	Error  string `json:",omitempty"`
+}
+
+// Worker status
+type LifecycleWorkerStatus struct {
+	Running            bool
+	Rules              []string
+	FilesExpired       uint64
+	BlocksTransitioned uint64
+	BytesTransitioned  uint64
+	Failures           uint64
+	LastRun            uint32
+	LastError          string
+	Events             []*LifecycleEvent // Most recent last
+}
+
+// Apply rules once
+func (this *LifecycleWorker) run() {
+	// Only one at a time
+	this.mux.Lock()
+	if this.running {
+		this.mux.Unlock()
+		return
+	}
+	this.running = true
+	this.mux.Unlock()
+
+	now := unixTsUint32()
+	this._expire(now)
+	this._transition(now)
+
+	this.mux.Lock()
+	this.running = false
+	this.lastRun = now
+	this.mux.Unlock()
+}
+
+// Tombstone expired files, in sealed blocks the contents are covered by parity and only the file meta is marked
+func (this *LifecycleWorker) _expire(now uint32) {
+	rules := conf.LifecycleRules
+	for _, volume := range datastore.Volumes() {
+		if !volume.IsWritable() {
+			continue
+		}
+		for _, shard := range volume.Shards() {
+			if shard.Parity {
+				continue
+			}
+			match := func(meta *FileMeta) bool {
+				return this._expireRule(rules, meta, now) != nil || meta.IsExpired(now)
+			}
+			var deleted []*FileMeta
+			var err error
+			if shard.Block().IsSealed() {
+				deleted, err = shard.DeleteSealedFiles(match)
+			} else {
+				deleted, err = shard.DeleteFiles(match)
+			}
+			for _, meta := range deleted {
+				binaryTransport._broadcastFileLocationInvalidation(meta.FullName)
+				var ruleStr string = ""
+				if rule := this._expireRule(rules, meta, now); rule != nil && !meta.IsExpired(now) {
+					ruleStr = rule.String()
+				}
+				this._record(&LifecycleEvent{Time: now, Action: ExpireLifecycleAction, Target: meta.FullName, Rule: ruleStr})
+			}
+			if err != nil {
+				this._record(&LifecycleEvent{Time: now, Action: ExpireLifecycleAction, Target: shard.IdStr(), Error: err.Error()})
+			}
+		}
+	}
+}
+
+// Expire rule that is due for the file, nil if none
+func (this *LifecycleWorker) _expireRule(rules []*LifecycleRule, meta *FileMeta, now uint32) *LifecycleRule {
+	rule := matchLifecycleRule(rules, meta.FullName, ExpireLifecycleAction)
+	if rule == nil || !rule.IsDue(meta, now) {
+		return nil
+	}
+	return rule
+}
+
+// Move sealed blocks of which all live files are due for a transition to the volume of the storage class
+func (this *LifecycleWorker) _transition(now uint32) {
+	rules := conf.LifecycleRules
+	blocks := make([]*Block, 0)
+	for _, volume := range datastore.Volumes() {
+		if !volume.IsReadable() {
+			continue
+		}
+		for _, block := range volume.Blocks() {
+			blocks = append(blocks, block)
+		}
+	}
+
+	for _, block := range blocks {
+		rule := this._transitionRule(rules, block, now)
+		if rule == nil || block.Volume().StorageClass == rule.StorageClass {
+			continue
+		}
+
+		// Target volume
+		n := uint64(block.ShardCount()) * uint64(conf.ShardSizeInBytes)
+		target := datastore.AllocateVolume(rule.StorageClass, n)
+		if target == nil {
+			err := fmt.Sprintf("No writable volume of storage class %s with capacity", rule.StorageClass)
+			this._record(&LifecycleEvent{Time: now, Action: TransitionLifecycleAction, Target: block.IdStr(), Rule: rule.String(), Error: err})
+			continue
+		}
+
+		// Move
+		diskBytes := block.DiskBytes()
+		if err := block.MoveToVolume(target); err != nil {
+			this._record(&LifecycleEvent{Time: now, Action: TransitionLifecycleAction, Target: block.IdStr(), Rule: rule.String(), Error: err.Error()})
+			continue
+		}
+		this.mux.Lock()
+		this.bytesTransitioned += diskBytes
+		this.mux.Unlock()
+		this._record(&LifecycleEvent{Time: now, Action: TransitionLifecycleAction, Target: block.IdStr(), Rule: rule.String()})
+	}
+}
+
+// Transition rule that is due for all live files of the local data shards of the block, nil if none (open blocks still receive writes)
+func (this *LifecycleWorker) _transitionRule(rules []*LifecycleRule, block *Block, now uint32) *LifecycleRule {
+	if !block.IsSealed() {
+		return nil
+	}
+	var res *LifecycleRule = nil
+	for _, shard := range block._shards() {
+		if shard.Parity {
+			continue
+		}
+		if _, err := shard.Load(); err != nil {
+			return nil
+		}
+		for _, meta := range shard.ShardFileMeta().Live() {
+			rule := matchLifecycleRule(rules, meta.FullName, TransitionLifecycleAction)
+			if rule == nil || !rule.IsDue(meta, now) {
+				return nil
+			}
+			if res != nil && res.StorageClass != rule.StorageClass {
+				return nil
+			}
+			res = rule
+		}
+	}
+	return res
+}
+
+// Record action
+func (this *LifecycleWorker) _record(event *LifecycleEvent) {
+	if len(event.Error) > 0 {
+		log.Warnf("Lifecycle %s of %s failed: %s", event.Action, event.Target, event.Error)
+	} else {
+		log.Infof("Lifecycle %s of %s", event.Action, event.Target)
+	}
+
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if len(event.Error) > 0 {
+		this.failures++
+		this.lastError = event.Error
+	} else if event.Action == ExpireLifecycleAction {
+		this.filesExpired++
+	} else if event.Action == TransitionLifecycleAction {
+		this.blocksTransitioned++
+	}
+	this.events = append(this.events, event)
+	if len(this.events) > LIFECYCLE_MAX_EVENTS {
+		this.events = this.events[len(this.events)-LIFECYCLE_MAX_EVENTS:]
+	}
+}
+
+// Status
+func (this *LifecycleWorker) Status() *LifecycleWorkerStatus {
+	rules := make([]string, 0)
+	for _, rule := range conf.LifecycleRules {
+		rules = append(rules, rule.String())
+	}
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	events := make([]*LifecycleEvent, len(this.events))
+	copy(events, this.events)
+	return &LifecycleWorkerStatus{
+		Running:            this.running,
+		Rules:              rules,
+		FilesExpired:       this.filesExpired,
+		BlocksTransitioned: this.blocksTransitioned,
+		BytesTransitioned:  this.bytesTransitioned,
+		Failures:           this.failures,
+		LastRun:            this.lastRun,
+		LastError:          this.lastError,
+		Events:             events,
+	}
+}
+
+// New lifecycle worker
+func newLifecycleWorker() *LifecycleWorker {
+	w := &LifecycleWorker{
+		events: make([]*LifecycleEvent, 0),
+	}
+
+	// Apply periodically
+	ticker := time.NewTicker(time.Second * time.Duration(conf.LifecycleInterval))
+	go func() {
+		for _ = range ticker.C {
+			w.run()
+		}
+	}()
+
+	return w
+}
@@ -2,15 +2,28 @@ package main
 
 import (
 	"flag"
+	"os"
 	"sync"
 )
 
 func init() {
 	flag.StringVar(&confSeedFlag, "seeds", "", "Seeds list (abc_host:port,xyz_host:port)")
+	flag.StringVar(&confVolumesFlag, "volumes", "", "Volumes list (path[:capacity[:storage_class]],..., e.g. /mnt/a:500G:standard,/mnt/b:2T:cold)")
+	flag.StringVar(&confLifecycleFlag, "lifecycle", "", "Lifecycle rules (prefix:action:age[:storage_class],..., e.g. /logs/*:expire:30d,/archive/*:transition:7d:cold)")
+	flag.BoolVar(&confDedupFlag, "dedup", false, "Deduplicate identical file contents within shards")
+	flag.StringVar(&confShardIndexFlag, "shard-index", "bloom", "Type of the shard indices (bloom, or counting to remove the names of deleted files at 4 times the memory)")
+	flag.StringVar(&confCompressionFlag, "compression", "none", "Compression at rest of files (none, gzip, snappy or zstd)")
+	flag.BoolVar(&confEncryptionFlag, "encryption", false, "Encrypt shards at rest (AES-GCM)")
+	flag.StringVar(&confKeyFileFlag, "keyfile", "", "Keyfile with the master keys of the encryption, must be the same on all nodes (default in the meta folder)")
 	flag.Parse()
 }
 
 func main() {
+	// Offline commands (e.g. fsck) do not start a node
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	startApplication()
 
 	// Wait for shutdown
@@ -37,9 +50,36 @@ func startApplication() {
 		// Data store config
 		conf.Datastore = newDatastoreConf()
 
+		// Data keys of encrypted blocks
+		keyring = newKeyring()
+
+		// Contents of files for deduplication, filled while the shards load
+		dedupIndex = newDedupIndex()
+
+		// Contents of hot files
+		fileCache = newFileCache(uint64(conf.FileCacheSize), conf.ShardIndexExpectedFileSize)
+
 		// Datatastore
 		datastore = newDatastore()
 
+		// Drains the node when requested
+		nodeDrainer = newNodeDrainer()
+
+		// Erasure codes blocks when they are ready
+		blockSealer = newBlockSealer()
+
+		// Reclaims space of deleted and overwritten files
+		shardCompactor = newShardCompactor()
+
+		// Evicts the file meta of idle shards beyond the memory budget
+		shardCache = newShardCache()
+
+		// Memory only shards of temporary files
+		temporaryStore = newTemporaryStore()
+
+		// Expires files and moves blocks between storage classes
+		lifecycleWorker = newLifecycleWorker()
+
 		// HTTP server
 		restServer = newRestServer()
 
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Drains this node while it is in draining mode: all local shards are migrated to other nodes until it is empty
+
+var nodeDrainer *NodeDrainer
+
+type NodeDrainer struct {
+	mux            sync.RWMutex
+	running        bool
+	shardsMigrated uint32
+	shardsFailed   uint32
+	lastError      string
+}
+
+// Drain status
+type NodeDrainStatus struct {
+	Mode            string
+	ModeUntil       uint32
+	ShardsRemaining int
+	ShardsMigrated  uint32
+	ShardsFailed    uint32
+	LastError       string
+}
+
+// Local shards
+func (this *NodeDrainer) _localShards() []*Shard {
+	list := make([]*Shard, 0)
+	for _, volume := range datastore.Volumes() {
+		for _, shard := range volume.Shards() {
+			list = append(list, shard)
+		}
+	}
+	return list
+}
+
+// Drain all local shards
+func (this *NodeDrainer) drain() {
+	// Only one at a time
+	this.mux.Lock()
+	if this.running {
+		this.mux.Unlock()
+		return
+	}
+	this.running = true
+	this.mux.Unlock()
+	defer func() {
+		this.mux.Lock()
+		this.running = false
+		this.mux.Unlock()
+	}()
+
+	shards := this._localShards()
+	if len(shards) == 0 {
+		log.Debug("Node is drained, no local shards left")
+		return
+	}
+	log.Infof("Draining %d local shard(s)", len(shards))
+
+	for _, shard := range shards {
+		// Still draining?
+		if mode, _ := runtime.GetMode(); mode != DrainingGossipNodeMode {
+			log.Infof("Stopped draining, node mode is %s", mode)
+			return
+		}
+
+		// Pick node that does not have a shard of this block yet, the shards of a block are on distinct nodes
+		criteria := newNodeRouterCriteria()
+		criteria.ExcludeLocalNodes = true
+		criteria.ExcludeNodes = this._blockNodes(shard)
+		node, nodeSelectionErr := datastore.nodeRouter.PickNode(criteria)
+		if nodeSelectionErr != nil {
+			this._failed(fmt.Sprintf("No target for shard %s: %s", shard.IdStr(), nodeSelectionErr))
+			continue
+		}
+
+		// No writes from here, the copy on the target must hold every file
+		shard.StopWrites()
+
+		// Migrate
+		migrateErr := binaryTransport._migrateShard(node, shard)
+		if migrateErr != nil {
+			shard.ResumeWrites()
+			this._failed(fmt.Sprintf("Failed to migrate shard %s to %s: %s", shard.IdStr(), node, migrateErr))
+			continue
+		}
+
+		// Remove local copy
+		removeErr := datastore.RemoveShard(shard)
+		if removeErr != nil {
+			log.Warnf("Failed to remove migrated shard %s: %s", shard.IdStr(), removeErr)
+		}
+		this.mux.Lock()
+		this.shardsMigrated++
+		this.mux.Unlock()
+	}
+}
+
+// Nodes that hold a shard of the block of the shard
+func (this *NodeDrainer) _blockNodes(shard *Shard) []string {
+	nodes := make([]string, 0)
+	shardIds := []string{shard.IdStr()}
+	if shard.Block() != nil {
+		for _, idx := range datastore.fileLocator.BlockShardIndices(datastore, shard.Block().Id) {
+			shardIds = append(shardIds, uuidToString(idx.ShardId))
+		}
+	}
+	for _, shardId := range shardIds {
+		for _, location := range datastore.fileLocator.ShardLocationsByIdStr(shardId) {
+			nodes = append(nodes, location.Node)
+		}
+	}
+	return nodes
+}
+
+// Register failure
+func (this *NodeDrainer) _failed(msg string) {
+	log.Warn(msg)
+	this.mux.Lock()
+	this.shardsFailed++
+	this.lastError = msg
+	this.mux.Unlock()
+}
+
+// Status
+func (this *NodeDrainer) Status() *NodeDrainStatus {
+	mode, modeUntil := runtime.GetMode()
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return &NodeDrainStatus{
+		Mode:            mode.String(),
+		ModeUntil:       modeUntil,
+		ShardsRemaining: len(this._localShards()),
+		ShardsMigrated:  this.shardsMigrated,
+		ShardsFailed:    this.shardsFailed,
+		LastError:       this.lastError,
+	}
+}
+
+// New drainer
+func newNodeDrainer() *NodeDrainer {
+	d := &NodeDrainer{}
+
+	// Ticker
+	ticker := time.NewTicker(time.Second * 10)
+	go func() {
+		for _ = range ticker.C {
+			if mode, _ := runtime.GetMode(); mode == DrainingGossipNodeMode {
+				d.drain()
+			}
+		}
+	}()
+
+	return d
+}
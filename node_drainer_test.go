@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+// Test that the target of a drained shard is not a node that holds another shard of its block
+func TestNodeDrainerBlockNodes(t *testing.T) {
+	startApplication()
+	node := "drain-other:1"
+	defer forgetTestNode(node)
+	b := datastore.NewBlock()
+	other := newShardIndex(randomUuid())
+	other.SetBlockInfo(b.Id, 1, false, uint32(conf.DataShardsPerBlock), uint32(conf.ParityShardsPerBlock))
+	datastore.fileLocator.LoadIndex(node, other.ShardId, other)
+	defer datastore.fileLocator.UnloadIndex(node, other.ShardId)
+
+	var found bool = false
+	for _, elm := range nodeDrainer._blockNodes(b.DataShards[0]) {
+		if elm == node {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected node with another shard of the block to be excluded")
+	}
+}
+
+// Test that a shard that is drained accepts no writes until it is resumed
+func TestShardStopWrites(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	name := "/drain/stopped.txt"
+	if _, err := shard.AddFile(newFileMeta(name), []byte("Before")); err != nil {
+		t.Fatal(err)
+	}
+
+	shard.StopWrites()
+	if shard.AllocateCapacity(1) {
+		t.Error("Stopped shard must not allocate capacity")
+	}
+	if _, err := shard.AddFile(newFileMeta("/drain/late.txt"), []byte("Late")); err == nil {
+		t.Error("Stopped shard must not accept files")
+	}
+	if _, err := shard.DeleteFile(name); err == nil || shard.ShardFileMeta().GetByName(name) == nil {
+		t.Error("Stopped shard must not delete files")
+	}
+
+	shard.ResumeWrites()
+	if _, err := shard.AddFile(newFileMeta("/drain/late.txt"), []byte("Late")); err != nil {
+		t.Errorf("Resumed shard must accept files: %s", err)
+	}
+}
@@ -38,10 +38,21 @@ func (this *NodeRouter) PickNode(criteria *NodeRouterCriteria) (string, error) {
 
 		// Local route?
 		if criteria != nil && criteria.ExcludeLocalNodes {
-			if inputNode.Node == runtime.GetNode() || inputNode.Node == "localhost" || inputNode.Node == "127.0.0.1" {
+			if runtime.IsLocalNode(inputNode.Node) {
 				continue
 			}
 		}
+
+		// Excluded?
+		if criteria != nil && criteria.IsExcluded(inputNode.Node) {
+			continue
+		}
+
+		// Draining or in maintenance? Then no new data is placed on this node
+		if !this._acceptsWrites(inputNode) {
+			log.Debugf("Ignoring node %s for mode %s", inputNode.Node, inputNode.GetMode())
+			continue
+		}
 		tmp = append(tmp, inputNode)
 	}
 	inputNodes = tmp
@@ -59,6 +70,15 @@ func (this *NodeRouter) PickNode(criteria *NodeRouterCriteria) (string, error) {
 	return nodes[0].Node, nil
 }
 
+// Does the node accept new data? The local mode is leading for ourselves
+func (this *NodeRouter) _acceptsWrites(ns *GossipNodeState) bool {
+	if runtime.IsLocalNode(ns.Node) || ns.GetRuntimeId() == runtime.Id {
+		mode, _ := runtime.GetMode()
+		return mode.AcceptsWrites()
+	}
+	return ns.GetMode().AcceptsWrites()
+}
+
 // New router
 func newNodeRouter() *NodeRouter {
 	return &NodeRouter{}
@@ -4,8 +4,21 @@ package main
 
 type NodeRouterCriteria struct {
 	ExcludeLocalNodes bool
+	ExcludeNodes      []string // E.g. nodes that already have a copy of a shard
+}
+
+// Is node excluded?
+func (this *NodeRouterCriteria) IsExcluded(node string) bool {
+	for _, excluded := range this.ExcludeNodes {
+		if excluded == node {
+			return true
+		}
+	}
+	return false
 }
 
 func newNodeRouterCriteria() *NodeRouterCriteria {
-	return &NodeRouterCriteria{}
+	return &NodeRouterCriteria{
+		ExcludeNodes: make([]string, 0),
+	}
 }
@@ -52,14 +52,39 @@ func (this *RestServer) start() {
 			// Block
 			router.POST("/v1/debug/block/allocate", PostDebugBlockAllocate)
 			router.PUT("/v1/debug/block/persist", PutDebugBlockPersist)
+			router.PUT("/v1/debug/block/seal", PutDebugBlockSeal)
 		}
 
+		// Admin
+		router.PUT("/v1/admin/node/mode", PutAdminNodeMode)
+		router.GET("/v1/admin/node/status", GetAdminNodeStatus)
+		router.DELETE("/v1/admin/node", DeleteAdminNode)
+		router.GET("/v1/admin/volumes", GetAdminVolumes)
+		router.PUT("/v1/admin/volume/state", PutAdminVolumeState)
+		router.GET("/v1/admin/compaction", GetAdminCompaction)
+		router.POST("/v1/admin/compaction", PostAdminCompaction)
+		router.GET("/v1/admin/temporary", GetAdminTemporary)
+		router.GET("/v1/admin/lifecycle", GetAdminLifecycle)
+		router.POST("/v1/admin/lifecycle", PostAdminLifecycle)
+		router.GET("/v1/admin/dedup", GetAdminDedup)
+		router.GET("/v1/admin/file-locator", GetAdminFileLocator)
+		router.GET("/v1/admin/file-cache", GetAdminFileCache)
+		router.GET("/v1/admin/shard-cache", GetAdminShardCache)
+		router.GET("/v1/admin/encryption", GetAdminEncryption)
+		router.POST("/v1/admin/encryption/rotate", PostAdminEncryptionRotate)
+
 		// File
 		router.POST("/v1/file", PostFile)
 		router.GET("/v1/file", GetFile)
+		router.DELETE("/v1/file", DeleteFile)
+		router.GET("/v1/file/versions", GetFileVersions)
 
 		// Local calls
 		router.GET("/v1/local/file", GetLocalFile) // Local file will attempt to load file from this server
+		router.DELETE("/v1/local/file", DeleteLocalFile)
+		router.GET("/v1/local/file/versions", GetLocalFileVersions)
+		router.GET("/v1/local/shard/range", GetLocalShardRange)
+		router.GET("/v1/local/shard/file-meta", GetLocalShardFileMeta)
 
 		// Start server
 		log.Infof("Starting REST HTTP server on port TCP/%d", conf.HttpPort)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+)
+
+// Shard compaction status of this node
+func GetAdminCompaction(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Response
+	jr.Set("compaction", shardCompactor.Status())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
+
+// Compact a single shard (waits for the result) or start a compaction run in the background
+func PostAdminCompaction(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Full run
+	id := strings.TrimSpace(r.URL.Query().Get("shard"))
+	if len(id) < 1 {
+		go shardCompactor.compact()
+		jr.Set("started", true)
+		jr.OK()
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Single shard
+	shard := datastore.LocalShardByIdStr(id)
+	if shard == nil {
+		restServer.notFound(w)
+		jr.Error("Shard not found")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+	result, err := shardCompactor.CompactShard(shard)
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Response
+	jr.Set("result", result)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Deduplication status of this node
+func GetAdminDedup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Response
+	jr.Set("dedup", dedupIndex.Status())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Encryption status of this node
+func GetAdminEncryption(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Response
+	jr.Set("encryption", keyring.Status())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
+
+// Rotate the master key of this node, the data keys of the local shards are re-wrapped (copy the keyfile to the other nodes afterwards)
+func PostAdminEncryptionRotate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Rotate
+	result, err := keyring.Rotate()
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Response
+	jr.Set("result", result)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// File cache status of this node (e.g. hit rate of the hot files)
+func GetAdminFileCache(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Response
+	jr.Set("file_cache", fileCache.Status())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
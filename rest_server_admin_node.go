@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Change node mode (normal, draining, maintenance)
+func PutAdminNodeMode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Mode
+	mode, modeErr := parseGossipNodeMode(strings.TrimSpace(r.URL.Query().Get("mode")))
+	if modeErr != nil {
+		jr.Error("Please provide the 'mode' (normal, draining, maintenance) as query parameter")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Maintenance is bounded in time
+	var until uint32 = 0
+	if mode == MaintenanceGossipNodeMode {
+		duration, durationErr := strconv.ParseUint(strings.TrimSpace(r.URL.Query().Get("duration")), 10, 32)
+		if durationErr != nil || duration < 1 || uint32(duration) > conf.MaxMaintenanceDuration {
+			jr.Error(fmt.Sprintf("Please provide the maintenance 'duration' in seconds (max %d) as query parameter", conf.MaxMaintenanceDuration))
+			fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+			return
+		}
+		until = unixTsUint32() + uint32(duration)
+	}
+
+	// Node (defaults to this node)
+	node := strings.TrimSpace(r.URL.Query().Get("node"))
+	if len(node) < 1 || runtime.IsLocalNode(node) {
+		runtime.SetMode(mode, until)
+	} else {
+		err := gossip._sendNodeMode(node, mode, until)
+		if err != nil {
+			jr.Error(fmt.Sprintf("%s", err))
+			fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+			return
+		}
+	}
+
+	// Response
+	jr.Set("mode", mode.String())
+	jr.Set("until", until)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
+
+// Mode and drain status of this node
+func GetAdminNodeStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Response
+	jr.Set("status", nodeDrainer.Status())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
+
+// Forget node, removes it from the gossip state of all nodes
+func DeleteAdminNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Node
+	node := strings.TrimSpace(r.URL.Query().Get("node"))
+	if len(node) < 1 {
+		jr.Error("Please provide the 'node' as query parameter")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+	if runtime.IsLocalNode(node) {
+		jr.Error("Can not forget this node")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Forget here and everywhere else
+	found := gossip.ForgetNode(node)
+	gossip._broadcastForgetNode(node)
+
+	// Response
+	jr.Set("forgotten", found)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
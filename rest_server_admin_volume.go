@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strings"
+)
+
+// Usage of the volumes of this node
+func GetAdminVolumes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Usage per volume
+	volumes := make([]*VolumeStatus, 0)
+	for _, volume := range datastore.Volumes() {
+		volumes = append(volumes, volume.Status())
+	}
+
+	// Response
+	jr.Set("volumes", volumes)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
+
+// Change volume state (e.g. back to healthy after replacing a disk)
+func PutAdminVolumeState(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// State
+	state, stateErr := parseVolumeState(strings.TrimSpace(r.URL.Query().Get("state")))
+	if stateErr != nil {
+		jr.Error("Please provide the 'state' (healthy, read-only, failed) as query parameter")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Volume
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	var volume *Volume
+	for _, v := range datastore.Volumes() {
+		if v.IdStr() == id {
+			volume = v
+			break
+		}
+	}
+	if volume == nil {
+		jr.Error("Volume not found")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Set
+	volume.SetState(state)
+
+	// Response
+	jr.Set("volume", volume.Status())
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
@@ -21,6 +21,11 @@ func PostDebugBlockAllocate(w http.ResponseWriter, r *http.Request, _ httprouter
 
 	// New block
 	block := datastore.NewBlock()
+	if block == nil {
+		jr.Error("No writable volume with capacity left")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
 
 	// Response
 	jr.Set("block_id", block.IdStr())
@@ -63,3 +68,44 @@ func PutDebugBlockPersist(w http.ResponseWriter, r *http.Request, _ httprouter.P
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
 }
+
+// Seal existing block (erasure coding and shard placement)
+func PutDebugBlockSeal(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Id
+	id := strings.TrimSpace(r.URL.Query().Get("id"))
+	if len(id) < 1 {
+		jr.Error("Please provide the block 'id' as query parameter")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Find block
+	block := datastore.BlockByIdStr(id)
+	if block == nil {
+		jr.Error("Block not found")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Seal
+	status, err := block.Seal()
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Response
+	jr.Set("status", status)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
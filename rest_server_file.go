@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/RobinUS2/golang-jresp"
 	"github.com/julienschmidt/httprouter"
-	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -43,10 +42,19 @@ func PostFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
+	// Upload options (e.g. temporary with TTL)
+	opts, optsErr := parseFileWriteOptions(r.URL.Query())
+	if optsErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jr.Error(fmt.Sprintf("%s", optsErr))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
 	// @todo is this a new file? In that case we have to modify it
 
 	// Add file
-	res, resE := datastore.AddFile(file, b)
+	meta, resE := datastore.AddFileWithOptions(file, b, opts)
 	if resE != nil {
 		jr.Error(fmt.Sprintf("%s", resE))
 		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
@@ -54,7 +62,8 @@ func PostFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 
 	// Response
-	jr.Set("created", res)
+	jr.Set("created", true)
+	jr.Set("version", meta.VersionId())
 	jr.OK()
 	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
 }
@@ -78,65 +87,110 @@ func GetFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
-	// Locate
-	res, _, e := datastore.LocateFile(file)
-	if e != nil {
+	// Read version, latest if none given, compressed contents are served as is when the client accepts the encoding
+	res, err := datastore.ReadFileVersionEncoded(file, strings.TrimSpace(r.URL.Query().Get("version")), acceptedCompressionCodecs(r.Header.Get("Accept-Encoding")))
+	if err != nil {
 		restServer.notFound(w)
-		jr.Error(fmt.Sprintf("%s", e))
+		jr.Error(fmt.Sprintf("%s", err))
 		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
 		return
 	}
 
-	// Shard IDs
-	var found bool = false
-outer:
-	for _, shardIdx := range res {
-		locations := datastore.fileLocator.ShardLocationsByIdStr(uuidToString(shardIdx.ShardId))
-		for _, location := range locations {
-			// log.Infof("%v", location)
-
-			// Request
-			uri := fmt.Sprintf("http://%s:%d/v1/local/file?filename=%s", location.Node, conf.HttpPort, file)
-			resp, err := http.Get(uri)
-			if err != nil {
-				log.Warnf("Failed to request %s: %s", uri, err)
-
-				// Attempt next location
-				continue
-			}
-			// Read body
-			defer resp.Body.Close()
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Warnf("Failed to ready body from %s: %s", uri, err)
-
-				// Attempt next location
-				continue
-			}
-
-			// Forward headers
-			for header, values := range r.Header {
-				for _, value := range values {
-					w.Header().Add(header, value)
-				}
-			}
-
-			// Output body
-			w.Write(body)
-
-			// Done
-			found = true
-
-			// Done
-			break outer
+	// Forward headers
+	for header, values := range r.Header {
+		for _, value := range values {
+			w.Header().Add(header, value)
 		}
 	}
+	if res.Degraded {
+		w.Header().Set("X-Xyzfs-Degraded-Read", "1")
+	}
+	w.Header().Set(FILE_VERSION_HEADER, res.VersionId)
+	if res.Codec != NoneCompressionCodec {
+		w.Header().Set("Content-Encoding", res.Codec.ContentEncoding())
+	}
+
+	// Output body
+	w.Write(res.Data)
+}
+
+// Delete file, the space is reclaimed when the shard is compacted
+func DeleteFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Get filename
+	file := strings.TrimSpace(r.URL.Query().Get("filename"))
+	if len(file) < 1 {
+		jr.Error("Please provide the 'filename' as query parameter")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Chunks are only deleted with the large file
+	if isFileChunkName(file) {
+		w.WriteHeader(http.StatusBadRequest)
+		jr.Error(fmt.Sprintf("%s", errReservedFileName))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
 
-	// Did we find?
-	if found == false {
+	// Delete version, all versions if none given
+	deleted, err := datastore.DeleteFileVersion(file, strings.TrimSpace(r.URL.Query().Get("version")))
+	if err != nil {
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+	if deleted == 0 {
 		restServer.notFound(w)
 		jr.Error("File not found")
 		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
 		return
 	}
+
+	// Response
+	jr.Set("deleted", deleted)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
+
+// Versions of a file, newest first
+func GetFileVersions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Get filename
+	file := strings.TrimSpace(r.URL.Query().Get("filename"))
+	if len(file) < 1 {
+		jr.Error("Please provide the 'filename' as query parameter")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Versions
+	versions, err := datastore.FileVersions(file)
+	if err != nil {
+		restServer.notFound(w)
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Response
+	jr.Set("versions", versions)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
 }
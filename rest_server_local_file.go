@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/RobinUS2/golang-jresp"
 	"github.com/julienschmidt/httprouter"
@@ -28,36 +29,20 @@ func GetLocalFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
-	// Locate
-	indices, _, e := datastore.LocateFile(file)
-	if e != nil {
-		restServer.notFound(w)
-		jr.Error(fmt.Sprintf("%s", e))
-		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
-		return
-	}
-
-	// Find local shard
+	// Read version, latest if none given, from the shard if the requesting node located it
+	var fileBytes []byte
+	var meta *FileMeta
 	var fileReadErr error
-	var fileBytes []byte = nil
-	for _, resIdx := range indices {
-		shard := datastore.LocalShardByIdStr(uuidToString(resIdx.ShardId))
-		if shard == nil {
-			continue
-		}
-		fileBytes, fileReadErr, _ = shard.ReadFile(file)
-		if fileReadErr == nil {
-			// log.Infof("Read local file bytes: %v", fileBytes)
-			break
-		} else {
-			log.Warnf("Failed to read local file %s: %s", file, fileReadErr)
-		}
-	}
-
-	// Did we read?
-	if fileBytes == nil {
+	version := strings.TrimSpace(r.URL.Query().Get("version"))
+	if shardId := strings.TrimSpace(r.URL.Query().Get("shard")); len(shardId) > 0 {
+		fileBytes, meta, fileReadErr = datastore._readLocalShardVersion(shardId, file, version)
+	} else {
+		fileBytes, meta, fileReadErr = datastore._readLocalVersion(file, version)
+	}
+	if fileReadErr != nil {
+		log.Warnf("Failed to read local file %s: %s", file, fileReadErr)
 		restServer.notFound(w)
-		jr.Error("Unable to read file locally")
+		jr.Error(fmt.Sprintf("%s", fileReadErr))
 		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
 		return
 	}
@@ -75,5 +60,104 @@ func GetLocalFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileBaseName))
 	w.Header().Set("Content-Type", fileContentType)
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(fileBytes)))
+	w.Header().Set(FILE_VERSION_HEADER, meta.VersionId())
+	if meta.Chunked {
+		w.Header().Set(CHUNKED_FILE_HEADER, "1")
+	}
+	if meta.Expires > 0 {
+		w.Header().Set(FILE_EXPIRES_HEADER, fmt.Sprintf("%d", meta.Expires))
+	}
+	if meta.IsCompressed() {
+		w.Header().Set(FILE_CODEC_HEADER, meta.Codec.String())
+		w.Header().Set(FILE_RAW_SIZE_HEADER, fmt.Sprintf("%d", meta.RawSize))
+	}
 	w.Write(fileBytes)
 }
+
+// Delete file from a local shard
+func DeleteLocalFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Get filename
+	file := strings.TrimSpace(r.URL.Query().Get("filename"))
+	if len(file) < 1 {
+		jr.Error("Please provide the 'filename' as query parameter")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Shard
+	shard := datastore.LocalShardByIdStr(strings.TrimSpace(r.URL.Query().Get("shard")))
+	if shard == nil {
+		restServer.notFound(w)
+		jr.Error("Shard not found")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Delete version, all versions if none given
+	var res bool
+	var err error
+	if version := strings.TrimSpace(r.URL.Query().Get("version")); len(version) > 0 {
+		res, err = shard.DeleteFileVersion(file, version)
+	} else {
+		res, err = shard.DeleteFile(file)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+	if !res {
+		restServer.notFound(w)
+		jr.Error("File not found")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Response
+	jr.Set("deleted", true)
+	jr.OK()
+	fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+}
+
+// Versions of a file in a local shard (used to find the latest version across shards)
+func GetLocalFileVersions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Shard
+	shard := datastore.LocalShardByIdStr(strings.TrimSpace(r.URL.Query().Get("shard")))
+	if shard == nil || shard.Parity {
+		restServer.notFound(w)
+		jr.Error("Shard not found")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Versions
+	b, err := json.Marshal(shard.ShardFileMeta().Versions(strings.TrimSpace(r.URL.Query().Get("filename"))))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
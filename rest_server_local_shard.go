@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RobinUS2/golang-jresp"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Get raw byte range of local shard (used for degraded reads)
+func GetLocalShardRange(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Shard
+	shard := datastore.LocalShardByIdStr(strings.TrimSpace(r.URL.Query().Get("shard")))
+	if shard == nil {
+		restServer.notFound(w)
+		jr.Error("Shard not found on this node")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Range
+	offset, offsetErr := strconv.ParseUint(r.URL.Query().Get("offset"), 10, 64)
+	length, lengthErr := strconv.ParseUint(r.URL.Query().Get("length"), 10, 64)
+	if offsetErr != nil || lengthErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jr.Error("Please provide the 'offset' and 'length' as query parameters")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Read
+	b, err := shard.ReadRange(offset, length)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		jr.Error(fmt.Sprintf("%s", err))
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	w.Write(b)
+}
+
+// Get copy of file meta from local parity shard (used for degraded reads)
+func GetLocalShardFileMeta(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// Response object
+	jr := jresp.NewJsonResp()
+
+	// Auth
+	if !restServer.auth(r) {
+		restServer.notAuthorized(w)
+		return
+	}
+
+	// Shard
+	shard := datastore.LocalShardByIdStr(strings.TrimSpace(r.URL.Query().Get("shard")))
+	if shard == nil || !shard.Parity {
+		restServer.notFound(w)
+		jr.Error("Parity shard not found on this node")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Data shard index
+	index, indexErr := strconv.ParseUint(r.URL.Query().Get("index"), 10, 32)
+	if indexErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jr.Error("Please provide the 'index' as query parameter")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	// Meta
+	meta := shard.ShardFileMeta().GetCopyByName(strings.TrimSpace(r.URL.Query().Get("filename")), uint32(index))
+	if meta == nil {
+		restServer.notFound(w)
+		jr.Error("File meta not found")
+		fmt.Fprint(w, jr.ToString(restServer.PrettyPrint))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(meta.Bytes())
+}
@@ -14,6 +14,10 @@ type Runtime struct {
 	Id   string
 	Node string
 
+	// Operational mode of this node (e.g. draining), persisted so it survives restarts
+	Mode      GossipNodeMode
+	ModeUntil uint32 // Unix timestamp after which the mode falls back to normal, 0 = no limit
+
 	mux sync.RWMutex
 }
 
@@ -48,6 +52,34 @@ func (this *Runtime) GetNode() string {
 	return this.Node
 }
 
+// Is this node referring to ourselves?
+func (this *Runtime) IsLocalNode(node string) bool {
+	return node == this.GetNode() || node == "localhost" || node == "127.0.0.1"
+}
+
+// Set mode
+func (this *Runtime) SetMode(mode GossipNodeMode, until uint32) {
+	this.mux.Lock()
+	var shouldSave bool = (mode != this.Mode || until != this.ModeUntil)
+	this.Mode = mode
+	this.ModeUntil = until
+	this.mux.Unlock()
+	if shouldSave {
+		log.Infof("Node mode is now %s", mode)
+		go this.Save(fmt.Sprintf("%s/runtime.json", conf.MetaBasePath))
+	}
+}
+
+// Get mode, expired modes fall back to normal
+func (this *Runtime) GetMode() (GossipNodeMode, uint32) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	if this.ModeUntil > 0 && this.ModeUntil < unixTsUint32() {
+		return NormalGossipNodeMode, 0
+	}
+	return this.Mode, this.ModeUntil
+}
+
 // New runtime
 func newRuntime() *Runtime {
 	var runtimeFilePath string = fmt.Sprintf("%s/runtime.json", conf.MetaBasePath)
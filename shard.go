@@ -1,13 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"os"
 	"sync"
+	"sync/atomic"
 )
 
 // Shard is a partial piece of data in a block
@@ -21,9 +23,15 @@ type Shard struct {
 	BlockIndex uint   // Numeric index (from to 0 to number_of_data_shards+number_of_parity_shards), used to align the shards before a restore using Reed Solomon
 	Parity     bool   // Is this real data or parity?
 
+	// Temporary shards live in memory only, without block
+	temporary bool
+
 	// Block reference
 	block *Block
 
+	// Shard file outside the volume layout (e.g. opened by a command)
+	path string
+
 	// Buffer mode
 	bufferMode    ShardBufferMode
 	bufferModeMux sync.RWMutex
@@ -31,11 +39,11 @@ type Shard struct {
 	// Byte buffers, file contents only
 	contents       *bytes.Buffer // Actual byte buffer in-memory, is lazy loaded, use Contents() method to get
 	contentsMux    sync.RWMutex
-	contentsOffset uint32
+	contentsOffset uint64
 
 	// Allocated capacity, this is used to acquire data in a shard to write data (a file) to
 	allocationMux       sync.RWMutex
-	allocatedBytesCount uint32
+	allocatedBytesCount uint64
 
 	// File metadata, recovered from byte buffers on disk
 	shardFileMeta *ShardFileMeta
@@ -50,9 +58,20 @@ type Shard struct {
 	isLoaded    bool
 	isLoadedMux sync.RWMutex
 
+	// File meta of idle sealed shards is evicted to stay within the memory budget, the index and shard meta stay loaded
+	fileMetaEvicted   bool
+	evictedLiveBytes  uint64 // Live bytes at eviction, evicted file meta does not change
+	evictedDedupBytes uint64 // Deduplicated bytes at eviction
+	lastAccess        uint32 // Last use of the file meta (unix time)
+
 	// Is flushed? (is this written to disk?)
 	isFlushed    bool
 	isFlushedMux sync.RWMutex
+
+	// Compaction swaps the contents, reads and writes hold the read lock
+	compactMux    sync.RWMutex
+	mutations     uint64 // Number of adds and deletes, used to detect changes during compaction
+	writesStopped bool   // No adds or deletes (e.g. while the shard is drained to another node), set under the compaction lock
 }
 
 // Buffer mode
@@ -74,7 +93,7 @@ func (this *Shard) TestContainsFile(fullName string) bool {
 // Get shard index
 func (this *Shard) ShardIndex() *ShardIndex {
 	// Lazy load?
-	this.Load()
+	this._loadIndex()
 
 	// Return
 	return this.shardIndex
@@ -83,29 +102,42 @@ func (this *Shard) ShardIndex() *ShardIndex {
 // Get shard meta
 func (this *Shard) ShardMeta() *ShardMeta {
 	// Lazy load?
-	this.Load()
+	this._loadIndex()
 
 	// Return
 	return this.shardMeta
 }
 
-// Get shard meta
+// Get shard file meta, empty if evicted file meta can not be read again (the files can not be read from this shard then)
 func (this *Shard) ShardFileMeta() *ShardFileMeta {
 	// Lazy load?
 	this.Load()
 
 	// Return
+	this.isLoadedMux.RLock()
+	defer this.isLoadedMux.RUnlock()
+	if this.shardFileMeta == nil {
+		return newShardFileMeta()
+	}
 	return this.shardFileMeta
 }
 
 // Allocate space, returns true if
-func (this *Shard) AllocateCapacity(n uint32) bool {
+func (this *Shard) AllocateCapacity(n uint64) bool {
+	// Sealed blocks accept no more writes
+	if this.Block() != nil && this.Block().IsSealed() {
+		return false
+	}
+	if this.WritesStopped() {
+		return false
+	}
+
 	// Lock
 	this.allocationMux.Lock()
 	defer this.allocationMux.Unlock()
 
 	// Available
-	available := uint32(conf.ShardSizeInBytes) - this.contentsOffset
+	available := shardCapacity() - this.contentsOffset
 
 	// Does it fit?
 	if available >= n {
@@ -119,39 +151,210 @@ func (this *Shard) AllocateCapacity(n uint32) bool {
 	return false
 }
 
+// Stop adds and deletes, waits for the ones in progress
+func (this *Shard) StopWrites() {
+	this.compactMux.Lock()
+	this.writesStopped = true
+	this.compactMux.Unlock()
+}
+
+// Accept adds and deletes again
+func (this *Shard) ResumeWrites() {
+	this.compactMux.Lock()
+	this.writesStopped = false
+	this.compactMux.Unlock()
+}
+
+// Are adds and deletes stopped?
+func (this *Shard) WritesStopped() bool {
+	this.compactMux.RLock()
+	defer this.compactMux.RUnlock()
+	return this.writesStopped
+}
+
+// Allocated bytes
+func (this *Shard) AllocatedBytes() uint64 {
+	this.allocationMux.RLock()
+	defer this.allocationMux.RUnlock()
+	return this.allocatedBytesCount
+}
+
+// Is temporary (memory only)?
+func (this *Shard) IsTemporary() bool {
+	return this.temporary
+}
+
+// Free bytes
+func (this *Shard) FreeBytes() uint64 {
+	this.contentsMux.RLock()
+	defer this.contentsMux.RUnlock()
+	if this.contentsOffset >= shardCapacity() {
+		return 0
+	}
+	return shardCapacity() - this.contentsOffset
+}
+
+// Bytes of contents a shard can hold, at most 4 GB until all nodes support 64-bit sizes
+func shardCapacity() uint64 {
+	n := uint64(conf.ShardSizeInBytes)
+	if max := clusterMaxSize(); n > max {
+		return max
+	}
+	return n
+}
+
 // Read contents
 // - locking should be done in the buffer itself
 func (this *Shard) Contents() *bytes.Buffer {
-	// @todo read from disk
 	if this.contents == nil {
+		// Read from disk
+		if this.contentsOffset > 0 {
+			b, err := this._readContentsFromDisk(0, this.contentsOffset)
+			if err == nil {
+				this.contents = bytes.NewBuffer(b)
+				return this.contents
+			}
+			log.Errorf("Failed to read contents of shard %s from disk: %s", this.IdStr(), err)
+		}
 		this.contents = bytes.NewBuffer(make([]byte, 0))
 	}
 	return this.contents
 }
 
+// Read contents from disk
+func (this *Shard) _readContentsFromDisk(offset uint64, length uint64) ([]byte, error) {
+	f, err := this._openFile()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, length)
+	_, readErr := f.ReadAt(b, int64(offset))
+	if readErr != nil {
+		this._registerIOError(readErr)
+		return nil, readErr
+	}
+	return b, nil
+}
+
+// Register I/O error with the volume
+func (this *Shard) _registerIOError(err error) {
+	if this.Block() != nil && this.Block().Volume() != nil {
+		this.Block().Volume().RegisterIOError(err)
+	}
+}
+
+// Read raw content bytes (works for parity too), regions beyond the contents are zero padded as during erasure coding
+func (this *Shard) ReadRange(offset uint64, length uint64) ([]byte, error) {
+	this.compactMux.RLock()
+	defer this.compactMux.RUnlock()
+
+	if offset+length < offset || offset+length > uint64(conf.ShardSizeInBytes) {
+		return nil, errors.New(fmt.Sprintf("Range %d-%d exceeds shard size", offset, offset+length))
+	}
+	b := make([]byte, length)
+
+	// Make sure loaded, the file meta is not needed
+	this._loadIndex()
+
+	// In-memory
+	this.contentsMux.RLock()
+	if this.contents != nil {
+		defer this.contentsMux.RUnlock()
+		buf := this.contents.Bytes()
+		if offset < uint64(len(buf)) {
+			copy(b, buf[offset:])
+		}
+		return b, nil
+	}
+	contentsLength := this.contentsOffset
+	this.contentsMux.RUnlock()
+
+	// From disk
+	if offset < contentsLength {
+		n := contentsLength - offset
+		if n > length {
+			n = length
+		}
+		diskBytes, err := this._readContentsFromDisk(offset, n)
+		if err != nil {
+			return nil, err
+		}
+		copy(b, diskBytes)
+	}
+	return b, nil
+}
+
+// Copy block layout into the index, so other nodes can find the other shards of the block
+func (this *Shard) _syncIndexBlockInfo() {
+	if this.shardIndex != nil && this.Block() != nil {
+		this.shardIndex.SetBlockInfo(this.Block().Id, uint32(this.BlockIndex), this.Parity, uint32(this.Block().DataShardCount()), uint32(this.Block().ParityShardCount()))
+	}
+}
+
+// Mark as changed, will be written on the next persist
+func (this *Shard) _markDirty() {
+	this.isFlushedMux.Lock()
+	this.isFlushed = false
+	this.isFlushedMux.Unlock()
+}
+
+// Keep a copy of the file metadata of the data shards of the block (parity only)
+func (this *Shard) _setDataShardsFileMeta(dataShards []*Shard) {
+	fm := newShardFileMeta()
+	for _, ds := range dataShards {
+		sfm := ds.ShardFileMeta()
+		sfm.mux.RLock()
+		for _, m := range sfm.FileMeta {
+			c := *m
+			c.DataShardIndex = uint32(ds.BlockIndex)
+			fm.Add(&c)
+		}
+		sfm.mux.RUnlock()
+	}
+	this.shardFileMeta = fm
+}
+
 // Persist
-func (this *Shard) Persist() {
+func (this *Shard) Persist() error {
+	// Memory only
+	if this.temporary {
+		return nil
+	}
+
 	// Only persist if this one is dirty / not-flushed before
 	this.isFlushedMux.Lock()
 	defer this.isFlushedMux.Unlock()
 	if this.isFlushed {
 		log.Debugf("Not persisting shard %s as this is already flushed")
-		return
+		return nil
 	}
 
 	// Make sure is loaded
 	this.Load()
 
+	// Loaded from disk without in-memory contents? Then the version on disk is the latest
+	this.contentsMux.RLock()
+	onDiskOnly := this.contents == nil && this.contentsOffset > 0
+	this.contentsMux.RUnlock()
+	if onDiskOnly {
+		this.isFlushed = true
+		return nil
+	}
+
 	// Make sure block folder is prepared
 	this.Block().PrepareFolder()
 
 	// @todo better writing to files, guaranteeing no data corruption
 	path := this.FullPath()
 	log.Infof("Persisting shard %s to disk in %s", this.IdStr(), path)
+	volume := this.Block().Volume()
+	atomic.AddInt32(&volume.activeWrites, 1)
 	err := ioutil.WriteFile(path, this._toBinaryFormat(), conf.UnixFilePermissions)
+	atomic.AddInt32(&volume.activeWrites, -1)
 	if err != nil {
-		// @tood handle better
-		panic(err)
+		this._registerIOError(err)
+		return err
 	}
 
 	// Send full index over wire
@@ -160,6 +363,85 @@ func (this *Shard) Persist() {
 
 	// Done
 	this.isFlushed = true
+	return nil
+}
+
+// Write file meta, index, wrapped data key and shard meta again (e.g. after key rotation or to upgrade the format), the contents stay as they are
+func (this *Shard) _rewriteFooter() error {
+	if this.temporary {
+		return nil
+	}
+
+	// No compaction or writes while the footer is replaced
+	this.compactMux.Lock()
+	defer this.compactMux.Unlock()
+
+	// File meta is part of the footer, read it again if evicted
+	if _, err := this.Load(); err != nil {
+		return err
+	}
+
+	// Changes that are not on disk yet? Then the next persist writes the new footer
+	this.isFlushedMux.Lock()
+	flushed := this.isFlushed
+	this.isFlushedMux.Unlock()
+	this.contentsMux.RLock()
+	onDiskOnly := this.contents == nil && this.contentsOffset > 0
+	this.contentsMux.RUnlock()
+	if !flushed && !onDiskOnly {
+		return this.Persist()
+	}
+
+	// Footer
+	this.contentsMux.Lock()
+	footer := this._footerToBinaryFormat()
+	this.shardMeta.mux.RLock()
+	offset := int64(this.shardMeta.ContentsLength)
+	this.shardMeta.mux.RUnlock()
+	this.contentsMux.Unlock()
+
+	// Contents and new footer into a temporary file, then moved into place (a crash leaves the old shard intact)
+	if err := this._writeFooterAtomic(footer, offset); err != nil {
+		this._registerIOError(err)
+		return err
+	}
+	return nil
+}
+
+// Write the contents on disk up to the offset followed by the footer, atomic by writing a temporary file first
+func (this *Shard) _writeFooterAtomic(footer []byte, offset int64) error {
+	tmpPath := fmt.Sprintf("%s.footer", this.FullPath())
+	if this.Block() != nil && this.Block().Volume() != nil {
+		volume := this.Block().Volume()
+		atomic.AddInt32(&volume.activeWrites, 1)
+		defer atomic.AddInt32(&volume.activeWrites, -1)
+	}
+	src, err := this._openFile()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, conf.UnixFilePermissions)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(dst, src, offset)
+	if err == nil {
+		_, err = dst.Write(footer)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, this.FullPath())
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
 }
 
 // Reset loaded
@@ -169,13 +451,148 @@ func (this *Shard) ResetLoaded() {
 	this.isLoadedMux.Unlock()
 }
 
-// Load from disk
+// Can the file meta be evicted? Only of sealed shards in a volume (no more writes), deletes read it again
+func (this *Shard) IsEvictable() bool {
+	return !this.temporary && len(this.path) == 0 && this.Block() != nil && this.Block().IsSealed()
+}
+
+// Evict the file meta (and contents that are on disk) of a shard that was not used for the idle time, false if nothing was evicted
+// the index and shard meta stay loaded so files can still be located
+func (this *Shard) EvictFileMeta(minIdle uint32) bool {
+	if !this.IsEvictable() {
+		return false
+	}
+
+	// No reads, writes or compaction in progress
+	this.compactMux.Lock()
+	defer this.compactMux.Unlock()
+
+	// Changes that are not on disk yet stay
+	this.isFlushedMux.RLock()
+	flushed := this.isFlushed
+	this.isFlushedMux.RUnlock()
+
+	this.isLoadedMux.Lock()
+	defer this.isLoadedMux.Unlock()
+	if !this.isLoaded || this.fileMetaEvicted || unixTsUint32()-atomic.LoadUint32(&this.lastAccess) < minIdle {
+		return false
+	}
+
+	// Contents in memory must be on disk (shards loaded from disk without contents are)
+	this.contentsMux.Lock()
+	defer this.contentsMux.Unlock()
+	this.shardMeta.mux.RLock()
+	contentsLength := this.shardMeta.ContentsLength
+	this.shardMeta.mux.RUnlock()
+	if this.contents != nil && (!flushed || uint64(this.contents.Len()) != contentsLength) {
+		return false
+	}
+
+	// Evict, contents are read from disk again as after loading
+	this.evictedLiveBytes = this.shardFileMeta.LiveBytes()
+	this.evictedDedupBytes = this.shardFileMeta.DedupBytes()
+	this.shardFileMeta = nil
+	this.fileMetaEvicted = true
+	if this.contents != nil {
+		this.contents = nil
+		this.contentsOffset = contentsLength
+	}
+	return true
+}
+
+// Memory of the file meta (encoded size as estimate) and contents that can be evicted
+func (this *Shard) EvictableBytes() uint64 {
+	var n uint64 = 0
+	this.isLoadedMux.RLock()
+	if !this.isLoaded {
+		this.isLoadedMux.RUnlock()
+		return 0
+	}
+	if !this.fileMetaEvicted {
+		this.shardMeta.mux.RLock()
+		n += this.shardMeta.FileMetaLength
+		this.shardMeta.mux.RUnlock()
+	}
+	this.isLoadedMux.RUnlock()
+	this.contentsMux.RLock()
+	if this.contents != nil {
+		n += uint64(this.contents.Len())
+	}
+	this.contentsMux.RUnlock()
+	return n
+}
+
+// Is the file meta evicted?
+func (this *Shard) IsFileMetaEvicted() bool {
+	this.isLoadedMux.RLock()
+	defer this.isLoadedMux.RUnlock()
+	return this.isLoaded && this.fileMetaEvicted
+}
+
+// Last use of the file meta (unix time)
+func (this *Shard) LastAccess() uint32 {
+	return atomic.LoadUint32(&this.lastAccess)
+}
+
+// Load from disk, evicted file meta is read again (shards in an older format are upgraded by the shard upgrader)
 func (this *Shard) Load() (bool, error) {
+	return this._load(true)
+}
+
+// Load from disk without reading evicted file meta again (e.g. to test the index)
+func (this *Shard) _loadIndex() (bool, error) {
+	return this._load(false)
+}
+
+// Is loaded?
+func (this *Shard) IsLoaded() bool {
+	this.isLoadedMux.RLock()
+	defer this.isLoadedMux.RUnlock()
+	return this.isLoaded
+}
+
+// Should the format on disk be upgraded? Shards opened by path (e.g. commands) are left as they are
+func (this *Shard) NeedsUpgrade() bool {
+	if this.temporary || len(this.path) > 0 || !this.IsLoaded() {
+		return false
+	}
+	meta := this.ShardMeta()
+	meta.mux.RLock()
+	defer meta.mux.RUnlock()
+	return meta.MetaVersion < clusterFormatVersion()
+}
+
+// Upgrade the format on disk to the newest format of the cluster, the contents stay as they are
+func (this *Shard) UpgradeFormat() error {
+	if !this.NeedsUpgrade() {
+		return nil
+	}
+	if err := this._rewriteFooter(); err != nil {
+		return err
+	}
+	log.Infof("Upgraded shard %s to version %d", this.IdStr(), this.ShardMeta().MetaVersion)
+	return nil
+}
+
+// Load from disk, with or without the evicted file meta
+func (this *Shard) _load(fileMeta bool) (bool, error) {
 	this.isLoadedMux.Lock()
 	defer this.isLoadedMux.Unlock()
+	if fileMeta {
+		atomic.StoreUint32(&this.lastAccess, unixTsUint32())
+	}
 
 	// Already loaded
 	if this.isLoaded {
+		// Evicted file meta
+		if fileMeta && this.fileMetaEvicted {
+			if err := this._reloadFileMeta(); err != nil {
+				log.Errorf("Failed to reload file meta of shard %s from disk in %s: %s", this.IdStr(), this.FullPath(), err)
+				this._registerIOError(err)
+				return false, err
+			}
+		}
+
 		// Yes
 		return true, nil
 	}
@@ -189,13 +606,22 @@ func (this *Shard) Load() (bool, error) {
 		return false, e
 	}
 
+	// Contents that can be deduplicated
+	if dedupIndex != nil && !this.Parity {
+		dedupIndex._registerShardFileMeta(this, this.shardFileMeta)
+	}
+
 	// Done
 	this.isLoaded = true
+	this.fileMetaEvicted = false
 	return true, nil
 }
 
 // Full path
 func (this *Shard) FullPath() string {
+	if len(this.path) > 0 {
+		return this.path
+	}
 	var infix string = ""
 	if this.Parity {
 		infix = ".parity"
@@ -228,70 +654,158 @@ func (this *Shard) ReadFile(filename string) ([]byte, error, bool) {
 		panic("Can not read file directly for parity shard")
 	}
 
+	this.compactMux.RLock()
+	defer this.compactMux.RUnlock()
+
 	// Get meta
-	meta := this.ShardFileMeta().GetByName(filename)
+	meta := this._fileMetaByName(filename).GetByName(filename)
 
 	// Meta found?
 	if meta == nil {
 		return nil, errors.New("File not found"), false
 	}
+	return this._readFile(meta)
+}
 
+// File meta with the versions of a file, evicted file meta is searched by its name index on disk instead of read again
+func (this *Shard) _fileMetaByName(name string) *ShardFileMeta {
+	sfm, err := this._lookupEvictedFileMeta(name)
+	if err != nil {
+		log.Warnf("Failed to look up %s in evicted file meta of shard %s: %s", name, this.IdStr(), err)
+	}
+	if sfm == nil {
+		return this.ShardFileMeta()
+	}
+	return sfm
+}
+
+// Read specific version of a file
+func (this *Shard) ReadFileVersion(filename string, versionId string) ([]byte, error, bool) {
+	// Only on data shards
+	if this.Parity {
+		panic("Can not read file directly for parity shard")
+	}
+
+	this.compactMux.RLock()
+	defer this.compactMux.RUnlock()
+
+	meta := this._fileMetaByName(filename).GetVersion(filename, versionId)
+	if meta == nil {
+		return nil, errors.New("File version not found"), false
+	}
+	return this._readFile(meta)
+}
+
+// Read file bytes by meta, hot files read from disk are cached
+func (this *Shard) _readFile(meta *FileMeta) ([]byte, error, bool) {
+	var key string
+	var since uint64
+	if fileCache != nil {
+		key = fileCacheShardKey(this.IdStr(), meta)
+		if res := fileCache.Get(key); res != nil {
+			return res.Data, nil, true
+		}
+		since = fileCache.Seq()
+	}
+	b, err, fromMemory := this._readStoredFile(meta)
+	if err != nil {
+		return nil, err, fromMemory
+	}
+	b, err = this._decryptFile(meta, b)
+	if err == nil && !fromMemory && fileCache != nil {
+		fileCache.Put(key, meta.FullName, &FileReadResult{Data: b, VersionId: meta.VersionId()}, since)
+	}
+	return b, err, fromMemory
+}
+
+// Read stored bytes of a file by meta (e.g. encrypted)
+func (this *Shard) _readStoredFile(meta *FileMeta) ([]byte, error, bool) {
 	// Support reading from this.Contents() in-memory buffer (E.g. during writes on this shard)
 	// log.Infof("Contents on read file %v", this.contents)
 	this.contentsMux.RLock()
-	if this.contents != nil && uint32(this.contents.Len()) >= meta.StartOffset+meta.Size {
+	if this.contents != nil && uint64(this.contents.Len()) >= meta.StartOffset+meta.Size {
 		defer this.contentsMux.RUnlock()
 		// log.Infof("Reading file at %d until %d from %s", meta.StartOffset, meta.StartOffset+meta.Size, this.IdStr())
 		return this.contents.Bytes()[meta.StartOffset : meta.StartOffset+meta.Size], nil, true
 	}
 	this.contentsMux.RUnlock()
 
-	// Open file on disk for random read
-	f, err := this._openFile()
-	defer f.Close()
-	if err != nil {
-		return nil, err, false
-	}
-
-	// Seek to start of file
-	f.Seek(int64(meta.StartOffset), 0)
-
-	// New reader
-	buf := bufio.NewReader(f)
-
-	// Buffer
-	fileBytes := make([]byte, int(meta.Size))
-
-	// Read
-	fileBytesRead, readE := buf.Read(fileBytes)
+	// Read only the file from disk at its offset
+	fileBytes, readE := this._readContentsFromDisk(meta.StartOffset, meta.Size)
 	if readE != nil {
 		return nil, readE, false
 	}
 
-	// Validate size and read
-	if int(meta.Size) != fileBytesRead {
-		return nil, errors.New("File bytes read mismatch"), false
-	}
-
 	// Validate CRC
 	readCrc := crc32.Checksum(fileBytes, crcTable)
 	if readCrc != meta.Checksum {
 		if meta.Size < 1024 {
 			log.Errorf("File bytes with wrong CRC: %v %s", fileBytes, string(fileBytes))
 		}
-		return nil, errors.New(fmt.Sprintf("CRC checksum mismatch, was %d (len %d) expected %d (len %d)", readCrc, len(fileBytes), meta.Checksum, meta.Size)), false
+		crcErr := errors.New(fmt.Sprintf("CRC checksum mismatch, was %d (len %d) expected %d (len %d)", readCrc, len(fileBytes), meta.Checksum, meta.Size))
+		this._registerIOError(crcErr)
+		return nil, crcErr, false
 	}
 
 	return fileBytes, nil, false
 }
 
+// Data key of the block, nil if not encrypted (e.g. temporary shards)
+func (this *Shard) _blockKey() *BlockKey {
+	if this.Block() == nil {
+		return nil
+	}
+	return keyring.BlockKey(this.Block().Id)
+}
+
+// Decrypt stored bytes of a file, as is if not encrypted
+func (this *Shard) _decryptFile(meta *FileMeta, b []byte) ([]byte, error) {
+	if !meta.IsEncrypted() {
+		return b, nil
+	}
+	bk := this._blockKey()
+	if bk == nil {
+		return nil, errors.New(fmt.Sprintf("Unable to decrypt %s, no data key for shard %s", meta.FullName, this.IdStr()))
+	}
+	return bk.OpenFile(meta, b)
+}
+
 // Add file
 func (this *Shard) AddFile(f *FileMeta, b []byte) (*FileMeta, error) {
+	res, overwritten, err := this._addFile(f, b)
+	if err != nil {
+		return nil, err
+	}
+	go datastore._deleteChunks(overwritten)
+	return res, nil
+}
+
+// Add file and write the shard, the add is undone if the shard can not be written so a retry elsewhere does not store the file twice
+func (this *Shard) AddFileAndPersist(f *FileMeta, b []byte) (*FileMeta, error) {
+	res, overwritten, err := this._addFile(f, b)
+	if err != nil {
+		return nil, err
+	}
+	if err := this.Persist(); err != nil {
+		this._undoAddFile(res, overwritten)
+		return nil, err
+	}
+	go datastore._deleteChunks(overwritten)
+	return res, nil
+}
+
+// Add file, returns the versions it overwrote (the chunks of these are not deleted yet)
+func (this *Shard) _addFile(f *FileMeta, b []byte) (*FileMeta, []*FileMeta, error) {
 	// Only on data shards
 	if this.Parity {
 		panic("Can not add file to parity shard")
 	}
 
+	// Sealed blocks are covered by parity, writes would leave it stale (e.g. a replicated write that arrives late)
+	if this.Block() != nil && this.Block().IsSealed() {
+		return nil, nil, errors.New(fmt.Sprintf("Can not add file to sealed block %s", this.Block().IdStr()))
+	}
+
 	// Validate mode
 	this.bufferModeMux.Lock()
 	if this.bufferMode == ReadShardBufferMode {
@@ -304,6 +818,19 @@ func (this *Shard) AddFile(f *FileMeta, b []byte) (*FileMeta, error) {
 	// Make sure loaded
 	this.Load()
 
+	// No compaction while writing
+	this.compactMux.RLock()
+	defer this.compactMux.RUnlock()
+
+	// Sealed while waiting for the lock? Sealing holds it from the sealed flag through parity
+	if this.Block() != nil && this.Block().IsSealed() {
+		return nil, nil, errors.New(fmt.Sprintf("Can not add file to sealed block %s", this.Block().IdStr()))
+	}
+	if this.writesStopped {
+		return nil, nil, errors.New(fmt.Sprintf("Shard %s does not accept writes", this.IdStr()))
+	}
+	atomic.AddUint64(&this.mutations, 1)
+
 	// We should flush again
 	this.isFlushedMux.Lock()
 	this.isFlushed = false
@@ -315,31 +842,65 @@ func (this *Shard) AddFile(f *FileMeta, b []byte) (*FileMeta, error) {
 	// Update metadata
 	f.UpdateFromData(b)
 
-	// Set start offset in shard
-	f.StartOffset = this.contentsOffset
-	log.Infof("Create file offset %d", f.StartOffset)
+	// Same contents already in this shard? Only reference them
+	existing := this.shardFileMeta.GetByContents(f)
+	if existing != nil {
+		f.StartOffset = existing.StartOffset
+		f.Size = existing.Size
+		f.Checksum = existing.Checksum
+		f.Nonce = existing.Nonce
+		log.Infof("Deduplicated file %s, contents at offset %d", f.FullName, f.StartOffset)
+	} else {
+		// Encryption at rest, replicas use the nonce of the primary and store the same bytes
+		if bk := this._blockKey(); bk != nil {
+			b = bk.SealFile(f, b)
+		} else if f.IsEncrypted() {
+			this.contentsMux.Unlock()
+			return nil, nil, errors.New(fmt.Sprintf("Unable to write encrypted file %s, no data key for shard %s", f.FullName, this.IdStr()))
+		}
+
+		// Set start offset in shard
+		f.StartOffset = this.contentsOffset
+		log.Infof("Create file offset %d", f.StartOffset)
 
-	// Write contents to buffer
-	this.Contents().Write(b)
+		// Write contents to buffer
+		this.Contents().Write(b)
 
-	// Update content offset
-	this.contentsOffset += f.Size
-	log.Infof("New contents offset %d", this.contentsOffset)
+		// Update content offset
+		this.contentsOffset += f.Size
+		log.Infof("New contents offset %d", this.contentsOffset)
+	}
 
 	// Unlock write
 	this.contentsMux.Unlock()
 
+	// Deduplication
+	if existing != nil {
+		dedupIndex.RecordHit(f)
+	} else {
+		dedupIndex.Register(this, f)
+	}
+
 	// Append meta
 	this.shardFileMeta.Add(f)
 
+	// Versions beyond the retention become dead bytes
+	overwritten := this.shardFileMeta.MarkOldVersions(f.FullName, conf.FileVersionRetention)
+	if len(overwritten) > 0 {
+		log.Infof("Removing %d old version(s) of file %s in shard %s", len(overwritten), f.FullName, this.IdStr())
+	}
+
 	// Update metadata
 	this.shardMeta.mux.Lock()
 	this.shardMeta.FileCount++
 	newCount := this.shardMeta.FileCount
 	this.shardMeta.mux.Unlock()
 
-	// Update index
+	// Update index, the overwritten versions are removed after the add so the name never goes missing
 	this.ShardIndex().Add(f.FullName)
+	for _, meta := range overwritten {
+		this.ShardIndex().Remove(meta.FullName)
+	}
 
 	// Log
 	log.Infof("Created file %s with size %d in shard %s, now contains %d file(s)", f.FullName, f.Size, this.IdStr(), newCount)
@@ -348,13 +909,222 @@ func (this *Shard) AddFile(f *FileMeta, b []byte) (*FileMeta, error) {
 	// @todo Remove this, we should only broadcast the changes
 	binaryTransport._broadcastShardIndex(this)
 
+	// Cached locations and contents of the file are stale (other nodes are told by the node that coordinates the write)
+	datastore.fileLocator.InvalidateLocation(f.FullName)
+	fileCache.Invalidate(f.FullName)
+
 	// Validate file in index
 	if this.TestContainsFile(f.FullName) == false {
 		panic(fmt.Sprintf("Unable to find file %s in index after creation", f.FullName))
 	}
 
 	// Done
-	return f, nil
+	return f, overwritten, nil
+}
+
+// Undo an add of which the shard could not be written: the version is marked deleted and the versions it overwrote are live again
+func (this *Shard) _undoAddFile(f *FileMeta, overwritten []*FileMeta) {
+	this.compactMux.RLock()
+	atomic.AddUint64(&this.mutations, 1)
+	this.shardFileMeta.MarkDeletedFunc(func(elm *FileMeta) bool {
+		return elm == f
+	})
+	this.shardFileMeta.MarkLive(overwritten)
+	this._markDirty()
+	this.compactMux.RUnlock()
+	log.Warnf("Undone add of file %s to shard %s, the shard could not be written", f.FullName, this.IdStr())
+
+	// Index, the restored versions are added before the undone one is removed so the name never goes missing
+	for _, meta := range overwritten {
+		this.ShardIndex().Add(meta.FullName)
+	}
+	this.ShardIndex().Remove(f.FullName)
+	binaryTransport._broadcastShardIndex(this)
+
+	// Cached locations and contents of the file are stale
+	datastore.fileLocator.InvalidateLocation(f.FullName)
+	fileCache.Invalidate(f.FullName)
+}
+
+// Delete file, the bytes are reclaimed by compaction
+func (this *Shard) DeleteFile(fullName string) (bool, error) {
+	deleted, err := this.DeleteFiles(func(meta *FileMeta) bool {
+		return meta.FullName == fullName
+	})
+	return len(deleted) > 0, err
+}
+
+// Delete specific version of a file
+func (this *Shard) DeleteFileVersion(fullName string, versionId string) (bool, error) {
+	deleted, err := this.DeleteFiles(func(meta *FileMeta) bool {
+		return meta.FullName == fullName && meta.VersionId() == versionId
+	})
+	return len(deleted) > 0, err
+}
+
+// Remove expired files, returns the files removed
+func (this *Shard) ExpireFiles(now uint32) ([]*FileMeta, error) {
+	return this.DeleteFiles(func(meta *FileMeta) bool {
+		return meta.IsExpired(now)
+	})
+}
+
+// Delete the live files that match, returns the files deleted
+func (this *Shard) DeleteFiles(match func(meta *FileMeta) bool) ([]*FileMeta, error) {
+	// Only on data shards
+	if this.Parity {
+		return nil, errors.New("Can not delete file from parity shard")
+	}
+
+	// Sealed blocks are covered by parity
+	if this.Block() != nil && this.Block().IsSealed() {
+		return nil, errors.New(fmt.Sprintf("Can not delete file from sealed block %s", this.Block().IdStr()))
+	}
+
+	// Make sure loaded
+	this.Load()
+
+	// No compaction while writing
+	this.compactMux.RLock()
+	if this.writesStopped {
+		this.compactMux.RUnlock()
+		return nil, errors.New(fmt.Sprintf("Shard %s does not accept writes", this.IdStr()))
+	}
+	deleted := this.shardFileMeta.MarkDeletedFunc(match)
+	if len(deleted) == 0 {
+		this.compactMux.RUnlock()
+		return deleted, nil
+	}
+	atomic.AddUint64(&this.mutations, 1)
+	this._markDirty()
+	this.compactMux.RUnlock()
+	for _, meta := range deleted {
+		if refs := this.shardFileMeta.ContentRefs(meta.StartOffset); meta.Size > 0 && refs > 0 {
+			log.Infof("Deleted file %s from shard %s, contents still referenced by %d file(s)", meta.FullName, this.IdStr(), refs)
+			continue
+		}
+		log.Infof("Deleted file %s from shard %s", meta.FullName, this.IdStr())
+	}
+
+	this._deindexFiles(deleted)
+
+	// Contents are written together with the file meta, read them if this was only loaded from disk
+	this.contentsMux.Lock()
+	this.Contents()
+	this.contentsMux.Unlock()
+
+	// Write
+	if err := this.Persist(); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// Mark the live files of a sealed block that match as deleted, returns the files marked
+// The contents are covered by parity and stay as they are, only the footer with the file meta is rewritten (the bytes are reclaimed when the block is dropped)
+func (this *Shard) DeleteSealedFiles(match func(meta *FileMeta) bool) ([]*FileMeta, error) {
+	if this.Parity {
+		return nil, errors.New("Can not delete file from parity shard")
+	}
+	if this.Block() == nil || !this.Block().IsSealed() {
+		return nil, errors.New(fmt.Sprintf("Block of shard %s is not sealed", this.IdStr()))
+	}
+
+	// Make sure loaded
+	if _, err := this.Load(); err != nil {
+		return nil, err
+	}
+
+	// No compaction while writing
+	this.compactMux.RLock()
+	if this.writesStopped {
+		this.compactMux.RUnlock()
+		return nil, errors.New(fmt.Sprintf("Shard %s does not accept writes", this.IdStr()))
+	}
+	deleted := this.shardFileMeta.MarkDeletedFunc(match)
+	if len(deleted) > 0 {
+		atomic.AddUint64(&this.mutations, 1)
+	}
+	this.compactMux.RUnlock()
+	if len(deleted) == 0 {
+		return deleted, nil
+	}
+	for _, meta := range deleted {
+		log.Infof("Deleted file %s from sealed shard %s", meta.FullName, this.IdStr())
+	}
+	this._deindexFiles(deleted)
+
+	// Write file meta
+	if err := this._rewriteFooter(); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// Files were deleted: their chunks are deleted, they are removed from the index and cached locations and contents are dropped
+func (this *Shard) _deindexFiles(deleted []*FileMeta) {
+	// Chunks of large files
+	go datastore._deleteChunks(deleted)
+
+	// Remove from index, other nodes stop locating the files here
+	var removed bool = false
+	for _, meta := range deleted {
+		if this.ShardIndex().Remove(meta.FullName) {
+			removed = true
+		}
+	}
+	if removed {
+		binaryTransport._broadcastShardIndex(this)
+	}
+
+	// Cached locations and contents of the files are stale (other nodes are told by the node that coordinates the delete)
+	invalidated := make(map[string]bool)
+	for _, meta := range deleted {
+		if invalidated[meta.FullName] {
+			continue
+		}
+		invalidated[meta.FullName] = true
+		datastore.fileLocator.InvalidateLocation(meta.FullName)
+		fileCache.Invalidate(meta.FullName)
+	}
+}
+
+// Bytes used by live files
+func (this *Shard) LiveBytes() uint64 {
+	// Evicted file meta is not read again, it did not change
+	this._loadIndex()
+	this.isLoadedMux.RLock()
+	if this.fileMetaEvicted {
+		defer this.isLoadedMux.RUnlock()
+		return this.evictedLiveBytes
+	}
+	this.isLoadedMux.RUnlock()
+	return this.ShardFileMeta().LiveBytes()
+}
+
+// Bytes saved by deduplicated files
+func (this *Shard) DedupBytes() uint64 {
+	// Evicted file meta is not read again, it did not change
+	this._loadIndex()
+	this.isLoadedMux.RLock()
+	if this.fileMetaEvicted {
+		defer this.isLoadedMux.RUnlock()
+		return this.evictedDedupBytes
+	}
+	this.isLoadedMux.RUnlock()
+	return this.ShardFileMeta().DedupBytes()
+}
+
+// Fraction of the contents used by live files, 1 if empty
+func (this *Shard) LiveRatio() float64 {
+	this._loadIndex()
+	this.contentsMux.RLock()
+	total := this.contentsOffset
+	this.contentsMux.RUnlock()
+	if total == 0 {
+		return 1
+	}
+	return float64(this.LiveBytes()) / float64(total)
 }
 
 func newShard(b *Block) *Shard {
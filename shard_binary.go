@@ -1,29 +1,32 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 )
 
+// Encrypted sections of a shard, the name is authenticated with the section
+const SHARD_FILE_META_SECTION string = "filemeta"
+const SHARD_INDEX_SECTION string = "index"
+
 // Byte writer to a shard
 
 // Write in-memory to bytes for disk
 func (this *Shard) _toBinaryFormat() []byte {
 	buf := new(bytes.Buffer)
 
-	// Re-usable byte array
-	var b []byte = nil
-
 	// Global read lock
 	this.contentsMux.Lock()
 
 	// Actual file contents
 	if this.contents != nil {
 		b := this.contents.Bytes()
-		this.shardMeta.SetContentsLength(uint32(len(b)))
+		this.shardMeta.SetContentsLength(uint64(len(b)))
 		buf.Write(b)
 		b = nil
 	} else {
@@ -31,26 +34,67 @@ func (this *Shard) _toBinaryFormat() []byte {
 		this.shardMeta.SetContentsLength(0)
 	}
 
+	// File meta, index and metadata
+	buf.Write(this._footerToBinaryFormat())
+
+	// Unlock
+	this.contentsMux.Unlock()
+
+	return buf.Bytes()
+}
+
+// Write file meta, index, wrapped data key and shard meta to bytes, these follow the contents (caller must hold the contents lock)
+func (this *Shard) _footerToBinaryFormat() []byte {
+	buf := new(bytes.Buffer)
+
+	// Re-usable byte array
+	var b []byte = nil
+
+	// Data key, the file meta and index are encrypted as well
+	bk := this._blockKey()
+
+	// Newest format all nodes can read, shards are sent to other nodes as is
+	version := clusterFormatVersion()
+
 	// File meta
-	b = this.shardFileMeta.Bytes()
-	this.shardMeta.SetFileMetaLength(uint32(len(b)))
-	buf.Write(this.shardFileMeta.Bytes())
+	if version < 2 {
+		b = this.shardFileMeta.Json()
+	} else {
+		b = this.shardFileMeta.Bytes()
+	}
+	if bk != nil {
+		b = bk.Seal(b, SHARD_FILE_META_SECTION)
+	}
+	this.shardMeta.SetFileMetaLength(uint64(len(b)))
+	buf.Write(b)
 	b = nil
 
 	// File index
+	this._syncIndexBlockInfo()
 	b = this.shardIndex.Bytes()
-	this.shardMeta.SetIndexLength(uint32(len(b)))
+	if bk != nil {
+		b = bk.Seal(b, SHARD_INDEX_SECTION)
+	}
+	this.shardMeta.SetIndexLength(uint64(len(b)))
 	buf.Write(b)
 	b = nil
 
+	// Wrapped data key
+	if bk != nil {
+		b = bk.Bytes()
+		this.shardMeta.SetKeyLength(uint32(len(b)))
+		buf.Write(b)
+		b = nil
+	} else {
+		this.shardMeta.SetKeyLength(0)
+	}
+
 	// Shard meta
+	this.shardMeta.SetMetaVersion(version)
 	log.Infof("Writing shard meta %v", this.shardMeta)
 	log.Debugf("Writing shard meta %v", this.shardMeta.Bytes())
 	buf.Write(this.shardMeta.Bytes())
 
-	// Unlock
-	this.contentsMux.Unlock()
-
 	return buf.Bytes()
 }
 
@@ -59,7 +103,42 @@ func (this *Shard) _openFile() (*os.File, error) {
 	return os.Open(this.FullPath())
 }
 
-// Read to memory structure from binary on disk
+// Length and checksum (crc32) of the shard file on disk
+func (this *Shard) FileChecksum() (uint64, uint32, error) {
+	f, err := this._openFile()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	hasher := crc32.New(crcTable)
+	n, err := io.Copy(hasher, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(n), hasher.Sum32(), nil
+}
+
+// Is the shard on disk identical to the copy with the shard meta, length and checksum of another node?
+func (this *Shard) _isCopy(shardMeta *ShardMeta, totalLength uint64, checksum uint32) bool {
+	if err := this.Persist(); err != nil {
+		return false
+	}
+	if !this.ShardMeta().Equals(shardMeta) {
+		return false
+	}
+	n, c, err := this.FileChecksum()
+	return err == nil && n == totalLength && c == checksum
+}
+
+// Does the shard on disk have the shard meta of a known version (e.g. the version before another node compacted its copy)?
+func (this *Shard) _isReplicaOf(shardMeta *ShardMeta) bool {
+	if err := this.Persist(); err != nil {
+		return false
+	}
+	return this.ShardMeta().Equals(shardMeta)
+}
+
+// Read to memory structure from binary on disk, a damaged file returns an error
 func (this *Shard) _fromBinaryFormat() (bool, error) {
 	// Open file
 	f, err := this._openFile()
@@ -73,64 +152,72 @@ func (this *Shard) _fromBinaryFormat() (bool, error) {
 	if fierr != nil {
 		return false, errors.New("Failed to stat file")
 	}
-	flen := fi.Size()
+	return this._fromBinaryReader(f, fi.Size())
+}
 
-	// Go to last byte to determine size of metadata
-	f.Seek(flen-4, 0)
-	buf := bufio.NewReader(f)
-	var metadataLength uint32
-	binary.Read(buf, binary.BigEndian, &metadataLength)
-	log.Debugf("Meta is size of %d", metadataLength)
+// Read to memory structure from the binary format of the given length (e.g. a shard file)
+func (this *Shard) _fromBinaryReader(f io.ReaderAt, flen int64) (res bool, err error) {
+	// Parsing a damaged section panics, report it as error
+	defer func() {
+		if r := recover(); r != nil {
+			res = false
+			err = errors.New(fmt.Sprintf("Damaged shard file: %v", r))
+		}
+	}()
 
-	// Read metadata
-	f.Seek(flen-int64(metadataLength), 0)
-	buf = bufio.NewReader(f)
-	metaBytes := make([]byte, metadataLength)
-	metaBytesRead, _ := buf.Read(metaBytes)
-	if metaBytesRead != len(metaBytes) || metaBytesRead < 1 {
-		panic("Failed to read metadata bytes")
+	// Metadata at the end
+	this.shardMeta, err = readShardMeta(f, flen)
+	if err != nil {
+		return false, err
 	}
-	log.Debugf("Read %d metadata bytes: %v", metaBytesRead, metaBytes)
-	this.shardMeta = newShardMeta()
-	this.shardMeta.FromBytes(metaBytes)
 	this.contentsOffset = this.shardMeta.ContentsLength
-	metaBytes = nil
-	if this.shardMeta.MetaVersion < 1 {
-		panic("Failed to read metadata, could not find version")
-	}
 	log.Debugf("Metadata: %v", this.shardMeta)
+	metadataLength := this.shardMeta.Length()
+
+	// Wrapped data key of an encrypted shard, between the index and the metadata
+	var bk *BlockKey = nil
+	footerLength := int64(metadataLength)
+	if this.shardMeta.KeyLength > 0 {
+		footerLength += int64(this.shardMeta.KeyLength)
+		if this.Block() == nil {
+			return false, errors.New("Encrypted shard without block")
+		}
+		keyBytes := make([]byte, this.shardMeta.KeyLength)
+		if _, err := f.ReadAt(keyBytes, flen-footerLength); err != nil {
+			return false, errors.New(fmt.Sprintf("Failed to read data key: %s", err))
+		}
+		if bk, err = keyring.ImportBlockKey(this.Block().Id, keyBytes); err != nil {
+			return false, err
+		}
+	}
 
 	// Read index
-	f.Seek(flen-int64(metadataLength)-int64(this.shardMeta.IndexLength), 0)
-	buf = bufio.NewReader(f)
 	indexBytes := make([]byte, int(this.shardMeta.IndexLength))
-	indexBytesRead, _ := buf.Read(indexBytes)
-	if indexBytesRead != len(indexBytes) || metaBytesRead < 1 {
-		panic("Failed to read index bytes")
+	if _, err := f.ReadAt(indexBytes, flen-footerLength-int64(this.shardMeta.IndexLength)); err != nil || len(indexBytes) < 1 {
+		return false, errors.New(fmt.Sprintf("Failed to read index bytes: %v", err))
+	}
+	log.Debugf("Read %d index bytes", len(indexBytes))
+	if bk != nil {
+		if indexBytes, err = bk.Open(indexBytes, SHARD_INDEX_SECTION); err != nil {
+			return false, err
+		}
 	}
-	log.Debugf("Read %d index bytes", indexBytesRead)
 	this.shardIndex = newShardIndex(this.Id)
 	this.shardIndex.FromBytes(indexBytes)
 	indexBytes = nil
-	if this.shardIndex.bloomFilter == nil {
-		panic("Bloom filter is nil")
+	if len(this.shardIndex.filters) == 0 {
+		return false, errors.New("Bloom filter is nil")
+	}
+	if this.shardIndex.HasBlockInfo() {
+		// Recover position in block
+		this.BlockIndex = uint(this.shardIndex.BlockIndex)
+		this.Parity = this.shardIndex.Parity
 	}
 	log.Debugf("Shard index %v", this.shardIndex)
 
 	// Read file meta
-	f.Seek(flen-int64(metadataLength)-int64(this.shardMeta.IndexLength)-int64(this.shardMeta.FileMetaLength), 0)
-	buf = bufio.NewReader(f)
-	fileMetaBytes := make([]byte, int(this.shardMeta.FileMetaLength))
-	fileMetaBytesRead, _ := buf.Read(fileMetaBytes)
-	if fileMetaBytesRead != len(fileMetaBytes) || fileMetaBytesRead < 1 {
-		panic("Failed to read file meta bytes")
-	}
-	log.Debugf("Read %d file meta bytes", fileMetaBytesRead)
-	this.shardFileMeta = newShardFileMeta()
-	this.shardFileMeta.FromBytes(fileMetaBytes)
-	fileMetaBytes = nil
-	if this.shardFileMeta.FileMeta == nil {
-		panic("File meta is nil")
+	if this.shardFileMeta, err = this._readFileMeta(f, bk); err != nil {
+		return false, err
 	}
 	log.Debugf("Shard file meta %v", this.shardFileMeta)
 
@@ -139,3 +226,165 @@ func (this *Shard) _fromBinaryFormat() (bool, error) {
 
 	return true, nil
 }
+
+// Read the bytes of the file meta section, after the contents
+func (this *Shard) _readFileMetaBytes(f io.ReaderAt, bk *BlockKey) ([]byte, error) {
+	fileMetaBytes := make([]byte, int(this.shardMeta.FileMetaLength))
+	if _, err := f.ReadAt(fileMetaBytes, int64(this.shardMeta.ContentsLength)); err != nil || len(fileMetaBytes) < 1 {
+		return nil, errors.New(fmt.Sprintf("Failed to read file meta bytes: %v", err))
+	}
+	log.Debugf("Read %d file meta bytes", len(fileMetaBytes))
+	if bk != nil {
+		return bk.Open(fileMetaBytes, SHARD_FILE_META_SECTION)
+	}
+	return fileMetaBytes, nil
+}
+
+// Read the file meta section, after the contents
+func (this *Shard) _readFileMeta(f io.ReaderAt, bk *BlockKey) (*ShardFileMeta, error) {
+	fileMetaBytes, err := this._readFileMetaBytes(f, bk)
+	if err != nil {
+		return nil, err
+	}
+	shardFileMeta := newShardFileMeta()
+	if this.shardMeta.MetaVersion < 2 {
+		// Version 1 stored the file meta as JSON
+		err = shardFileMeta.FromJson(fileMetaBytes)
+	} else {
+		err = shardFileMeta.FromBytes(fileMetaBytes)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to parse file meta: %s", err))
+	}
+	if shardFileMeta.FileMeta == nil {
+		return nil, errors.New("File meta is nil")
+	}
+	return shardFileMeta, nil
+}
+
+// Read evicted file meta again, the index and shard meta are still loaded (caller must hold the loaded lock)
+func (this *Shard) _reloadFileMeta() (err error) {
+	// Parsing a damaged section panics, report it as error
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("Damaged shard file: %v", r))
+		}
+	}()
+
+	f, err := this._openFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Data key was imported when the shard was loaded
+	var bk *BlockKey = nil
+	if this.shardMeta.KeyLength > 0 {
+		if bk = this._blockKey(); bk == nil {
+			return errors.New(fmt.Sprintf("No data key for shard %s", this.IdStr()))
+		}
+	}
+	shardFileMeta, err := this._readFileMeta(f, bk)
+	if err != nil {
+		return err
+	}
+	this.shardFileMeta = shardFileMeta
+	this.fileMetaEvicted = false
+	if shardCache != nil {
+		shardCache._recordReload()
+	}
+	return nil
+}
+
+// Versions of a file in evicted file meta, found by the name index on disk without reading the file meta again, nil if the file meta is in memory
+func (this *Shard) _lookupEvictedFileMeta(name string) (sfm *ShardFileMeta, err error) {
+	// Parsing a damaged section panics, report it as error
+	defer func() {
+		if r := recover(); r != nil {
+			sfm = nil
+			err = errors.New(fmt.Sprintf("Damaged shard file: %v", r))
+		}
+	}()
+
+	this._loadIndex()
+	this.isLoadedMux.RLock()
+	defer this.isLoadedMux.RUnlock()
+
+	// Version 1 has no name index
+	if !this.isLoaded || !this.fileMetaEvicted || this.shardMeta.MetaVersion < 2 {
+		return nil, nil
+	}
+
+	f, err := this._openFile()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var bk *BlockKey = nil
+	if this.shardMeta.KeyLength > 0 {
+		if bk = this._blockKey(); bk == nil {
+			return nil, errors.New(fmt.Sprintf("No data key for shard %s", this.IdStr()))
+		}
+	}
+	fileMetaBytes, err := this._readFileMetaBytes(f, bk)
+	if err != nil {
+		return nil, err
+	}
+	list, err := lookupShardFileMeta(fileMetaBytes, name)
+	if err != nil {
+		return nil, err
+	}
+	sfm = newShardFileMeta()
+	sfm._set(list)
+	return sfm, nil
+}
+
+// Read and validate the metadata at the end of a shard file, the lengths of the sections must add up to the file length
+func readShardMeta(f io.ReaderAt, flen int64) (*ShardMeta, error) {
+	// Length of the metadata in the last 4 bytes
+	if flen < int64(BINARY_METADATA_LENGTH) {
+		return nil, errors.New(fmt.Sprintf("File of %d bytes too short for metadata", flen))
+	}
+	lengthBytes := make([]byte, 4)
+	if _, err := f.ReadAt(lengthBytes, flen-4); err != nil {
+		return nil, err
+	}
+	metadataLength := binary.BigEndian.Uint32(lengthBytes)
+	log.Debugf("Meta is size of %d", metadataLength)
+	if !isShardMetaLength(metadataLength) {
+		return nil, errors.New(fmt.Sprintf("Invalid metadata length %d", metadataLength))
+	}
+
+	// Read metadata
+	metaBytes := make([]byte, metadataLength)
+	if _, err := f.ReadAt(metaBytes, flen-int64(metadataLength)); err != nil {
+		return nil, err
+	}
+	log.Debugf("Read %d metadata bytes: %v", len(metaBytes), metaBytes)
+	return parseShardMeta(metaBytes, flen)
+}
+
+// Parse and validate metadata bytes of a shard file of the given length
+func parseShardMeta(metaBytes []byte, flen int64) (*ShardMeta, error) {
+	if !bytes.HasPrefix(metaBytes, BINARY_METADATA_MAGIC_STRING) {
+		return nil, errors.New("Magic string not found in metadata")
+	}
+	meta := newShardMeta()
+	meta.FromBytes(metaBytes)
+	if meta.MetaVersion < 1 || meta.MetaVersion > BINARY_VERSION {
+		return nil, errors.New(fmt.Sprintf("Unsupported metadata version %d", meta.MetaVersion))
+	}
+	if uint32(len(metaBytes)) != meta.Length() {
+		return nil, errors.New(fmt.Sprintf("Metadata length %d does not match version", len(metaBytes)))
+	}
+	for _, l := range []uint64{meta.ContentsLength, meta.FileMetaLength, meta.IndexLength} {
+		if l > uint64(flen) {
+			return nil, errors.New(fmt.Sprintf("Section of %d bytes exceeds file of %d bytes", l, flen))
+		}
+	}
+	expected := meta.ContentsLength + meta.FileMetaLength + meta.IndexLength + uint64(meta.KeyLength) + uint64(len(metaBytes))
+	if expected != uint64(flen) {
+		return nil, errors.New(fmt.Sprintf("Sections take %d bytes, file has %d bytes", expected, flen))
+	}
+	return meta, nil
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"testing"
 )
 
@@ -12,3 +16,91 @@ func TestShardWrite(t *testing.T) {
 		panic("Binary format too short")
 	}
 }
+
+// Test that a shard in format version 1 (file meta as JSON) loads and is upgraded by the shard cache
+func TestShardFormatUpgrade(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	for i := 0; i < 50; i++ {
+		if _, err := shard.AddFile(newFileMeta(fmt.Sprintf("/upgrade/%d.txt", i)), []byte(fmt.Sprintf("Contents %d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shard.DeleteFile("/upgrade/7.txt")
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite as version 1
+	onDisk, err := ioutil.ReadFile(shard.FullPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := parseShardMetaFooter(onDisk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.MetaVersion != BINARY_VERSION {
+		t.Errorf("Expected version %d, found %d", BINARY_VERSION, meta.MetaVersion)
+	}
+	fileMetaJson, _ := json.Marshal(shard.shardFileMeta.FileMeta)
+	indexOffset := meta.ContentsLength + meta.FileMetaLength
+	buf := new(bytes.Buffer)
+	buf.Write(onDisk[:meta.ContentsLength])
+	buf.Write(fileMetaJson)
+	buf.Write(onDisk[indexOffset : indexOffset+meta.IndexLength])
+	meta.MetaVersion = 1
+	meta.FileMetaLength = uint64(len(fileMetaJson))
+	buf.Write(meta.Bytes())
+	ioutil.WriteFile(shard.FullPath(), buf.Bytes(), conf.UnixFilePermissions)
+
+	// Loading leaves the format as it is, the shard cache upgrades
+	shard.ResetLoaded()
+	if _, err := shard.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !shard.NeedsUpgrade() {
+		t.Fatal("Expected shard to need an upgrade")
+	}
+	if loaded, _ := ioutil.ReadFile(shard.FullPath()); !bytes.Equal(loaded, buf.Bytes()) {
+		t.Error("Load must not rewrite the shard")
+	}
+	if read, err, _ := shard.ReadFile("/upgrade/3.txt"); err != nil || string(read) != "Contents 3" {
+		t.Errorf("Failed to read version 1 file: %s", err)
+	}
+	if n := shardCache.Upgrade(); n < 1 || shard.NeedsUpgrade() {
+		t.Fatalf("Expected shard to be upgraded, upgraded %d", n)
+	}
+	upgraded, _ := ioutil.ReadFile(shard.FullPath())
+	meta, err = parseShardMetaFooter(upgraded)
+	if err != nil || meta.MetaVersion != BINARY_VERSION {
+		t.Fatalf("Expected upgraded shard, found %v (%v)", meta, err)
+	}
+	if !bytes.Equal(upgraded[:meta.ContentsLength], onDisk[:meta.ContentsLength]) {
+		t.Error("Upgrade must not rewrite the contents")
+	}
+	shard.ResetLoaded()
+	if read, err, _ := shard.ReadFile("/upgrade/42.txt"); err != nil || string(read) != "Contents 42" {
+		t.Errorf("Failed to read upgraded file: %s", err)
+	}
+	if _, err, _ := shard.ReadFile("/upgrade/7.txt"); err == nil {
+		t.Error("Deleted file must stay deleted")
+	}
+
+	// Lookup by name index
+	fileMetaBytes := upgraded[meta.ContentsLength : meta.ContentsLength+meta.FileMetaLength]
+	list, err := lookupShardFileMeta(fileMetaBytes, "/upgrade/13.txt")
+	if err != nil || len(list) != 1 || list[0].FullName != "/upgrade/13.txt" {
+		t.Errorf("Expected 1 file by name index, found %v (%v)", list, err)
+	}
+	if list, _ := lookupShardFileMeta(fileMetaBytes, "/upgrade/missing.txt"); len(list) != 0 {
+		t.Error("Expected no file by name index")
+	}
+	if list, _ := lookupShardFileMeta(fileMetaBytes, "/upgrade/7.txt"); len(list) != 1 || !list[0].Deleted {
+		t.Error("Expected deleted file by name index")
+	}
+	if _, err := shardFileMetaFromBytes(fileMetaBytes[1:]); err == nil {
+		t.Error("Expected damaged file meta to fail")
+	}
+}
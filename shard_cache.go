@@ -0,0 +1,175 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keeps the metadata of the local shards within the memory budget, the file meta of the least recently used idle sealed shards is evicted
+// and read from disk again on the next use, the shard indices stay loaded for the file locator. Loaded shards in an older format are upgraded
+// on the same pass (never while loading, readers and writers hold the shard locks then)
+
+var shardCache *ShardCache
+
+type ShardCache struct {
+	mux       sync.RWMutex
+	running   bool
+	evictions uint64
+	reloads   uint64
+	upgrades  uint64
+	lastRun   uint32
+}
+
+// Shard cache status
+type ShardCacheStatus struct {
+	Running        bool
+	LoadedShards   int
+	EvictedShards  int
+	EvictableBytes uint64 // File meta and contents in memory
+	MemoryBudget   int
+	Evictions      uint64
+	Reloads        uint64
+	Upgrades       uint64
+	LastRun        uint32
+}
+
+// Evict the least recently used shards until the loaded shards fit in the budget, returns the number of evicted shards
+func (this *ShardCache) Enforce() int {
+	if conf.ShardMetaMemoryBudget < 1 {
+		return 0
+	}
+
+	// Only one at a time
+	this.mux.Lock()
+	if this.running {
+		this.mux.Unlock()
+		return 0
+	}
+	this.running = true
+	this.lastRun = unixTsUint32()
+	this.mux.Unlock()
+	defer func() {
+		this.mux.Lock()
+		this.running = false
+		this.mux.Unlock()
+	}()
+
+	// Memory in use
+	var total uint64 = 0
+	candidates := make([]*Shard, 0)
+	for _, shard := range this._shards() {
+		n := shard.EvictableBytes()
+		total += n
+		if n > 0 && shard.IsEvictable() {
+			candidates = append(candidates, shard)
+		}
+	}
+
+	// Least recently used first
+	sort.Sort(ShardsByLastAccess(candidates))
+	var evicted int = 0
+	for _, shard := range candidates {
+		if total <= uint64(conf.ShardMetaMemoryBudget) {
+			break
+		}
+		n := shard.EvictableBytes()
+		if !shard.EvictFileMeta(conf.ShardMetaMinIdleSeconds) {
+			continue
+		}
+		log.Infof("Evicted file meta of shard %s (%d bytes)", shard.IdStr(), n)
+		total -= n
+		evicted++
+	}
+
+	this.mux.Lock()
+	this.evictions += uint64(evicted)
+	this.mux.Unlock()
+	return evicted
+}
+
+// Upgrade the format on disk of loaded shards, returns the number of upgraded shards
+func (this *ShardCache) Upgrade() int {
+	var upgraded int = 0
+	for _, shard := range this._shards() {
+		if !shard.NeedsUpgrade() {
+			continue
+		}
+		if err := shard.UpgradeFormat(); err != nil {
+			log.Warnf("Failed to upgrade shard %s: %s", shard.IdStr(), err)
+			continue
+		}
+		upgraded++
+	}
+
+	this.mux.Lock()
+	this.upgrades += uint64(upgraded)
+	this.mux.Unlock()
+	return upgraded
+}
+
+// Local shards of the volumes
+func (this *ShardCache) _shards() []*Shard {
+	list := make([]*Shard, 0)
+	for _, volume := range datastore.Volumes() {
+		for _, shard := range volume.Shards() {
+			list = append(list, shard)
+		}
+	}
+	return list
+}
+
+// Evicted file meta was read again
+func (this *ShardCache) _recordReload() {
+	this.mux.Lock()
+	this.reloads++
+	this.mux.Unlock()
+}
+
+// Status
+func (this *ShardCache) Status() *ShardCacheStatus {
+	s := &ShardCacheStatus{
+		MemoryBudget: conf.ShardMetaMemoryBudget,
+	}
+	for _, shard := range this._shards() {
+		if shard.IsFileMetaEvicted() {
+			s.EvictedShards++
+			continue
+		}
+		if n := shard.EvictableBytes(); n > 0 {
+			s.LoadedShards++
+			s.EvictableBytes += n
+		}
+	}
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	s.Running = this.running
+	s.Evictions = this.evictions
+	s.Reloads = this.reloads
+	s.Upgrades = this.upgrades
+	s.LastRun = this.lastRun
+	return s
+}
+
+// New shard cache
+func newShardCache() *ShardCache {
+	c := &ShardCache{}
+
+	// Ticker
+	ticker := time.NewTicker(time.Second * time.Duration(conf.ShardMetaCacheInterval))
+	go func() {
+		for _ = range ticker.C {
+			c.Upgrade()
+			c.Enforce()
+		}
+	}()
+
+	return c
+}
+
+// Sort shards by last use, least recent first
+type ShardsByLastAccess []*Shard
+
+func (a ShardsByLastAccess) Len() int           { return len(a) }
+func (a ShardsByLastAccess) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ShardsByLastAccess) Less(i, j int) bool { return a[i].LastAccess() < a[j].LastAccess() }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// Test that the file meta of idle sealed shards is evicted and read again on demand
+func TestShardCacheEvict(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	for _, name := range []string{"/evict/a.txt", "/evict/b.txt"} {
+		if _, err := shard.AddFile(newFileMeta(name), []byte("Evict "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := shard.DeleteFile("/evict/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	liveBytes := shard.LiveBytes()
+
+	// Open blocks still receive writes
+	if shard.EvictFileMeta(0) {
+		t.Error("Expected shard of open block not to be evicted")
+	}
+	b.SetSealed(true)
+	if shard.EvictFileMeta(3600) {
+		t.Error("Expected recently used shard not to be evicted")
+	}
+	if !shard.EvictFileMeta(0) || !shard.IsFileMetaEvicted() {
+		t.Fatal("Expected shard to be evicted")
+	}
+	if shard.EvictableBytes() != 0 {
+		t.Errorf("Expected no evictable bytes, found %d", shard.EvictableBytes())
+	}
+
+	// Located without reading the file meta
+	if !shard.TestContainsFile("/evict/a.txt") || shard.LiveBytes() != liveBytes || !shard.IsFileMetaEvicted() {
+		t.Error("Expected index and live bytes without reading the file meta")
+	}
+	dedupIndex.Status()
+	if _, _, err := datastore.fileLocator._locate(datastore, "/evict/a.txt"); err != nil || !shard.IsFileMetaEvicted() {
+		t.Errorf("Expected status and locate without reading the file meta (%v)", err)
+	}
+
+	// Damaged on disk, the files can not be read from this shard
+	if err := os.Rename(shard.FullPath(), shard.FullPath()+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	if fileMeta := shard.ShardFileMeta(); fileMeta == nil || len(fileMeta.FileMeta) != 0 {
+		t.Error("Expected empty file meta when it can not be read again")
+	}
+	if err := os.Rename(shard.FullPath()+".moved", shard.FullPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are read by the name index on disk
+	before := shardCache.Status()
+	if data, err, fromMemory := shard.ReadFile("/evict/a.txt"); err != nil || fromMemory || string(data) != "Evict /evict/a.txt" {
+		t.Errorf("Failed to read evicted shard: %s", err)
+	}
+	if _, err, _ := shard.ReadFile("/evict/b.txt"); err == nil {
+		t.Error("Expected deleted file to stay deleted")
+	}
+	if !shard.IsFileMetaEvicted() || shardCache.Status().Reloads != before.Reloads {
+		t.Error("Expected files to be read without reading the file meta again")
+	}
+
+	// Read again on demand
+	if shard.ShardFileMeta().GetByName("/evict/a.txt") == nil {
+		t.Error("Expected file in file meta that is read again")
+	}
+	if shard.IsFileMetaEvicted() || shardCache.Status().Reloads != before.Reloads+1 {
+		t.Error("Expected file meta to be read again")
+	}
+}
+
+// Test that the least recently used shards are evicted beyond the budget
+func TestShardCacheEnforce(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	if _, err := shard.AddFile(newFileMeta("/evict/enforce.txt"), []byte("Enforce")); err != nil {
+		t.Fatal(err)
+	}
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	b.SetSealed(true)
+
+	// Within the budget
+	if shardCache.Enforce(); shard.IsFileMetaEvicted() {
+		t.Error("Expected shard within the budget not to be evicted")
+	}
+
+	// Beyond the budget
+	budget, minIdle := conf.ShardMetaMemoryBudget, conf.ShardMetaMinIdleSeconds
+	conf.ShardMetaMemoryBudget, conf.ShardMetaMinIdleSeconds = 1, 0
+	defer func() {
+		conf.ShardMetaMemoryBudget, conf.ShardMetaMinIdleSeconds = budget, minIdle
+	}()
+	if evicted := shardCache.Enforce(); evicted < 1 || !shard.IsFileMetaEvicted() {
+		t.Errorf("Expected shard to be evicted, evicted %d", evicted)
+	}
+	if status := shardCache.Status(); status.EvictedShards < 1 || status.Evictions < 1 {
+		t.Errorf("Unexpected status %v", status)
+	}
+	if data, err, _ := shard.ReadFile("/evict/enforce.txt"); err != nil || string(data) != "Enforce" {
+		t.Errorf("Failed to read evicted shard: %s", err)
+	}
+}
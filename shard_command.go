@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Commands on a single shard file, for debugging: xyzfs shard inspect|extract
+
+// Shard file details
+type ShardInspection struct {
+	Path       string
+	ShardId    string
+	BlockId    string `json:",omitempty"`
+	BlockIndex uint
+	Parity     bool
+	Encrypted  bool
+	Meta       *ShardMeta
+	Bloom      *ShardInspectionBloom
+	Files      []*ShardInspectionFile
+}
+
+// Bloom filter parameters
+type ShardInspectionBloom struct {
+	Type              string
+	Bits              uint64 // All filters
+	HashFunctions     uint32 // First filter
+	Filters           int
+	Bytes             uint64  // Serialized
+	FalsePositiveRate float64 // Estimated for the files in the shard
+}
+
+// File in a shard
+type ShardInspectionFile struct {
+	FullName    string
+	VersionId   string
+	StartOffset uint64
+	Size        uint64
+	Checksum    uint32
+	Created     uint32
+	Timestamp   uint64 `json:",omitempty"`
+	Deleted     bool   `json:",omitempty"`
+	Chunked     bool   `json:",omitempty"`
+	Codec       string `json:",omitempty"`
+	RawSize     uint64 `json:",omitempty"`
+	Encrypted   bool   `json:",omitempty"`
+	Expires     uint32 `json:",omitempty"`
+}
+
+// Open a shard file, the block is taken from the folder when it is in the volume layout (b_UUID/s_UUID(.parity).data)
+func openShardFile(path string) (*Shard, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	blockId, ok := fsckParseId(filepath.Base(filepath.Dir(path)), "b_")
+	if !ok {
+		blockId = randomUuid()
+	}
+	volume := newVolume()
+	volume.Id = randomUuid()
+	name := strings.TrimSuffix(filepath.Base(path), ".data")
+	shardId, ok := fsckParseId(strings.TrimSuffix(name, ".parity"), "s_")
+	if !ok {
+		shardId = randomUuid()
+	}
+	shard := newShardFromId(newBlockFromId(volume, blockId), shardId)
+	shard.Parity = strings.HasSuffix(name, ".parity")
+	shard.path = path
+	if _, err := shard.Load(); err != nil {
+		return nil, err
+	}
+	return shard, nil
+}
+
+// Inspect a loaded shard
+func inspectShard(shard *Shard) *ShardInspection {
+	meta := shard.ShardMeta()
+	idx := shard.ShardIndex()
+	res := &ShardInspection{
+		Path:       shard.FullPath(),
+		ShardId:    shard.IdStr(),
+		BlockIndex: shard.BlockIndex,
+		Parity:     shard.Parity,
+		Encrypted:  meta.KeyLength > 0,
+		Meta:       meta,
+		Bloom: &ShardInspectionBloom{
+			Type:              idx.Type().String(),
+			Bits:              idx.Bits(),
+			HashFunctions:     idx.hashFunctions,
+			Filters:           idx.FilterCount(),
+			Bytes:             meta.IndexLength,
+			FalsePositiveRate: idx.EstimatedFalsePositiveRate(),
+		},
+		Files: make([]*ShardInspectionFile, 0),
+	}
+	if idx.HasBlockInfo() {
+		res.BlockId = uuidToString(idx.BlockId)
+	}
+	for _, f := range shard.ShardFileMeta().FileMeta {
+		file := &ShardInspectionFile{
+			FullName:    f.FullName,
+			VersionId:   f.VersionId(),
+			StartOffset: f.StartOffset,
+			Size:        f.Size,
+			Checksum:    f.Checksum,
+			Created:     f.Created,
+			Timestamp:   f.Timestamp,
+			Deleted:     f.Deleted,
+			Chunked:     f.Chunked,
+			RawSize:     f.RawSize,
+			Encrypted:   f.IsEncrypted(),
+			Expires:     f.Expires,
+		}
+		if f.IsCompressed() {
+			file.Codec = f.Codec.String()
+		}
+		res.Files = append(res.Files, file)
+	}
+	return res
+}
+
+// Contents of a file in a shard as written by the client, the latest version if no version id is given
+func extractShardFile(shard *Shard, fullName string, versionId string) ([]byte, error) {
+	if shard.Parity {
+		return nil, errors.New("Parity shards hold no files")
+	}
+	var meta *FileMeta
+	if len(versionId) > 0 {
+		meta = shard.ShardFileMeta().GetVersion(fullName, versionId)
+	} else {
+		meta = shard.ShardFileMeta().GetByName(fullName)
+	}
+	if meta == nil {
+		return nil, errors.New(fmt.Sprintf("File %s not found in shard", fullName))
+	}
+	if meta.Chunked {
+		return nil, errors.New(fmt.Sprintf("File %s is chunked, its %d chunk(s) are in other shards", fullName, len(meta.Chunks)))
+	}
+	b, err, _ := shard.ReadFileVersion(fullName, meta.VersionId())
+	if err != nil {
+		return nil, err
+	}
+	return decompressBytes(meta.Codec, b, meta.ContentSize())
+}
+
+// Command: xyzfs shard inspect <file> [--json] | xyzfs shard extract <file> --name <fullName> [--version <id>] [-o <out>]
+func runShardCommand(args []string) int {
+	usage := "Usage: xyzfs shard inspect <file> [--json]\n       xyzfs shard extract <file> --name <fullName> [--version <id>] [-o <out>]"
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	fs := flag.NewFlagSet("shard", flag.ContinueOnError)
+	asJson := fs.Bool("json", false, "Print as JSON")
+	name := fs.String("name", "", "Full name of the file to extract")
+	versionId := fs.String("version", "", "Version of the file to extract, the latest if empty")
+	out := fs.String("o", "-", "Output file of the extracted contents, - for stdout")
+
+	// Shard file before or after the options
+	rest := args[1:]
+	var path string
+	if len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		path = rest[0]
+		rest = rest[1:]
+	}
+	if err := fs.Parse(rest); err != nil {
+		return 2
+	}
+	if len(path) == 0 {
+		path = fs.Arg(0)
+	}
+	if len(path) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	shard, err := openShardFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open shard %s: %s\n", path, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "inspect":
+		res := inspectShard(shard)
+		if *asJson {
+			printCommandJson(res)
+			return 0
+		}
+		fmt.Printf("Shard %s (block %s, index %d, parity %t, encrypted %t)\n", res.ShardId, res.BlockId, res.BlockIndex, res.Parity, res.Encrypted)
+		fmt.Printf("Meta version %d, %d file(s), contents %d bytes, file meta %d bytes, index %d bytes\n", res.Meta.MetaVersion, res.Meta.FileCount, res.Meta.ContentsLength, res.Meta.FileMetaLength, res.Meta.IndexLength)
+		fmt.Printf("Index %s filter %d bits in %d filters, %d hash functions, estimated false positive rate %f\n", res.Bloom.Type, res.Bloom.Bits, res.Bloom.Filters, res.Bloom.HashFunctions, res.Bloom.FalsePositiveRate)
+		for _, f := range res.Files {
+			var flags string
+			if f.Deleted {
+				flags += " deleted"
+			}
+			if f.Chunked {
+				flags += " chunked"
+			}
+			if len(f.Codec) > 0 {
+				flags += " " + f.Codec
+			}
+			if f.Encrypted {
+				flags += " encrypted"
+			}
+			fmt.Printf("%s\t%s\toffset %d\tsize %d\tcrc %d%s\n", f.FullName, f.VersionId, f.StartOffset, f.Size, f.Checksum, flags)
+		}
+		return 0
+	case "extract":
+		if len(*name) == 0 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+		b, err := extractShardFile(shard, *name, *versionId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to extract %s: %s\n", *name, err)
+			return 1
+		}
+		if *out == "-" {
+			os.Stdout.Write(b)
+		} else if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write %s: %s\n", *out, err)
+			return 1
+		}
+		if *asJson && *out != "-" {
+			printCommandJson(map[string]interface{}{"name": *name, "bytes": len(b), "output": *out})
+		}
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, usage)
+	return 2
+}
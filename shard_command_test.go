@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test inspection and extraction of a shard file
+func TestShardCommand(t *testing.T) {
+	startApplication()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	plain := []byte("Plain contents")
+	compressed := []byte(strings.Repeat("Compressible contents ", 100))
+	shard.AddFile(newFileMeta("/inspect/plain.txt"), plain)
+	compressedMeta := newFileMeta("/inspect/compressed.txt")
+	stored := compressFileContents(compressedMeta, compressed, GzipCompressionCodec)
+	shard.AddFile(compressedMeta, stored)
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Inspect in place
+	opened, err := openShardFile(shard.FullPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := inspectShard(opened)
+	if res.ShardId != shard.IdStr() || res.BlockId != b.IdStr() || res.Meta.FileCount != 2 || len(res.Files) != 2 {
+		t.Errorf("Unexpected inspection %v", res)
+	}
+	if res.Bloom.Bits == 0 || res.Bloom.HashFunctions == 0 || res.Bloom.FalsePositiveRate <= 0 || res.Bloom.FalsePositiveRate >= 0.01 {
+		t.Errorf("Unexpected bloom filter parameters %v", res.Bloom)
+	}
+	if res.Files[1].Codec != "gzip" || res.Files[1].RawSize != uint64(len(compressed)) {
+		t.Error("Expected codec of compressed file")
+	}
+
+	// Extract from a copy outside the volume
+	tmp, err := ioutil.TempDir("", "xyzfs-shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	onDisk, _ := ioutil.ReadFile(shard.FullPath())
+	path := filepath.Join(tmp, "copy.data")
+	ioutil.WriteFile(path, onDisk, 0644)
+	opened, err = openShardFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string][]byte{"/inspect/plain.txt": plain, "/inspect/compressed.txt": compressed} {
+		extracted, err := extractShardFile(opened, name, "")
+		if err != nil || !bytes.Equal(extracted, expected) {
+			t.Errorf("Failed to extract %s: %s", name, err)
+		}
+	}
+	if _, err := extractShardFile(opened, "/inspect/missing.txt", ""); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Compaction: rewrite the live files of a shard into a fresh shard, reclaiming the bytes of deleted and overwritten files
+// shards of sealed blocks are not compacted (parity covers their contents), files in sealed blocks can not be deleted either,
+// so their bytes are only reclaimed once the whole block is dropped
+
+// Compaction result
+type ShardCompactionResult struct {
+	ShardId     string
+	FilesBefore int
+	FilesAfter  int
+	BytesBefore uint64
+	BytesAfter  uint64
+	Replicated  int
+	Diverged    int     // Copies on other nodes that differ from the version before compaction, left as they are
+	Duration    float64 // Seconds
+}
+
+// Bytes reclaimed
+func (this *ShardCompactionResult) BytesReclaimed() uint64 {
+	return this.BytesBefore - this.BytesAfter
+}
+
+// Can this shard be compacted?
+func (this *Shard) CanCompact() error {
+	if this.Parity {
+		return errors.New(fmt.Sprintf("Shard %s is a parity shard", this.IdStr()))
+	}
+	if this.Block() != nil && this.Block().IsSealed() {
+		return errors.New(fmt.Sprintf("Block %s of shard %s is sealed, compaction would invalidate parity", this.Block().IdStr(), this.IdStr()))
+	}
+	return nil
+}
+
+// Should this shard be compacted? Shards that were not loaded since the start are skipped, reading their file meta just
+// for the ratio would load every shard on disk (a delete loads the shard, so new garbage is found)
+func (this *Shard) ShouldCompact() bool {
+	if this.CanCompact() != nil || !this.IsLoaded() {
+		return false
+	}
+	return this.LiveRatio() < conf.CompactionLiveRatio
+}
+
+// Compact, live files are copied (throttled) into a fresh shard that replaces this one
+func (this *Shard) Compact() (*ShardCompactionResult, error) {
+	if err := this.CanCompact(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	this.Load()
+
+	// On disk, copies on other nodes are replaced only if they match this version
+	if err := this.Persist(); err != nil {
+		return nil, err
+	}
+
+	// Snapshot
+	this.compactMux.RLock()
+	mutations := atomic.LoadUint64(&this.mutations)
+	previous := newShardMeta()
+	previous.FromBytes(this.shardMeta.Bytes())
+	live := this.shardFileMeta.Live()
+	this.contentsMux.RLock()
+	bytesBefore := this.contentsOffset
+	this.contentsMux.RUnlock()
+	filesBefore := len(this.shardFileMeta.FileMeta)
+	this.compactMux.RUnlock()
+	log.Infof("Compacting shard %s: %d of %d file(s) live", this.IdStr(), len(live), filesBefore)
+
+	// Fresh shard, same id
+	fresh := newShardFromId(this.block, this.Id)
+	fresh.BlockIndex = this.BlockIndex
+	fresh.Parity = false
+	fresh.isLoaded = true
+	fresh.contents = bytes.NewBuffer(make([]byte, 0))
+
+	// Copy live files, contents shared by deduplicated files are copied once
+	var copied uint64 = 0
+	offsets := make(map[uint64]uint64)
+	for _, meta := range live {
+		c := *meta
+		if newOffset, ok := offsets[meta.StartOffset]; ok && meta.Size > 0 {
+			c.StartOffset = newOffset
+		} else {
+			b, err, _ := this._readStoredFile(meta)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("Failed to read %s during compaction of shard %s: %s", meta.FullName, this.IdStr(), err))
+			}
+			c.StartOffset = fresh.contentsOffset
+			if meta.Size > 0 {
+				offsets[meta.StartOffset] = c.StartOffset
+			}
+			fresh.contents.Write(b)
+			fresh.contentsOffset += c.Size
+			copied += c.Size
+		}
+		fresh.shardFileMeta.Add(&c)
+		fresh.shardIndex.Add(c.FullName)
+		fresh.shardMeta.FileCount++
+
+		// Throttle
+		throttleBytes(uint64(copied), start, conf.CompactionBytesPerSecond)
+	}
+	fresh.allocatedBytesCount = fresh.contentsOffset
+
+	// Swap in, unless the shard changed in the meantime
+	this.compactMux.Lock()
+	if atomic.LoadUint64(&this.mutations) != mutations {
+		this.compactMux.Unlock()
+		return nil, errors.New(fmt.Sprintf("Shard %s was modified during compaction", this.IdStr()))
+	}
+	if this.temporary {
+		fresh.temporary = true
+	} else if err := fresh._writeAtomic(); err != nil {
+		this.compactMux.Unlock()
+		fresh._registerIOError(err)
+		return nil, err
+	}
+	this._swap(fresh)
+	this.compactMux.Unlock()
+
+	result := &ShardCompactionResult{
+		ShardId:     this.IdStr(),
+		FilesBefore: filesBefore,
+		FilesAfter:  len(live),
+		BytesBefore: bytesBefore,
+		BytesAfter:  copied,
+	}
+
+	// New index, the rebuilt bloom filter no longer contains the removed names
+	binaryTransport._broadcastShardIndex(this)
+
+	// Replicate new version to copies of the previous version, temporary shards are compacted by every node itself
+	for _, location := range datastore.fileLocator.ShardLocationsByIdStr(this.IdStr()) {
+		if location.Local || this.temporary {
+			continue
+		}
+		err := binaryTransport._replaceShardCopy(location.Node, this, previous)
+		if err == errShardDiverged {
+			log.Warnf("Copy of compacted shard %s on %s differs from the version before compaction, not replaced", this.IdStr(), location.Node)
+			result.Diverged++
+			continue
+		}
+		if err != nil {
+			log.Warnf("Failed to replicate compacted shard %s to %s: %s", this.IdStr(), location.Node, err)
+			continue
+		}
+		result.Replicated++
+	}
+
+	result.Duration = time.Since(start).Seconds()
+	log.Infof("Compacted shard %s: %d to %d bytes, %d to %d file(s)", this.IdStr(), result.BytesBefore, result.BytesAfter, result.FilesBefore, result.FilesAfter)
+	return result, nil
+}
+
+// Write to disk, atomic by writing a temporary file first
+func (this *Shard) _writeAtomic() error {
+	this.Block().PrepareFolder()
+	tmpPath := fmt.Sprintf("%s.compact", this.FullPath())
+	volume := this.Block().Volume()
+	atomic.AddInt32(&volume.activeWrites, 1)
+	defer atomic.AddInt32(&volume.activeWrites, -1)
+	if err := ioutil.WriteFile(tmpPath, this._toBinaryFormat(), conf.UnixFilePermissions); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, this.FullPath()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	this.isFlushedMux.Lock()
+	this.isFlushed = true
+	this.isFlushedMux.Unlock()
+	return nil
+}
+
+// Replace contents with a shard file received from another node (e.g. compacted version)
+func (this *Shard) _replaceFromFile(path string, expectedMeta *ShardMeta) error {
+	this.compactMux.Lock()
+	defer this.compactMux.Unlock()
+
+	// Move into place
+	if err := os.Rename(path, this.FullPath()); err != nil {
+		return err
+	}
+
+	// Load and validate
+	shard := newShardFromId(this.block, this.Id)
+	shard.BlockIndex = this.BlockIndex
+	shard.Parity = this.Parity
+	if _, err := shard.Load(); err != nil {
+		this.ResetLoaded()
+		return err
+	}
+	if !shard.ShardMeta().Equals(expectedMeta) {
+		this.ResetLoaded()
+		return errors.New(fmt.Sprintf("Shard meta mismatch, expected %v found %v", expectedMeta.Bytes(), shard.ShardMeta().Bytes()))
+	}
+	shard.isFlushed = true
+
+	this._swap(shard)
+	log.Infof("Replaced shard %s with received version", this.IdStr())
+	return nil
+}
+
+// Take over the state of another version of this shard, caller must hold the compaction lock
+func (this *Shard) _swap(o *Shard) {
+	this.contentsMux.Lock()
+	this.contents = o.contents
+	this.contentsOffset = o.contentsOffset
+	this.contentsMux.Unlock()
+
+	this.allocationMux.Lock()
+	this.allocatedBytesCount = o.contentsOffset
+	this.allocationMux.Unlock()
+
+	this.isLoadedMux.Lock()
+	this.shardFileMeta = o.shardFileMeta
+	this.shardIndex = o.shardIndex
+	this.shardMeta = o.shardMeta
+	this.isLoaded = true
+	this.fileMetaEvicted = false
+	this.isLoadedMux.Unlock()
+
+	this.isFlushedMux.Lock()
+	this.isFlushed = o.isFlushed
+	this.isFlushedMux.Unlock()
+
+	atomic.AddUint64(&this.mutations, 1)
+}
+
+// Sleep so that copying n bytes since start does not exceed the rate (bytes per second, 0 is unlimited)
+func throttleBytes(n uint64, start time.Time, bytesPerSecond int) {
+	if bytesPerSecond <= 0 {
+		return
+	}
+	expected := time.Duration(float64(n) / float64(bytesPerSecond) * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
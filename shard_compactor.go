@@ -0,0 +1,152 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Compacts local shards whose live ratio dropped below the threshold
+
+var shardCompactor *ShardCompactor
+
+type ShardCompactor struct {
+	mux             sync.RWMutex
+	running         bool
+	shardsCompacted uint32
+	shardsFailed    uint32
+	bytesReclaimed  uint64
+	lastRun         uint32
+	lastError       string
+}
+
+// Compaction candidate
+type ShardCompactionCandidate struct {
+	ShardId    string
+	BlockId    string
+	LiveRatio  float64
+	LiveBytes  uint64
+	TotalBytes uint64
+}
+
+// Compactor status
+type ShardCompactorStatus struct {
+	Running         bool
+	ShardsCompacted uint32
+	ShardsFailed    uint32
+	BytesReclaimed  uint64
+	LastRun         uint32
+	LastError       string
+	LiveRatio       float64 // Threshold
+	BytesPerSecond  int     // Throttle
+	Candidates      []*ShardCompactionCandidate
+}
+
+// Shards below the live ratio threshold, lowest ratio first
+func (this *ShardCompactor) Candidates() []*ShardCompactionCandidate {
+	list := make([]*ShardCompactionCandidate, 0)
+	for _, volume := range datastore.Volumes() {
+		if !volume.IsWritable() {
+			continue
+		}
+		for _, shard := range volume.Shards() {
+			if !shard.ShouldCompact() {
+				continue
+			}
+			list = append(list, &ShardCompactionCandidate{
+				ShardId:    shard.IdStr(),
+				BlockId:    shard.Block().IdStr(),
+				LiveRatio:  shard.LiveRatio(),
+				LiveBytes:  shard.LiveBytes(),
+				TotalBytes: shard.ShardMeta().ContentsLength,
+			})
+		}
+	}
+	sort.Sort(ShardCompactionCandidates(list))
+	return list
+}
+
+// Compact one shard
+func (this *ShardCompactor) CompactShard(shard *Shard) (*ShardCompactionResult, error) {
+	result, err := shard.Compact()
+	this.mux.Lock()
+	if err != nil {
+		log.Warnf("Failed to compact shard %s: %s", shard.IdStr(), err)
+		this.shardsFailed++
+		this.lastError = err.Error()
+	} else {
+		this.shardsCompacted++
+		this.bytesReclaimed += uint64(result.BytesReclaimed())
+	}
+	this.mux.Unlock()
+	return result, err
+}
+
+// Compact the shards with the lowest live ratio
+func (this *ShardCompactor) compact() {
+	// Only one at a time
+	this.mux.Lock()
+	if this.running {
+		this.mux.Unlock()
+		return
+	}
+	this.running = true
+	this.lastRun = unixTsUint32()
+	this.mux.Unlock()
+	defer func() {
+		this.mux.Lock()
+		this.running = false
+		this.mux.Unlock()
+	}()
+
+	for i, candidate := range this.Candidates() {
+		if i >= conf.CompactionMaxShardsPerRun {
+			break
+		}
+		shard := datastore.LocalShardByIdStr(candidate.ShardId)
+		if shard == nil {
+			continue
+		}
+		this.CompactShard(shard)
+	}
+}
+
+// Status
+func (this *ShardCompactor) Status() *ShardCompactorStatus {
+	candidates := this.Candidates()
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return &ShardCompactorStatus{
+		Running:         this.running,
+		ShardsCompacted: this.shardsCompacted,
+		ShardsFailed:    this.shardsFailed,
+		BytesReclaimed:  this.bytesReclaimed,
+		LastRun:         this.lastRun,
+		LastError:       this.lastError,
+		LiveRatio:       conf.CompactionLiveRatio,
+		BytesPerSecond:  conf.CompactionBytesPerSecond,
+		Candidates:      candidates,
+	}
+}
+
+// New compactor
+func newShardCompactor() *ShardCompactor {
+	c := &ShardCompactor{}
+
+	// Ticker
+	ticker := time.NewTicker(time.Second * time.Duration(conf.CompactionInterval))
+	go func() {
+		for _ = range ticker.C {
+			c.compact()
+		}
+	}()
+
+	return c
+}
+
+// Sort candidates by live ratio
+type ShardCompactionCandidates []*ShardCompactionCandidate
+
+func (a ShardCompactionCandidates) Len() int           { return len(a) }
+func (a ShardCompactionCandidates) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ShardCompactionCandidates) Less(i, j int) bool { return a[i].LiveRatio < a[j].LiveRatio }
@@ -1,55 +1,310 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"sync"
 )
 
 type ShardFileMeta struct {
 	FileMeta []*FileMeta
 	mux      sync.RWMutex
+
+	// All versions of a file by name (including deleted ones), in order of addition
+	names map[string][]*FileMeta
+
+	// Live files by contents (deduplication) and the number of live files by start offset of their contents
+	contents map[string][]*FileMeta
+	refs     map[uint64]int
+}
+
+// Key of the contents of a file, empty if its contents can not be matched
+func fileMetaContentsKey(f *FileMeta) string {
+	if len(f.ContentHash) != sha256.Size {
+		return ""
+	}
+	return fmt.Sprintf("%x/%d/%d", f.ContentHash, f.Codec, f.RawSize)
 }
 
 // Add file meta
 func (this *ShardFileMeta) Add(f *FileMeta) {
 	this.mux.Lock()
 	this.FileMeta = append(this.FileMeta, f)
+	this.names[f.FullName] = append(this.names[f.FullName], f)
+	if !f.Deleted {
+		this._addLive(f)
+	}
 	this.mux.Unlock()
 }
 
-// To bytes
+// Register live file by contents (caller must hold the lock)
+func (this *ShardFileMeta) _addLive(f *FileMeta) {
+	if key := fileMetaContentsKey(f); len(key) > 0 {
+		this.contents[key] = append(this.contents[key], f)
+	}
+	if f.Size > 0 {
+		this.refs[f.StartOffset]++
+	}
+}
+
+// Unregister file that is no longer live (caller must hold the lock)
+func (this *ShardFileMeta) _removeLive(f *FileMeta) {
+	if key := fileMetaContentsKey(f); len(key) > 0 {
+		remaining := make([]*FileMeta, 0, len(this.contents[key]))
+		for _, elm := range this.contents[key] {
+			if elm != f {
+				remaining = append(remaining, elm)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(this.contents, key)
+		} else {
+			this.contents[key] = remaining
+		}
+	}
+	if f.Size > 0 {
+		this.refs[f.StartOffset]--
+		if this.refs[f.StartOffset] <= 0 {
+			delete(this.refs, f.StartOffset)
+		}
+	}
+}
+
+// To bytes (binary format with name index)
 func (this *ShardFileMeta) Bytes() []byte {
 	this.mux.RLock()
-	b, be := json.Marshal(this.FileMeta)
-	this.mux.RUnlock()
-	if be != nil {
-		panic("Failed to convert file meta to JSON")
-	}
+	defer this.mux.RUnlock()
+	return shardFileMetaToBytes(this.FileMeta)
+}
+
+// To JSON (shard format version 1)
+func (this *ShardFileMeta) Json() []byte {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	b, err := json.Marshal(this.FileMeta)
+	panicErr(err)
 	return b
 }
 
-// Get by name
+// Get by name (latest version, skips deleted and expired files)
 func (this *ShardFileMeta) GetByName(name string) *FileMeta {
+	versions := this.Versions(name)
+	if len(versions) == 0 || versions[0].IsExpired(unixTsUint32()) {
+		return nil
+	}
+	return versions[0]
+}
+
+// Has any version of a file (including deleted ones, these stay in the index until compaction)
+func (this *ShardFileMeta) HasName(name string) bool {
 	this.mux.RLock()
-	for _, elm := range this.FileMeta {
-		if elm.FullName == name {
-			this.mux.RUnlock()
+	defer this.mux.RUnlock()
+	return len(this.names[name]) > 0
+}
+
+// Get specific version by name and version id (skips deleted and expired files)
+func (this *ShardFileMeta) GetVersion(name string, versionId string) *FileMeta {
+	for _, elm := range this.Versions(name) {
+		if elm.VersionId() == versionId {
+			if elm.IsExpired(unixTsUint32()) {
+				return nil
+			}
 			return elm
 		}
 	}
-	this.mux.RUnlock()
 	return nil
 }
 
-// From bytes
-func (this *ShardFileMeta) FromBytes(b []byte) {
+// Live versions of a file, newest first
+func (this *ShardFileMeta) Versions(name string) []*FileMeta {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	list := make([]*FileMeta, 0)
+	for _, elm := range this.names[name] {
+		if elm.Deleted {
+			continue
+		}
+		// Insert sorted, there are few versions
+		i := len(list)
+		list = append(list, elm)
+		for ; i > 0 && elm.IsNewerThan(list[i-1]); i-- {
+			list[i] = list[i-1]
+		}
+		list[i] = elm
+	}
+	return list
+}
+
+// Get copy of file metadata of a data shard by name (parity shards only, latest version)
+func (this *ShardFileMeta) GetCopyByName(name string, dataShardIndex uint32) *FileMeta {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	var res *FileMeta = nil
+	for _, elm := range this.names[name] {
+		if elm.DataShardIndex == dataShardIndex && !elm.Deleted {
+			if res == nil || elm.IsNewerThan(res) {
+				res = elm
+			}
+		}
+	}
+	return res
+}
+
+// Mark the versions of a file beyond the newest n (0 = keep all) as deleted, returns the versions marked
+func (this *ShardFileMeta) MarkOldVersions(name string, n int) []*FileMeta {
+	versions := this.Versions(name)
+	if n < 1 || len(versions) <= n {
+		return make([]*FileMeta, 0)
+	}
+	old := make(map[*FileMeta]bool)
+	for _, elm := range versions[n:] {
+		old[elm] = true
+	}
+	return this.MarkDeletedFunc(func(elm *FileMeta) bool {
+		return old[elm]
+	})
+}
+
+// Mark all versions of a file as deleted, returns the versions marked
+func (this *ShardFileMeta) MarkDeleted(name string) []*FileMeta {
+	return this.MarkDeletedFunc(func(elm *FileMeta) bool {
+		return elm.FullName == name
+	})
+}
+
+// Mark expired files as deleted, returns the files marked
+func (this *ShardFileMeta) MarkExpired(now uint32) []*FileMeta {
+	return this.MarkDeletedFunc(func(elm *FileMeta) bool {
+		return elm.IsExpired(now)
+	})
+}
+
+// Mark live files that match as deleted, returns the files marked
+func (this *ShardFileMeta) MarkDeletedFunc(match func(elm *FileMeta) bool) []*FileMeta {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	list := make([]*FileMeta, 0)
+	for _, elm := range this.FileMeta {
+		if !elm.Deleted && match(elm) {
+			elm.Deleted = true
+			this._removeLive(elm)
+			list = append(list, elm)
+		}
+	}
+	return list
+}
+
+// Mark files as live again (an add that is undone)
+func (this *ShardFileMeta) MarkLive(list []*FileMeta) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for _, elm := range list {
+		if elm.Deleted {
+			elm.Deleted = false
+			this._addLive(elm)
+		}
+	}
+}
+
+// Live files (not deleted)
+func (this *ShardFileMeta) Live() []*FileMeta {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	list := make([]*FileMeta, 0)
+	for _, elm := range this.FileMeta {
+		if !elm.Deleted {
+			list = append(list, elm)
+		}
+	}
+	return list
+}
+
+// Bytes used by live files, contents shared by deduplicated files count once
+func (this *ShardFileMeta) LiveBytes() uint64 {
+	var n uint64 = 0
+	seen := make(map[uint64]bool)
+	for _, elm := range this.Live() {
+		if elm.Size == 0 || seen[elm.StartOffset] {
+			continue
+		}
+		seen[elm.StartOffset] = true
+		n += elm.Size
+	}
+	return n
+}
+
+// Bytes not stored because live files share their contents
+func (this *ShardFileMeta) DedupBytes() uint64 {
+	var n uint64 = 0
+	for _, elm := range this.Live() {
+		n += uint64(elm.Size)
+	}
+	return n - uint64(this.LiveBytes())
+}
+
+// Live file with the same contents, nil if none
+func (this *ShardFileMeta) GetByContents(f *FileMeta) *FileMeta {
+	key := fileMetaContentsKey(f)
+	if len(key) == 0 {
+		return nil
+	}
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	if list := this.contents[key]; len(list) > 0 {
+		return list[0]
+	}
+	return nil
+}
+
+// Number of live files that reference the contents at the offset, the bytes are reclaimed by compaction when this drops to zero
+func (this *ShardFileMeta) ContentRefs(startOffset uint64) int {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.refs[startOffset]
+}
+
+// From bytes (binary format)
+func (this *ShardFileMeta) FromBytes(b []byte) error {
+	list, err := shardFileMetaFromBytes(b)
+	if err != nil {
+		return err
+	}
+	this._set(list)
+	return nil
+}
+
+// From JSON (shard format version 1)
+func (this *ShardFileMeta) FromJson(b []byte) error {
+	list := make([]*FileMeta, 0)
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	this._set(list)
+	return nil
+}
+
+// Replace all file meta
+func (this *ShardFileMeta) _set(list []*FileMeta) {
 	this.mux.Lock()
-	json.Unmarshal(b, &this.FileMeta)
-	this.mux.Unlock()
+	defer this.mux.Unlock()
+	this.FileMeta = list
+	this.names = make(map[string][]*FileMeta)
+	this.contents = make(map[string][]*FileMeta)
+	this.refs = make(map[uint64]int)
+	for _, elm := range list {
+		this.names[elm.FullName] = append(this.names[elm.FullName], elm)
+		if !elm.Deleted {
+			this._addLive(elm)
+		}
+	}
 }
 
 func newShardFileMeta() *ShardFileMeta {
 	return &ShardFileMeta{
 		FileMeta: make([]*FileMeta, 0),
+		names:    make(map[string][]*FileMeta),
+		contents: make(map[string][]*FileMeta),
+		refs:     make(map[uint64]int),
 	}
 }
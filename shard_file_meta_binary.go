@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Binary format of the file meta of a shard (format version 2), followed by an index of the names for lookups without parsing all entries
+// uint32 - length of the entry, entry - for every file
+// uint64 - hash of the name, uint32 - offset of the entry - for every file, sorted by hash
+// uint32 - number of files
+
+// Bytes of a name index slot
+const SHARD_FILE_META_INDEX_SLOT_LENGTH int = 8 + 4
+
+// Flags of an entry, after the file meta
+const (
+	DeletedShardFileMetaFlag        byte = 1 << iota // 1 = deleted
+	DataShardIndexShardFileMetaFlag                  // 2 = followed by data shard index (uint32, copies on parity shards)
+	ChunksShardFileMetaFlag                          // 4 = followed by the chunks of a large file (uint32 length + JSON)
+)
+
+// Slot of the name index
+type shardFileMetaIndexSlot struct {
+	hash   uint64
+	offset uint32
+}
+
+// Encode file meta with name index
+func shardFileMetaToBytes(list []*FileMeta) []byte {
+	buf := new(bytes.Buffer)
+	slots := make([]shardFileMetaIndexSlot, 0, len(list))
+	for _, f := range list {
+		slots = append(slots, shardFileMetaIndexSlot{hash: f.GetHash(), offset: uint32(buf.Len())})
+		entry := shardFileMetaEntryBytes(f)
+		binary.Write(buf, binary.BigEndian, uint32(len(entry))) // length of the entry
+		buf.Write(entry)                                        // entry
+	}
+
+	// Name index, versions of the same name stay in order
+	sort.SliceStable(slots, func(i, j int) bool {
+		return slots[i].hash < slots[j].hash
+	})
+	for _, slot := range slots {
+		binary.Write(buf, binary.BigEndian, slot.hash)   // hash of the name
+		binary.Write(buf, binary.BigEndian, slot.offset) // offset of the entry
+	}
+	binary.Write(buf, binary.BigEndian, uint32(len(list))) // number of files
+	return buf.Bytes()
+}
+
+// Entry of a file: file meta length (uint32) - file meta - flags (byte) - optional fields of the flags
+func shardFileMetaEntryBytes(f *FileMeta) []byte {
+	buf := new(bytes.Buffer)
+	meta := f.Bytes()
+	binary.Write(buf, binary.BigEndian, uint32(len(meta)))
+	buf.Write(meta)
+	var flags byte = 0
+	if f.Deleted {
+		flags |= DeletedShardFileMetaFlag
+	}
+	if f.DataShardIndex > 0 {
+		flags |= DataShardIndexShardFileMetaFlag
+	}
+	if len(f.Chunks) > 0 {
+		flags |= ChunksShardFileMetaFlag
+	}
+	buf.WriteByte(flags)
+	if f.DataShardIndex > 0 {
+		binary.Write(buf, binary.BigEndian, f.DataShardIndex)
+	}
+	if len(f.Chunks) > 0 {
+		chunks, err := json.Marshal(f.Chunks)
+		panicErr(err)
+		binary.Write(buf, binary.BigEndian, uint32(len(chunks)))
+		buf.Write(chunks)
+	}
+	return buf.Bytes()
+}
+
+// Decode entry
+func shardFileMetaEntryFromBytes(b []byte) (*FileMeta, error) {
+	buf := bytes.NewReader(b)
+	var metaLen uint32
+	if err := binary.Read(buf, binary.BigEndian, &metaLen); err != nil || int(metaLen) > buf.Len() {
+		return nil, errors.New("Invalid file meta length")
+	}
+	meta := make([]byte, metaLen)
+	buf.Read(meta)
+	f := &FileMeta{}
+	f.FromBytes(meta)
+	flags, err := buf.ReadByte()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Missing flags of %s", f.FullName))
+	}
+	f.Deleted = flags&DeletedShardFileMetaFlag != 0
+	if flags&DataShardIndexShardFileMetaFlag != 0 {
+		if err := binary.Read(buf, binary.BigEndian, &f.DataShardIndex); err != nil {
+			return nil, errors.New(fmt.Sprintf("Missing data shard index of %s", f.FullName))
+		}
+	}
+	if flags&ChunksShardFileMetaFlag != 0 {
+		var chunksLen uint32
+		if err := binary.Read(buf, binary.BigEndian, &chunksLen); err != nil || int(chunksLen) > buf.Len() {
+			return nil, errors.New(fmt.Sprintf("Invalid chunks of %s", f.FullName))
+		}
+		chunks := make([]byte, chunksLen)
+		buf.Read(chunks)
+		if err := json.Unmarshal(chunks, &f.Chunks); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid chunks of %s: %s", f.FullName, err))
+		}
+	}
+	return f, nil
+}
+
+// Offset of the name index and number of files
+func shardFileMetaIndexOffset(b []byte) (int, int, error) {
+	if len(b) < 4 {
+		return 0, 0, errors.New("File meta too short")
+	}
+	count := int(binary.BigEndian.Uint32(b[len(b)-4:]))
+	offset := len(b) - 4 - count*SHARD_FILE_META_INDEX_SLOT_LENGTH
+	if count < 0 || offset < 0 {
+		return 0, 0, errors.New(fmt.Sprintf("Invalid number of files %d in file meta", count))
+	}
+	return offset, count, nil
+}
+
+// Entry at an offset
+func shardFileMetaEntryAt(b []byte, offset int, end int) (*FileMeta, int, error) {
+	if offset+4 > end {
+		return nil, 0, errors.New(fmt.Sprintf("Entry at %d out of bounds", offset))
+	}
+	entryLen := int(binary.BigEndian.Uint32(b[offset : offset+4]))
+	if offset+4+entryLen > end {
+		return nil, 0, errors.New(fmt.Sprintf("Entry at %d of %d bytes out of bounds", offset, entryLen))
+	}
+	f, err := shardFileMetaEntryFromBytes(b[offset+4 : offset+4+entryLen])
+	return f, offset + 4 + entryLen, err
+}
+
+// Decode all file meta
+func shardFileMetaFromBytes(b []byte) (list []*FileMeta, err error) {
+	// Damaged file meta panics
+	defer func() {
+		if r := recover(); r != nil {
+			list = nil
+			err = errors.New(fmt.Sprintf("Damaged file meta: %v", r))
+		}
+	}()
+	end, count, err := shardFileMetaIndexOffset(b)
+	if err != nil {
+		return nil, err
+	}
+	list = make([]*FileMeta, 0, count)
+	for offset := 0; offset < end; {
+		var f *FileMeta
+		if f, offset, err = shardFileMetaEntryAt(b, offset, end); err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	if len(list) != count {
+		return nil, errors.New(fmt.Sprintf("Found %d files in file meta, expected %d", len(list), count))
+	}
+	return list, nil
+}
+
+// Versions of a file in encoded file meta (including deleted ones) by the name index, without decoding the other entries
+func lookupShardFileMeta(b []byte, name string) (list []*FileMeta, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			list = nil
+			err = errors.New(fmt.Sprintf("Damaged file meta: %v", r))
+		}
+	}()
+	end, count, err := shardFileMetaIndexOffset(b)
+	if err != nil {
+		return nil, err
+	}
+	hash := (&FileMeta{FullName: name}).GetHash()
+	slot := func(i int) (uint64, int) {
+		pos := end + i*SHARD_FILE_META_INDEX_SLOT_LENGTH
+		return binary.BigEndian.Uint64(b[pos : pos+8]), int(binary.BigEndian.Uint32(b[pos+8 : pos+12]))
+	}
+	list = make([]*FileMeta, 0)
+	for i := sort.Search(count, func(i int) bool {
+		h, _ := slot(i)
+		return h >= hash
+	}); i < count; i++ {
+		h, offset := slot(i)
+		if h != hash {
+			break
+		}
+		f, _, err := shardFileMetaEntryAt(b, offset, end)
+		if err != nil {
+			return nil, err
+		}
+		if f.FullName == name {
+			list = append(list, f)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+// Test that the contents index follows adds, deletes, undone adds and reloads
+func TestShardFileMetaContents(t *testing.T) {
+	startApplication()
+	conf.Dedup = true
+	defer func() {
+		conf.Dedup = false
+	}()
+
+	sfm := newShardFileMeta()
+	a := newFileMetaWithData("/contents/a.txt", []byte("Shared"))
+	a.StartOffset = 10
+	b := newFileMetaWithData("/contents/b.txt", []byte("Shared"))
+	b.StartOffset = 10
+	sfm.Add(a)
+	sfm.Add(b)
+	if sfm.GetByContents(b) != a || sfm.ContentRefs(10) != 2 {
+		t.Fatal("Expected both files to reference the contents")
+	}
+
+	// Delete
+	sfm.MarkDeleted(a.FullName)
+	if sfm.GetByContents(a) != b || sfm.ContentRefs(10) != 1 {
+		t.Error("Expected remaining file after delete")
+	}
+	sfm.MarkDeleted(b.FullName)
+	if sfm.GetByContents(a) != nil || sfm.ContentRefs(10) != 0 {
+		t.Error("Expected no file with the contents")
+	}
+
+	// Undone delete
+	sfm.MarkLive([]*FileMeta{a})
+	if sfm.GetByContents(b) != a || sfm.ContentRefs(10) != 1 {
+		t.Error("Expected file to be live again")
+	}
+
+	// Reload
+	reloaded := newShardFileMeta()
+	if err := reloaded.FromBytes(sfm.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if found := reloaded.GetByContents(b); found == nil || found.FullName != a.FullName || reloaded.ContentRefs(10) != 1 {
+		t.Error("Expected contents index after reload")
+	}
+}
@@ -3,51 +3,245 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
-	"github.com/willf/bloom"
+	"math"
 	"sync"
 )
 
-// Index on a shard
+// Index on a shard, a scalable bloom filter: when a filter holds the files it was sized for a larger one with a lower error rate is added
 
 type ShardIndex struct {
-	// Internal bloom filter
-	bloomFilter *bloom.BloomFilter
+	// Internal bloom filters, the first one is sized from the configuration
+	indexType ShardIndexType
+	filters   []*ShardIndexFilter
+
+	// Target false positive rate of all filters together
+	falsePositiveRate float64
 
 	// Mutex
 	mux sync.RWMutex
 
-	// Size
+	// Size of the first filter
 	size          uint32
 	hashFunctions uint32
 
 	// Id
 	ShardId []byte
+
+	// Block layout, used to find the other shards of the block (e.g. for degraded reads)
+	BlockId      []byte
+	BlockIndex   uint32
+	Parity       bool
+	DataShards   uint32 // Erasure coding scheme of the block
+	ParityShards uint32
+}
+
+// Single bloom filter of a shard index
+type ShardIndexFilter struct {
+	filter   ShardFilter
+	capacity uint32 // Files the filter is sized for
+	count    uint32 // Files added
+}
+
+// Each filter that is added holds this many times the files of the previous one
+const SHARD_INDEX_GROWTH uint32 = 2
+
+// Each filter that is added has this fraction of the error rate of the previous one, this keeps the total below the target rate
+const SHARD_INDEX_TIGHTENING float64 = 0.5
+
+// Error rate of indices without parameters (written by older nodes)
+const SHARD_INDEX_LEGACY_FALSE_POSITIVE_RATE float64 = 0.01
+
+// Minimum number of files a shard index is sized for
+const SHARD_INDEX_MIN_FILES uint32 = 1024
+
+// New filter, the n-th filter of an index gets a lower error rate
+func newShardIndexFilter(t ShardIndexType, capacity uint32, falsePositiveRate float64, n int) *ShardIndexFilter {
+	p := falsePositiveRate * (1 - SHARD_INDEX_TIGHTENING) * math.Pow(SHARD_INDEX_TIGHTENING, float64(n))
+	return &ShardIndexFilter{
+		filter:   newShardFilter(t, capacity, p),
+		capacity: capacity,
+	}
+}
+
+// Files a filter can hold at the error rate
+func shardIndexFilterCapacity(bits uint, falsePositiveRate float64) uint32 {
+	return uint32(float64(bits) * math.Ln2 * math.Ln2 / -math.Log(falsePositiveRate))
+}
+
+// Estimated false positive rate for the files added
+func (this *ShardIndexFilter) FalsePositiveRate() float64 {
+	m := float64(this.filter.Cap())
+	k := float64(this.filter.K())
+	if m < 1 {
+		return 0
+	}
+	return math.Pow(1-math.Exp(-k*float64(this.count)/m), k)
+}
+
+// Number of files the first filter of a shard index is sized for, derived from the shard size unless configured
+func shardIndexExpectedFiles() uint32 {
+	if conf == nil {
+		return SHARD_INDEX_MIN_FILES
+	}
+	n := conf.ShardIndexExpectedFiles
+	if n < 1 && conf.ShardIndexExpectedFileSize > 0 {
+		n = conf.ShardSizeInBytes / conf.ShardIndexExpectedFileSize
+	}
+	if n < int(SHARD_INDEX_MIN_FILES) {
+		return SHARD_INDEX_MIN_FILES
+	}
+	return uint32(n)
+}
+
+// Type of new shard indices, bloom filters until all nodes can read other types
+func shardIndexType() ShardIndexType {
+	if conf == nil || clusterFormatVersion() < BINARY_COUNTING_INDEX_VERSION {
+		return BloomShardIndexType
+	}
+	return conf.ShardIndexType
+}
+
+// Target false positive rate of new shard indices
+func shardIndexFalsePositiveRate() float64 {
+	if conf == nil || conf.ShardIndexFalsePosRate <= 0 || conf.ShardIndexFalsePosRate >= 1 {
+		return SHARD_INDEX_LEGACY_FALSE_POSITIVE_RATE
+	}
+	return conf.ShardIndexFalsePosRate
+}
+
+// Type
+func (this *ShardIndex) Type() ShardIndexType {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.indexType
+}
+
+// Number of filters
+func (this *ShardIndex) FilterCount() int {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return len(this.filters)
+}
+
+// Total bits of all filters
+func (this *ShardIndex) Bits() uint64 {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	var bits uint64 = 0
+	for _, f := range this.filters {
+		bits += uint64(f.filter.Cap())
+	}
+	return bits
+}
+
+// Estimated false positive rate for the files added, any of the filters can match
+func (this *ShardIndex) EstimatedFalsePositiveRate() float64 {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	var logNone float64 = 0
+	for _, f := range this.filters {
+		logNone += math.Log1p(-f.FalsePositiveRate())
+	}
+	return -math.Expm1(logNone)
+}
+
+// Set block layout
+func (this *ShardIndex) SetBlockInfo(blockId []byte, blockIndex uint32, parity bool, dataShards uint32, parityShards uint32) {
+	this.mux.Lock()
+	this.BlockId = blockId
+	this.BlockIndex = blockIndex
+	this.Parity = parity
+	this.DataShards = dataShards
+	this.ParityShards = parityShards
+	this.mux.Unlock()
+}
+
+// Has block layout? (not available from older nodes)
+func (this *ShardIndex) HasBlockInfo() bool {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return len(this.BlockId) == 16
+}
+
+// Erasure coding scheme of the block, falls back to the configured scheme for older indices
+func (this *ShardIndex) ErasureCodingScheme() (int, int) {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	if this.DataShards < 1 {
+		return conf.DataShardsPerBlock, conf.ParityShardsPerBlock
+	}
+	return int(this.DataShards), int(this.ParityShards)
 }
 
 // Add to index
 func (this *ShardIndex) Add(fullName string) bool {
 	this.mux.Lock()
 	// log.Infof("Adding %s to index of shard %s", fullName, uuidToString(this.ShardId))
-	this.bloomFilter.Add([]byte(fullName))
+	f := this.filters[len(this.filters)-1]
+
+	// Full? Grow once all nodes can read more than one filter, until then the error rate of the last filter goes up
+	if f.count >= f.capacity && clusterFormatVersion() >= BINARY_SCALABLE_INDEX_VERSION {
+		capacity := f.capacity * SHARD_INDEX_GROWTH
+		if capacity < f.capacity {
+			capacity = math.MaxUint32
+		}
+		f = newShardIndexFilter(this.indexType, capacity, this.falsePositiveRate, len(this.filters))
+		this.filters = append(this.filters, f)
+	}
+	f.filter.Add([]byte(fullName))
+	f.count++
 	this.mux.Unlock()
 	return true
 }
 
+// Remove from index (e.g. file deleted), one removal per add, returns false if the type does not support it
+// names are only removed from the filter they were added to, when more than one filter matches the name stays
+func (this *ShardIndex) Remove(fullName string) bool {
+	b := []byte(fullName)
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	var match *ShardIndexFilter = nil
+	for _, f := range this.filters {
+		if !f.filter.Test(b) {
+			continue
+		}
+		if match != nil {
+			return false
+		}
+		match = f
+	}
+	if match == nil || !match.filter.Remove(b) {
+		return false
+	}
+	if match.count > 0 {
+		match.count--
+	}
+	return true
+}
+
 // Test index contains this file
 func (this *ShardIndex) Test(fullName string) bool {
+	b := []byte(fullName)
 	this.mux.RLock()
-	res := this.bloomFilter.Test([]byte(fullName))
-	this.mux.RUnlock()
-	// log.Infof("Testing %s in index of shard %s, res %t", fullName, uuidToString(this.ShardId), res)
-	return res
+	defer this.mux.RUnlock()
+	for _, f := range this.filters {
+		if f.filter.Test(b) {
+			// log.Infof("Testing %s in index of shard %s, res %t", fullName, uuidToString(this.ShardId), true)
+			return true
+		}
+	}
+	return false
 }
 
 // To bytes
 func (this *ShardIndex) Bytes() []byte {
 	buf := new(bytes.Buffer)
 	this.mux.RLock()
-	bytes, e := this.bloomFilter.GobEncode()
-	panicErr(e)
+	bytes := this.filters[0].filter.Bytes()
+	if this.indexType != BloomShardIndexType {
+		binary.Write(buf, binary.BigEndian, uint32(0)) // No bloom filter, older nodes can not read other types
+		buf.WriteByte(byte(this.indexType))            // Type
+	}
 	binary.Write(buf, binary.BigEndian, uint32(len(bytes))) // Length of index
 	buf.Write(bytes)                                        // Actual index
 	idLen := uint32(len(this.ShardId))
@@ -57,6 +251,31 @@ func (this *ShardIndex) Bytes() []byte {
 	binary.Write(buf, binary.BigEndian, idLen) // Length of shard ID
 	buf.Write(this.ShardId)                    // Shard ID
 
+	// Block layout, without block ID when unknown (the filter parameters follow)
+	binary.Write(buf, binary.BigEndian, uint32(len(this.BlockId))) // Length of block ID
+	buf.Write(this.BlockId)                                        // Block ID
+	binary.Write(buf, binary.BigEndian, this.BlockIndex)           // Block index
+	if this.Parity {                                               // Parity
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	binary.Write(buf, binary.BigEndian, this.DataShards)   // Data shards of block
+	binary.Write(buf, binary.BigEndian, this.ParityShards) // Parity shards of block
+
+	// Filter parameters, older nodes only read the first filter
+	binary.Write(buf, binary.BigEndian, this.falsePositiveRate)      // Target false positive rate
+	binary.Write(buf, binary.BigEndian, this.filters[0].capacity)    // Files the first filter is sized for
+	binary.Write(buf, binary.BigEndian, this.filters[0].count)       // Files in the first filter
+	binary.Write(buf, binary.BigEndian, uint32(len(this.filters)-1)) // Number of additional filters
+	for _, f := range this.filters[1:] {
+		fb := f.filter.Bytes()
+		binary.Write(buf, binary.BigEndian, f.capacity)      // Files the filter is sized for
+		binary.Write(buf, binary.BigEndian, f.count)         // Files in the filter
+		binary.Write(buf, binary.BigEndian, uint32(len(fb))) // Length of filter
+		buf.Write(fb)                                        // Filter
+	}
+
 	// Unlock
 	this.mux.RUnlock()
 
@@ -75,20 +294,34 @@ func (this *ShardIndex) FromBytes(b []byte) {
 	err = binary.Read(buf, binary.BigEndian, &idxLen) // index length
 	panicErr(err)
 
+	// Type, other than bloom filters
+	this.indexType = BloomShardIndexType
+	if idxLen == 0 {
+		t, typeErr := buf.ReadByte()
+		panicErr(typeErr)
+		this.indexType = ShardIndexType(t)
+		err = binary.Read(buf, binary.BigEndian, &idxLen)
+		panicErr(err)
+	}
+
 	// Read actual index
-	indexBytes := make([]byte, idxLen)
+	indexBytes := allocByteArr(uint64(idxLen), uint64(buf.Len()))
 	indexBytesRead, _ := buf.Read(indexBytes)
 	if uint32(indexBytesRead) != idxLen {
 		panic("Index bytes read mismatch")
 	}
 
 	// Decode index
-	e := this.bloomFilter.GobDecode(indexBytes)
+	first := &ShardIndexFilter{filter: this._newFilter()}
+	e := first.filter.FromBytes(indexBytes)
 	panicErr(e)
+	this.filters = []*ShardIndexFilter{first}
 
-	// Set size and hash functions from bloom filter
-	this.size = uint32(this.bloomFilter.Cap())
-	this.hashFunctions = uint32(this.bloomFilter.K())
+	// Set size and hash functions from bloom filter, the parameters of older indices are of the fixed size filter
+	this.size = uint32(first.filter.Cap())
+	this.hashFunctions = uint32(first.filter.K())
+	this.falsePositiveRate = SHARD_INDEX_LEGACY_FALSE_POSITIVE_RATE
+	first.capacity = shardIndexFilterCapacity(first.filter.Cap(), this.falsePositiveRate)
 
 	// Read shard ID length
 	var shardIdLen uint32
@@ -102,16 +335,83 @@ func (this *ShardIndex) FromBytes(b []byte) {
 	}
 	this.ShardId = shardIdBytes
 
+	// Block layout (optional)
+	if buf.Len() > 0 {
+		var blockIdLen uint32
+		err = binary.Read(buf, binary.BigEndian, &blockIdLen)
+		panicErr(err)
+		blockIdBytes := allocByteArr(uint64(blockIdLen), 16)
+		blockIdBytesRead, _ := buf.Read(blockIdBytes)
+		if uint32(blockIdBytesRead) != blockIdLen {
+			panic("Block id bytes read mismatch")
+		}
+		this.BlockId = blockIdBytes
+		err = binary.Read(buf, binary.BigEndian, &this.BlockIndex)
+		panicErr(err)
+		parity, parityErr := buf.ReadByte()
+		panicErr(parityErr)
+		this.Parity = parity == 1
+
+		// Erasure coding scheme (optional)
+		if buf.Len() > 0 {
+			err = binary.Read(buf, binary.BigEndian, &this.DataShards)
+			panicErr(err)
+			err = binary.Read(buf, binary.BigEndian, &this.ParityShards)
+			panicErr(err)
+		}
+	}
+
+	// Filter parameters (optional)
+	if buf.Len() > 0 {
+		err = binary.Read(buf, binary.BigEndian, &this.falsePositiveRate)
+		panicErr(err)
+		err = binary.Read(buf, binary.BigEndian, &first.capacity)
+		panicErr(err)
+		err = binary.Read(buf, binary.BigEndian, &first.count)
+		panicErr(err)
+		var filterCount uint32
+		err = binary.Read(buf, binary.BigEndian, &filterCount)
+		panicErr(err)
+		for i := uint32(0); i < filterCount; i++ {
+			f := &ShardIndexFilter{filter: this._newFilter()}
+			err = binary.Read(buf, binary.BigEndian, &f.capacity)
+			panicErr(err)
+			err = binary.Read(buf, binary.BigEndian, &f.count)
+			panicErr(err)
+			var filterLen uint32
+			err = binary.Read(buf, binary.BigEndian, &filterLen)
+			panicErr(err)
+			filterBytes := allocByteArr(uint64(filterLen), uint64(buf.Len()))
+			filterBytesRead, _ := buf.Read(filterBytes)
+			if uint32(filterBytesRead) != filterLen {
+				panic("Filter bytes read mismatch")
+			}
+			panicErr(f.filter.FromBytes(filterBytes))
+			this.filters = append(this.filters, f)
+		}
+	}
+
 	this.mux.Unlock()
 }
 
+// Empty filter of the type of this index (caller must hold the lock)
+func (this *ShardIndex) _newFilter() ShardFilter {
+	f, err := newEmptyShardFilter(this.indexType)
+	panicErr(err)
+	return f
+}
+
+// New shard index, sized for the expected number of files in a shard
 func newShardIndex(id []byte) *ShardIndex {
-	size := uint(9585059)
-	k := uint(7)
+	t := shardIndexType()
+	falsePositiveRate := shardIndexFalsePositiveRate()
+	first := newShardIndexFilter(t, shardIndexExpectedFiles(), falsePositiveRate, 0)
 	return &ShardIndex{
-		ShardId:       id,
-		bloomFilter:   bloom.New(size, k), // 1% error rate for 1MM items
-		size:          uint32(size),
-		hashFunctions: uint32(k),
+		ShardId:           id,
+		indexType:         t,
+		filters:           []*ShardIndexFilter{first},
+		falsePositiveRate: falsePositiveRate,
+		size:              uint32(first.filter.Cap()),
+		hashFunctions:     uint32(first.filter.K()),
 	}
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/willf/bloom"
+	"strings"
+)
+
+// Filters of a shard index, the type is stored with the index so shards with different types can be located side by side
+
+type ShardIndexType byte
+
+const (
+	BloomShardIndexType    ShardIndexType = iota // 0 = bloom filter, names stay until the shard is compacted
+	CountingShardIndexType                       // 1 = counting bloom filter, names of deleted files are removed
+)
+
+// Filter of a shard index
+type ShardFilter interface {
+	Add(b []byte)
+	Test(b []byte) bool
+	Remove(b []byte) bool // False if not supported by the type or not in the filter
+	Cap() uint            // Bits (or counters)
+	K() uint              // Hash functions
+	Bytes() []byte
+	FromBytes(b []byte) error
+}
+
+// Name of the type
+func (this ShardIndexType) String() string {
+	switch this {
+	case BloomShardIndexType:
+		return "bloom"
+	case CountingShardIndexType:
+		return "counting"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(this))
+}
+
+// Parse type by name
+func parseShardIndexType(s string) (ShardIndexType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "bloom":
+		return BloomShardIndexType, nil
+	case "counting":
+		return CountingShardIndexType, nil
+	}
+	return BloomShardIndexType, errors.New(fmt.Sprintf("Invalid shard index type %s, expected bloom or counting", s))
+}
+
+// New filter of the type, sized for the files at the error rate
+func newShardFilter(t ShardIndexType, capacity uint32, falsePositiveRate float64) ShardFilter {
+	switch t {
+	case CountingShardIndexType:
+		m, k := bloom.EstimateParameters(uint(capacity), falsePositiveRate)
+		return newCountingBloomFilter(m, k)
+	}
+	return &BloomShardFilter{bloomFilter: bloom.NewWithEstimates(uint(capacity), falsePositiveRate)}
+}
+
+// Empty filter of the type, to load bytes into
+func newEmptyShardFilter(t ShardIndexType) (ShardFilter, error) {
+	switch t {
+	case BloomShardIndexType:
+		return &BloomShardFilter{bloomFilter: &bloom.BloomFilter{}}, nil
+	case CountingShardIndexType:
+		return &CountingBloomFilter{}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown shard index type %d", t))
+}
+
+// Bloom filter
+type BloomShardFilter struct {
+	bloomFilter *bloom.BloomFilter
+}
+
+// Add
+func (this *BloomShardFilter) Add(b []byte) {
+	this.bloomFilter.Add(b)
+}
+
+// Test
+func (this *BloomShardFilter) Test(b []byte) bool {
+	return this.bloomFilter.Test(b)
+}
+
+// Remove, not supported
+func (this *BloomShardFilter) Remove(b []byte) bool {
+	return false
+}
+
+// Bits
+func (this *BloomShardFilter) Cap() uint {
+	return this.bloomFilter.Cap()
+}
+
+// Hash functions
+func (this *BloomShardFilter) K() uint {
+	return this.bloomFilter.K()
+}
+
+// To bytes
+func (this *BloomShardFilter) Bytes() []byte {
+	b, err := this.bloomFilter.GobEncode()
+	panicErr(err)
+	return b
+}
+
+// From bytes
+func (this *BloomShardFilter) FromBytes(b []byte) error {
+	return this.bloomFilter.GobDecode(b)
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"github.com/willf/bloom"
 	"testing"
 )
 
@@ -53,6 +56,166 @@ func TestShardIndex(t *testing.T) {
 	}
 }
 
+// Test that the index grows beyond the files it is sized for and keeps its parameters
+func TestShardIndexScaling(t *testing.T) {
+	startApplication()
+	idx := newShardIndex(randomUuid())
+	expected := shardIndexExpectedFiles()
+	if idx.FilterCount() != 1 || idx.filters[0].capacity != expected || idx.falsePositiveRate != conf.ShardIndexFalsePosRate {
+		t.Fatalf("Unexpected index parameters, capacity %d rate %f", idx.filters[0].capacity, idx.falsePositiveRate)
+	}
+	n := int(expected) * 4
+	for i := 0; i < n; i++ {
+		idx.Add(fmt.Sprintf("/scaling/%d.txt", i))
+	}
+	if idx.FilterCount() != 3 {
+		t.Errorf("Expected 3 filters, found %d", idx.FilterCount())
+	}
+	if rate := idx.EstimatedFalsePositiveRate(); rate <= 0 || rate > conf.ShardIndexFalsePosRate {
+		t.Errorf("Unexpected false positive rate %f", rate)
+	}
+
+	// Round trip
+	idx2 := newShardIndex(randomUuid())
+	idx2.FromBytes(idx.Bytes())
+	if idx2.FilterCount() != 3 || idx2.filters[2].count != idx.filters[2].count || idx2.filters[2].capacity != expected*4 || idx2.HasBlockInfo() {
+		t.Errorf("Filters not recovered from bytes")
+	}
+	for i := 0; i < n; i++ {
+		if !idx2.Test(fmt.Sprintf("/scaling/%d.txt", i)) {
+			t.Fatalf("File %d missing after loading bytes", i)
+		}
+	}
+	var falsePositives int = 0
+	for i := 0; i < 10000; i++ {
+		if idx2.Test(fmt.Sprintf("/missing/%d.txt", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 200 {
+		t.Errorf("Too many false positives %d", falsePositives)
+	}
+}
+
+// Test that an index of an older node (single fixed size filter, no parameters) loads
+func TestShardIndexLegacy(t *testing.T) {
+	filter := bloom.New(9585059, 7)
+	filter.Add([]byte("legacy.txt"))
+	fb, _ := filter.GobEncode()
+	id := randomUuid()
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(len(fb)))
+	buf.Write(fb)
+	binary.Write(buf, binary.BigEndian, uint32(len(id)))
+	buf.Write(id)
+
+	idx := newShardIndex(randomUuid())
+	idx.FromBytes(buf.Bytes())
+	if !idx.Test("legacy.txt") || idx.Test("other.txt") || !bytes.Equal(idx.ShardId, id) {
+		t.Error("Failed to load legacy index")
+	}
+	if c := idx.filters[0].capacity; c < 990000 || c > 1010000 {
+		t.Errorf("Expected capacity of 1MM files, found %d", c)
+	}
+}
+
+// Test that names can be removed from a counting index
+func TestShardIndexRemove(t *testing.T) {
+	startApplication()
+	previousType := conf.ShardIndexType
+	conf.ShardIndexType = CountingShardIndexType
+	defer func() {
+		conf.ShardIndexType = previousType
+	}()
+	idx := newShardIndex(randomUuid())
+	if idx.Type() != CountingShardIndexType {
+		t.Fatalf("Expected counting index, found %s", idx.Type())
+	}
+	idx.Add("a.txt")
+	idx.Add("b.txt")
+	idx.Add("b.txt")
+	if !idx.Remove("a.txt") || idx.Test("a.txt") || !idx.Test("b.txt") {
+		t.Error("Failed to remove a.txt")
+	}
+	if idx.Remove("a.txt") {
+		t.Error("Removed name twice")
+	}
+
+	// Added twice, removed twice
+	idx.Remove("b.txt")
+	if !idx.Test("b.txt") {
+		t.Error("Name added twice must stay after one removal")
+	}
+	idx.Remove("b.txt")
+	if idx.Test("b.txt") {
+		t.Error("Failed to remove b.txt")
+	}
+
+	// Round trip keeps type and counters
+	idx.Add("c.txt")
+	idx2 := newShardIndex(randomUuid())
+	idx2.FromBytes(idx.Bytes())
+	if idx2.Type() != CountingShardIndexType || !idx2.Test("c.txt") || idx2.Test("a.txt") {
+		t.Error("Counting index not recovered from bytes")
+	}
+	if !idx2.Remove("c.txt") || idx2.Test("c.txt") {
+		t.Error("Failed to remove after loading bytes")
+	}
+
+	// Bloom filters can not remove
+	conf.ShardIndexType = BloomShardIndexType
+	bloomIdx := newShardIndex(randomUuid())
+	conf.ShardIndexType = CountingShardIndexType
+	bloomIdx.Add("a.txt")
+	if bloomIdx.Type() != BloomShardIndexType || bloomIdx.Remove("a.txt") || !bloomIdx.Test("a.txt") {
+		t.Error("Bloom index must keep names")
+	}
+}
+
+// Test counters that reach the maximum
+func TestCountingBloomFilter(t *testing.T) {
+	f := newCountingBloomFilter(1000, 3)
+	for i := 0; i < 20; i++ {
+		f.Add([]byte("full"))
+	}
+	for i := 0; i < 20; i++ {
+		f.Remove([]byte("full"))
+	}
+	if !f.Test([]byte("full")) {
+		t.Error("Saturated counters must not be decremented")
+	}
+	if err := (&CountingBloomFilter{}).FromBytes(f.Bytes()[:20]); err == nil {
+		t.Error("Expected truncated filter to fail")
+	}
+}
+
+// Test that deleted files are removed from the counting index of the shard
+func TestShardIndexDeleteFile(t *testing.T) {
+	startApplication()
+	previousType := conf.ShardIndexType
+	conf.ShardIndexType = CountingShardIndexType
+	defer func() {
+		conf.ShardIndexType = previousType
+	}()
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	shard.AddFile(newFileMeta("/index/delete.txt"), []byte("Delete me"))
+	shard.AddFile(newFileMeta("/index/overwrite.txt"), []byte("First"))
+	shard.AddFile(newFileMeta("/index/overwrite.txt"), []byte("Second"))
+	if deleted, err := shard.DeleteFile("/index/delete.txt"); !deleted || err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+	if shard.TestContainsFile("/index/delete.txt") {
+		t.Error("Deleted file must be removed from index")
+	}
+	if !shard.TestContainsFile("/index/overwrite.txt") {
+		t.Error("Overwritten file must stay in index")
+	}
+	if _, _, err := datastore.LocateFile("/index/delete.txt"); err == nil {
+		t.Error("Deleted file must not be located")
+	}
+}
+
 var writeRes bool = false
 
 func BenchmarkShardIndexWrite(b *testing.B) {
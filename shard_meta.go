@@ -11,9 +11,10 @@ import (
 type ShardMeta struct {
 	MetaVersion    uint32
 	FileCount      uint32
-	IndexLength    uint32
-	FileMetaLength uint32
-	ContentsLength uint32
+	IndexLength    uint64
+	FileMetaLength uint64
+	ContentsLength uint64
+	KeyLength      uint32 // Wrapped data key of an encrypted shard, before the shard meta (optional)
 
 	// Lock
 	mux sync.RWMutex
@@ -27,7 +28,7 @@ func (this *Shard) FileCount() uint32 {
 }
 
 // Set index length
-func (this *ShardMeta) SetIndexLength(v uint32) {
+func (this *ShardMeta) SetIndexLength(v uint64) {
 	this.mux.Lock()
 	// Should never be empty
 	if v < 1 {
@@ -38,7 +39,7 @@ func (this *ShardMeta) SetIndexLength(v uint32) {
 }
 
 // Set contents length
-func (this *ShardMeta) SetContentsLength(v uint32) {
+func (this *ShardMeta) SetContentsLength(v uint64) {
 	this.mux.Lock()
 	// Empty is acceptable
 	if v < 0 {
@@ -49,7 +50,7 @@ func (this *ShardMeta) SetContentsLength(v uint32) {
 }
 
 // Set file metadata length
-func (this *ShardMeta) SetFileMetaLength(v uint32) {
+func (this *ShardMeta) SetFileMetaLength(v uint64) {
 	this.mux.Lock()
 	// Should never be empty
 	if v < 1 {
@@ -59,18 +60,83 @@ func (this *ShardMeta) SetFileMetaLength(v uint32) {
 	this.mux.Unlock()
 }
 
+// Length of the metadata in bytes
+func (this *ShardMeta) Length() uint32 {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return shardMetaLength(this.MetaVersion, this.KeyLength > 0)
+}
+
+// Length of the metadata of a version in bytes
+func shardMetaLength(version uint32, encrypted bool) uint32 {
+	if version >= BINARY_LARGE_VERSION {
+		if encrypted {
+			return BINARY_LARGE_ENCRYPTED_METADATA_LENGTH
+		}
+		return BINARY_LARGE_METADATA_LENGTH
+	}
+	if encrypted {
+		return BINARY_ENCRYPTED_METADATA_LENGTH
+	}
+	return BINARY_METADATA_LENGTH
+}
+
+// Is this the length of the metadata of any version?
+func isShardMetaLength(n uint32) bool {
+	return n == BINARY_METADATA_LENGTH || n == BINARY_ENCRYPTED_METADATA_LENGTH || n == BINARY_LARGE_METADATA_LENGTH || n == BINARY_LARGE_ENCRYPTED_METADATA_LENGTH
+}
+
+// Set meta version
+func (this *ShardMeta) SetMetaVersion(v uint32) {
+	this.mux.Lock()
+	this.MetaVersion = v
+	this.mux.Unlock()
+}
+
+// Set wrapped data key length
+func (this *ShardMeta) SetKeyLength(v uint32) {
+	this.mux.Lock()
+	this.KeyLength = v
+	this.mux.Unlock()
+}
+
+// Equals compares the lengths and counts of two shard metas (e.g. after a shard migration), a shard upgraded to a newer version only has to hold the same files
+func (this *ShardMeta) Equals(o *ShardMeta) bool {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	o.mux.RLock()
+	defer o.mux.RUnlock()
+	if this.MetaVersion != o.MetaVersion {
+		return this.FileCount == o.FileCount &&
+			this.ContentsLength == o.ContentsLength
+	}
+	return this.MetaVersion == o.MetaVersion &&
+		this.FileCount == o.FileCount &&
+		this.IndexLength == o.IndexLength &&
+		this.FileMetaLength == o.FileMetaLength &&
+		this.ContentsLength == o.ContentsLength &&
+		this.KeyLength == o.KeyLength
+}
+
 // To bytes
 func (this *ShardMeta) Bytes() []byte {
 	this.mux.RLock()
 	defer this.mux.RUnlock()
 	buf := new(bytes.Buffer)
-	buf.Write(BINARY_METADATA_MAGIC_STRING)                     // magic string
-	binary.Write(buf, binary.BigEndian, this.MetaVersion)       // meta version
-	binary.Write(buf, binary.BigEndian, this.FileCount)         // file count
-	binary.Write(buf, binary.BigEndian, this.IndexLength)       // bloom filter length
-	binary.Write(buf, binary.BigEndian, this.FileMetaLength)    // file metadata length
-	binary.Write(buf, binary.BigEndian, this.ContentsLength)    // contents (actual file bytes) length
-	binary.Write(buf, binary.BigEndian, BINARY_METADATA_LENGTH) // length of the metadata
+	buf.Write(BINARY_METADATA_MAGIC_STRING)               // magic string
+	binary.Write(buf, binary.BigEndian, this.MetaVersion) // meta version
+	binary.Write(buf, binary.BigEndian, this.FileCount)   // file count
+	for _, v := range []uint64{this.IndexLength, this.FileMetaLength, this.ContentsLength} {
+		if this.MetaVersion >= BINARY_LARGE_VERSION {
+			binary.Write(buf, binary.BigEndian, v) // bloom filter, file metadata and contents (actual file bytes) length
+		} else {
+			binary.Write(buf, binary.BigEndian, uint32(v))
+		}
+	}
+	if this.KeyLength > 0 {
+		binary.Write(buf, binary.BigEndian, this.KeyLength) // wrapped data key length
+	}
+	binary.Write(buf, binary.BigEndian, shardMetaLength(this.MetaVersion, this.KeyLength > 0)) // length of the metadata
 	return buf.Bytes()
 }
 
@@ -83,18 +149,37 @@ func (this *ShardMeta) FromBytes(b []byte) {
 	panicErr(err)
 	err = binary.Read(buf, binary.BigEndian, &this.FileCount) // file count
 	panicErr(err)
-	err = binary.Read(buf, binary.BigEndian, &this.IndexLength) // bloom filter length
-	panicErr(err)
-	err = binary.Read(buf, binary.BigEndian, &this.FileMetaLength) // file metadata length
-	panicErr(err)
-	err = binary.Read(buf, binary.BigEndian, &this.ContentsLength) // contents (actual file bytes) length
-	panicErr(err)
+	for _, v := range []*uint64{&this.IndexLength, &this.FileMetaLength, &this.ContentsLength} {
+		if this.MetaVersion >= BINARY_LARGE_VERSION {
+			err = binary.Read(buf, binary.BigEndian, v) // bloom filter, file metadata and contents (actual file bytes) length
+		} else {
+			var v32 uint32
+			err = binary.Read(buf, binary.BigEndian, &v32)
+			*v = uint64(v32)
+		}
+		panicErr(err)
+	}
+	if buf.Len() > 4 {
+		err = binary.Read(buf, binary.BigEndian, &this.KeyLength) // wrapped data key length (encrypted shards only)
+		panicErr(err)
+	}
 	// We don't have to read the binary metadata length, because we already know
 }
 
 // Version
-const BINARY_VERSION uint32 = 1
+// 1 = file meta as JSON
+// 2 = file meta in binary format with name index
+// 3 = 64-bit section lengths
+// 4 = scalable shard index (more than one bloom filter)
+// 5 = shard index types (counting bloom filter)
+const BINARY_VERSION uint32 = 5
+const BINARY_LARGE_VERSION uint32 = 3
+const BINARY_SCALABLE_INDEX_VERSION uint32 = 4
+const BINARY_COUNTING_INDEX_VERSION uint32 = 5
 const BINARY_METADATA_LENGTH uint32 = 3 + 4 + 4 + 4 + 4 + 4 + 4
+const BINARY_ENCRYPTED_METADATA_LENGTH uint32 = BINARY_METADATA_LENGTH + 4
+const BINARY_LARGE_METADATA_LENGTH uint32 = 3 + 4 + 4 + 8 + 8 + 8 + 4
+const BINARY_LARGE_ENCRYPTED_METADATA_LENGTH uint32 = BINARY_LARGE_METADATA_LENGTH + 4
 
 var BINARY_METADATA_MAGIC_STRING []byte = []byte("YXZ")
 
@@ -113,6 +198,7 @@ func newShardMeta() *ShardMeta {
 // uint32 - Meta Version - Numeric incremental ID that indicates the version of this file
 // uint32 - FileCount - Number of files in this shard
 // uint32 - Number of bytes that the metadata takes
-// uint32 - IndexLength - Number of bytes that contains the ShardIndex
-// uint32 - FileMetaLength - Number of bytes that contains the file metadata contents
-// uint32 - ContentsLength - Number of bytes that contain the actual file bytes
+// uint32 (uint64 from version 3) - IndexLength - Number of bytes that contains the ShardIndex
+// uint32 (uint64 from version 3) - FileMetaLength - Number of bytes that contains the file metadata contents
+// uint32 (uint64 from version 3) - ContentsLength - Number of bytes that contain the actual file bytes
+// uint32 - KeyLength - Number of bytes of the wrapped data key before the metadata (only for encrypted shards)
@@ -10,6 +10,7 @@ func TestShardMeta(t *testing.T) {
 	// Set some file count
 	meta.mux.Lock()
 	meta.FileCount += 123
+	meta.MetaVersion = 2
 	meta.mux.Unlock()
 
 	// To bytes
@@ -32,4 +33,17 @@ func TestShardMeta(t *testing.T) {
 	if meta2.FileCount != 123 {
 		t.Error("Count should be 123 after loading bytes")
 	}
+
+	// 64-bit lengths
+	meta.SetMetaVersion(BINARY_LARGE_VERSION)
+	meta.SetContentsLength(5 << 30)
+	b = meta.Bytes()
+	if len(b) != 39 || uint32(len(b)) != BINARY_LARGE_METADATA_LENGTH {
+		t.Errorf("Meta should be 39 bytes was %d", len(b))
+	}
+	meta3 := newShardMeta()
+	meta3.FromBytes(b)
+	if meta3.ContentsLength != 5<<30 || meta3.FileCount != 123 || meta3.MetaVersion != BINARY_LARGE_VERSION {
+		t.Errorf("Unexpected 64-bit meta %v", meta3)
+	}
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"net/url"
+	"os"
 	"testing"
 )
 
@@ -26,7 +29,7 @@ func TestNewFile(t *testing.T) {
 	}
 
 	// Validate size
-	if updatedFileMeta.Size != uint32(len(fileBytes)) {
+	if updatedFileMeta.Size != uint64(len(fileBytes)) {
 		t.Error("Failed size validation")
 	}
 
@@ -47,7 +50,7 @@ func TestNewFile(t *testing.T) {
 	}
 
 	// Offset of file 2 should be after file 1
-	if updatedFileMeta2.StartOffset != uint32(len(fileBytes)) {
+	if updatedFileMeta2.StartOffset != uint64(len(fileBytes)) {
 		t.Error("Should start after file 1")
 	}
 
@@ -184,3 +187,401 @@ func TestNewFile(t *testing.T) {
 		t.Error("Reading non-existing file should throw error without bytes")
 	}
 }
+
+func TestShardCompaction(t *testing.T) {
+	startApplication()
+
+	// New block
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+
+	// Files, one deleted and one overwritten
+	shard.AddFile(newFileMeta("/compaction/keep.txt"), []byte("Keep this file"))
+	shard.AddFile(newFileMeta("/compaction/delete.txt"), []byte("Delete this file"))
+	shard.AddFile(newFileMeta("/compaction/overwrite.txt"), []byte("First version"))
+	shard.AddFile(newFileMeta("/compaction/overwrite.txt"), []byte("Second version"))
+	if err := shard.Persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete
+	deleted, err := shard.DeleteFile("/compaction/delete.txt")
+	if !deleted || err != nil {
+		t.Fatalf("Failed to delete file: %s", err)
+	}
+	if _, readErr, _ := shard.ReadFile("/compaction/delete.txt"); readErr == nil {
+		t.Error("Deleted file must not be readable")
+	}
+	if deleted, _ := shard.DeleteFile("/compaction/non-existing.txt"); deleted {
+		t.Error("Deleting non-existing file must not report a deletion")
+	}
+
+	// Overwritten file returns the latest version
+	b2, _, _ := shard.ReadFile("/compaction/overwrite.txt")
+	if string(b2) != "Second version" {
+		t.Errorf("Expected latest version of overwritten file, got %s", string(b2))
+	}
+
+	// Live ratio
+	totalBytes := shard.ShardMeta().ContentsLength
+	liveBytes := uint64(len("Keep this file") + len("Second version"))
+	if shard.LiveBytes() != liveBytes {
+		t.Errorf("Expected %d live bytes, got %d", liveBytes, shard.LiveBytes())
+	}
+	if shard.LiveRatio() >= 1 {
+		t.Error("Live ratio must drop below 1 after delete")
+	}
+
+	// Compact
+	result, err := shard.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BytesBefore != totalBytes || result.BytesAfter != liveBytes {
+		t.Errorf("Unexpected compaction result %v", result)
+	}
+	if result.FilesBefore != 4 || result.FilesAfter != 2 {
+		t.Errorf("Unexpected file counts %d, %d", result.FilesBefore, result.FilesAfter)
+	}
+	if shard.LiveRatio() != 1 {
+		t.Error("Live ratio must be 1 after compaction")
+	}
+	if shard.FileCount() != 2 {
+		t.Error("Shard should contain 2 files after compaction")
+	}
+
+	// Rebuilt index no longer contains the deleted file
+	if shard.TestContainsFile("/compaction/delete.txt") {
+		t.Error("Index must not contain deleted file after compaction")
+	}
+	if !shard.TestContainsFile("/compaction/keep.txt") {
+		t.Error("Index must contain live file after compaction")
+	}
+
+	// Reload from disk
+	shard.SetContents(nil)
+	shard.ResetLoaded()
+	if _, err := shard.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"/compaction/keep.txt": "Keep this file", "/compaction/overwrite.txt": "Second version"} {
+		b, readErr, _ := shard.ReadFile(name)
+		if readErr != nil || string(b) != expected {
+			t.Errorf("Failed to read %s after compaction: %s", name, readErr)
+		}
+	}
+	if _, readErr, _ := shard.ReadFile("/compaction/delete.txt"); readErr == nil {
+		t.Error("Deleted file must not be readable after compaction")
+	}
+
+	// Sealed blocks are not compacted
+	b.SetSealed(true)
+	if _, err := shard.Compact(); err == nil {
+		t.Error("Compaction of sealed block must fail")
+	}
+	b.SetSealed(false)
+}
+
+func TestTemporaryShard(t *testing.T) {
+	startApplication()
+
+	// Temporary file
+	opts, err := parseFileWriteOptions(url.Values{"temporary": {"1"}, "ttl": {"60"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileBytes := []byte("Short-lived file")
+	fileMeta := newFileMeta("/temporary/hello.txt")
+	fileMeta.UpdateFromData(fileBytes)
+	opts.Apply(fileMeta)
+	if !fileMeta.Temporary || fileMeta.Expires != fileMeta.Created+60 {
+		t.Errorf("Unexpected temporary file meta %v", fileMeta)
+	}
+
+	// Flags survive the binary format
+	decoded := &FileMeta{}
+	decoded.FromBytes(fileMeta.Bytes())
+	if !decoded.Temporary || decoded.Expires != fileMeta.Expires {
+		t.Error("Temporary flag and expiry must survive binary format")
+	}
+
+	// Temporary files can not live forever
+	if _, err := parseFileWriteOptions(url.Values{"temporary": {"1"}, "ttl": {"999999999"}}); err == nil {
+		t.Error("TTL beyond the maximum of temporary files must fail")
+	}
+
+	// Add
+	shard, err := temporaryStore.AllocateShardCapacity(fileMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shard.AddFile(fileMeta, fileBytes); err != nil {
+		t.Fatal(err)
+	}
+	temporaryStore.WriteDone(shard)
+	if datastore.LocalShardByIdStr(shard.IdStr()) != shard {
+		t.Error("Temporary shard must be found as local shard")
+	}
+	if indices, _, err := datastore.LocateFile(fileMeta.FullName); err != nil || len(indices) < 1 {
+		t.Error("Temporary file must be located")
+	}
+
+	// Never written to disk
+	if err := shard.Persist(); err != nil {
+		t.Error(err)
+	}
+	if shard.Block() != nil {
+		t.Error("Temporary shard must not have a block")
+	}
+	b, readErr, fromMemory := shard.ReadFile(fileMeta.FullName)
+	if readErr != nil || !fromMemory || string(b) != string(fileBytes) {
+		t.Errorf("Failed to read temporary file: %s", readErr)
+	}
+
+	// Expire
+	used := temporaryStore.UsedBytes()
+	if used < uint64(len(fileBytes)) {
+		t.Errorf("Expected at least %d bytes in use, got %d", len(fileBytes), used)
+	}
+	if expired, _ := shard.ExpireFiles(fileMeta.Expires - 1); len(expired) != 0 {
+		t.Error("File must not expire before its TTL")
+	}
+	if expired, _ := shard.ExpireFiles(fileMeta.Expires); len(expired) != 1 {
+		t.Error("File must expire after its TTL")
+	}
+	if _, readErr, _ := shard.ReadFile(fileMeta.FullName); readErr == nil {
+		t.Error("Expired file must not be readable")
+	}
+
+	// Memory is reclaimed
+	temporaryStore.expire()
+	if temporaryStore.ShardByIdStr(shard.IdStr()) != nil {
+		t.Error("Empty temporary shard must be dropped")
+	}
+	if temporaryStore.Status().BytesReclaimed < uint64(len(fileBytes)) {
+		t.Error("Reclaimed bytes must be reported")
+	}
+
+	// Allocated shard is not dropped before the file is added
+	pendingMeta := newFileMeta("/temporary/pending.txt")
+	pendingMeta.UpdateFromData(fileBytes)
+	pending, err := temporaryStore.AllocateShardCapacity(pendingMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	temporaryStore.expire()
+	if temporaryStore.ShardByIdStr(pending.IdStr()) != pending {
+		t.Error("Temporary shard with a write in progress must not be dropped")
+	}
+	temporaryStore.WriteDone(pending)
+
+	// Memory budget
+	budget := conf.TemporaryMemoryBudget
+	conf.TemporaryMemoryBudget = int(temporaryStore.UsedBytes()) + 10
+	largeMeta := newFileMeta("/temporary/large.txt")
+	largeMeta.UpdateFromData(make([]byte, 100))
+	if _, err := temporaryStore.AllocateShardCapacity(largeMeta); err == nil {
+		t.Error("Allocation beyond memory budget must fail")
+	}
+	conf.TemporaryMemoryBudget = budget
+}
+
+func TestFileVersions(t *testing.T) {
+	startApplication()
+	retention := conf.FileVersionRetention
+	conf.FileVersionRetention = 3
+	defer func() {
+		conf.FileVersionRetention = retention
+	}()
+
+	// Versions
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	name := "/versions/hello.txt"
+	metas := make([]*FileMeta, 0)
+	for i := 1; i <= 4; i++ {
+		meta := newFileMeta(name)
+		if _, err := shard.AddFile(meta, []byte(fmt.Sprintf("Version %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		metas = append(metas, meta)
+	}
+	for i := 1; i < len(metas); i++ {
+		if metas[i].Timestamp <= metas[i-1].Timestamp || !metas[i].IsNewerThan(metas[i-1]) {
+			t.Error("Timestamps of versions must increase")
+		}
+	}
+
+	// Timestamp survives the binary format
+	decoded := &FileMeta{}
+	decoded.FromBytes(metas[3].Bytes())
+	if decoded.Timestamp != metas[3].Timestamp {
+		t.Error("Timestamp must survive binary format")
+	}
+
+	// Retention, newest first
+	versions := shard.ShardFileMeta().Versions(name)
+	if len(versions) != 3 || versions[0] != metas[3] || versions[2] != metas[1] {
+		t.Fatalf("Expected the 3 newest versions, found %d", len(versions))
+	}
+	if !metas[0].Deleted {
+		t.Error("Version beyond retention must be deleted")
+	}
+
+	// Latest by default, older on request
+	if data, _, _ := shard.ReadFile(name); string(data) != "Version 4" {
+		t.Errorf("Expected latest version, got %s", string(data))
+	}
+	if data, err, _ := shard.ReadFileVersion(name, metas[1].VersionId()); err != nil || string(data) != "Version 2" {
+		t.Errorf("Failed to read older version: %s", err)
+	}
+	if _, err, _ := shard.ReadFileVersion(name, metas[0].VersionId()); err == nil {
+		t.Error("Version beyond retention must not be readable")
+	}
+
+	// Latest across shards
+	other := newFileMeta(name)
+	if _, err := b.DataShards[1].AddFile(other, []byte("Version 5")); err != nil {
+		t.Fatal(err)
+	}
+	list, err := datastore.FileVersions(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 || list[0].VersionId != other.VersionId() || !list[0].Latest || list[1].Latest {
+		t.Errorf("Unexpected versions %v", list)
+	}
+	if data, meta, err := datastore._readLocalVersion(name, ""); err != nil || string(data) != "Version 5" || meta != other {
+		t.Errorf("Expected latest version across shards: %s", err)
+	}
+
+	// Delete single version
+	if deleted, err := shard.DeleteFileVersion(name, metas[3].VersionId()); !deleted || err != nil {
+		t.Errorf("Failed to delete version: %s", err)
+	}
+	if data, _, _ := shard.ReadFile(name); string(data) != "Version 3" {
+		t.Errorf("Expected previous version after delete, got %s", string(data))
+	}
+}
+
+// Test that an add is undone when the shard can not be written
+func TestShardAddFileAndPersist(t *testing.T) {
+	startApplication()
+	retention := conf.FileVersionRetention
+	conf.FileVersionRetention = 1
+	defer func() {
+		conf.FileVersionRetention = retention
+	}()
+
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	name := "/persist/undo.txt"
+	if _, err := shard.AddFileAndPersist(newFileMeta(name), []byte("First")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shard file can not be written
+	os.Remove(shard.FullPath())
+	if err := os.MkdirAll(shard.FullPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer shard.Block().Volume().SetState(HealthyVolumeState)
+	if _, err := shard.AddFileAndPersist(newFileMeta(name), []byte("Second")); err == nil {
+		t.Fatal("Expected write of shard to fail")
+	}
+
+	// Overwritten version is back
+	if data, err, _ := shard.ReadFile(name); err != nil || string(data) != "First" {
+		t.Errorf("Expected first version after undone add, got %s: %s", string(data), err)
+	}
+	if versions := shard.ShardFileMeta().Versions(name); len(versions) != 1 {
+		t.Errorf("Expected single version, found %d", len(versions))
+	}
+	if !shard.ShardIndex().Test(name) {
+		t.Error("Expected file to be in index")
+	}
+	os.RemoveAll(shard.FullPath())
+	if err := shard.Persist(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestShardDedup(t *testing.T) {
+	startApplication()
+	conf.Dedup = true
+	defer func() {
+		conf.Dedup = false
+	}()
+
+	// Same contents under different names
+	b := datastore.NewBlock()
+	shard := b.DataShards[0]
+	contents := []byte("Identical icon bytes")
+	a, _ := shard.AddFile(newFileMeta("/dedup/a.png"), contents)
+	c, _ := shard.AddFile(newFileMeta("/dedup/c.png"), contents)
+	other, _ := shard.AddFile(newFileMeta("/dedup/other.png"), []byte("Other icon"))
+	if len(a.ContentHash) != 32 || a.StartOffset != c.StartOffset {
+		t.Fatal("Expected second file to reference the contents of the first")
+	}
+	if shard.contentsOffset != uint64(len(contents)+len("Other icon")) || shard.LiveBytes() != shard.contentsOffset {
+		t.Errorf("Contents must be stored once, %d bytes stored", shard.contentsOffset)
+	}
+	if shard.ShardFileMeta().ContentRefs(a.StartOffset) != 2 || shard.ShardFileMeta().DedupBytes() != uint64(len(contents)) {
+		t.Error("Expected 2 references to the shared contents")
+	}
+	if dedupIndex.Lookup(newFileMetaWithData("/dedup/d.png", contents)) != shard {
+		t.Error("Dedup index must find the shard with the contents")
+	}
+	if dedupIndex.Status().Hits < 1 {
+		t.Error("Expected dedup hit in stats")
+	}
+
+	// Delete one reference, the contents stay
+	if deleted, err := shard.DeleteFile("/dedup/a.png"); !deleted || err != nil {
+		t.Fatalf("Failed to delete: %s", err)
+	}
+	if shard.ShardFileMeta().ContentRefs(c.StartOffset) != 1 {
+		t.Error("Expected 1 reference after delete")
+	}
+	if shard.ShardFileMeta().GetByContents(a) != c {
+		t.Error("Expected remaining file with the contents to be found")
+	}
+	if bytes, err, _ := shard.ReadFile("/dedup/c.png"); err != nil || string(bytes) != string(contents) {
+		t.Errorf("Failed to read shared contents after delete: %s", err)
+	}
+
+	// Compaction keeps the contents once
+	shard.DeleteFile("/dedup/other.png")
+	shard.AddFile(newFileMeta("/dedup/e.png"), contents)
+	if _, err := shard.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if shard.LiveBytes() != uint64(len(contents)) || shard.contentsOffset != uint64(len(contents)) {
+		t.Errorf("Expected %d bytes after compaction, got %d", len(contents), shard.contentsOffset)
+	}
+	for _, name := range []string{"/dedup/c.png", "/dedup/e.png"} {
+		if bytes, err, _ := shard.ReadFile(name); err != nil || string(bytes) != string(contents) {
+			t.Errorf("Failed to read %s after compaction: %s", name, err)
+		}
+	}
+	if _, err, _ := shard.ReadFile(other.FullName); err == nil {
+		t.Error("Deleted file must be gone after compaction")
+	}
+
+	// Last reference gone, the bytes are reclaimed
+	shard.DeleteFile("/dedup/c.png")
+	shard.DeleteFile("/dedup/e.png")
+	if _, err := shard.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if shard.contentsOffset != 0 {
+		t.Error("Expected contents to be reclaimed")
+	}
+}
+
+// New file meta with the contents set
+func newFileMetaWithData(name string, b []byte) *FileMeta {
+	f := newFileMeta(name)
+	f.UpdateFromData(b)
+	return f
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Temporary tier: shards in memory only, replicated to memory on other nodes, files expire after their TTL
+
+var temporaryStore *TemporaryStore
+
+type TemporaryStore struct {
+	mux    sync.RWMutex
+	shards map[string]*Shard
+
+	// Nodes that keep a copy of a shard
+	replicas map[string][]string
+
+	// Writes in progress by shard, capacity is allocated but the file is not added yet
+	activeWrites map[string]int
+
+	// Stats
+	statsMux       sync.RWMutex
+	filesExpired   uint64
+	bytesReclaimed uint64
+	shardsDropped  uint64
+	lastRun        uint32
+}
+
+// Temporary tier status
+type TemporaryStoreStatus struct {
+	Shards         int
+	Files          int
+	UsedBytes      uint64
+	BudgetBytes    uint64
+	FilesExpired   uint64
+	BytesReclaimed uint64
+	ShardsDropped  uint64
+	LastRun        uint32
+}
+
+// New in-memory shard
+func newTemporaryShard(id []byte) *Shard {
+	s := newShardFromId(nil, id)
+	s.temporary = true
+	s.isLoaded = true
+	s.contents = bytes.NewBuffer(make([]byte, 0))
+	return s
+}
+
+// Shards
+func (this *TemporaryStore) Shards() []*Shard {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	list := make([]*Shard, 0)
+	for _, shard := range this.shards {
+		list = append(list, shard)
+	}
+	return list
+}
+
+// Get shard by id
+func (this *TemporaryStore) ShardByIdStr(id string) *Shard {
+	this.mux.RLock()
+	defer this.mux.RUnlock()
+	return this.shards[id]
+}
+
+// Memory in use (including dead bytes that are not reclaimed yet)
+func (this *TemporaryStore) UsedBytes() uint64 {
+	var n uint64 = 0
+	for _, shard := range this.Shards() {
+		n += uint64(shard.AllocatedBytes())
+	}
+	return n
+}
+
+// Fits within the memory budget? Expires files first when it does not
+func (this *TemporaryStore) _hasBudget(n uint64) bool {
+	if this.UsedBytes()+n <= uint64(conf.TemporaryMemoryBudget) {
+		return true
+	}
+	this.expire()
+	return this.UsedBytes()+n <= uint64(conf.TemporaryMemoryBudget)
+}
+
+// Find shard with capacity, creates one if needed
+func (this *TemporaryStore) AllocateShardCapacity(fileMeta *FileMeta) (*Shard, error) {
+	if fileMeta.Size > uint64(conf.ShardSizeInBytes) {
+		return nil, errors.New(fmt.Sprintf("File of %d bytes exceeds shard size of %d bytes", fileMeta.Size, conf.ShardSizeInBytes))
+	}
+	if !this._hasBudget(fileMeta.Size) {
+		return nil, errors.New(fmt.Sprintf("Temporary memory budget of %d bytes exhausted", conf.TemporaryMemoryBudget))
+	}
+
+	// Existing shard
+	if shard := this._allocateExisting(fileMeta.Size); shard != nil {
+		return shard, nil
+	}
+
+	// New shard
+	shard, ok := this._allocate(randomUuid(), fileMeta.Size)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unable to allocate %d bytes in temporary shard %s", fileMeta.Size, shard.IdStr()))
+	}
+	return shard, nil
+}
+
+// Allocate in a shard that has capacity left, nil if none has
+func (this *TemporaryStore) _allocateExisting(n uint64) *Shard {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for k, shard := range this.shards {
+		if shard.AllocateCapacity(n) {
+			this.activeWrites[k]++
+			return shard
+		}
+	}
+	return nil
+}
+
+// Allocate in a shard, created if it does not exist yet, expiry does not drop it until the write is done
+func (this *TemporaryStore) _allocate(id []byte, n uint64) (*Shard, bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	shard := this._registerShard(id)
+	if !shard.AllocateCapacity(n) {
+		return shard, false
+	}
+	this.activeWrites[shard.IdStr()]++
+	return shard, true
+}
+
+// Write to a shard that was allocated is done (added or failed)
+func (this *TemporaryStore) WriteDone(shard *Shard) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	k := shard.IdStr()
+	this.activeWrites[k]--
+	if this.activeWrites[k] <= 0 {
+		delete(this.activeWrites, k)
+	}
+}
+
+// Shard that receives a replica, created if it does not exist yet
+func (this *TemporaryStore) ReplicaShard(id []byte, fileMeta *FileMeta) (*Shard, error) {
+	if !this._hasBudget(fileMeta.Size) {
+		return nil, errors.New(fmt.Sprintf("Temporary memory budget of %d bytes exhausted", conf.TemporaryMemoryBudget))
+	}
+	shard, _ := this._allocate(id, fileMeta.Size)
+	return shard, nil
+}
+
+// Register new shard
+func (this *TemporaryStore) RegisterShard(id []byte) *Shard {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return this._registerShard(id)
+}
+
+// Register new shard (caller must hold the lock)
+func (this *TemporaryStore) _registerShard(id []byte) *Shard {
+	k := uuidToString(id)
+	if this.shards[k] == nil {
+		log.Infof("Registered temporary shard %s", k)
+		this.shards[k] = newTemporaryShard(id)
+	}
+	return this.shards[k]
+}
+
+// Drop shard, its memory is released
+func (this *TemporaryStore) RemoveShard(shard *Shard) {
+	this.mux.Lock()
+	delete(this.shards, shard.IdStr())
+	delete(this.replicas, shard.IdStr())
+	this.mux.Unlock()
+	this._released(shard)
+}
+
+// Drop shard if no file is left and no write to it is in progress
+func (this *TemporaryStore) _removeIfEmpty(shard *Shard) bool {
+	this.mux.Lock()
+	k := shard.IdStr()
+	if this.activeWrites[k] > 0 || shard.AllocatedBytes() == 0 || len(shard.ShardFileMeta().Live()) > 0 {
+		this.mux.Unlock()
+		return false
+	}
+	delete(this.shards, k)
+	delete(this.replicas, k)
+	this.mux.Unlock()
+	this._released(shard)
+	return true
+}
+
+// Shard was dropped, it is no longer located and its cached files are invalidated
+func (this *TemporaryStore) _released(shard *Shard) {
+	log.Infof("Dropped temporary shard %s", shard.IdStr())
+
+	// No longer available from this node
+	datastore.fileLocator.UnloadIndex(runtime.GetNode(), shard.Id)
+	binaryTransport._broadcastRemoveShardIndex(shard.Id)
+
+	// Cached contents of its files
+	fileMeta := shard.ShardFileMeta()
+	fileMeta.mux.RLock()
+	defer fileMeta.mux.RUnlock()
+	invalidated := make(map[string]bool)
+	for _, meta := range fileMeta.FileMeta {
+		if invalidated[meta.FullName] {
+			continue
+		}
+		invalidated[meta.FullName] = true
+		datastore.fileLocator.InvalidateLocation(meta.FullName)
+		fileCache.Invalidate(meta.FullName)
+	}
+}
+
+// Nodes to replicate a shard to, the same nodes are used for all files of the shard
+func (this *TemporaryStore) ReplicaNodes(shard *Shard) []string {
+	k := shard.IdStr()
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	nodes := this.replicas[k]
+	if len(nodes) >= conf.TemporaryReplicas {
+		return nodes
+	}
+
+	// Pick more nodes
+	criteria := newNodeRouterCriteria()
+	criteria.ExcludeLocalNodes = true
+	criteria.ExcludeNodes = append(criteria.ExcludeNodes, nodes...)
+	for len(nodes) < conf.TemporaryReplicas {
+		node, err := datastore.nodeRouter.PickNode(criteria)
+		if err != nil {
+			log.Warnf("Only %d replica node(s) for temporary shard %s: %s", len(nodes), k, err)
+			break
+		}
+		nodes = append(nodes, node)
+		criteria.ExcludeNodes = append(criteria.ExcludeNodes, node)
+	}
+	this.replicas[k] = nodes
+	return nodes
+}
+
+// Expire files and reclaim memory
+func (this *TemporaryStore) expire() {
+	now := unixTsUint32()
+	var filesExpired uint64 = 0
+	var bytesReclaimed uint64 = 0
+	var shardsDropped uint64 = 0
+	for _, shard := range this.Shards() {
+		expired, err := shard.ExpireFiles(now)
+		if err != nil {
+			log.Warnf("Failed to expire files of temporary shard %s: %s", shard.IdStr(), err)
+		}
+		filesExpired += uint64(len(expired))
+
+		// Nothing left
+		allocated := shard.AllocatedBytes()
+		if this._removeIfEmpty(shard) {
+			bytesReclaimed += allocated
+			shardsDropped++
+			continue
+		}
+
+		// Reclaim dead bytes
+		if shard.LiveRatio() < conf.CompactionLiveRatio {
+			result, err := shard.Compact()
+			if err != nil {
+				log.Warnf("Failed to compact temporary shard %s: %s", shard.IdStr(), err)
+				continue
+			}
+			bytesReclaimed += uint64(result.BytesReclaimed())
+		}
+	}
+
+	this.statsMux.Lock()
+	this.filesExpired += filesExpired
+	this.bytesReclaimed += bytesReclaimed
+	this.shardsDropped += shardsDropped
+	this.lastRun = now
+	this.statsMux.Unlock()
+}
+
+// Status
+func (this *TemporaryStore) Status() *TemporaryStoreStatus {
+	shards := this.Shards()
+	var files int = 0
+	for _, shard := range shards {
+		files += len(shard.ShardFileMeta().Live())
+	}
+	this.statsMux.RLock()
+	defer this.statsMux.RUnlock()
+	return &TemporaryStoreStatus{
+		Shards:         len(shards),
+		Files:          files,
+		UsedBytes:      this.UsedBytes(),
+		BudgetBytes:    uint64(conf.TemporaryMemoryBudget),
+		FilesExpired:   this.filesExpired,
+		BytesReclaimed: this.bytesReclaimed,
+		ShardsDropped:  this.shardsDropped,
+		LastRun:        this.lastRun,
+	}
+}
+
+// New temporary store
+func newTemporaryStore() *TemporaryStore {
+	s := &TemporaryStore{
+		shards:       make(map[string]*Shard),
+		replicas:     make(map[string][]string),
+		activeWrites: make(map[string]int),
+	}
+
+	// Expiry
+	ticker := time.NewTicker(time.Second * time.Duration(conf.TemporaryExpiryInterval))
+	go func() {
+		for _ = range ticker.C {
+			s.expire()
+		}
+	}()
+
+	return s
+}
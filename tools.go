@@ -15,7 +15,7 @@ func unixTsUint32() uint32 {
 	return uint32(time.Now().Unix())
 }
 
-func allocByteArr(size uint32, maxSize uint32) []byte {
+func allocByteArr(size uint64, maxSize uint64) []byte {
 	if size > maxSize {
 		panic(fmt.Sprintf("Unable to allocate byte array, size %d exceeds maximum of %d", size, maxSize))
 	}
@@ -4,7 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-	// "errors"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -16,6 +16,12 @@ import (
 
 var TRANSPORT_MAGIC_FOOTER []byte = []byte{'\r', '\n', 'X', 'Y', 'Z'}
 
+// Frames start with their length (uint32), longer frames with this value followed by the length (uint64), only sent to nodes that support 64-bit sizes
+const TRANSPORT_EXTENDED_LENGTH uint32 = 0xFFFFFFFF
+
+// Room for message headers and file meta next to the largest payload (a shard, files are chunked to fit one)
+const TRANSPORT_MAX_HEADER_LENGTH uint64 = 1024 * 1024
+
 // Network transport layer
 
 type NetworkTransport struct {
@@ -188,6 +194,41 @@ func (this *NetworkTransport) _validateMagicFooter(connbuf *bufio.Reader, magicS
 	panic("Magic bytes invalid")
 }
 
+// Write frame length
+func writeTransportLength(buf *bytes.Buffer, n uint64) {
+	if n < uint64(TRANSPORT_EXTENDED_LENGTH) {
+		binary.Write(buf, binary.BigEndian, uint32(n))
+		return
+	}
+	binary.Write(buf, binary.BigEndian, TRANSPORT_EXTENDED_LENGTH)
+	binary.Write(buf, binary.BigEndian, n)
+}
+
+// Largest frame accepted, the buffer is allocated before reading
+func maxTransportLength() uint64 {
+	return uint64(conf.ShardSizeInBytes) + TRANSPORT_MAX_HEADER_LENGTH
+}
+
+// Read frame length, frames beyond the maximum are refused
+func readTransportLength(conn net.Conn) (uint64, error) {
+	lenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return 0, err
+	}
+	n := uint64(binary.BigEndian.Uint32(lenBuf))
+	if n == uint64(TRANSPORT_EXTENDED_LENGTH) {
+		extBuf := make([]byte, 8)
+		if _, err := io.ReadFull(conn, extBuf); err != nil {
+			return 0, err
+		}
+		n = binary.BigEndian.Uint64(extBuf)
+	}
+	if n > maxTransportLength() {
+		return 0, errors.New(fmt.Sprintf("Frame of %d bytes exceeds the maximum of %d bytes", n, maxTransportLength()))
+	}
+	return n, nil
+}
+
 // Handles reading from a given connection.
 func readFromConnection(reader *net.Conn, buffer []byte) (int, error) {
 	// This fills the buffer
@@ -235,21 +276,15 @@ func (this *NetworkTransport) handleConnection(conn net.Conn) {
 
 	// Reader
 	var dataBuffer []byte = nil
-	var contentLength uint32 = 0
-	var totalDataBytesRead uint32 = 0
+	var contentLength uint64 = 0
+	var totalDataBytesRead uint64 = 0
 
 	for {
 		// Read content length
 		if contentLength == 0 {
 			// Read content length
-			lenBuf := make([]byte, 4)
-			lenBufRead, lenReadErr := conn.Read(lenBuf)
-			panicErr(lenReadErr)
-			if lenBufRead != len(lenBuf) {
-				panic("Not enough bytes read for content length")
-			}
-			lenReader := bytes.NewReader(lenBuf)
-			lenErr := binary.Read(lenReader, binary.BigEndian, &contentLength)
+			var lenErr error
+			contentLength, lenErr = readTransportLength(conn)
 			panicErr(lenErr)
 
 			if this.traceLog {
@@ -257,7 +292,7 @@ func (this *NetworkTransport) handleConnection(conn net.Conn) {
 			}
 
 			// Create content buffer
-			dataBuffer = allocByteArr(contentLength, uint32(this.receiveBufferLen))
+			dataBuffer = allocByteArr(contentLength, uint64(this.receiveBufferLen))
 		} else {
 			// Read content
 			var dataReadError error
@@ -265,7 +300,7 @@ func (this *NetworkTransport) handleConnection(conn net.Conn) {
 			for totalDataBytesRead < contentLength && dataReadError == nil {
 				// While we haven't read enough yet, pass in the slice that represents where we are in the buffer
 				bytesRead, dataReadError = readFromConnection(&conn, dataBuffer[totalDataBytesRead:contentLength])
-				totalDataBytesRead += uint32(bytesRead)
+				totalDataBytesRead += uint64(bytesRead)
 			}
 			if dataReadError != nil {
 				if dataReadError == io.EOF {
@@ -286,17 +321,17 @@ func (this *NetworkTransport) handleConnection(conn net.Conn) {
 			responseBytes := this._onMessage(newTransportConnectionMeta(conn.RemoteAddr().String()), db)
 
 			// Resonse content
-			var responseLen uint32 = 4
+			var responseLen uint64 = 4
 			if responseBytes != nil {
 				// With content
-				responseLen += uint32(len(responseBytes))
+				responseLen += uint64(len(responseBytes))
 			}
 
 			// Response (length + crc32 (4 bytes) + response)
 			ackBuf := new(bytes.Buffer)
 
 			// Length first
-			binary.Write(ackBuf, binary.BigEndian, responseLen)
+			writeTransportLength(ackBuf, responseLen)
 
 			// Ack with checksum of decompressed received bytes
 			// this is after the message processing, to make it synchronous
@@ -419,6 +454,16 @@ func (this *NetworkTransport) _prepareConnection(node string) {
 	this.connectionsMux.Unlock()
 }
 
+// Close all connections to node
+func (this *NetworkTransport) _closeConnections(node string) {
+	this.connectionsMux.Lock()
+	if this.connections[node] != nil {
+		this.connections[node].Close()
+		delete(this.connections, node)
+	}
+	this.connectionsMux.Unlock()
+}
+
 // Get connection
 func (this *NetworkTransport) _getConnection(node string) *TransportConnection {
 	// Make sure prepared
@@ -469,6 +514,11 @@ func (this *NetworkTransport) _send(node string, b []byte) ([]byte, error) {
 	// CRC
 	sendCrc := crc32.Checksum(b, crcTable)
 
+	// Frames of 4 GB and more only to nodes that support them
+	if uint64(len(bc)) >= uint64(TRANSPORT_EXTENDED_LENGTH) && nodeFormatVersion(node) < BINARY_LARGE_VERSION {
+		return nil, errors.New(fmt.Sprintf("Message of %d bytes too large for %s, the node does not support 64-bit sizes", len(bc), node))
+	}
+
 	// Retries (entire connection pool + 1 more)
 	var responseBytes []byte = nil
 	var errb error
@@ -500,7 +550,7 @@ outer:
 
 		// Write length
 		lenBuf := new(bytes.Buffer)
-		binary.Write(lenBuf, binary.BigEndian, uint32(len(bc)))
+		writeTransportLength(lenBuf, uint64(len(bc)))
 		_, errl := conn.Write(lenBuf.Bytes())
 		panicErr(errl)
 
@@ -535,37 +585,22 @@ outer:
 		// Keep reading until we have all
 		// Reader
 		var dataBuffer []byte = nil
-		var contentLength uint32 = 0
-		var totalDataBytesRead uint32 = 0
+		var contentLength uint64 = 0
+		var totalDataBytesRead uint64 = 0
 
 	inner:
 		for {
 			// Read content length
 			if contentLength == 0 {
 				// Read content length
-				lenBuf := make([]byte, 4)
-				lenBufRead, lenReadErr := conn.Read(lenBuf)
+				var lenReadErr error
+				contentLength, lenReadErr = readTransportLength(conn)
 				if lenReadErr != nil {
 					log.Warnf("Unable to read length bytes in _send response: %s", lenReadErr)
 					// Discard connection and retry
 					this._discardConnection(node, tc)
 					continue outer
 				}
-				if lenBufRead != len(lenBuf) {
-					log.Warn("Not enough bytes read for content length")
-					// Discard connection and retry
-					this._discardConnection(node, tc)
-					continue outer
-				}
-				lenReader := bytes.NewReader(lenBuf)
-				lenErr := binary.Read(lenReader, binary.BigEndian, &contentLength)
-				if lenErr != nil {
-					log.Warnf("Unable to read length uint32 in _send response: %s", lenErr)
-
-					// Discard connection and retry
-					this._discardConnection(node, tc)
-					continue outer
-				}
 				// log.Infof("Content length %d", contentLength)
 
 				// Create content buffer
@@ -577,7 +612,7 @@ outer:
 				for totalDataBytesRead < contentLength && dataReadError == nil {
 					// While we haven't read enough yet, pass in the slice that represents where we are in the buffer
 					bytesRead, dataReadError = readFromConnection(&conn, dataBuffer[totalDataBytesRead:contentLength])
-					totalDataBytesRead += uint32(bytesRead)
+					totalDataBytesRead += uint64(bytesRead)
 				}
 				break inner
 			}
@@ -597,7 +632,7 @@ outer:
 		}
 
 		// Content
-		var receivedContentLen uint32 = contentLength - 4
+		var receivedContentLen uint64 = contentLength - 4
 		if receivedContentLen > 0 {
 			receivedContentBytes := make([]byte, receivedContentLen)
 			_, readErr = ackBuf.Read(receivedContentBytes)
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"net"
 	"testing"
 	"time"
 )
@@ -196,3 +197,86 @@ func TestTransportOnConnect(t *testing.T) {
 	// Close
 	tr.close()
 }
+
+// Test the length prefix of frames of 4 GB and more
+func TestTransportLength(t *testing.T) {
+	startApplication()
+	max := conf.ShardSizeInBytes
+	conf.ShardSizeInBytes = 6 << 30
+	defer func() {
+		conf.ShardSizeInBytes = max
+	}()
+	for _, n := range []uint64{0, 1234, uint64(TRANSPORT_EXTENDED_LENGTH) - 1, uint64(TRANSPORT_EXTENDED_LENGTH), 5 << 30} {
+		buf := new(bytes.Buffer)
+		writeTransportLength(buf, n)
+		if (n < uint64(TRANSPORT_EXTENDED_LENGTH) && buf.Len() != 4) || (n >= uint64(TRANSPORT_EXTENDED_LENGTH) && buf.Len() != 12) {
+			t.Errorf("Unexpected prefix of %d bytes for %d", buf.Len(), n)
+		}
+		client, server := net.Pipe()
+		go func() {
+			client.Write(buf.Bytes())
+			client.Close()
+		}()
+		read, err := readTransportLength(server)
+		server.Close()
+		if err != nil || read != n {
+			t.Errorf("Expected length %d, found %d (%v)", n, read, err)
+		}
+	}
+
+	// Beyond the maximum
+	conf.ShardSizeInBytes = max
+	buf := new(bytes.Buffer)
+	writeTransportLength(buf, maxTransportLength()+1)
+	client, server := net.Pipe()
+	go func() {
+		client.Write(buf.Bytes())
+		client.Close()
+	}()
+	if _, err := readTransportLength(server); err == nil {
+		t.Error("Expected frame beyond the maximum to be refused")
+	}
+	server.Close()
+}
+
+// Test that nodes write the format of the oldest node in the cluster
+func TestFormatVersionNegotiation(t *testing.T) {
+	startApplication()
+	if clusterFormatVersion() != BINARY_VERSION || clusterMaxSize() != ^uint64(0) {
+		t.Fatalf("Expected version %d, found %d", BINARY_VERSION, clusterFormatVersion())
+	}
+
+	// Node that did not say hello yet
+	node := "old-format-node"
+	state := newGossipNodeState(node)
+	gossip.nodesMux.Lock()
+	gossip.nodes[node] = state
+	gossip.nodesMux.Unlock()
+	defer func() {
+		gossip.nodesMux.Lock()
+		delete(gossip.nodes, node)
+		gossip.nodesMux.Unlock()
+	}()
+	if clusterFormatVersion() != MIN_FORMAT_VERSION {
+		t.Errorf("Expected version %d before hello, found %d", MIN_FORMAT_VERSION, clusterFormatVersion())
+	}
+
+	// Node that did not announce a format
+	state.UpdateLastHelloReceived()
+	if nodeFormatVersion(node) != MIN_FORMAT_VERSION || clusterFormatVersion() != MIN_FORMAT_VERSION {
+		t.Errorf("Expected version %d, found %d", MIN_FORMAT_VERSION, clusterFormatVersion())
+	}
+	if clusterMaxSize() >= uint64(FILE_META_EXTENDED_SIZE) {
+		t.Errorf("Expected 32-bit sizes, found %d", clusterMaxSize())
+	}
+	meta := newShard(nil)._footerToBinaryFormat()
+	if parsed, err := parseShardMetaFooter(meta); err != nil || parsed.MetaVersion != MIN_FORMAT_VERSION {
+		t.Errorf("Expected footer in version %d, found %v (%v)", MIN_FORMAT_VERSION, parsed, err)
+	}
+
+	// Upgraded node
+	state.SetFormatVersion(BINARY_VERSION)
+	if clusterFormatVersion() != BINARY_VERSION {
+		t.Errorf("Expected version %d, found %d", BINARY_VERSION, clusterFormatVersion())
+	}
+}
@@ -6,13 +6,27 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Volume is a location on a server that points to a local data storage directory
 
 type Volume struct {
-	Id   []byte // Unique ID
-	Path string // Path to local directory
+	Id           []byte // Unique ID
+	Path         string // Path to local directory
+	Capacity     uint64 // Maximum bytes to allocate, 0 = unlimited
+	StorageClass string // E.g. standard, cold
+
+	// Number of shard writes in progress
+	activeWrites int32
+
+	// Health
+	healthMux     sync.Mutex
+	state         VolumeState
+	ioErrors      []time.Time
+	full          bool
+	fullCheckedAt time.Time
 
 	// Shards
 	shards    map[string]*Shard
@@ -23,6 +37,26 @@ type Volume struct {
 	blocksMux sync.RWMutex
 }
 
+// Volume usage
+type VolumeStatus struct {
+	Id             string
+	Path           string
+	StorageClass   string
+	Capacity       uint64
+	AllocatedBytes uint64
+	UsedBytes      uint64
+	FillRatio      float64
+	UsageRatio     float64
+	FreeDiskBytes  uint64
+	DiskBytes      uint64
+	State          string
+	Full           bool
+	IOErrors       int
+	Blocks         int
+	Shards         int
+	ActiveWrites   int32
+}
+
 // To string
 func (this *Volume) IdStr() string {
 	return uuidToString(this.Id)
@@ -50,6 +84,22 @@ func (this *Volume) RegisterShard(s *Shard) {
 	this.shardsMux.Unlock()
 }
 
+// Unregister shard
+func (this *Volume) UnregisterShard(s *Shard) {
+	this.shardsMux.Lock()
+	log.Infof("Unregistered shard %s from volume %s", s.IdStr(), this.IdStr())
+	delete(this.shards, s.IdStr())
+	this.shardsMux.Unlock()
+}
+
+// Unregister block
+func (this *Volume) UnregisterBlock(b *Block) {
+	this.blocksMux.Lock()
+	log.Infof("Unregistered block %s from volume %s", b.IdStr(), this.IdStr())
+	delete(this.blocks, b.IdStr())
+	this.blocksMux.Unlock()
+}
+
 // Register block
 func (this *Volume) RegisterBlock(b *Block) {
 	this.blocksMux.Lock()
@@ -106,9 +156,12 @@ func (this *Volume) prepare() {
 		// Init
 		b := newBlock(this)
 		b.Id = uuidStringToBytes(split[1])
+		b.created = uint32(elm.ModTime().Unix())
 
-		// Recover shards
-		b.recoverShards()
+		// Recover shards, the manifest has the layout of the block
+		if !b.recoverFromManifest() {
+			b.recoverWithoutManifest()
+		}
 
 		// Register
 		this.RegisterBlock(b)
@@ -118,6 +171,68 @@ func (this *Volume) prepare() {
 	log.Infof("Loaded volume %s", this.IdStr())
 }
 
+// Bytes allocated by shards (fixed size per shard)
+func (this *Volume) AllocatedBytes() uint64 {
+	return uint64(len(this.Shards())) * uint64(conf.ShardSizeInBytes)
+}
+
+// Bytes used on disk by shard files
+func (this *Volume) UsedBytes() uint64 {
+	var used uint64 = 0
+	for _, shard := range this.Shards() {
+		if fi, err := os.Stat(shard.FullPath()); err == nil {
+			used += uint64(fi.Size())
+		}
+	}
+	return used
+}
+
+// Fraction of capacity allocated, unlimited volumes are measured against the size of their disk (0 if that can not be read)
+func (this *Volume) FillRatio() float64 {
+	capacity := this.Capacity
+	if capacity == 0 {
+		_, total, err := this.DiskUsage()
+		if err != nil || total == 0 {
+			return 0
+		}
+		capacity = total
+	}
+	return float64(this.AllocatedBytes()) / float64(capacity)
+}
+
+// Has capacity to allocate n more bytes?
+func (this *Volume) HasCapacity(n uint64) bool {
+	return this.Capacity == 0 || this.AllocatedBytes()+n <= this.Capacity
+}
+
+// Number of shard writes in progress
+func (this *Volume) ActiveWrites() int32 {
+	return atomic.LoadInt32(&this.activeWrites)
+}
+
+// Usage
+func (this *Volume) Status() *VolumeStatus {
+	free, total, _ := this.DiskUsage()
+	return &VolumeStatus{
+		Id:             this.IdStr(),
+		Path:           this.FullPath(),
+		StorageClass:   this.StorageClass,
+		Capacity:       this.Capacity,
+		AllocatedBytes: this.AllocatedBytes(),
+		UsedBytes:      this.UsedBytes(),
+		FillRatio:      this.FillRatio(),
+		UsageRatio:     this.UsageRatio(),
+		FreeDiskBytes:  free,
+		DiskBytes:      total,
+		State:          this.GetState().String(),
+		Full:           this.IsFull(),
+		IOErrors:       this.IOErrorCount(),
+		Blocks:         len(this.Blocks()),
+		Shards:         len(this.Shards()),
+		ActiveWrites:   this.ActiveWrites(),
+	}
+}
+
 // Full path
 func (this *Volume) FullPath() string {
 	return fmt.Sprintf("%s/v_%s", this.Path, this.IdStr())
@@ -126,8 +241,9 @@ func (this *Volume) FullPath() string {
 // New volume
 func newVolume() *Volume {
 	v := &Volume{
-		shards: make(map[string]*Shard),
-		blocks: make(map[string]*Block),
+		shards:   make(map[string]*Shard),
+		blocks:   make(map[string]*Block),
+		ioErrors: make([]time.Time, 0),
 	}
 	return v
 }
@@ -0,0 +1,39 @@
+package main
+
+// Picks the volume for new data
+
+// Pick the least full (then least busy) writable volume of the storage class (any class if empty) that can hold n more bytes
+func pickVolume(volumes []*Volume, storageClass string, n uint64) *Volume {
+	var best *Volume = nil
+	for _, volume := range volumes {
+		if len(storageClass) > 0 && volume.StorageClass != storageClass {
+			continue
+		}
+		if !volume.IsWritable() {
+			continue
+		}
+		if !volume.HasCapacity(n) {
+			continue
+		}
+		if best == nil || volume._lessLoadedThan(best) {
+			best = volume
+		}
+	}
+	return best
+}
+
+// Compare load of volumes
+func (this *Volume) _lessLoadedThan(o *Volume) bool {
+	if this.FillRatio() != o.FillRatio() {
+		return this.FillRatio() < o.FillRatio()
+	}
+	if this.ActiveWrites() != o.ActiveWrites() {
+		return this.ActiveWrites() < o.ActiveWrites()
+	}
+	return this.AllocatedBytes() < o.AllocatedBytes()
+}
+
+// Allocate volume for n bytes in storage class
+func (this *Datastore) AllocateVolume(storageClass string, n uint64) *Volume {
+	return pickVolume(this.Volumes(), storageClass, n)
+}
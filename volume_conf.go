@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Declared volume: path[:capacity[:storage_class]]
+
+type VolumeConf struct {
+	Path         string // Local directory, volumes are stored in v_<uuid> folders within
+	Capacity     uint64 // Maximum bytes to allocate, 0 = unlimited
+	StorageClass string // E.g. standard, cold
+}
+
+// Parse list of declared volumes
+func parseVolumeConfs(s string, defaultStorageClass string) ([]*VolumeConf, error) {
+	res := make([]*VolumeConf, 0)
+	for _, elm := range strings.Split(s, ",") {
+		elm = strings.TrimSpace(elm)
+		if len(elm) < 1 {
+			continue
+		}
+		vc, err := parseVolumeConf(elm, defaultStorageClass)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range res {
+			if other.Path == vc.Path {
+				return nil, errors.New(fmt.Sprintf("Volume path %s declared twice", vc.Path))
+			}
+		}
+		res = append(res, vc)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("No volumes declared")
+	}
+	return res, nil
+}
+
+// Parse single declared volume
+func parseVolumeConf(s string, defaultStorageClass string) (*VolumeConf, error) {
+	split := strings.Split(s, ":")
+	if len(split) > 3 || len(strings.TrimSpace(split[0])) < 1 {
+		return nil, errors.New(fmt.Sprintf("Invalid volume %s, expected path[:capacity[:storage_class]]", s))
+	}
+	vc := newVolumeConf(strings.TrimSpace(split[0]), 0, defaultStorageClass)
+	if len(split) > 1 && len(strings.TrimSpace(split[1])) > 0 {
+		capacity, err := parseByteSize(strings.TrimSpace(split[1]))
+		if err != nil {
+			return nil, err
+		}
+		vc.Capacity = capacity
+	}
+	if len(split) > 2 && len(strings.TrimSpace(split[2])) > 0 {
+		vc.StorageClass = strings.TrimSpace(split[2])
+	}
+	return vc, nil
+}
+
+// Parse byte size with optional unit (K, M, G, T; powers of 1024)
+func parseByteSize(s string) (uint64, error) {
+	var multiplier uint64 = 1
+	upper := strings.TrimSuffix(strings.ToUpper(s), "B")
+	if len(upper) > 0 {
+		switch upper[len(upper)-1] {
+		case 'K':
+			multiplier = 1024
+		case 'M':
+			multiplier = 1024 * 1024
+		case 'G':
+			multiplier = 1024 * 1024 * 1024
+		case 'T':
+			multiplier = 1024 * 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			upper = upper[:len(upper)-1]
+		}
+	}
+	n, err := strconv.ParseUint(upper, 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid size %s", s))
+	}
+	return n * multiplier, nil
+}
+
+// New declared volume
+func newVolumeConf(path string, capacity uint64, storageClass string) *VolumeConf {
+	return &VolumeConf{
+		Path:         path,
+		Capacity:     capacity,
+		StorageClass: storageClass,
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Health of a volume: free space watermarks and I/O errors
+
+type VolumeState uint32
+
+const (
+	HealthyVolumeState  VolumeState = iota // 0 = reads and writes
+	ReadOnlyVolumeState                    // 1 = repeated I/O errors, reads only
+	FailedVolumeState                      // 2 = too many I/O errors, shards are repaired from other nodes
+)
+
+// To string
+func (this VolumeState) String() string {
+	switch this {
+	case HealthyVolumeState:
+		return "healthy"
+	case ReadOnlyVolumeState:
+		return "read-only"
+	case FailedVolumeState:
+		return "failed"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(this))
+}
+
+// Parse state from string
+func parseVolumeState(s string) (VolumeState, error) {
+	for _, state := range []VolumeState{HealthyVolumeState, ReadOnlyVolumeState, FailedVolumeState} {
+		if state.String() == s {
+			return state, nil
+		}
+	}
+	return HealthyVolumeState, errors.New(fmt.Sprintf("Unknown volume state %s", s))
+}
+
+// Free and total bytes of the disk of the volume
+func (this *Volume) DiskUsage() (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(this.Path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
+
+// Fraction of the disk or declared capacity in use, whichever is higher
+func (this *Volume) UsageRatio() float64 {
+	ratio := this.FillRatio()
+	free, total, err := this.DiskUsage()
+	if err == nil && total > 0 {
+		diskRatio := 1 - float64(free)/float64(total)
+		if diskRatio > ratio {
+			ratio = diskRatio
+		}
+	}
+	return ratio
+}
+
+// Is full? Becomes full above the high watermark and accepts writes again below the low watermark
+func (this *Volume) IsFull() bool {
+	this.healthMux.Lock()
+	defer this.healthMux.Unlock()
+
+	// Check at most once per second
+	if time.Now().Sub(this.fullCheckedAt) < time.Second {
+		return this.full
+	}
+	this.fullCheckedAt = time.Now()
+
+	ratio := this.UsageRatio()
+	if !this.full && ratio >= conf.VolumeHighWatermark {
+		log.Warnf("Volume %s is full (%.2f), refusing writes", this.IdStr(), ratio)
+		this.full = true
+	} else if this.full && ratio < conf.VolumeLowWatermark {
+		log.Infof("Volume %s has space again (%.2f), accepting writes", this.IdStr(), ratio)
+		this.full = false
+	}
+	return this.full
+}
+
+// Get state
+func (this *Volume) GetState() VolumeState {
+	this.healthMux.Lock()
+	defer this.healthMux.Unlock()
+	return this.state
+}
+
+// Set state (e.g. reset by an administrator after replacing a disk)
+func (this *Volume) SetState(state VolumeState) {
+	this.healthMux.Lock()
+	previous := this.state
+	this.state = state
+	if state == HealthyVolumeState {
+		this.ioErrors = make([]time.Time, 0)
+	}
+	this.healthMux.Unlock()
+
+	if previous != state {
+		log.Warnf("Volume %s is now %s", this.IdStr(), state)
+		if state == FailedVolumeState {
+			go datastore._reportFailedVolume(this)
+		}
+	}
+}
+
+// Accepts new data?
+func (this *Volume) IsWritable() bool {
+	return this.GetState() == HealthyVolumeState && !this.IsFull()
+}
+
+// Can be read?
+func (this *Volume) IsReadable() bool {
+	return this.GetState() != FailedVolumeState
+}
+
+// Number of I/O errors in the error window
+func (this *Volume) IOErrorCount() int {
+	this.healthMux.Lock()
+	defer this.healthMux.Unlock()
+	return this._recentIOErrors()
+}
+
+// Remove errors outside the window, returns the number left (must be locked)
+func (this *Volume) _recentIOErrors() int {
+	minTime := time.Now().Add(-1 * time.Duration(conf.VolumeIOErrorWindow) * time.Second)
+	recent := make([]time.Time, 0)
+	for _, t := range this.ioErrors {
+		if t.After(minTime) {
+			recent = append(recent, t)
+		}
+	}
+	this.ioErrors = recent
+	return len(recent)
+}
+
+// Register I/O error, repeated errors make the volume read-only and eventually failed
+func (this *Volume) RegisterIOError(err error) {
+	// Disk full is not a failure of the disk
+	if isNoSpaceError(err) {
+		this.healthMux.Lock()
+		log.Warnf("Volume %s is out of space: %s", this.IdStr(), err)
+		this.full = true
+		this.fullCheckedAt = time.Now()
+		this.healthMux.Unlock()
+		return
+	}
+
+	this.healthMux.Lock()
+	this.ioErrors = append(this.ioErrors, time.Now())
+	count := this._recentIOErrors()
+	state := this.state
+	this.healthMux.Unlock()
+	log.Errorf("I/O error on volume %s (%d in window): %s", this.IdStr(), count, err)
+
+	if count >= conf.VolumeFailedErrors && state != FailedVolumeState {
+		this.SetState(FailedVolumeState)
+	} else if count >= conf.VolumeReadOnlyErrors && state == HealthyVolumeState {
+		this.SetState(ReadOnlyVolumeState)
+	}
+}
+
+// Is disk full error?
+func isNoSpaceError(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+// Report shards of failed volume, other nodes with a copy repair them
+func (this *Datastore) _reportFailedVolume(volume *Volume) {
+	shards := volume.Shards()
+	log.Errorf("Volume %s failed, reporting %d shard(s) for repair", volume.IdStr(), len(shards))
+	for _, shard := range shards {
+		this.fileLocator.UnloadIndex(runtime.GetNode(), shard.Id)
+		binaryTransport._broadcastShardRepair(shard.Id)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestParseVolumeConfs(t *testing.T) {
+	vcs, err := parseVolumeConfs("/mnt/a:500G, /mnt/b:2T:cold,/mnt/c", "standard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vcs) != 3 {
+		t.Fatalf("Expected 3 volumes, found %d", len(vcs))
+	}
+	if vcs[0].Path != "/mnt/a" || vcs[0].Capacity != 500*1024*1024*1024 || vcs[0].StorageClass != "standard" {
+		t.Errorf("Unexpected volume %v", vcs[0])
+	}
+	if vcs[1].Capacity != 2*1024*1024*1024*1024 || vcs[1].StorageClass != "cold" {
+		t.Errorf("Unexpected volume %v", vcs[1])
+	}
+	if vcs[2].Capacity != 0 {
+		t.Errorf("Volume without capacity should be unlimited, was %d", vcs[2].Capacity)
+	}
+
+	// Invalid
+	for _, s := range []string{"", "/mnt/a:abc", "/mnt/a:1G:cold:x", "/mnt/a,/mnt/a"} {
+		if _, err := parseVolumeConfs(s, "standard"); err == nil {
+			t.Errorf("Volumes %s should be invalid", s)
+		}
+	}
+}
+
+func TestPickVolume(t *testing.T) {
+	startApplication()
+
+	shardBytes := uint64(conf.ShardSizeInBytes)
+	full := newVolume()
+	full.Id = randomUuid()
+	full.Capacity = 2 * shardBytes
+	full.StorageClass = "standard"
+	full.RegisterShard(newShard(newBlock(full)))
+	half := newVolume()
+	half.Id = randomUuid()
+	half.Capacity = 4 * shardBytes
+	half.StorageClass = "standard"
+	half.RegisterShard(newShard(newBlock(half)))
+	cold := newVolume()
+	cold.Id = randomUuid()
+	cold.StorageClass = "cold"
+	volumes := []*Volume{full, half, cold}
+
+	// Least full of the class
+	if v := pickVolume(volumes, "standard", shardBytes); v != half {
+		t.Errorf("Expected least full volume, found %v", v)
+	}
+
+	// Capacity
+	if v := pickVolume(volumes, "standard", 3*shardBytes); v != half {
+		t.Errorf("Expected volume with capacity, found %v", v)
+	}
+	if v := pickVolume(volumes, "standard", 4*shardBytes); v != nil {
+		t.Errorf("Expected no volume with capacity, found %v", v)
+	}
+
+	// Storage class
+	if v := pickVolume(volumes, "cold", 4*shardBytes); v != cold {
+		t.Errorf("Expected cold volume, found %v", v)
+	}
+
+	// Unlimited volumes are measured against their disk
+	emptyCold := newVolume()
+	emptyCold.Id = randomUuid()
+	emptyCold.Path = conf.VolumeBasePath
+	emptyCold.StorageClass = "cold"
+	usedCold := newVolume()
+	usedCold.Id = randomUuid()
+	usedCold.Path = conf.VolumeBasePath
+	usedCold.StorageClass = "cold"
+	usedCold.RegisterShard(newShard(newBlock(usedCold)))
+	if usedCold.FillRatio() <= 0 {
+		t.Error("Expected fill ratio of unlimited volume with shards")
+	}
+	if v := pickVolume([]*Volume{usedCold, emptyCold}, "cold", shardBytes); v != emptyCold {
+		t.Errorf("Expected empty unlimited volume, found %v", v)
+	}
+}
+
+func TestVolumeHealth(t *testing.T) {
+	startApplication()
+
+	v := newVolume()
+	v.Id = randomUuid()
+	v.Path = conf.VolumeBasePath
+	if !v.IsWritable() || !v.IsReadable() {
+		t.Fatal("New volume should be healthy")
+	}
+
+	// Repeated errors make the volume read-only, then failed
+	for i := 0; i < conf.VolumeReadOnlyErrors; i++ {
+		v.RegisterIOError(errors.New("input/output error"))
+	}
+	if v.GetState() != ReadOnlyVolumeState || v.IsWritable() || !v.IsReadable() {
+		t.Errorf("Volume should be read-only, is %s", v.GetState())
+	}
+	for i := conf.VolumeReadOnlyErrors; i < conf.VolumeFailedErrors; i++ {
+		v.RegisterIOError(errors.New("input/output error"))
+	}
+	if v.GetState() != FailedVolumeState || v.IsReadable() {
+		t.Errorf("Volume should be failed, is %s", v.GetState())
+	}
+	if pickVolume([]*Volume{v}, "", 0) != nil {
+		t.Error("Failed volume should not be picked")
+	}
+
+	// Reset
+	v.SetState(HealthyVolumeState)
+	if !v.IsWritable() || v.IOErrorCount() != 0 {
+		t.Error("Volume should be healthy after reset")
+	}
+
+	// Disk full is not a failure
+	v.RegisterIOError(&os.PathError{Op: "write", Path: v.Path, Err: syscall.ENOSPC})
+	if v.GetState() != HealthyVolumeState || !v.IsFull() || v.IsWritable() {
+		t.Error("Volume should be full but healthy")
+	}
+}
+
+func TestShardPersistError(t *testing.T) {
+	startApplication()
+
+	// Volume on a path that can not be written
+	v := newVolume()
+	v.Id = randomUuid()
+	v.Path = "/dev/null/xyzfs"
+	b := newBlock(v)
+	b.initShards()
+	shard := b.DataShards[0]
+	shard.AddFile(newFileMeta("/persist/error.txt"), []byte("Hello"))
+
+	// Error instead of panic
+	if err := shard.Persist(); err == nil {
+		t.Error("Persist should fail")
+	}
+	if v.IOErrorCount() != 1 {
+		t.Errorf("Expected I/O error to be registered, found %d", v.IOErrorCount())
+	}
+}